@@ -0,0 +1,105 @@
+// Loads yearly archives of minute candles of the broker into the candle store:
+//
+//	go run ./cmd/archive -instruments <UID>,<UID> -years 2015-2024 [-dir <archives>] [-store <dir>]
+//
+// Archives are downloaded with TINKOFF_MARKET_DATA_API_TOKEN unless -dir has them as "<UID>_<year>.zip".
+// The store is CANDLE_CACHE_DIR by default, CachedMarketDataProvider reads it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/env"
+	"github.com/Reensef/sigmasage/pkg/marketdata"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	instruments := flag.String("instruments", "", "comma separated UIDs or FIGIs")
+	years := flag.String("years", "", "years, e.g. 2020,2021 or 2015-2024")
+	dir := flag.String("dir", "", "directory with downloaded archives instead of the download")
+	storeDir := flag.String("store", "", "candle store directory, CANDLE_CACHE_DIR by default")
+	flag.Parse()
+
+	// .env is optional, flags are enough for local archives
+	godotenv.Load(".env")
+
+	instrumentIDs := strings.Split(*instruments, ",")
+	if *instruments == "" {
+		log.Fatal("No instruments")
+	}
+
+	yearList, err := parseYears(*years)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *storeDir == "" {
+		*storeDir = env.MustString("CANDLE_CACHE_DIR")
+	}
+	store, err := marketdata.NewCandleStore(*storeDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var source marketdata.TinkoffArchiveSource
+	if *dir != "" {
+		source = marketdata.TinkoffArchiveDir(*dir)
+	} else {
+		source = marketdata.NewTinkoffArchiveClient(
+			env.String("TINKOFF_HISTORY_DATA_URL", marketdata.TinkoffHistoryDataURL),
+			env.MustString("TINKOFF_MARKET_DATA_API_TOKEN"),
+		)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	imports, err := marketdata.ImportTinkoffArchives(ctx, clock.Real, source, store, instrumentIDs, yearList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	total := 0
+	for _, imported := range imports {
+		total += imported.Candles
+	}
+	log.Printf("Imported %d candles from %d archives", total, len(imports))
+}
+
+// "2020,2021" or "2015-2024"
+func parseYears(value string) ([]int, error) {
+	result := make([]int, 0)
+
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid years %q", value)
+		}
+		to := from
+		if isRange {
+			to, err = strconv.Atoi(last)
+			if err != nil || to < from {
+				return nil, fmt.Errorf("invalid years %q", value)
+			}
+		}
+
+		for year := from; year <= to; year++ {
+			result = append(result, year)
+		}
+	}
+
+	return result, nil
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Reensef/sigmasage/internal/service"
 	"github.com/Reensef/sigmasage/pkg/domain"
 	"github.com/Reensef/sigmasage/pkg/env"
+	"github.com/Reensef/sigmasage/pkg/instruments"
 	"github.com/Reensef/sigmasage/pkg/marketdata"
 	"github.com/Reensef/sigmasage/pkg/techanalysis"
+	"github.com/Reensef/sigmasage/pkg/utils"
 
 	"github.com/joho/godotenv"
 )
@@ -37,14 +42,55 @@ func main() {
 	multiWriter := io.MultiWriter(file, os.Stdout)
 	logger := log.New(multiWriter, "APP: ", log.LstdFlags)
 
-	tinkoffProvider, err := marketdata.NewTinkoffMarketDataProvider(
-		env.MustString("TINKOFF_MARKET_DATA_API_TOKEN"),
-	)
-	if err != nil {
-		log.Panic(err)
+	// Cancelling ctx stops streams and history requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// MARKET_DATA_DIR switches to offline candles from local files
+	providerType := domain.MarketDataProviderType_TINKOFF
+	var mdProvider marketdata.MarketDataProvider
+	var instrumentService *service.InstrumentService
+
+	if dir := env.String("MARKET_DATA_DIR", ""); dir != "" {
+		provider, err := marketdata.NewFileMarketDataProvider(dir)
+		if err != nil {
+			log.Panic(err)
+		}
+		mdProvider = provider
+		providerType = domain.MarketDataProviderType_FILE
+	} else {
+		token := env.MustString("TINKOFF_MARKET_DATA_API_TOKEN")
+		endpoint := env.String("TINKOFF_ENDPOINT", utils.TinkoffEndpoint)
+		config := utils.TinkoffConfig{Endpoint: endpoint, Token: token}
+
+		provider, err := marketdata.NewTinkoffMarketDataProvider(ctx, config)
+		if err != nil {
+			log.Panic(err)
+		}
+		mdProvider = provider
+
+		instrumentProvider, err := instruments.NewTinkoffInstrumentProvider(config)
+		if err != nil {
+			log.Panic(err)
+		}
+		instrumentService = service.NewInstrumentService()
+		err = instrumentService.RegisterProvider(domain.MarketDataProviderType_TINKOFF, instrumentProvider)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		// CANDLE_CACHE_DIR keeps downloaded history between runs
+		if cacheDir := env.String("CANDLE_CACHE_DIR", ""); cacheDir != "" {
+			cachedProvider, err := marketdata.NewCachedMarketDataProvider(provider, cacheDir)
+			if err != nil {
+				log.Panic(err)
+			}
+			mdProvider = cachedProvider
+		}
 	}
 
-	mdService, err := service.NewMarketDataService(tinkoffProvider)
+	mdService := service.NewMarketDataService()
+	err = mdService.RegisterProvider(providerType, mdProvider)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -53,7 +99,7 @@ func main() {
 
 	techAnalysisService := service.NewTechAnalysisService(mdService, smaProvider)
 	strategyService := service.NewStrategyService(mdService, techAnalysisService)
-	tradingBotService := service.NewTradingBotService(strategyService, mdService)
+	tradingBotService := service.NewTradingBotService(strategyService, mdService, instrumentService)
 
 	intervals := []domain.MarketDataInterval{
 		// domain.MarketDataInterval_ONE_MINUTE,
@@ -63,20 +109,26 @@ func main() {
 		domain.MarketDataInterval_WEEK,
 	}
 
-	marketdataID := "02cfdf61-6298-4c0f-a9ca-9cabc82afaf3"
-	// e6123145-9665-43e0-8413-cd61b8aa9b13 Сбер
-	// 7de75794-a27f-4d81-a39b-492345813822 Яндекс
-	// 02cfdf61-6298-4c0f-a9ca-9cabc82afaf3 Лукойл
+	// Tinkoff candles are requested by instrument UID, local files are named by ticker
+	marketdataID := "LKOH"
+	if instrumentService != nil {
+		instrument, err := instrumentService.InstrumentByTicker(providerType, "LKOH", "TQBR")
+		if err != nil {
+			log.Panic(err)
+		}
+		marketdataID = instrument.UID
+	}
 
 	test := func(interval domain.MarketDataInterval, l1, l2 int) {
 		startBalance := 10000.0
 
 		deals, balanceHistory, err := tradingBotService.BacktestGoldenCross(
+			ctx,
 			domain.GoldenCrossStrategyInfo{
 				Md: domain.MarketData{
 					ID:           marketdataID,
 					Interval:     interval,
-					ProviderType: domain.MarketDataProviderType_TINKOFF,
+					ProviderType: providerType,
 				},
 				ShortLength: l1,
 				LongLength:  l2,
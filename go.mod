@@ -2,7 +2,12 @@ module github.com/Reensef/sigmasage
 
 go 1.23.4
 
-require github.com/russianinvestments/invest-api-go-sdk v1.28.1
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/russianinvestments/invest-api-go-sdk v1.28.1
+	google.golang.org/grpc v1.57.0
+	google.golang.org/protobuf v1.31.0
+)
 
 require (
 	cloud.google.com/go/compute v1.20.1 // indirect
@@ -23,7 +28,5 @@ require (
 	google.golang.org/genproto v0.0.0-20230530153820-e85fd2cbaebc // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20230530153820-e85fd2cbaebc // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20230530153820-e85fd2cbaebc // indirect
-	google.golang.org/grpc v1.57.0 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,16 +1,21 @@
 package app
 
 import (
+	"context"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Reensef/sigmasage/internal/service"
+	"github.com/Reensef/sigmasage/pkg/calendar"
 	"github.com/Reensef/sigmasage/pkg/domain"
 	"github.com/Reensef/sigmasage/pkg/env"
 	"github.com/Reensef/sigmasage/pkg/marketdata"
 	"github.com/Reensef/sigmasage/pkg/techanalysis"
+	"github.com/Reensef/sigmasage/pkg/utils"
 
 	"github.com/joho/godotenv"
 )
@@ -41,6 +46,10 @@ func Run() {
 	multiWriter := io.MultiWriter(file, os.Stdout)
 	logger := log.New(multiWriter, "APP: ", log.LstdFlags)
 
+	// Cancelling ctx stops streams and history requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// tgbot, err := tgbotapi.NewBotAPI(env.MustString("TELEGRAM_API_TOKEN"))
 	// if err != nil {
 	// 	log.Panic(err)
@@ -51,14 +60,66 @@ func Run() {
 	// receiver := tgserver.NewServer(tgbot, sender)
 	// receiver.Run()
 
-	tinkoffProvider, err := marketdata.NewTinkoffMarketDataProvider(
-		env.MustString("TINKOFF_MARKET_DATA_API_TOKEN"),
+	// MARKET_DATA_DIR switches to offline candles from local files
+	providerType := domain.MarketDataProviderType_TINKOFF
+	var mdProvider marketdata.MarketDataProvider
+
+	if dir := env.String("MARKET_DATA_DIR", ""); dir != "" {
+		provider, err := marketdata.NewFileMarketDataProvider(dir)
+		if err != nil {
+			logger.Panic(err)
+		}
+		mdProvider = provider
+		providerType = domain.MarketDataProviderType_FILE
+	} else {
+		endpoint := env.String("TINKOFF_ENDPOINT", utils.TinkoffEndpoint)
+		token := env.MustString("TINKOFF_MARKET_DATA_API_TOKEN")
+		config := utils.TinkoffConfig{Endpoint: endpoint, Token: token}
+
+		provider, err := marketdata.NewTinkoffMarketDataProvider(ctx, config)
+		if err != nil {
+			logger.Panic(err)
+		}
+		mdProvider = provider
+	}
+
+	// MARKET_DATA_RECORD_FILE keeps the session to play it back with RecordingPlayerMarketDataProvider
+	if path := env.String("MARKET_DATA_RECORD_FILE", ""); path != "" {
+		recorder, err := marketdata.NewRecordingMarketDataProvider(mdProvider, path)
+		if err != nil {
+			logger.Panic(err)
+		}
+		defer recorder.Close()
+		mdProvider = recorder
+	}
+
+	// A silently dead stream stops the bots, the watchdog reports it
+	mdProvider = marketdata.NewWatchdogMarketDataProvider(mdProvider, calendar.NewMOEXCalendar())
+
+	mdService := service.NewMarketDataService()
+	err = mdService.RegisterProvider(providerType, mdProvider)
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	// Free public history, e.g. to compare with the broker
+	err = mdService.RegisterProvider(
+		domain.MarketDataProviderType_MOEX,
+		marketdata.NewMOEXMarketDataProvider(env.String("MOEX_ISS_ENDPOINT", utils.MOEXISSEndpoint)),
 	)
 	if err != nil {
 		logger.Panic(err)
 	}
 
-	mdService, err := service.NewMarketDataService(tinkoffProvider)
+	// Crypto spot market trades 24/7, the stream is opened on the first subscription
+	err = mdService.RegisterProvider(
+		domain.MarketDataProviderType_BINANCE,
+		marketdata.NewBinanceMarketDataProvider(
+			ctx,
+			env.String("BINANCE_REST_ENDPOINT", marketdata.BinanceRESTEndpoint),
+			env.String("BINANCE_STREAM_ENDPOINT", marketdata.BinanceStreamEndpoint),
+		),
+	)
 	if err != nil {
 		logger.Panic(err)
 	}
@@ -108,11 +169,12 @@ func Run() {
 	// }
 
 	signals, err := strategyService.BacktestGoldenCross(
+		ctx,
 		domain.GoldenCrossStrategyInfo{
 			Md: domain.MarketData{
 				ID:           "e6123145-9665-43e0-8413-cd61b8aa9b13",
 				Interval:     domain.MarketDataInterval_ONE_HOUR,
-				ProviderType: domain.MarketDataProviderType_TINKOFF,
+				ProviderType: providerType,
 			},
 			ShortLength: 50,
 			LongLength:  100,
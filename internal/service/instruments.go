@@ -0,0 +1,189 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+	"github.com/Reensef/sigmasage/pkg/instruments"
+)
+
+// Instrument metadata rarely changes, trading status is refreshed with the cache
+const instrumentCacheTTL = time.Hour
+
+// InstrumentService routes lookups to the provider registered for the provider type
+// and caches found instruments
+type InstrumentService struct {
+	clock     clock.Clock
+	mu        sync.Mutex
+	providers map[domain.MarketDataProviderType]instruments.InstrumentProvider
+	byTicker  map[instrumentTickerKey]cachedInstrument
+	byUID     map[instrumentUIDKey]cachedInstrument
+}
+
+type instrumentTickerKey struct {
+	providerType domain.MarketDataProviderType
+	ticker       string
+	classCode    string
+}
+
+type instrumentUIDKey struct {
+	providerType domain.MarketDataProviderType
+	uid          string
+}
+
+type cachedInstrument struct {
+	instrument domain.Instrument
+	loadedAt   time.Time
+}
+
+func NewInstrumentService() *InstrumentService {
+	return &InstrumentService{
+		clock:     clock.Real,
+		providers: make(map[domain.MarketDataProviderType]instruments.InstrumentProvider),
+		byTicker:  make(map[instrumentTickerKey]cachedInstrument),
+		byUID:     make(map[instrumentUIDKey]cachedInstrument),
+	}
+}
+
+// Cached instruments expire by c
+func (s *InstrumentService) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// Providers are registered at startup, one per provider type
+func (s *InstrumentService) RegisterProvider(
+	providerType domain.MarketDataProviderType,
+	provider instruments.InstrumentProvider,
+) error {
+	if provider == nil {
+		return fmt.Errorf("provider %d is nil", providerType)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.providers[providerType]; exists {
+		return fmt.Errorf("provider %d is already registered", providerType)
+	}
+
+	s.providers[providerType] = provider
+
+	return nil
+}
+
+func (s *InstrumentService) InstrumentByTicker(
+	providerType domain.MarketDataProviderType,
+	ticker string,
+	classCode string,
+) (domain.Instrument, error) {
+	key := instrumentTickerKey{
+		providerType: providerType,
+		ticker:       strings.ToUpper(ticker),
+		classCode:    strings.ToUpper(classCode),
+	}
+
+	s.mu.Lock()
+	cached, ok := s.byTicker[key]
+	s.mu.Unlock()
+
+	if ok && s.clock.Now().Sub(cached.loadedAt) < instrumentCacheTTL {
+		return cached.instrument, nil
+	}
+
+	provider, err := s.provider(providerType)
+	if err != nil {
+		return domain.Instrument{}, err
+	}
+
+	instrument, err := provider.GetInstrumentByTicker(key.ticker, key.classCode)
+	if err != nil {
+		return domain.Instrument{}, err
+	}
+
+	s.store(providerType, instrument)
+
+	return instrument, nil
+}
+
+func (s *InstrumentService) InstrumentByUID(
+	providerType domain.MarketDataProviderType,
+	uid string,
+) (domain.Instrument, error) {
+	key := instrumentUIDKey{providerType: providerType, uid: uid}
+
+	s.mu.Lock()
+	cached, ok := s.byUID[key]
+	s.mu.Unlock()
+
+	if ok && s.clock.Now().Sub(cached.loadedAt) < instrumentCacheTTL {
+		return cached.instrument, nil
+	}
+
+	provider, err := s.provider(providerType)
+	if err != nil {
+		return domain.Instrument{}, err
+	}
+
+	instrument, err := provider.GetInstrumentByUID(uid)
+	if err != nil {
+		return domain.Instrument{}, err
+	}
+
+	s.store(providerType, instrument)
+
+	return instrument, nil
+}
+
+// Builds MarketData of the instrument found by ticker and class code, e.g. "SBER" and "TQBR"
+func (s *InstrumentService) MarketDataByTicker(
+	providerType domain.MarketDataProviderType,
+	ticker string,
+	classCode string,
+	interval domain.MarketDataInterval,
+) (domain.MarketData, error) {
+	instrument, err := s.InstrumentByTicker(providerType, ticker, classCode)
+	if err != nil {
+		return domain.MarketData{}, err
+	}
+
+	return domain.MarketData{
+		ID:           instrument.UID,
+		Interval:     interval,
+		ProviderType: providerType,
+	}, nil
+}
+
+func (s *InstrumentService) store(
+	providerType domain.MarketDataProviderType,
+	instrument domain.Instrument,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached := cachedInstrument{instrument: instrument, loadedAt: s.clock.Now()}
+
+	s.byTicker[instrumentTickerKey{
+		providerType: providerType,
+		ticker:       strings.ToUpper(instrument.Ticker),
+		classCode:    strings.ToUpper(instrument.ClassCode),
+	}] = cached
+	s.byUID[instrumentUIDKey{providerType: providerType, uid: instrument.UID}] = cached
+}
+
+func (s *InstrumentService) provider(
+	providerType domain.MarketDataProviderType,
+) (instruments.InstrumentProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	provider, exists := s.providers[providerType]
+	if !exists {
+		return nil, fmt.Errorf("provider %d is not registered", providerType)
+	}
+
+	return provider, nil
+}
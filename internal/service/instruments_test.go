@@ -0,0 +1,97 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Counts lookups, the trading status changes with every lookup
+type countingInstrumentProvider struct {
+	calls int
+}
+
+func (p *countingInstrumentProvider) instrument() domain.Instrument {
+	p.calls++
+	return domain.Instrument{
+		UID:           "uid-sber",
+		Ticker:        "SBER",
+		ClassCode:     "TQBR",
+		Lot:           10,
+		TradingStatus: domain.InstrumentTradingStatus(p.calls),
+	}
+}
+
+func (p *countingInstrumentProvider) GetInstrumentByTicker(ticker string, classCode string) (domain.Instrument, error) {
+	if ticker != "SBER" || classCode != "TQBR" {
+		return domain.Instrument{}, fmt.Errorf("instrument %s %s not found", ticker, classCode)
+	}
+	return p.instrument(), nil
+}
+
+func (p *countingInstrumentProvider) GetInstrumentByUID(uid string) (domain.Instrument, error) {
+	if uid != "uid-sber" {
+		return domain.Instrument{}, fmt.Errorf("instrument %s not found", uid)
+	}
+	return p.instrument(), nil
+}
+
+func TestInstrumentService_Cache(t *testing.T) {
+	provider := &countingInstrumentProvider{}
+	service := NewInstrumentService()
+	if err := service.RegisterProvider(domain.MarketDataProviderType_TINKOFF, provider); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := service.RegisterProvider(domain.MarketDataProviderType_TINKOFF, provider); err == nil {
+		t.Errorf("expected error registering provider type twice")
+	}
+
+	virtualClock := clock.NewVirtualClock(time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	service.SetClock(virtualClock)
+
+	// Ticker and class code are case insensitive
+	instrument, err := service.InstrumentByTicker(domain.MarketDataProviderType_TINKOFF, "sber", "tqbr")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if instrument.UID != "uid-sber" || instrument.Lot != 10 {
+		t.Fatalf("unexpected instrument %+v", instrument)
+	}
+
+	// Found by ticker is cached by UID too
+	if _, err := service.InstrumentByUID(domain.MarketDataProviderType_TINKOFF, "uid-sber"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := service.InstrumentByTicker(domain.MarketDataProviderType_TINKOFF, "SBER", "TQBR"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if provider.calls != 1 {
+		t.Fatalf("expected one lookup, got %d", provider.calls)
+	}
+
+	// Cache expires, e.g. to refresh the trading status
+	virtualClock.Advance(instrumentCacheTTL)
+	instrument, err = service.InstrumentByUID(domain.MarketDataProviderType_TINKOFF, "uid-sber")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if provider.calls != 2 || instrument.TradingStatus != 2 {
+		t.Fatalf("expected refreshed instrument, got %+v after %d lookups", instrument, provider.calls)
+	}
+
+	// Provider types have their own caches
+	if _, err := service.InstrumentByUID(domain.MarketDataProviderType_MOEX, "uid-sber"); err == nil {
+		t.Errorf("expected error of not registered provider type")
+	}
+
+	md, err := service.MarketDataByTicker(domain.MarketDataProviderType_TINKOFF, "SBER", "TQBR", domain.MarketDataInterval_ONE_HOUR)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if md.ID != "uid-sber" || md.ProviderType != domain.MarketDataProviderType_TINKOFF || provider.calls != 2 {
+		t.Errorf("unexpected market data %+v", md)
+	}
+}
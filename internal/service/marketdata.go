@@ -1,84 +1,223 @@
 package service
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Reensef/sigmasage/pkg/domain"
 	"github.com/Reensef/sigmasage/pkg/marketdata"
 )
 
+// MarketDataService routes requests to the provider registered for MarketData.ProviderType
 type MarketDataService struct {
-	tinkoffProvider marketdata.MarketDataProvider
+	mu        sync.RWMutex
+	providers map[domain.MarketDataProviderType]marketdata.MarketDataProvider
 }
 
-func NewMarketDataService(tinkoffProvider marketdata.MarketDataProvider) (
-	*MarketDataService,
-	error,
-) {
+func NewMarketDataService() *MarketDataService {
 	return &MarketDataService{
-		tinkoffProvider: tinkoffProvider,
-	}, nil
+		providers: make(map[domain.MarketDataProviderType]marketdata.MarketDataProvider),
+	}
+}
+
+// Providers are registered at startup, one per provider type
+func (m *MarketDataService) RegisterProvider(
+	providerType domain.MarketDataProviderType,
+	provider marketdata.MarketDataProvider,
+) error {
+	if provider == nil {
+		return fmt.Errorf("provider %d is nil", providerType)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.providers[providerType]; exists {
+		return fmt.Errorf("provider %d is already registered", providerType)
+	}
+
+	m.providers[providerType] = provider
+
+	return nil
 }
 
-func (m *MarketDataService) SubscribeCandles(marketData domain.MarketData) (
+func (m *MarketDataService) SubscribeCandles(ctx context.Context, marketData domain.MarketData) (
 	<-chan domain.Candle,
 	error,
 ) {
-	if marketData.ProviderType == domain.MarketDataProviderType_TINKOFF {
-		resultChan, err := m.tinkoffProvider.SubscribeCandles(marketData)
-		if err != nil {
-			return nil, err
-		}
-		return resultChan, nil
-	} else {
-		return nil, fmt.Errorf("undefined provider type")
+	provider, err := m.provider(marketData.ProviderType)
+	if err != nil {
+		return nil, err
+	}
+
+	resultChan, err := provider.SubscribeCandles(ctx, marketData)
+	if err != nil {
+		return nil, err
 	}
+	return resultChan, nil
 }
 
 func (m *MarketDataService) UnsubscribeCandles(
 	marketData domain.MarketData,
 	ch <-chan domain.Candle,
 ) error {
-	if marketData.ProviderType == domain.MarketDataProviderType_TINKOFF {
-		err := m.tinkoffProvider.UnsubscribeCandles(marketData, ch)
-		if err != nil {
-			return err
-		}
-		return nil
-	} else {
-		return fmt.Errorf("undefined provider type")
+	provider, err := m.provider(marketData.ProviderType)
+	if err != nil {
+		return err
+	}
+
+	err = provider.UnsubscribeCandles(marketData, ch)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Forming candles for subscribers that need the price before the candle is closed
+func (m *MarketDataService) SubscribeCandleUpdates(ctx context.Context, marketData domain.MarketData) (
+	<-chan domain.Candle,
+	error,
+) {
+	provider, err := m.provider(marketData.ProviderType)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.SubscribeCandleUpdates(ctx, marketData)
+}
+
+func (m *MarketDataService) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	provider, err := m.provider(marketData.ProviderType)
+	if err != nil {
+		return err
 	}
+
+	return provider.UnsubscribeCandleUpdates(marketData, ch)
 }
 
 func (m *MarketDataService) GetCandlesByTime(
+	ctx context.Context,
 	marketData domain.MarketData,
 	from time.Time,
 	to time.Time,
 ) ([]domain.Candle, error) {
-	if marketData.ProviderType == domain.MarketDataProviderType_TINKOFF {
-		candles, err := m.tinkoffProvider.GetCandlesByTime(marketData, from, to)
-		if err != nil {
-			return nil, err
-		}
-		return candles, nil
-	} else {
-		return nil, fmt.Errorf("undefined provider type")
+	provider, err := m.provider(marketData.ProviderType)
+	if err != nil {
+		return nil, err
+	}
+
+	candles, err := provider.GetCandlesByTime(ctx, marketData, from, to)
+	if err != nil {
+		return nil, err
 	}
+	return candles, nil
 }
 
 func (m *MarketDataService) GetCandlesByCount(
+	ctx context.Context,
 	marketData domain.MarketData,
 	to time.Time,
 	count int,
 ) ([]domain.Candle, error) {
-	if marketData.ProviderType == domain.MarketDataProviderType_TINKOFF {
-		candles, err := m.tinkoffProvider.GetCandlesByCount(marketData, to, count)
-		if err != nil {
-			return nil, err
-		}
-		return candles, nil
-	} else {
-		return nil, fmt.Errorf("undefined provider type")
+	provider, err := m.provider(marketData.ProviderType)
+	if err != nil {
+		return nil, err
+	}
+
+	candles, err := provider.GetCandlesByCount(ctx, marketData, to, count)
+	if err != nil {
+		return nil, err
+	}
+	return candles, nil
+}
+
+func (m *MarketDataService) SubscribeOrderBook(ctx context.Context, orderBookInfo domain.OrderBookInfo) (
+	<-chan domain.OrderBook,
+	error,
+) {
+	provider, err := m.provider(orderBookInfo.ProviderType)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.SubscribeOrderBook(ctx, orderBookInfo)
+}
+
+func (m *MarketDataService) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	provider, err := m.provider(orderBookInfo.ProviderType)
+	if err != nil {
+		return err
+	}
+
+	return provider.UnsubscribeOrderBook(orderBookInfo, ch)
+}
+
+func (m *MarketDataService) SubscribeLastPrices(ctx context.Context, instrumentInfo domain.InstrumentInfo) (
+	<-chan domain.LastPrice,
+	error,
+) {
+	provider, err := m.provider(instrumentInfo.ProviderType)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.SubscribeLastPrices(ctx, instrumentInfo)
+}
+
+func (m *MarketDataService) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	provider, err := m.provider(instrumentInfo.ProviderType)
+	if err != nil {
+		return err
+	}
+
+	return provider.UnsubscribeLastPrices(instrumentInfo, ch)
+}
+
+func (m *MarketDataService) SubscribeTrades(ctx context.Context, instrumentInfo domain.InstrumentInfo) (
+	<-chan domain.Trade,
+	error,
+) {
+	provider, err := m.provider(instrumentInfo.ProviderType)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.SubscribeTrades(ctx, instrumentInfo)
+}
+
+func (m *MarketDataService) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	provider, err := m.provider(instrumentInfo.ProviderType)
+	if err != nil {
+		return err
 	}
+
+	return provider.UnsubscribeTrades(instrumentInfo, ch)
+}
+
+func (m *MarketDataService) provider(
+	providerType domain.MarketDataProviderType,
+) (marketdata.MarketDataProvider, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	provider, exists := m.providers[providerType]
+	if !exists {
+		return nil, fmt.Errorf("provider %d is not registered", providerType)
+	}
+
+	return provider, nil
 }
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+	"github.com/Reensef/sigmasage/pkg/marketdata"
+)
+
+func TestMarketDataService_RoutesByProviderType(t *testing.T) {
+	dir := t.TempDir()
+	md := domain.MarketData{
+		ID:           "SBER",
+		Interval:     domain.MarketDataInterval_ONE_HOUR,
+		ProviderType: domain.MarketDataProviderType_FILE,
+	}
+	start := time.Date(2024, time.January, 3, 10, 0, 0, 0, time.UTC)
+
+	err := marketdata.WriteCandlesFile(filepath.Join(dir, marketdata.CandleFileName(md, ".csv")), []domain.Candle{
+		{MarketData: md, OpenTime: start, Close: 1},
+		{MarketData: md, OpenTime: start.Add(time.Hour), Close: 2},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	provider, err := marketdata.NewFileMarketDataProvider(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mdService := NewMarketDataService()
+	if err := mdService.RegisterProvider(domain.MarketDataProviderType_FILE, provider); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mdService.RegisterProvider(domain.MarketDataProviderType_FILE, provider); err == nil {
+		t.Errorf("expected error registering provider type twice")
+	}
+
+	candles, err := mdService.GetCandlesByTime(context.Background(), md, start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 2 {
+		t.Fatalf("expected 2 candles, got %d", len(candles))
+	}
+
+	md.ProviderType = domain.MarketDataProviderType_TINKOFF
+	if _, err := mdService.GetCandlesByTime(context.Background(), md, start, start.Add(2*time.Hour)); err == nil {
+		t.Errorf("expected error for provider type that is not registered")
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+	"github.com/Reensef/sigmasage/pkg/exchange"
+	"github.com/Reensef/sigmasage/pkg/marketdata"
+	"github.com/Reensef/sigmasage/pkg/techanalysis"
+)
+
+// Hourly candles of main sessions from Monday to Friday with a price that crosses its SMA,
+// the replay covers Tuesday to Friday, Monday is the history for SMA
+func writeReplayCandles(t *testing.T, dir string, md domain.MarketData) (time.Time, time.Time) {
+	t.Helper()
+
+	monday := time.Date(2024, time.March, 11, 10, 0, 0, 0, calendar.MoscowLocation)
+
+	candles := make([]domain.Candle, 0)
+	for day := 0; day < 5; day++ {
+		for hour := 0; hour < 8; hour++ {
+			openTime := monday.AddDate(0, 0, day).Add(time.Duration(hour) * time.Hour)
+			price := 100 + 10*math.Sin(float64(len(candles))*0.7)
+
+			candles = append(candles, domain.Candle{
+				MarketData: md,
+				Open:       price,
+				High:       price,
+				Low:        price,
+				Close:      price,
+				Volume:     1,
+				OpenTime:   openTime,
+				CloseTime:  openTime.Add(time.Hour),
+			})
+		}
+	}
+
+	err := marketdata.WriteCandlesFile(filepath.Join(dir, marketdata.CandleFileName(md, ".csv")), candles)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return monday.AddDate(0, 0, 1), monday.AddDate(0, 0, 4).Add(8 * time.Hour)
+}
+
+type replayServices struct {
+	replay      *marketdata.ReplayMarketDataProvider
+	strategy    *StrategyService
+	tradingBots *TradingBotService
+	fileMD      domain.MarketData
+	replayMD    domain.MarketData
+	from        time.Time
+	to          time.Time
+}
+
+// Live services read candles from the replay, backtests read the same file directly
+func newReplayServices(t *testing.T) replayServices {
+	t.Helper()
+
+	dir := t.TempDir()
+	fileMD := domain.MarketData{
+		ID:           "LKOH",
+		Interval:     domain.MarketDataInterval_ONE_HOUR,
+		ProviderType: domain.MarketDataProviderType_FILE,
+	}
+	from, to := writeReplayCandles(t, dir, fileMD)
+
+	fileProvider, err := marketdata.NewFileMarketDataProvider(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	replay, err := marketdata.NewReplayMarketDataProvider(fileProvider, from, to, marketdata.ReplaySpeedMax)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mdService := NewMarketDataService()
+	if err := mdService.RegisterProvider(domain.MarketDataProviderType_FILE, fileProvider); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mdService.RegisterProvider(domain.MarketDataProviderType_REPLAY, replay); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	techAnalysisService := NewTechAnalysisService(mdService, techanalysis.NewSMAProvider())
+	techAnalysisService.SetClock(replay.Clock())
+	strategyService := NewStrategyService(mdService, techAnalysisService)
+	tradingBotService := NewTradingBotService(strategyService, mdService, nil)
+	tradingBotService.SetClock(replay.Clock())
+
+	replayMD := fileMD
+	replayMD.ProviderType = domain.MarketDataProviderType_REPLAY
+
+	return replayServices{
+		replay:      replay,
+		strategy:    strategyService,
+		tradingBots: tradingBotService,
+		fileMD:      fileMD,
+		replayMD:    replayMD,
+		from:        from,
+		to:          to,
+	}
+}
+
+func TestReplay_LiveSignalsMatchBacktest(t *testing.T) {
+	s := newReplayServices(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	expected, err := s.strategy.BacktestSMAC(ctx, domain.SMAInfo{MarketData: s.fileMD, Length: 5}, s.from, s.to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(expected) < 2 {
+		t.Fatalf("test data must have crosses, got %d signals", len(expected))
+	}
+
+	signals, err := s.strategy.SubscribeSMAC(ctx, domain.SMAInfo{MarketData: s.replayMD, Length: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.replay.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, want := range expected {
+		select {
+		case got := <-signals:
+			if got.SignalType != want.SignalType || !got.Time.Equal(want.Time) || got.LastPrice != want.LastPrice {
+				t.Fatalf("signal %d: expected %v at %s, got %v at %s", i, want.SignalType, want.Time, got.SignalType, got.Time)
+			}
+		case <-ctx.Done():
+			t.Fatalf("signal %d is not received", i)
+		}
+	}
+}
+
+// Passes orders of the bot to the test
+type recordingExchange struct {
+	*exchange.MockExchange
+	orders chan exchange.OrderRequest
+}
+
+func (e *recordingExchange) Buy(orderRequest exchange.OrderRequest) (exchange.OrderResult, error) {
+	e.orders <- orderRequest
+	return e.MockExchange.Buy(orderRequest)
+}
+
+func (e *recordingExchange) Sell(orderRequest exchange.OrderRequest) (exchange.OrderResult, error) {
+	e.orders <- orderRequest
+	return e.MockExchange.Sell(orderRequest)
+}
+
+func TestReplay_LiveBotMatchesBacktest(t *testing.T) {
+	s := newReplayServices(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deals, _, err := s.tradingBots.BacktestSMAC(
+		ctx,
+		domain.SMAInfo{MarketData: s.fileMD, Length: 5},
+		10000,
+		exchange.NewMockExchange(0.0005, 0.0005),
+		s.from,
+		s.to,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deals) < 2 {
+		t.Fatalf("test data must have deals, got %d", len(deals))
+	}
+
+	exchanger := &recordingExchange{
+		MockExchange: exchange.NewMockExchange(0.0005, 0.0005),
+		orders:       make(chan exchange.OrderRequest, 100),
+	}
+
+	// Every candle closes in a session, so the bot doesn't postpone signals
+	id, err := s.tradingBots.CreateSMACBot(ctx, domain.SMAInfo{MarketData: s.replayMD, Length: 5}, exchanger, 10000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.tradingBots.RunSMACBot(id); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.tradingBots.StopSMACBot(id)
+
+	if err := s.replay.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, deal := range deals {
+		select {
+		case order := <-exchanger.orders:
+			if order.Count != deal.Deal.Count || order.Price != deal.Deal.Price {
+				t.Fatalf("order %d: expected %d at %.2f, got %d at %.2f", i, deal.Deal.Count, deal.Deal.Price, order.Count, order.Price)
+			}
+		case <-ctx.Done():
+			t.Fatalf("order %d is not placed", i)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/Reensef/sigmasage/pkg/domain"
@@ -14,29 +16,37 @@ type StrategyService struct {
 	techAnalysisService *TechAnalysisService
 	smacStrategy        *strategy.SMACStrategy
 	goldenCrossStrategy *strategy.GoldenCrossStrategy
+	mu                  sync.Mutex
 	smaSignalToSMA      map[<-chan domain.SMACSignal]<-chan domain.SMA
 	smaSignalToCandles  map[<-chan domain.SMACSignal]<-chan domain.Candle
+	smaSignalStops      map[<-chan domain.SMACSignal]func() bool
 }
 
 func NewStrategyService(mdService *MarketDataService, techAnalysisService *TechAnalysisService) *StrategyService {
 	return &StrategyService{
 		mdService:           mdService,
 		techAnalysisService: techAnalysisService,
+		smacStrategy:        strategy.NewSMACStrategy(),
+		goldenCrossStrategy: strategy.NewGoldenCrossStrategy(),
 		smaSignalToSMA:      make(map[<-chan domain.SMACSignal]<-chan domain.SMA),
 		smaSignalToCandles:  make(map[<-chan domain.SMACSignal]<-chan domain.Candle),
+		smaSignalStops:      make(map[<-chan domain.SMACSignal]func() bool),
 	}
 }
 
+// Signals stop and the channel is closed when ctx is done
 func (s *StrategyService) SubscribeSMAC(
+	ctx context.Context,
 	info domain.SMAInfo,
 ) (<-chan domain.SMACSignal, error) {
-	candleChan, err := s.mdService.SubscribeCandles(info.MarketData)
+	candleChan, err := s.mdService.SubscribeCandles(ctx, info.MarketData)
 	if err != nil {
 		return nil, err
 	}
 
-	smaChan, err := s.techAnalysisService.SubscribeSMA(info.MarketData, info.Length)
+	smaChan, err := s.techAnalysisService.SubscribeSMA(ctx, info.MarketData, info.Length)
 	if err != nil {
+		s.mdService.UnsubscribeCandles(info.MarketData, candleChan)
 		return nil, err
 	}
 
@@ -59,6 +69,22 @@ func (s *StrategyService) SubscribeSMAC(
 		return nil, err
 	}
 
+	s.mu.Lock()
+	s.smaSignalToSMA[ch] = smaChan
+	s.smaSignalToCandles[ch] = candleChan
+	// Candles and SMA are cancelled by ctx themselves, only the strategy is left
+	s.smaSignalStops[ch] = context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		s.forgetSMAC(ch)
+		s.mu.Unlock()
+
+		err := s.smacStrategy.UnsubscribeSMACStrategy(info, ch)
+		if err != nil {
+			log.Printf("Error unsubscribing SMAC strategy: %v", err)
+		}
+	})
+	s.mu.Unlock()
+
 	return ch, nil
 }
 
@@ -66,8 +92,16 @@ func (s *StrategyService) UnsubscribeSMAC(
 	info domain.SMAInfo,
 	ch <-chan domain.SMACSignal,
 ) error {
-	smaChan, ok := s.smaSignalToSMA[ch]
-	if !ok {
+	s.mu.Lock()
+	smaChan, smaOk := s.smaSignalToSMA[ch]
+	candleChan, candleOk := s.smaSignalToCandles[ch]
+	if stop, ok := s.smaSignalStops[ch]; ok {
+		stop()
+	}
+	s.forgetSMAC(ch)
+	s.mu.Unlock()
+
+	if !smaOk {
 		return fmt.Errorf("smaChan not found")
 	}
 
@@ -75,10 +109,8 @@ func (s *StrategyService) UnsubscribeSMAC(
 	if err != nil {
 		return err
 	}
-	delete(s.smaSignalToSMA, ch)
 
-	candleChan, ok := s.smaSignalToCandles[ch]
-	if !ok {
+	if !candleOk {
 		return fmt.Errorf("candleChan not found")
 	}
 
@@ -86,7 +118,6 @@ func (s *StrategyService) UnsubscribeSMAC(
 	if err != nil {
 		return err
 	}
-	delete(s.smaSignalToCandles, ch)
 
 	err = s.smacStrategy.UnsubscribeSMACStrategy(info, ch)
 	if err != nil {
@@ -96,12 +127,21 @@ func (s *StrategyService) UnsubscribeSMAC(
 	return nil
 }
 
+// Must be called with mu locked
+func (s *StrategyService) forgetSMAC(ch <-chan domain.SMACSignal) {
+	delete(s.smaSignalToSMA, ch)
+	delete(s.smaSignalToCandles, ch)
+	delete(s.smaSignalStops, ch)
+}
+
 func (s *StrategyService) BacktestSMAC(
+	ctx context.Context,
 	info domain.SMAInfo,
 	from time.Time,
 	to time.Time,
 ) ([]domain.SMACSignal, error) {
 	smaHistory, err := s.techAnalysisService.SMAHistory(
+		ctx,
 		info,
 		from,
 		to,
@@ -111,6 +151,7 @@ func (s *StrategyService) BacktestSMAC(
 	}
 
 	candleHistory, err := s.mdService.GetCandlesByTime(
+		ctx,
 		info.MarketData,
 		from,
 		to,
@@ -136,11 +177,13 @@ func (s *StrategyService) BacktestSMAC(
 }
 
 func (s *StrategyService) BacktestGoldenCross(
+	ctx context.Context,
 	info domain.GoldenCrossStrategyInfo,
 	from time.Time,
 	to time.Time,
 ) ([]domain.GoldenCrossSignal, error) {
 	shortSmaHistory, err := s.techAnalysisService.SMAHistory(
+		ctx,
 		domain.SMAInfo{
 			MarketData: info.Md,
 			Length:     info.ShortLength,
@@ -153,6 +196,7 @@ func (s *StrategyService) BacktestGoldenCross(
 	}
 
 	longSmaHistory, err := s.techAnalysisService.SMAHistory(
+		ctx,
 		domain.SMAInfo{
 			MarketData: info.Md,
 			Length:     info.LongLength,
@@ -165,6 +209,7 @@ func (s *StrategyService) BacktestGoldenCross(
 	}
 
 	candleHistory, err := s.mdService.GetCandlesByTime(
+		ctx,
 		info.Md,
 		from,
 		to,
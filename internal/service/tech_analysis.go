@@ -1,17 +1,29 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/Reensef/sigmasage/pkg/clock"
 	"github.com/Reensef/sigmasage/pkg/domain"
 	"github.com/Reensef/sigmasage/pkg/techanalysis"
 )
 
 type TechAnalysisService struct {
-	mdService    *MarketDataService
-	smaProvider  *techanalysis.SMAProvider
-	smaToCandles map[<-chan domain.SMA]<-chan domain.Candle
+	mdService        *MarketDataService
+	smaProvider      *techanalysis.SMAProvider
+	clock            clock.Clock
+	mu               sync.Mutex
+	smaSubscriptions map[<-chan domain.SMA]smaSubscription
+}
+
+type smaSubscription struct {
+	candles <-chan domain.Candle
+	// Stops the cleanup on ctx done after explicit unsubscribe
+	stop func() bool
 }
 
 func NewTechAnalysisService(
@@ -19,17 +31,25 @@ func NewTechAnalysisService(
 	smaProvider *techanalysis.SMAProvider,
 ) *TechAnalysisService {
 	return &TechAnalysisService{
-		mdService:    mdService,
-		smaProvider:  smaProvider,
-		smaToCandles: make(map[<-chan domain.SMA]<-chan domain.Candle),
+		mdService:        mdService,
+		smaProvider:      smaProvider,
+		clock:            clock.Real,
+		smaSubscriptions: make(map[<-chan domain.SMA]smaSubscription),
 	}
 }
 
+// History of new SMA subscriptions ends at c
+func (t *TechAnalysisService) SetClock(c clock.Clock) {
+	t.clock = c
+}
+
+// Candles and SMA subscriptions are cancelled when ctx is done
 func (t *TechAnalysisService) SubscribeSMA(
+	ctx context.Context,
 	marketData domain.MarketData,
 	length int,
 ) (<-chan domain.SMA, error) {
-	candleHistory, err := t.mdService.GetCandlesByCount(marketData, time.Now(), length)
+	candleHistory, err := t.mdService.GetCandlesByCount(ctx, marketData, t.clock.Now(), length)
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +59,7 @@ func (t *TechAnalysisService) SubscribeSMA(
 		precalcSrc = append(precalcSrc, candle.Close)
 	}
 
-	candleChan, err := t.mdService.SubscribeCandles(marketData)
+	candleChan, err := t.mdService.SubscribeCandles(ctx, marketData)
 	if err != nil {
 		return nil, err
 	}
@@ -47,6 +67,7 @@ func (t *TechAnalysisService) SubscribeSMA(
 	smaSrcChan := make(chan domain.SMASrc, 100)
 
 	smaChan, err := t.smaProvider.Subscribe(
+		ctx,
 		domain.SMAInfo{
 			MarketData: marketData,
 			Length:     length,
@@ -55,10 +76,20 @@ func (t *TechAnalysisService) SubscribeSMA(
 		smaSrcChan,
 	)
 	if err != nil {
+		t.mdService.UnsubscribeCandles(marketData, candleChan)
 		return nil, err
 	}
 
-	t.smaToCandles[smaChan] = candleChan
+	t.mu.Lock()
+	t.smaSubscriptions[smaChan] = smaSubscription{
+		candles: candleChan,
+		stop: context.AfterFunc(ctx, func() {
+			t.mu.Lock()
+			delete(t.smaSubscriptions, smaChan)
+			t.mu.Unlock()
+		}),
+	}
+	t.mu.Unlock()
 
 	go func() {
 		for candle := range candleChan {
@@ -79,7 +110,17 @@ func (t *TechAnalysisService) UnsubscribeSMA(
 	info domain.SMAInfo,
 	ch <-chan domain.SMA,
 ) error {
-	err := t.mdService.UnsubscribeCandles(info.MarketData, t.smaToCandles[ch])
+	t.mu.Lock()
+	subscription, ok := t.smaSubscriptions[ch]
+	delete(t.smaSubscriptions, ch)
+	t.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("undefined subscriber")
+	}
+	subscription.stop()
+
+	err := t.mdService.UnsubscribeCandles(info.MarketData, subscription.candles)
 	if err != nil {
 		return err
 	}
@@ -89,17 +130,16 @@ func (t *TechAnalysisService) UnsubscribeSMA(
 		return err
 	}
 
-	delete(t.smaToCandles, ch)
-
 	return nil
 }
 
 func (t *TechAnalysisService) SMAHistory(
+	ctx context.Context,
 	info domain.SMAInfo,
 	from time.Time,
 	to time.Time,
 ) ([]domain.SMA, error) {
-	candleHistory, err := t.mdService.GetCandlesByCount(info.MarketData, from, info.Length)
+	candleHistory, err := t.mdService.GetCandlesByCount(ctx, info.MarketData, from, info.Length)
 	if err != nil {
 		return nil, err
 	}
@@ -109,7 +149,7 @@ func (t *TechAnalysisService) SMAHistory(
 		precalcSrc = append(precalcSrc, candle.Close)
 	}
 
-	candleHistory, err = t.mdService.GetCandlesByTime(info.MarketData, from, to)
+	candleHistory, err = t.mdService.GetCandlesByTime(ctx, info.MarketData, from, to)
 	if err != nil {
 		return nil, err
 	}
@@ -1,78 +1,152 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
+	"sync"
 	"time"
 
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/corporateactions"
 	"github.com/Reensef/sigmasage/pkg/domain"
 	"github.com/Reensef/sigmasage/pkg/exchange"
+	"github.com/Reensef/sigmasage/pkg/marketdata"
 	"github.com/Reensef/sigmasage/pkg/tradingbots"
 )
 
 type TradingBotService struct {
 	mdService       *MarketDataService
 	strategyService *StrategyService
+	mu              sync.Mutex
+	nextSMACBotID   int64
 	smacBots        map[int64]*tradingbots.SMACBot // TODO Наследование?
 	smacBotInfo     map[int64]domain.SMAInfo
-	smacSignals     map[domain.SMAInfo]<-chan domain.SMACSignal
+	smacSignals     map[int64]<-chan domain.SMACSignal
+	calendar        calendar.Calendar
+	// Calendars of providers that don't trade by MOEX sessions
+	providerCalendars map[domain.MarketDataProviderType]calendar.Calendar
+	clock             clock.Clock
+	// Optional, bots align orders to lots and price steps when it is set
+	instrumentService *InstrumentService
+	// Optional, backtests credit dividends when it is set
+	corporateActions corporateactions.CorporateActionProvider
 }
 
-func NewTradingBotService(strategyService *StrategyService, mdService *MarketDataService) *TradingBotService {
-	return &TradingBotService{strategyService: strategyService, mdService: mdService}
+func NewTradingBotService(
+	strategyService *StrategyService,
+	mdService *MarketDataService,
+	instrumentService *InstrumentService,
+) *TradingBotService {
+	return &TradingBotService{
+		strategyService:   strategyService,
+		mdService:         mdService,
+		smacBots:          make(map[int64]*tradingbots.SMACBot),
+		smacBotInfo:       make(map[int64]domain.SMAInfo),
+		smacSignals:       make(map[int64]<-chan domain.SMACSignal),
+		calendar:          calendar.NewMOEXCalendar(),
+		providerCalendars: make(map[domain.MarketDataProviderType]calendar.Calendar),
+		clock:             clock.Real,
+		instrumentService: instrumentService,
+	}
+}
+
+// Bots created after the call run by c, dividends are looked up until it
+func (t *TradingBotService) SetClock(c clock.Clock) {
+	t.clock = c
+}
+
+// Bots of the provider type wait for sessions of the calendar instead of MOEX ones,
+// e.g. calendar.NewAlwaysOpenCalendar() for a crypto exchange
+func (t *TradingBotService) SetProviderCalendar(
+	providerType domain.MarketDataProviderType,
+	cal calendar.Calendar,
+) {
+	t.providerCalendars[providerType] = cal
 }
 
+// Backtests credit dividends of the provider to the bots at their ex-dates.
+// Candles must be adjusted only for splits, e.g. by AdjustedMarketDataProvider
+// with AdjustmentType_SPLITS, dividends are adjusted the same way.
+func (t *TradingBotService) SetCorporateActionProvider(provider corporateactions.CorporateActionProvider) {
+	t.corporateActions = provider
+}
+
+// Bot stops getting signals when ctx is done
 func (t *TradingBotService) CreateSMACBot(
+	ctx context.Context,
 	info domain.SMAInfo,
 	exchanger exchange.Exchanger,
 	startBalance float64,
 ) (int64, error) {
-	signalChan, err := t.strategyService.SubscribeSMAC(info)
+	signalChan, err := t.strategyService.SubscribeSMAC(ctx, info)
 	if err != nil {
 		return 0, err
 	}
 
-	bot := tradingbots.NewSMACBot(exchanger, startBalance, signalChan)
+	bot := tradingbots.NewSMACBot(exchanger, startBalance, signalChan, t.calendarOf(info.MarketData))
+	bot.SetClock(t.clock)
+	t.setInstrument(bot, info.MarketData)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextSMACBotID++
+	id := t.nextSMACBotID
 
-	t.smacBots[0] = bot
-	t.smacBotInfo[0] = info
-	t.smacSignals[info] = signalChan
+	t.smacBots[id] = bot
+	t.smacBotInfo[id] = info
+	t.smacSignals[id] = signalChan
 
-	return 0, nil
+	return id, nil
 }
 
 func (t *TradingBotService) DeleteSMACBot(id int64) error {
-	bot, ok := t.smacBots[0]
+	t.mu.Lock()
+	bot, ok := t.smacBots[id]
+	info, infoOk := t.smacBotInfo[id]
+	signalChan, signalOk := t.smacSignals[id]
+	delete(t.smacBots, id)
+	delete(t.smacBotInfo, id)
+	delete(t.smacSignals, id)
+	t.mu.Unlock()
+
 	if !ok {
 		return fmt.Errorf("bot not found")
 	}
 
 	bot.Stop()
-	delete(t.smacBots, 0)
 
-	info, exists := t.smacBotInfo[0]
-	if !exists {
+	if !infoOk {
 		return fmt.Errorf("bot info not found")
 	}
 
-	signalChan, exists := t.smacSignals[info]
-	if !exists {
+	if !signalOk {
 		return fmt.Errorf("signal channel not found")
 	}
 
-	t.strategyService.UnsubscribeSMAC(info, signalChan)
+	return t.strategyService.UnsubscribeSMAC(info, signalChan)
+}
 
-	delete(t.smacSignals, info)
-	delete(t.smacBotInfo, 0)
+// Bot that was created before, e.g. to read its deals
+func (t *TradingBotService) SMACBot(id int64) (*tradingbots.SMACBot, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	return nil
+	bot, ok := t.smacBots[id]
+	if !ok {
+		return nil, fmt.Errorf("bot not found")
+	}
+
+	return bot, nil
 }
 
 func (t *TradingBotService) RunSMACBot(id int64) error {
-	bot, ok := t.smacBots[id]
-	if !ok {
-		return fmt.Errorf("bot not found")
+	bot, err := t.SMACBot(id)
+	if err != nil {
+		return err
 	}
 
 	go bot.Run()
@@ -80,9 +154,9 @@ func (t *TradingBotService) RunSMACBot(id int64) error {
 }
 
 func (t *TradingBotService) StopSMACBot(id int64) error {
-	bot, ok := t.smacBots[id]
-	if !ok {
-		return fmt.Errorf("bot not found")
+	bot, err := t.SMACBot(id)
+	if err != nil {
+		return err
 	}
 
 	bot.Stop()
@@ -90,32 +164,49 @@ func (t *TradingBotService) StopSMACBot(id int64) error {
 }
 
 func (t *TradingBotService) BacktestSMAC(
+	ctx context.Context,
 	smaInfo domain.SMAInfo,
 	startBalance float64,
 	exchanger exchange.Exchanger,
 	from time.Time,
 	to time.Time,
 ) (resultSignalDeals []domain.SMACSignalDial, balanceHistory []float64, err error) {
-	signals, err := t.strategyService.BacktestSMAC(smaInfo, from, to)
+	signals, err := t.strategyService.BacktestSMAC(ctx, smaInfo, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dividends, err := t.backtestDividends(ctx, smaInfo.MarketData.ID, from, to)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	signalChan := make(chan domain.SMACSignal)
-	bot := tradingbots.NewSMACBot(exchanger, startBalance, signalChan)
+	bot := tradingbots.NewSMACBot(exchanger, startBalance, signalChan, nil)
+	t.setInstrument(bot, smaInfo.MarketData)
+	bot.AddDividends(dividends)
 
-	go bot.Run()
+	// Bot returns when the channel is closed and every signal is handled
+	done := make(chan struct{})
+	go func() {
+		bot.Run()
+		close(done)
+	}()
 
 	for _, signal := range signals {
 		signalChan <- signal
 	}
-	bot.Stop()
 	close(signalChan)
+	<-done
+
+	// Dividends after the last signal
+	bot.CreditDividends(to)
 
 	return bot.Deals(), bot.BalanceHistory(), nil
 }
 
 func (t *TradingBotService) BacktestGoldenCross(
+	ctx context.Context,
 	strategyInfo domain.GoldenCrossStrategyInfo,
 	startBalance float64,
 	commissionPercent float64,
@@ -123,7 +214,12 @@ func (t *TradingBotService) BacktestGoldenCross(
 	from time.Time,
 	to time.Time,
 ) (resultSignalDeals []domain.GoldenCrossSignalDial, balanceHistory []float64, err error) {
-	signals, err := t.strategyService.BacktestGoldenCross(strategyInfo, from, to)
+	signals, err := t.strategyService.BacktestGoldenCross(ctx, strategyInfo, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dividends, err := t.backtestDividends(ctx, strategyInfo.Md.ID, from, to)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -134,21 +230,86 @@ func (t *TradingBotService) BacktestGoldenCross(
 	)
 
 	signalChan := make(chan domain.GoldenCrossSignal)
-	bot := tradingbots.NewGoldenCrossBot(exchanger, startBalance, signalChan)
+	bot := tradingbots.NewGoldenCrossBot(exchanger, startBalance, signalChan, nil)
+	t.setInstrument(bot, strategyInfo.Md)
+	bot.AddDividends(dividends)
 
-	go bot.Run()
+	// Bot returns when the channel is closed and every signal is handled
+	done := make(chan struct{})
+	go func() {
+		bot.Run()
+		close(done)
+	}()
 
 	for _, signal := range signals {
 		signalChan <- signal
 	}
-	bot.Stop()
 	close(signalChan)
+	<-done
+
+	// Dividends after the last signal
+	bot.CreditDividends(to)
 
 	return bot.Deals(), bot.BalanceHistory(), nil
 }
 
+// Dividends with ex-dates in [from, to], adjusted for the splits up to now like the candles
+func (t *TradingBotService) backtestDividends(
+	ctx context.Context,
+	instrumentID string,
+	from time.Time,
+	to time.Time,
+) ([]domain.CorporateAction, error) {
+	if t.corporateActions == nil {
+		return nil, nil
+	}
+
+	actions, err := t.corporateActions.GetCorporateActions(ctx, instrumentID, from, t.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]domain.CorporateAction, 0)
+	for _, dividend := range corporateactions.SplitAdjustedDividends(actions) {
+		if !dividend.ExDate.After(to) {
+			result = append(result, dividend)
+		}
+	}
+
+	return result, nil
+}
+
+// Sessions outside the session filter of md don't count as trading
+func (t *TradingBotService) calendarOf(md domain.MarketData) calendar.Calendar {
+	cal, ok := t.providerCalendars[md.ProviderType]
+	if !ok {
+		cal = t.calendar
+	}
+
+	return marketdata.SessionCalendar(cal, md.SessionFilter)
+}
+
+type instrumentSetter interface {
+	SetInstrument(marketData domain.MarketData, instrument domain.Instrument)
+}
+
+func (t *TradingBotService) setInstrument(bot instrumentSetter, md domain.MarketData) {
+	if t.instrumentService == nil {
+		return
+	}
+
+	instrument, err := t.instrumentService.InstrumentByUID(md.ProviderType, md.ID)
+	if err != nil {
+		log.Printf("Instrument %s metadata is not available, orders are not aligned: %v", md.ID, err)
+		return
+	}
+
+	bot.SetInstrument(md, instrument)
+}
+
 // DCA - Dollar Cost Averaging
 func (t *TradingBotService) BacktestDCA(
+	ctx context.Context,
 	md domain.MarketData,
 	addition int,
 	commissionPercent float64,
@@ -156,7 +317,7 @@ func (t *TradingBotService) BacktestDCA(
 	from time.Time,
 	to time.Time,
 ) (deals []domain.Deal, baseInvestments float64, resultBalance float64, err error) {
-	candles, err := t.mdService.GetCandlesByTime(md, from, to)
+	candles, err := t.mdService.GetCandlesByTime(ctx, md, from, to)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -165,10 +326,21 @@ func (t *TradingBotService) BacktestDCA(
 		return nil, 0, 0, fmt.Errorf("not enough data")
 	}
 
+	dividends, err := t.backtestDividends(ctx, md.ID, from, to)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
 	currBalance := 0.0
 	currCount := 0
 
 	for _, candle := range candles {
+		// Dividends are reinvested with the next addition
+		for len(dividends) > 0 && !dividends[0].ExDate.After(candle.OpenTime) {
+			currBalance += float64(currCount) * dividends[0].Dividend
+			dividends = dividends[1:]
+		}
+
 		log.Println(candle.Open, candle.OpenTime)
 		baseInvestments += float64(addition)
 		currBalance += float64(addition)
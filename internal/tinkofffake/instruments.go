@@ -0,0 +1,89 @@
+package tinkofffake
+
+import (
+	"context"
+	"strings"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type instrumentsServer struct {
+	pb.UnimplementedInstrumentsServiceServer
+	server *Server
+}
+
+// Adds an instrument found by GetInstrumentBy with FIGI, UID or ticker and class code
+func (s *Server) AddInstrument(instrument *pb.Instrument) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.instruments = append(s.instruments, instrument)
+}
+
+func (i *instrumentsServer) GetInstrumentBy(
+	ctx context.Context,
+	req *pb.InstrumentRequest,
+) (*pb.InstrumentResponse, error) {
+	s := i.server
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, instrument := range s.instruments {
+		var found bool
+
+		switch req.GetIdType() {
+		case pb.InstrumentIdType_INSTRUMENT_ID_TYPE_FIGI:
+			found = instrument.GetFigi() == req.GetId()
+		case pb.InstrumentIdType_INSTRUMENT_ID_TYPE_UID:
+			found = instrument.GetUid() == req.GetId()
+		case pb.InstrumentIdType_INSTRUMENT_ID_TYPE_TICKER:
+			found = strings.EqualFold(instrument.GetTicker(), req.GetId()) &&
+				strings.EqualFold(instrument.GetClassCode(), req.GetClassCode())
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported id type %d", req.GetIdType())
+		}
+
+		if found {
+			return &pb.InstrumentResponse{Instrument: instrument}, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.NotFound, "instrument %s not found", req.GetId())
+}
+
+// Adds a dividend returned by GetDividends for the instrument UID or FIGI
+func (s *Server) AddDividend(instrumentID string, dividend *pb.Dividend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dividends[instrumentID] = append(s.dividends[instrumentID], dividend)
+}
+
+// Dividends are filtered by the record date like the broker does
+func (i *instrumentsServer) GetDividends(
+	ctx context.Context,
+	req *pb.GetDividendsRequest,
+) (*pb.GetDividendsResponse, error) {
+	s := i.server
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instrumentID := req.GetInstrumentId()
+	if instrumentID == "" {
+		instrumentID = req.GetFigi()
+	}
+
+	result := make([]*pb.Dividend, 0)
+	for _, dividend := range s.dividends[instrumentID] {
+		recordDate := dividend.GetRecordDate().AsTime()
+		if !recordDate.Before(req.GetFrom().AsTime()) && !recordDate.After(req.GetTo().AsTime()) {
+			result = append(result, dividend)
+		}
+	}
+
+	return &pb.GetDividendsResponse{Dividends: result}, nil
+}
@@ -0,0 +1,315 @@
+package tinkofffake
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type candlesKey struct {
+	instrumentID string
+	interval     pb.CandleInterval
+}
+
+type marketDataServer struct {
+	pb.UnimplementedMarketDataServiceServer
+	server *Server
+}
+
+// Adds history returned by GetCandles, instrumentID is matched with instrument_id or figi of requests
+func (s *Server) AddCandles(
+	instrumentID string,
+	interval pb.CandleInterval,
+	candles ...*pb.HistoricCandle,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := candlesKey{instrumentID: instrumentID, interval: interval}
+	s.candles[key] = append(s.candles[key], candles...)
+	slices.SortStableFunc(s.candles[key], func(a, b *pb.HistoricCandle) int {
+		return a.GetTime().AsTime().Compare(b.GetTime().AsTime())
+	})
+}
+
+// GetCandles requests received so far, in order of arrival
+func (s *Server) CandleRequests() []*pb.GetCandlesRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.candleRequests)
+}
+
+func (m *marketDataServer) GetCandles(
+	ctx context.Context,
+	req *pb.GetCandlesRequest,
+) (*pb.GetCandlesResponse, error) {
+	s := m.server
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.candleRequests = append(s.candleRequests, req)
+	s.notifyChanged()
+
+	instrumentID := req.GetInstrumentId()
+	if instrumentID == "" {
+		instrumentID = req.GetFigi()
+	}
+	if instrumentID == "" {
+		return nil, status.Error(codes.InvalidArgument, "instrument_id is empty")
+	}
+
+	from := req.GetFrom().AsTime()
+	to := req.GetTo().AsTime()
+
+	result := make([]*pb.HistoricCandle, 0)
+	for _, candle := range s.candles[candlesKey{instrumentID: instrumentID, interval: req.GetInterval()}] {
+		openTime := candle.GetTime().AsTime()
+		if !openTime.Before(from) && openTime.Before(to) {
+			result = append(result, candle)
+		}
+	}
+
+	return &pb.GetCandlesResponse{Candles: result}, nil
+}
+
+type marketDataStreamServer struct {
+	pb.UnimplementedMarketDataStreamServiceServer
+	server *Server
+}
+
+// One open MarketDataStream of a client
+type stream struct {
+	srv pb.MarketDataStreamService_MarketDataStreamServer
+	// Send of a gRPC stream must not be called concurrently
+	sendMu sync.Mutex
+	// Ends the stream with the error
+	drop chan error
+}
+
+func (st *stream) send(resp *pb.MarketDataResponse) error {
+	st.sendMu.Lock()
+	defer st.sendMu.Unlock()
+
+	return st.srv.Send(resp)
+}
+
+func (m *marketDataStreamServer) MarketDataStream(
+	srv pb.MarketDataStreamService_MarketDataStreamServer,
+) error {
+	s := m.server
+
+	st := &stream{
+		srv:  srv,
+		drop: make(chan error, 1),
+	}
+
+	s.mu.Lock()
+	s.streams[st] = struct{}{}
+	s.streamsOpened++
+	s.notifyChanged()
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, st)
+		s.notifyChanged()
+		s.mu.Unlock()
+	}()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := srv.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			resp := s.subscriptionResponse(req)
+			if resp == nil {
+				continue
+			}
+
+			err = st.send(resp)
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			s.mu.Lock()
+			s.subscribeCount++
+			s.notifyChanged()
+			s.mu.Unlock()
+		}
+	}()
+
+	select {
+	case err := <-st.drop:
+		return err
+	case err := <-recvErr:
+		return err
+	case <-srv.Context().Done():
+		return srv.Context().Err()
+	}
+}
+
+// Sends the response to every open stream, e.g. a candle or an order book
+func (s *Server) Send(resp *pb.MarketDataResponse) error {
+	s.mu.Lock()
+	streams := make([]*stream, 0, len(s.streams))
+	for st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		err := st.send(resp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sends an update of a forming candle
+func (s *Server) SendCandle(candle *pb.Candle) error {
+	return s.Send(&pb.MarketDataResponse{
+		Payload: &pb.MarketDataResponse_Candle{Candle: candle},
+	})
+}
+
+// Breaks every open stream with UNAVAILABLE as the broker does on restarts
+func (s *Server) DropStreams() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for st := range s.streams {
+		select {
+		case st.drop <- status.Error(codes.Unavailable, "stream dropped by tinkofffake"):
+		default:
+		}
+	}
+}
+
+// Blocks until count streams have been opened since the start
+func (s *Server) WaitStreams(ctx context.Context, count int) error {
+	return s.wait(ctx, func() bool { return s.streamsOpened >= count })
+}
+
+// Subscriptions of the instrument are answered with the status instead of SUCCESS,
+// e.g. INSTRUMENT_NOT_FOUND or LIMIT_IS_EXCEEDED
+func (s *Server) RejectSubscriptions(instrumentID string, subscriptionStatus pb.SubscriptionStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscriptionStatuses[instrumentID] = subscriptionStatus
+}
+
+// Blocks until count subscription requests have been answered since the start
+func (s *Server) WaitSubscriptions(ctx context.Context, count int) error {
+	return s.wait(ctx, func() bool { return s.subscribeCount >= count })
+}
+
+// Subscriptions succeed unless rejected by RejectSubscriptions, other requests are not answered
+func (s *Server) subscriptionResponse(req *pb.MarketDataRequest) *pb.MarketDataResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriptionStatus := func(instrumentID string) pb.SubscriptionStatus {
+		rejected, ok := s.subscriptionStatuses[instrumentID]
+		if !ok {
+			return pb.SubscriptionStatus_SUBSCRIPTION_STATUS_SUCCESS
+		}
+
+		return rejected
+	}
+
+	if candlesReq := req.GetSubscribeCandlesRequest(); candlesReq != nil {
+		subscriptions := make([]*pb.CandleSubscription, 0, len(candlesReq.GetInstruments()))
+		for _, instrument := range candlesReq.GetInstruments() {
+			subscriptions = append(subscriptions, &pb.CandleSubscription{
+				Figi:               instrument.GetFigi(),
+				Interval:           instrument.GetInterval(),
+				SubscriptionStatus: subscriptionStatus(instrument.GetInstrumentId()),
+				InstrumentUid:      instrument.GetInstrumentId(),
+				WaitingClose:       candlesReq.GetWaitingClose(),
+			})
+		}
+
+		return &pb.MarketDataResponse{
+			Payload: &pb.MarketDataResponse_SubscribeCandlesResponse{
+				SubscribeCandlesResponse: &pb.SubscribeCandlesResponse{
+					CandlesSubscriptions: subscriptions,
+				},
+			},
+		}
+	}
+
+	if orderBookReq := req.GetSubscribeOrderBookRequest(); orderBookReq != nil {
+		subscriptions := make([]*pb.OrderBookSubscription, 0, len(orderBookReq.GetInstruments()))
+		for _, instrument := range orderBookReq.GetInstruments() {
+			subscriptions = append(subscriptions, &pb.OrderBookSubscription{
+				Figi:               instrument.GetFigi(),
+				Depth:              instrument.GetDepth(),
+				SubscriptionStatus: subscriptionStatus(instrument.GetInstrumentId()),
+				InstrumentUid:      instrument.GetInstrumentId(),
+			})
+		}
+
+		return &pb.MarketDataResponse{
+			Payload: &pb.MarketDataResponse_SubscribeOrderBookResponse{
+				SubscribeOrderBookResponse: &pb.SubscribeOrderBookResponse{
+					OrderBookSubscriptions: subscriptions,
+				},
+			},
+		}
+	}
+
+	if tradesReq := req.GetSubscribeTradesRequest(); tradesReq != nil {
+		subscriptions := make([]*pb.TradeSubscription, 0, len(tradesReq.GetInstruments()))
+		for _, instrument := range tradesReq.GetInstruments() {
+			subscriptions = append(subscriptions, &pb.TradeSubscription{
+				Figi:               instrument.GetFigi(),
+				SubscriptionStatus: subscriptionStatus(instrument.GetInstrumentId()),
+				InstrumentUid:      instrument.GetInstrumentId(),
+			})
+		}
+
+		return &pb.MarketDataResponse{
+			Payload: &pb.MarketDataResponse_SubscribeTradesResponse{
+				SubscribeTradesResponse: &pb.SubscribeTradesResponse{
+					TradeSubscriptions: subscriptions,
+				},
+			},
+		}
+	}
+
+	lastPriceReq := req.GetSubscribeLastPriceRequest()
+	if lastPriceReq == nil {
+		return nil
+	}
+
+	subscriptions := make([]*pb.LastPriceSubscription, 0, len(lastPriceReq.GetInstruments()))
+	for _, instrument := range lastPriceReq.GetInstruments() {
+		subscriptions = append(subscriptions, &pb.LastPriceSubscription{
+			Figi:               instrument.GetFigi(),
+			SubscriptionStatus: subscriptionStatus(instrument.GetInstrumentId()),
+			InstrumentUid:      instrument.GetInstrumentId(),
+		})
+	}
+
+	return &pb.MarketDataResponse{
+		Payload: &pb.MarketDataResponse_SubscribeLastPriceResponse{
+			SubscribeLastPriceResponse: &pb.SubscribeLastPriceResponse{
+				LastPriceSubscriptions: subscriptions,
+			},
+		},
+	}
+}
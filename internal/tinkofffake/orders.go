@@ -0,0 +1,235 @@
+package tinkofffake
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type ordersServer struct {
+	pb.UnimplementedOrdersServiceServer
+	server *Server
+}
+
+// State of a posted order, responses are built from it on every request
+type order struct {
+	accountID     string
+	orderID       string
+	requestID     string
+	instrumentID  string
+	direction     pb.OrderDirection
+	orderType     pb.OrderType
+	status        pb.OrderExecutionReportStatus
+	lotsRequested int64
+	lotsExecuted  int64
+	price         *pb.Quotation
+	date          time.Time
+}
+
+func (o *order) isActive() bool {
+	return o.status == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW ||
+		o.status == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_PARTIALLYFILL
+}
+
+func (o *order) amount(lots int64) *pb.MoneyValue {
+	nano := int64(o.price.GetNano()) * lots
+
+	return &pb.MoneyValue{
+		Currency: "rub",
+		Units:    o.price.GetUnits()*lots + nano/1e9,
+		Nano:     int32(nano % 1e9),
+	}
+}
+
+func (o *order) state() *pb.OrderState {
+	return &pb.OrderState{
+		OrderId:               o.orderID,
+		ExecutionReportStatus: o.status,
+		LotsRequested:         o.lotsRequested,
+		LotsExecuted:          o.lotsExecuted,
+		InitialOrderPrice:     o.amount(o.lotsRequested),
+		ExecutedOrderPrice:    o.amount(o.lotsExecuted),
+		Direction:             o.direction,
+		OrderType:             o.orderType,
+		InstrumentUid:         o.instrumentID,
+		OrderDate:             timestamppb.New(o.date),
+		OrderRequestId:        o.requestID,
+	}
+}
+
+// Status of orders posted after the call, FILL by default.
+// NEW orders stay active until FillOrder or CancelOrder.
+func (s *Server) SetOrderStatus(status pb.OrderExecutionReportStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orderStatus = status
+}
+
+// Executes the rest of an active order as the exchange would
+func (s *Server) FillOrder(orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.findOrder(orderID)
+	if o == nil || !o.isActive() {
+		return fmt.Errorf("order %s is not active", orderID)
+	}
+
+	o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL
+	o.lotsExecuted = o.lotsRequested
+	s.notifyChanged()
+
+	return nil
+}
+
+// Every posted order in order of arrival
+func (s *Server) Orders() []*pb.OrderState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]*pb.OrderState, 0, len(s.orders))
+	for _, o := range s.orders {
+		result = append(result, o.state())
+	}
+
+	return result
+}
+
+// Must be called with mu locked
+func (s *Server) findOrder(orderID string) *order {
+	i := slices.IndexFunc(s.orders, func(o *order) bool { return o.orderID == orderID })
+	if i < 0 {
+		return nil
+	}
+
+	return s.orders[i]
+}
+
+func (o *ordersServer) PostOrder(
+	ctx context.Context,
+	req *pb.PostOrderRequest,
+) (*pb.PostOrderResponse, error) {
+	s := o.server
+
+	if req.GetQuantity() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "quantity must be positive")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// order_id of the request is an idempotency key, a retry gets the same order
+	i := slices.IndexFunc(s.orders, func(posted *order) bool {
+		return req.GetOrderId() != "" && posted.requestID == req.GetOrderId()
+	})
+	if i >= 0 {
+		return postOrderResponse(s.orders[i]), nil
+	}
+
+	posted := &order{
+		accountID:     req.GetAccountId(),
+		orderID:       fmt.Sprintf("tinkofffake-%d", len(s.orders)+1),
+		requestID:     req.GetOrderId(),
+		instrumentID:  req.GetInstrumentId(),
+		direction:     req.GetDirection(),
+		orderType:     req.GetOrderType(),
+		status:        s.orderStatus,
+		lotsRequested: req.GetQuantity(),
+		price:         req.GetPrice(),
+		date:          time.Now(),
+	}
+
+	switch posted.status {
+	case pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL:
+		posted.lotsExecuted = posted.lotsRequested
+	case pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_PARTIALLYFILL:
+		posted.lotsExecuted = posted.lotsRequested / 2
+	}
+
+	s.orders = append(s.orders, posted)
+	s.notifyChanged()
+
+	return postOrderResponse(posted), nil
+}
+
+func postOrderResponse(o *order) *pb.PostOrderResponse {
+	return &pb.PostOrderResponse{
+		OrderId:               o.orderID,
+		ExecutionReportStatus: o.status,
+		LotsRequested:         o.lotsRequested,
+		LotsExecuted:          o.lotsExecuted,
+		InitialOrderPrice:     o.amount(o.lotsRequested),
+		ExecutedOrderPrice:    o.amount(o.lotsExecuted),
+		Direction:             o.direction,
+		OrderType:             o.orderType,
+		InstrumentUid:         o.instrumentID,
+		OrderRequestId:        o.requestID,
+	}
+}
+
+func (o *ordersServer) CancelOrder(
+	ctx context.Context,
+	req *pb.CancelOrderRequest,
+) (*pb.CancelOrderResponse, error) {
+	s := o.server
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cancelled := s.findOrder(req.GetOrderId())
+	if cancelled == nil || cancelled.accountID != req.GetAccountId() {
+		return nil, status.Errorf(codes.NotFound, "order %s not found", req.GetOrderId())
+	}
+	if !cancelled.isActive() {
+		return nil, status.Errorf(codes.FailedPrecondition, "order %s is not active", req.GetOrderId())
+	}
+
+	cancelled.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED
+	s.notifyChanged()
+
+	return &pb.CancelOrderResponse{Time: timestamppb.Now()}, nil
+}
+
+func (o *ordersServer) GetOrderState(
+	ctx context.Context,
+	req *pb.GetOrderStateRequest,
+) (*pb.OrderState, error) {
+	s := o.server
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := s.findOrder(req.GetOrderId())
+	if found == nil || found.accountID != req.GetAccountId() {
+		return nil, status.Errorf(codes.NotFound, "order %s not found", req.GetOrderId())
+	}
+
+	return found.state(), nil
+}
+
+// Only active orders are returned as the broker does
+func (o *ordersServer) GetOrders(
+	ctx context.Context,
+	req *pb.GetOrdersRequest,
+) (*pb.GetOrdersResponse, error) {
+	s := o.server
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]*pb.OrderState, 0)
+	for _, active := range s.orders {
+		if active.accountID == req.GetAccountId() && active.isActive() {
+			result = append(result, active.state())
+		}
+	}
+
+	return &pb.GetOrdersResponse{Orders: result}, nil
+}
@@ -0,0 +1,141 @@
+// Package tinkofffake is an in-process fake of the Tinkoff Invest API for tests.
+// It serves MarketDataService, MarketDataStreamService, InstrumentsService
+// and OrdersService over gRPC with responses scripted by the test.
+package tinkofffake
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/Reensef/sigmasage/pkg/utils"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Any token is accepted by the fake
+const Token = "tinkofffake"
+
+type Server struct {
+	listener   net.Listener
+	grpcServer *grpc.Server
+	rootCAs    *x509.CertPool
+
+	mu sync.Mutex
+	// Closed and replaced on every change, waiters recheck their condition
+	changed chan struct{}
+
+	candles        map[candlesKey][]*pb.HistoricCandle
+	candleRequests []*pb.GetCandlesRequest
+
+	streams              map[*stream]struct{}
+	streamsOpened        int
+	subscribeCount       int
+	subscriptionStatuses map[string]pb.SubscriptionStatus
+
+	instruments []*pb.Instrument
+	dividends   map[string][]*pb.Dividend
+
+	orders      []*order
+	orderStatus pb.OrderExecutionReportStatus
+}
+
+// Starts the fake on a random local port, see Config
+func NewServer() (*Server, error) {
+	cert, _, err := certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	rootCAs, err := certPool()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		grpcServer: grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}))),
+		rootCAs:              rootCAs,
+		changed:              make(chan struct{}),
+		candles:              make(map[candlesKey][]*pb.HistoricCandle),
+		streams:              make(map[*stream]struct{}),
+		subscriptionStatuses: make(map[string]pb.SubscriptionStatus),
+		dividends:            make(map[string][]*pb.Dividend),
+		orderStatus:          pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL,
+	}
+
+	pb.RegisterMarketDataServiceServer(s.grpcServer, &marketDataServer{server: s})
+	pb.RegisterMarketDataStreamServiceServer(s.grpcServer, &marketDataStreamServer{server: s})
+	pb.RegisterInstrumentsServiceServer(s.grpcServer, &instrumentsServer{server: s})
+	pb.RegisterOrdersServiceServer(s.grpcServer, &ordersServer{server: s})
+
+	go s.grpcServer.Serve(listener)
+
+	return s, nil
+}
+
+// Address to pass as the endpoint of the client
+func (s *Server) Endpoint() string {
+	return s.listener.Addr().String()
+}
+
+// Connection of clients to the fake, its certificate is the only trusted root
+func (s *Server) Config() utils.TinkoffConfig {
+	return utils.TinkoffConfig{
+		Endpoint: s.Endpoint(),
+		Token:    Token,
+		RootCAs:  s.rootCAs,
+	}
+}
+
+func (s *Server) Stop() {
+	s.DropStreams()
+	s.grpcServer.Stop()
+}
+
+// Must be called with mu locked
+func (s *Server) notifyChanged() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Blocks until ready returns true or ctx is done, ready is called with mu locked
+func (s *Server) wait(ctx context.Context, ready func() bool) error {
+	for {
+		s.mu.Lock()
+		if ready() {
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Builds a quotation as the API sends prices
+func Quotation(value float64) *pb.Quotation {
+	units := int64(value)
+
+	return &pb.Quotation{
+		Units: units,
+		Nano:  int32(math.Round((value - float64(units)) * 1e9)),
+	}
+}
@@ -0,0 +1,148 @@
+package tinkofffake
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Reensef/sigmasage/pkg/instruments"
+	"github.com/Reensef/sigmasage/pkg/utils"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(server.Stop)
+
+	return server
+}
+
+func TestInstrumentByTicker(t *testing.T) {
+	server := newTestServer(t)
+	server.AddInstrument(&pb.Instrument{
+		Uid:               "uid-lkoh",
+		Figi:              "BBG004731032",
+		Ticker:            "LKOH",
+		ClassCode:         "TQBR",
+		Lot:               1,
+		MinPriceIncrement: Quotation(0.5),
+	})
+
+	provider, err := instruments.NewTinkoffInstrumentProvider(server.Config())
+	if err != nil {
+		t.Fatalf("NewTinkoffInstrumentProvider: %v", err)
+	}
+
+	instrument, err := provider.GetInstrumentByTicker("LKOH", "TQBR")
+	if err != nil {
+		t.Fatalf("GetInstrumentByTicker: %v", err)
+	}
+	if instrument.UID != "uid-lkoh" || instrument.MinPriceIncrement != 0.5 {
+		t.Fatalf("unexpected instrument %+v", instrument)
+	}
+
+	_, err = provider.GetInstrumentByUID("unknown")
+	if err == nil {
+		t.Fatalf("expected error for unknown instrument")
+	}
+}
+
+func TestOrderFlow(t *testing.T) {
+	server := newTestServer(t)
+
+	conn, err := utils.NewTinkoffConn(server.Config())
+	if err != nil {
+		t.Fatalf("NewTinkoffConn: %v", err)
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	orders := pb.NewOrdersServiceClient(conn)
+
+	buy := &pb.PostOrderRequest{
+		InstrumentId: "uid-lkoh",
+		Quantity:     3,
+		Price:        Quotation(7000.5),
+		Direction:    pb.OrderDirection_ORDER_DIRECTION_BUY,
+		AccountId:    "account",
+		OrderType:    pb.OrderType_ORDER_TYPE_LIMIT,
+		OrderId:      "request-1",
+	}
+
+	// Limit order waits in the order book
+	server.SetOrderStatus(pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW)
+
+	posted, err := orders.PostOrder(ctx, buy)
+	if err != nil {
+		t.Fatalf("PostOrder: %v", err)
+	}
+	if posted.GetExecutionReportStatus() != pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW {
+		t.Fatalf("expected NEW order, got %v", posted.GetExecutionReportStatus())
+	}
+
+	// Retry with the same key doesn't post a second order
+	retried, err := orders.PostOrder(ctx, buy)
+	if err != nil {
+		t.Fatalf("PostOrder retry: %v", err)
+	}
+	if retried.GetOrderId() != posted.GetOrderId() {
+		t.Fatalf("retry posted a new order %s", retried.GetOrderId())
+	}
+
+	active, err := orders.GetOrders(ctx, &pb.GetOrdersRequest{AccountId: "account"})
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(active.GetOrders()) != 1 {
+		t.Fatalf("expected 1 active order, got %d", len(active.GetOrders()))
+	}
+
+	_, err = orders.CancelOrder(ctx, &pb.CancelOrderRequest{AccountId: "account", OrderId: posted.GetOrderId()})
+	if err != nil {
+		t.Fatalf("CancelOrder: %v", err)
+	}
+
+	active, err = orders.GetOrders(ctx, &pb.GetOrdersRequest{AccountId: "account"})
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(active.GetOrders()) != 0 {
+		t.Fatalf("expected no active orders, got %d", len(active.GetOrders()))
+	}
+
+	_, err = orders.CancelOrder(ctx, &pb.CancelOrderRequest{AccountId: "account", OrderId: posted.GetOrderId()})
+	if err == nil {
+		t.Fatalf("expected error cancelling a cancelled order")
+	}
+
+	// Market order is filled at once
+	server.SetOrderStatus(pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL)
+
+	filled, err := orders.PostOrder(ctx, &pb.PostOrderRequest{
+		InstrumentId: "uid-lkoh",
+		Quantity:     2,
+		Direction:    pb.OrderDirection_ORDER_DIRECTION_SELL,
+		AccountId:    "account",
+		OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
+		OrderId:      "request-2",
+	})
+	if err != nil {
+		t.Fatalf("PostOrder: %v", err)
+	}
+	if filled.GetLotsExecuted() != 2 {
+		t.Fatalf("expected 2 executed lots, got %d", filled.GetLotsExecuted())
+	}
+
+	history := server.Orders()
+	if len(history) != 2 {
+		t.Fatalf("expected 2 orders, got %d", len(history))
+	}
+	if history[0].GetExecutionReportStatus() != pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED {
+		t.Errorf("expected first order to be cancelled, got %v", history[0].GetExecutionReportStatus())
+	}
+}
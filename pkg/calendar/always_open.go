@@ -0,0 +1,35 @@
+package calendar
+
+import "time"
+
+// AlwaysOpenCalendar is a market that trades around the clock, e.g. a crypto exchange.
+// Every day of the location is one main session.
+type AlwaysOpenCalendar struct {
+	location *time.Location
+}
+
+func NewAlwaysOpenCalendar() *AlwaysOpenCalendar {
+	return &AlwaysOpenCalendar{location: time.UTC}
+}
+
+func (c *AlwaysOpenCalendar) Location() *time.Location {
+	return c.location
+}
+
+func (c *AlwaysOpenCalendar) Sessions(day time.Time) []Session {
+	open := StartOfDay(c, day)
+
+	return []Session{{
+		Type:  SessionType_MAIN,
+		Open:  open,
+		Close: open.AddDate(0, 0, 1),
+	}}
+}
+
+func (c *AlwaysOpenCalendar) IsOpen(t time.Time) bool {
+	return true
+}
+
+func (c *AlwaysOpenCalendar) NextOpen(t time.Time) time.Time {
+	return t
+}
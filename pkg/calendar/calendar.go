@@ -0,0 +1,75 @@
+package calendar
+
+import (
+	"time"
+)
+
+// Moscow Exchange works in Moscow time, which has no DST since 2014
+var MoscowLocation = time.FixedZone("MSK", 3*60*60)
+
+type SessionType int
+
+const (
+	SessionType_MAIN SessionType = iota
+	SessionType_EVENING
+	SessionType_WEEKEND
+)
+
+// Trading session [Open, Close)
+type Session struct {
+	Type  SessionType
+	Open  time.Time
+	Close time.Time
+}
+
+type Calendar interface {
+	// Sessions of the trading day that contains day, sorted by Open
+	Sessions(day time.Time) []Session
+	IsOpen(t time.Time) bool
+	// Returns t if the market is open, otherwise the open time of the next session
+	NextOpen(t time.Time) time.Time
+	Location() *time.Location
+}
+
+// How far NextOpen looks for a session before giving up
+const maxClosedDays = 31
+
+// Session that contains t, if any
+func SessionAt(cal Calendar, t time.Time) (Session, bool) {
+	for _, session := range cal.Sessions(t) {
+		if !t.Before(session.Open) && t.Before(session.Close) {
+			return session, true
+		}
+	}
+
+	return Session{}, false
+}
+
+// Midnight of the day of t in the calendar location
+func StartOfDay(cal Calendar, t time.Time) time.Time {
+	local := t.In(cal.Location())
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, cal.Location())
+}
+
+func isOpen(cal Calendar, t time.Time) bool {
+	_, ok := SessionAt(cal, t)
+	return ok
+}
+
+func nextOpen(cal Calendar, t time.Time) time.Time {
+	day := StartOfDay(cal, t)
+
+	for i := 0; i <= maxClosedDays; i++ {
+		for _, session := range cal.Sessions(day) {
+			if t.Before(session.Close) {
+				if t.Before(session.Open) {
+					return session.Open
+				}
+				return t
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+
+	return time.Time{}
+}
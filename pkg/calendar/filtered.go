@@ -0,0 +1,43 @@
+package calendar
+
+import (
+	"slices"
+	"time"
+)
+
+// FilteredCalendar keeps only sessions of the given types of another calendar,
+// e.g. main sessions of MOEX for indicators that skip thin evening and weekend trading
+type FilteredCalendar struct {
+	cal   Calendar
+	types []SessionType
+}
+
+func NewFilteredCalendar(cal Calendar, types ...SessionType) *FilteredCalendar {
+	return &FilteredCalendar{
+		cal:   cal,
+		types: types,
+	}
+}
+
+func (c *FilteredCalendar) Location() *time.Location {
+	return c.cal.Location()
+}
+
+func (c *FilteredCalendar) Sessions(day time.Time) []Session {
+	result := make([]Session, 0)
+	for _, session := range c.cal.Sessions(day) {
+		if slices.Contains(c.types, session.Type) {
+			result = append(result, session)
+		}
+	}
+
+	return result
+}
+
+func (c *FilteredCalendar) IsOpen(t time.Time) bool {
+	return isOpen(c, t)
+}
+
+func (c *FilteredCalendar) NextOpen(t time.Time) time.Time {
+	return nextOpen(c, t)
+}
@@ -0,0 +1,248 @@
+package calendar
+
+import (
+	"slices"
+	"time"
+)
+
+// Time of day in Moscow, offset from midnight
+type ClockTime = time.Duration
+
+func At(hour int, minute int) ClockTime {
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute
+}
+
+type MOEXSchedule struct {
+	// Session times sorted by Since, days before the first one use the first
+	SessionTimes []MOEXSessionTimes
+
+	// Saturday and Sunday sessions, zero WeekendSince disables them
+	WeekendOpen  ClockTime
+	WeekendClose ClockTime
+	WeekendSince time.Time
+
+	// Holidays that happen every year on the same date, within their years
+	YearlyHolidays []YearlyDate
+	// One-off holidays, e.g. holidays moved by the government
+	Holidays []time.Time
+	// Saturdays or Sundays that work as a usual weekday
+	WorkingWeekends []time.Time
+	// Days when the main session closes early and there is no evening session
+	ShortDays map[time.Time]ClockTime
+}
+
+// Main and evening sessions of days since the date, zero EveningClose means no evening session
+type MOEXSessionTimes struct {
+	Since time.Time
+
+	// Main session with opening and closing auctions
+	MainOpen  ClockTime
+	MainClose ClockTime
+
+	EveningOpen  ClockTime
+	EveningClose ClockTime
+}
+
+// FromYear and ToYear bound the years of the date inclusively, zero is unbounded
+type YearlyDate struct {
+	Month    time.Month
+	Day      int
+	FromYear int
+	ToYear   int
+}
+
+func (d YearlyDate) matches(t time.Time) bool {
+	if t.Month() != d.Month || t.Day() != d.Day {
+		return false
+	}
+
+	return (d.FromYear == 0 || t.Year() >= d.FromYear) && (d.ToYear == 0 || t.Year() <= d.ToYear)
+}
+
+// Default MOEX stock market schedule.
+// Holidays moved by the government differ every year and must be added to Holidays.
+func DefaultMOEXSchedule() MOEXSchedule {
+	return MOEXSchedule{
+		SessionTimes: []MOEXSessionTimes{
+			{
+				MainOpen:  At(9, 50),
+				MainClose: At(18, 50),
+			},
+			// Evening session of the stock market
+			{
+				Since:        time.Date(2020, time.June, 22, 0, 0, 0, 0, MoscowLocation),
+				MainOpen:     At(9, 50),
+				MainClose:    At(18, 50),
+				EveningOpen:  At(19, 5),
+				EveningClose: At(23, 50),
+			},
+		},
+		WeekendOpen:  At(10, 0),
+		WeekendClose: At(19, 0),
+		WeekendSince: time.Date(2025, time.March, 1, 0, 0, 0, 0, MoscowLocation),
+		YearlyHolidays: []YearlyDate{
+			{Month: time.January, Day: 1},
+			{Month: time.January, Day: 2},
+			{Month: time.January, Day: 7},
+			{Month: time.February, Day: 23},
+			{Month: time.March, Day: 8},
+			{Month: time.May, Day: 1},
+			{Month: time.May, Day: 9},
+			{Month: time.June, Day: 12},
+			{Month: time.November, Day: 4},
+			{Month: time.December, Day: 31},
+		},
+		ShortDays: make(map[time.Time]ClockTime),
+	}
+}
+
+type dateKey struct {
+	year  int
+	month time.Month
+	day   int
+}
+
+// MOEXCalendar is the trading calendar of the Moscow Exchange stock market
+type MOEXCalendar struct {
+	schedule        MOEXSchedule
+	holidays        map[dateKey]struct{}
+	workingWeekends map[dateKey]struct{}
+	shortDays       map[dateKey]ClockTime
+}
+
+// Calendar of DefaultMOEXSchedule. Its sessions follow the exchange since the evening session
+// of 22 June 2020, earlier days have the main session only. Holidays are the fixed yearly ones,
+// holidays moved by the government and short days of any year are missing,
+// see NewMOEXCalendarWithSchedule to add them.
+func NewMOEXCalendar() *MOEXCalendar {
+	return NewMOEXCalendarWithSchedule(DefaultMOEXSchedule())
+}
+
+func NewMOEXCalendarWithSchedule(schedule MOEXSchedule) *MOEXCalendar {
+	schedule.SessionTimes = slices.Clone(schedule.SessionTimes)
+	slices.SortStableFunc(schedule.SessionTimes, func(a, b MOEXSessionTimes) int {
+		return a.Since.Compare(b.Since)
+	})
+
+	c := &MOEXCalendar{
+		schedule:        schedule,
+		holidays:        make(map[dateKey]struct{}),
+		workingWeekends: make(map[dateKey]struct{}),
+		shortDays:       make(map[dateKey]ClockTime),
+	}
+
+	for _, d := range schedule.Holidays {
+		c.holidays[c.key(d)] = struct{}{}
+	}
+	for _, d := range schedule.WorkingWeekends {
+		c.workingWeekends[c.key(d)] = struct{}{}
+	}
+	for d, closeTime := range schedule.ShortDays {
+		c.shortDays[c.key(d)] = closeTime
+	}
+
+	return c
+}
+
+func (c *MOEXCalendar) Location() *time.Location {
+	return MoscowLocation
+}
+
+func (c *MOEXCalendar) Sessions(day time.Time) []Session {
+	midnight := StartOfDay(c, day)
+	key := c.key(midnight)
+
+	if c.IsHoliday(midnight) {
+		return nil
+	}
+
+	session := func(sessionType SessionType, openAt ClockTime, closeAt ClockTime) Session {
+		return Session{
+			Type:  sessionType,
+			Open:  midnight.Add(openAt),
+			Close: midnight.Add(closeAt),
+		}
+	}
+
+	weekday := midnight.Weekday()
+	_, working := c.workingWeekends[key]
+
+	if (weekday == time.Saturday || weekday == time.Sunday) && !working {
+		since := c.schedule.WeekendSince
+		if since.IsZero() || midnight.Before(since) {
+			return nil
+		}
+
+		return []Session{
+			session(SessionType_WEEKEND, c.schedule.WeekendOpen, c.schedule.WeekendClose),
+		}
+	}
+
+	times, ok := c.sessionTimes(midnight)
+	if !ok {
+		return nil
+	}
+
+	if closeTime, ok := c.shortDays[key]; ok {
+		return []Session{
+			session(SessionType_MAIN, times.MainOpen, closeTime),
+		}
+	}
+
+	if times.EveningClose == 0 {
+		return []Session{
+			session(SessionType_MAIN, times.MainOpen, times.MainClose),
+		}
+	}
+
+	return []Session{
+		session(SessionType_MAIN, times.MainOpen, times.MainClose),
+		session(SessionType_EVENING, times.EveningOpen, times.EveningClose),
+	}
+}
+
+// The last session times that started by the day
+func (c *MOEXCalendar) sessionTimes(midnight time.Time) (MOEXSessionTimes, bool) {
+	if len(c.schedule.SessionTimes) == 0 {
+		return MOEXSessionTimes{}, false
+	}
+
+	result := c.schedule.SessionTimes[0]
+	for _, times := range c.schedule.SessionTimes[1:] {
+		if midnight.Before(times.Since) {
+			break
+		}
+		result = times
+	}
+
+	return result, true
+}
+
+func (c *MOEXCalendar) IsOpen(t time.Time) bool {
+	return isOpen(c, t)
+}
+
+func (c *MOEXCalendar) NextOpen(t time.Time) time.Time {
+	return nextOpen(c, t)
+}
+
+func (c *MOEXCalendar) IsHoliday(day time.Time) bool {
+	local := day.In(MoscowLocation)
+
+	if _, ok := c.holidays[c.key(local)]; ok {
+		return true
+	}
+
+	for _, d := range c.schedule.YearlyHolidays {
+		if d.matches(local) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *MOEXCalendar) key(t time.Time) dateKey {
+	local := t.In(MoscowLocation)
+	return dateKey{local.Year(), local.Month(), local.Day()}
+}
@@ -0,0 +1,100 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+)
+
+func msk(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, MoscowLocation)
+}
+
+func TestMOEXCalendar_Sessions(t *testing.T) {
+	cal := NewMOEXCalendar()
+
+	sessions := cal.Sessions(msk(2024, time.January, 10, 12, 0))
+	if len(sessions) != 2 {
+		t.Fatalf("expected main and evening sessions, got %v", sessions)
+	}
+	if sessions[0].Type != SessionType_MAIN || !sessions[0].Open.Equal(msk(2024, time.January, 10, 9, 50)) {
+		t.Errorf("unexpected main session: %+v", sessions[0])
+	}
+	if sessions[1].Type != SessionType_EVENING || !sessions[1].Close.Equal(msk(2024, time.January, 10, 23, 50)) {
+		t.Errorf("unexpected evening session: %+v", sessions[1])
+	}
+
+	if sessions := cal.Sessions(msk(2024, time.January, 13, 12, 0)); len(sessions) != 0 {
+		t.Errorf("expected no sessions on Saturday before weekend trading, got %v", sessions)
+	}
+	if sessions := cal.Sessions(msk(2025, time.March, 15, 12, 0)); len(sessions) != 1 || sessions[0].Type != SessionType_WEEKEND {
+		t.Errorf("expected weekend session, got %v", sessions)
+	}
+	if sessions := cal.Sessions(msk(2024, time.February, 23, 12, 0)); len(sessions) != 0 {
+		t.Errorf("expected no sessions on a holiday, got %v", sessions)
+	}
+
+	// Day is taken in Moscow time, 22:00 UTC is already the next day
+	utc := time.Date(2024, time.February, 22, 22, 0, 0, 0, time.UTC)
+	if sessions := cal.Sessions(utc); len(sessions) != 0 {
+		t.Errorf("expected holiday sessions for %v, got %v", utc, sessions)
+	}
+}
+
+func TestMOEXCalendar_ShortDay(t *testing.T) {
+	schedule := DefaultMOEXSchedule()
+	schedule.ShortDays[msk(2024, time.December, 30, 0, 0)] = At(14, 0)
+	cal := NewMOEXCalendarWithSchedule(schedule)
+
+	sessions := cal.Sessions(msk(2024, time.December, 30, 12, 0))
+	if len(sessions) != 1 || !sessions[0].Close.Equal(msk(2024, time.December, 30, 14, 0)) {
+		t.Errorf("expected one short main session, got %v", sessions)
+	}
+}
+
+func TestMOEXCalendar_IsOpenAndNextOpen(t *testing.T) {
+	cal := NewMOEXCalendar()
+
+	tests := []struct {
+		at       time.Time
+		open     bool
+		nextOpen time.Time
+	}{
+		{msk(2024, time.January, 10, 12, 0), true, msk(2024, time.January, 10, 12, 0)},
+		{msk(2024, time.January, 10, 19, 0), false, msk(2024, time.January, 10, 19, 5)},
+		{msk(2024, time.January, 10, 23, 55), false, msk(2024, time.January, 11, 9, 50)},
+		{msk(2024, time.January, 12, 23, 55), false, msk(2024, time.January, 15, 9, 50)},
+		{msk(2024, time.February, 22, 23, 55), false, msk(2024, time.February, 26, 9, 50)},
+	}
+
+	for _, test := range tests {
+		if open := cal.IsOpen(test.at); open != test.open {
+			t.Errorf("IsOpen(%v): expected %v, got %v", test.at, test.open, open)
+		}
+		if next := cal.NextOpen(test.at); !next.Equal(test.nextOpen) {
+			t.Errorf("NextOpen(%v): expected %v, got %v", test.at, test.nextOpen, next)
+		}
+	}
+}
+
+func TestMOEXCalendar_DateRanges(t *testing.T) {
+	cal := NewMOEXCalendar()
+
+	// Evening session of stocks started on 22 June 2020
+	if sessions := cal.Sessions(msk(2020, time.June, 19, 12, 0)); len(sessions) != 1 || sessions[0].Type != SessionType_MAIN {
+		t.Errorf("expected only the main session before the evening one, got %v", sessions)
+	}
+	if sessions := cal.Sessions(msk(2020, time.June, 22, 12, 0)); len(sessions) != 2 {
+		t.Errorf("expected main and evening sessions, got %v", sessions)
+	}
+
+	schedule := DefaultMOEXSchedule()
+	schedule.YearlyHolidays = append(schedule.YearlyHolidays, YearlyDate{Month: time.January, Day: 3, FromYear: 2024, ToYear: 2024})
+	cal = NewMOEXCalendarWithSchedule(schedule)
+
+	if !cal.IsHoliday(msk(2024, time.January, 3, 12, 0)) {
+		t.Errorf("expected a holiday within its years")
+	}
+	if cal.IsHoliday(msk(2023, time.January, 3, 12, 0)) || cal.IsHoliday(msk(2025, time.January, 3, 12, 0)) {
+		t.Errorf("expected no holiday out of its years")
+	}
+}
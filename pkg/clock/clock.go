@@ -0,0 +1,92 @@
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of live components,
+// replays and tests substitute it with VirtualClock.
+// SetClock of a component isn't synchronized with its goroutines,
+// so the clock must be set before its subscriptions start or Run is called.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Wall clock
+var Real Clock = realClock{}
+
+// VirtualClock stands still until Set moves it forward,
+// timers of After fire when their time is reached
+type VirtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []virtualTimer
+}
+
+type virtualTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.timers = append(c.timers, virtualTimer{at: c.now.Add(d), ch: ch})
+
+	return ch
+}
+
+// Moves the clock to t, the clock never goes back
+func (c *VirtualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !t.After(c.now) {
+		return
+	}
+	c.now = t
+
+	c.timers = slices.DeleteFunc(c.timers, func(timer virtualTimer) bool {
+		if timer.at.After(t) {
+			return false
+		}
+		timer.ch <- t
+		return true
+	})
+}
+
+// Moves the clock forward by d
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
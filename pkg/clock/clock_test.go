@@ -0,0 +1,36 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtualClock_After(t *testing.T) {
+	start := time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+	c := NewVirtualClock(start)
+
+	timer := c.After(time.Hour)
+
+	c.Advance(30 * time.Minute)
+	select {
+	case <-timer:
+		t.Fatalf("timer fired before its time")
+	default:
+	}
+
+	c.Set(start.Add(2 * time.Hour))
+	select {
+	case fired := <-timer:
+		if !fired.Equal(start.Add(2 * time.Hour)) {
+			t.Errorf("expected timer to fire at the new time, got %s", fired)
+		}
+	default:
+		t.Fatalf("timer didn't fire")
+	}
+
+	// Clock never goes back
+	c.Set(start)
+	if !c.Now().Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("clock went back to %s", c.Now())
+	}
+}
@@ -0,0 +1,82 @@
+package corporateactions
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+type CorporateActionProvider interface {
+	// Actions of the instrument with ExDate in [from, to], sorted by ExDate
+	GetCorporateActions(ctx context.Context, instrumentID string, from time.Time, to time.Time) ([]domain.CorporateAction, error)
+}
+
+// CombinedCorporateActionProvider merges actions of several providers,
+// e.g. dividends of the broker and splits from a file
+type CombinedCorporateActionProvider struct {
+	providers []CorporateActionProvider
+}
+
+func NewCombinedCorporateActionProvider(providers ...CorporateActionProvider) *CombinedCorporateActionProvider {
+	return &CombinedCorporateActionProvider{providers: providers}
+}
+
+// Actions of the same type and ExDate are taken from the first provider that has them
+func (c *CombinedCorporateActionProvider) GetCorporateActions(
+	ctx context.Context,
+	instrumentID string,
+	from time.Time,
+	to time.Time,
+) ([]domain.CorporateAction, error) {
+	result := make([]domain.CorporateAction, 0)
+
+	for _, provider := range c.providers {
+		actions, err := provider.GetCorporateActions(ctx, instrumentID, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, action := range actions {
+			duplicate := slices.ContainsFunc(result, func(a domain.CorporateAction) bool {
+				return a.Type == action.Type && a.ExDate.Equal(action.ExDate)
+			})
+			if !duplicate {
+				result = append(result, action)
+			}
+		}
+	}
+
+	SortByExDate(result)
+
+	return result, nil
+}
+
+func SortByExDate(actions []domain.CorporateAction) {
+	slices.SortStableFunc(actions, func(a, b domain.CorporateAction) int {
+		return a.ExDate.Compare(b.ExDate)
+	})
+}
+
+// Dividends of actions sorted by ExDate, amounts are per share after the later splits,
+// as the prices of back-adjusted candles
+func SplitAdjustedDividends(actions []domain.CorporateAction) []domain.CorporateAction {
+	result := make([]domain.CorporateAction, 0)
+
+	for i, action := range actions {
+		if action.Type != domain.CorporateActionType_DIVIDEND {
+			continue
+		}
+
+		for _, later := range actions[i+1:] {
+			if later.Type == domain.CorporateActionType_SPLIT && later.ExDate.After(action.ExDate) && later.Ratio > 0 {
+				action.Dividend /= later.Ratio
+			}
+		}
+
+		result = append(result, action)
+	}
+
+	return result
+}
@@ -0,0 +1,74 @@
+package corporateactions
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestFileCorporateActionProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "actions.csv")
+	content := "instrument_id,type,ex_date,value,payment_date\n" +
+		"SBER,dividend,2024-07-11,33.3,2024-07-25\n" +
+		"SBER,split,2024-09-02,10,\n" +
+		"SBER,dividend,2023-05-11,25,\n" +
+		"GAZP,dividend,2024-07-18,10,\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	provider, err := NewFileCorporateActionProvider(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	from := time.Date(2024, time.January, 1, 0, 0, 0, 0, calendar.MoscowLocation)
+	to := time.Date(2025, time.January, 1, 0, 0, 0, 0, calendar.MoscowLocation)
+	actions, err := provider.GetCorporateActions(context.Background(), "SBER", from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(actions) != 2 {
+		t.Fatalf("expected 2 actions, got %d", len(actions))
+	}
+
+	dividend := actions[0]
+	if dividend.Type != domain.CorporateActionType_DIVIDEND || dividend.Dividend != 33.3 {
+		t.Errorf("unexpected dividend %+v", dividend)
+	}
+	if !dividend.ExDate.Equal(time.Date(2024, time.July, 11, 0, 0, 0, 0, calendar.MoscowLocation)) {
+		t.Errorf("unexpected ex-date %v", dividend.ExDate)
+	}
+	if dividend.PaymentDate.IsZero() {
+		t.Errorf("payment date is not parsed")
+	}
+	if actions[1].Type != domain.CorporateActionType_SPLIT || actions[1].Ratio != 10 {
+		t.Errorf("unexpected split %+v", actions[1])
+	}
+
+	adjusted := SplitAdjustedDividends(actions)
+	if len(adjusted) != 1 {
+		t.Fatalf("expected 1 dividend, got %d", len(adjusted))
+	}
+	if math.Abs(adjusted[0].Dividend-3.33) > 1e-9 {
+		t.Errorf("expected dividend 3.33 after the split, got %v", adjusted[0].Dividend)
+	}
+}
+
+func TestFileCorporateActionProvider_InvalidType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "actions.csv")
+	content := "instrument_id,type,ex_date,value\nSBER,spinoff,2024-07-11,1\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := NewFileCorporateActionProvider(path); err == nil {
+		t.Fatalf("expected error for undefined action type")
+	}
+}
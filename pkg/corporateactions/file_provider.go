@@ -0,0 +1,154 @@
+package corporateactions
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Corporate actions file is CSV with a header row:
+//
+// instrument_id,type,ex_date,value,payment_date
+// SBER,dividend,2024-07-11,33.3,2024-07-25
+// GMKN,split,2024-04-04,100,
+//
+// type is "dividend" or "split", value is the dividend per share or the split ratio.
+// Dates are days in Moscow, payment_date is optional.
+var corporateActionsCSVHeader = []string{"instrument_id", "type", "ex_date", "value", "payment_date"}
+
+const corporateActionsDateLayout = "2006-01-02"
+
+// FileCorporateActionProvider serves corporate actions of every instrument from one CSV file
+type FileCorporateActionProvider struct {
+	actions map[string][]domain.CorporateAction
+}
+
+func NewFileCorporateActionProvider(path string) (*FileCorporateActionProvider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	actions, err := readCorporateActionsCSV(file)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	result := make(map[string][]domain.CorporateAction)
+	for _, action := range actions {
+		result[action.InstrumentID] = append(result[action.InstrumentID], action)
+	}
+	for _, instrumentActions := range result {
+		SortByExDate(instrumentActions)
+	}
+
+	return &FileCorporateActionProvider{actions: result}, nil
+}
+
+func (f *FileCorporateActionProvider) GetCorporateActions(
+	ctx context.Context,
+	instrumentID string,
+	from time.Time,
+	to time.Time,
+) ([]domain.CorporateAction, error) {
+	result := make([]domain.CorporateAction, 0)
+
+	for _, action := range f.actions[instrumentID] {
+		if !action.ExDate.Before(from) && !action.ExDate.After(to) {
+			result = append(result, action)
+		}
+	}
+
+	return result, nil
+}
+
+func readCorporateActionsCSV(file *os.File) ([]domain.CorporateAction, error) {
+	r := csv.NewReader(bufio.NewReader(file))
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range corporateActionsCSVHeader[:4] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	result := make([]domain.CorporateAction, 0)
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		action, err := parseCorporateAction(record, columns)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		result = append(result, action)
+	}
+
+	return result, nil
+}
+
+func parseCorporateAction(record []string, columns map[string]int) (domain.CorporateAction, error) {
+	action := domain.CorporateAction{
+		InstrumentID: record[columns["instrument_id"]],
+	}
+
+	var err error
+	action.ExDate, err = time.ParseInLocation(corporateActionsDateLayout, record[columns["ex_date"]], calendar.MoscowLocation)
+	if err != nil {
+		return action, err
+	}
+
+	value, err := strconv.ParseFloat(record[columns["value"]], 64)
+	if err != nil {
+		return action, err
+	}
+	if value <= 0 {
+		return action, fmt.Errorf("value must be positive")
+	}
+
+	switch strings.ToLower(record[columns["type"]]) {
+	case "dividend":
+		action.Type = domain.CorporateActionType_DIVIDEND
+		action.Dividend = value
+	case "split":
+		action.Type = domain.CorporateActionType_SPLIT
+		action.Ratio = value
+	default:
+		return action, fmt.Errorf("undefined corporate action %q", record[columns["type"]])
+	}
+
+	if i, ok := columns["payment_date"]; ok && record[i] != "" {
+		action.PaymentDate, err = time.ParseInLocation(corporateActionsDateLayout, record[i], calendar.MoscowLocation)
+		if err != nil {
+			return action, err
+		}
+	}
+
+	return action, nil
+}
@@ -0,0 +1,88 @@
+package corporateactions
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+	"github.com/Reensef/sigmasage/pkg/utils"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// TinkoffCorporateActionProvider gets dividends from the broker.
+// The broker has no splits, they can be added from a file by CombinedCorporateActionProvider.
+type TinkoffCorporateActionProvider struct {
+	instrumentService pb.InstrumentsServiceClient
+	calendar          calendar.Calendar
+}
+
+func NewTinkoffCorporateActionProvider(config utils.TinkoffConfig) (*TinkoffCorporateActionProvider, error) {
+	conn, err := utils.NewTinkoffConn(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TinkoffCorporateActionProvider{
+		instrumentService: pb.NewInstrumentsServiceClient(conn),
+		calendar:          calendar.NewMOEXCalendar(),
+	}, nil
+}
+
+func (t *TinkoffCorporateActionProvider) GetCorporateActions(
+	ctx context.Context,
+	instrumentID string,
+	from time.Time,
+	to time.Time,
+) ([]domain.CorporateAction, error) {
+	// Ex-date is a trading day after the last buy date, it may be a few days later
+	resp, err := t.instrumentService.GetDividends(ctx, &pb.GetDividendsRequest{
+		InstrumentId: instrumentID,
+		From:         timestamppb.New(from.AddDate(0, 0, -14)),
+		To:           timestamppb.New(to),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dividends of %s: %w", instrumentID, err)
+	}
+
+	result := make([]domain.CorporateAction, 0)
+	for _, dividend := range resp.GetDividends() {
+		action := t.convertDividend(instrumentID, dividend)
+		if action.Dividend > 0 && !action.ExDate.Before(from) && !action.ExDate.After(to) {
+			result = append(result, action)
+		}
+	}
+
+	SortByExDate(result)
+
+	return result, nil
+}
+
+func (t *TinkoffCorporateActionProvider) convertDividend(
+	instrumentID string,
+	dividend *pb.Dividend,
+) domain.CorporateAction {
+	action := domain.CorporateAction{
+		InstrumentID: instrumentID,
+		Type:         domain.CorporateActionType_DIVIDEND,
+		Dividend:     dividend.GetDividendNet().ToFloat(),
+	}
+
+	if dividend.GetPaymentDate() != nil {
+		action.PaymentDate = calendar.StartOfDay(t.calendar, dividend.GetPaymentDate().AsTime())
+	}
+
+	// T+1 settlement: the share trades without the dividend from the next trading day
+	// after the last buy date, that is the record date
+	if lastBuy := dividend.GetLastBuyDate(); lastBuy != nil {
+		nextDay := calendar.StartOfDay(t.calendar, lastBuy.AsTime()).AddDate(0, 0, 1)
+		action.ExDate = calendar.StartOfDay(t.calendar, t.calendar.NextOpen(nextDay))
+	} else {
+		action.ExDate = calendar.StartOfDay(t.calendar, dividend.GetRecordDate().AsTime())
+	}
+
+	return action
+}
@@ -0,0 +1,30 @@
+package domain
+
+import "time"
+
+// Dividend or split of an instrument. Prices before ExDate are affected by it.
+type CorporateAction struct {
+	InstrumentID string
+	Type         CorporateActionType
+	// First day the share trades without the dividend or after the split, midnight in Moscow
+	ExDate time.Time
+	// Dividend per share in the currency of the instrument
+	Dividend    float64
+	PaymentDate time.Time
+	// New shares for one old share, e.g. 10 for a 1:10 split and 0.1 for a reverse one
+	Ratio float64
+}
+
+type CorporateActionType int32
+
+const (
+	CorporateActionType_DIVIDEND CorporateActionType = iota
+	CorporateActionType_SPLIT
+)
+
+// Dividend received for the shares held at the ex-date
+type DividendPayment struct {
+	Action CorporateAction
+	Count  int
+	Amount float64
+}
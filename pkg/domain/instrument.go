@@ -0,0 +1,37 @@
+package domain
+
+type Instrument struct {
+	UID               string
+	FIGI              string
+	Ticker            string
+	ClassCode         string
+	Name              string
+	Type              InstrumentType
+	Currency          string
+	Lot               int
+	MinPriceIncrement float64
+	TradingStatus     InstrumentTradingStatus
+	ProviderType      MarketDataProviderType
+}
+
+type InstrumentType int32
+
+const (
+	InstrumentType_UNSPECIFIED InstrumentType = iota
+	InstrumentType_SHARE
+	InstrumentType_BOND
+	InstrumentType_ETF
+	InstrumentType_CURRENCY
+	InstrumentType_FUTURES
+	InstrumentType_OPTION
+)
+
+type InstrumentTradingStatus int32
+
+const (
+	InstrumentTradingStatus_UNSPECIFIED InstrumentTradingStatus = iota
+	InstrumentTradingStatus_NOT_AVAILABLE
+	InstrumentTradingStatus_NORMAL_TRADING
+	InstrumentTradingStatus_BREAK
+	InstrumentTradingStatus_AUCTION
+)
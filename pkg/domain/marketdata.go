@@ -6,6 +6,8 @@ type MarketData struct {
 	ID           string
 	Interval     MarketDataInterval
 	ProviderType MarketDataProviderType
+	// Zero value keeps candles of every session
+	SessionFilter SessionFilter
 }
 
 type Candle struct {
@@ -17,12 +19,29 @@ type Candle struct {
 	Volume     float64
 	OpenTime   time.Time
 	CloseTime  time.Time
+	// Candle is still forming, its values may change until CloseTime
+	Partial bool
 }
 
 type MarketDataProviderType int32
 
 const (
 	MarketDataProviderType_TINKOFF MarketDataProviderType = iota
+	MarketDataProviderType_FILE
+	MarketDataProviderType_REPLAY
+	MarketDataProviderType_SYNTHETIC
+	MarketDataProviderType_MOEX
+	MarketDataProviderType_BINANCE
+)
+
+// Sessions whose candles are kept, evening and weekend bars are thin
+// and distort indicator windows of the main session
+type SessionFilter int32
+
+const (
+	SessionFilter_ALL SessionFilter = iota
+	SessionFilter_MAIN
+	SessionFilter_MAIN_EVENING
 )
 
 type MarketDataInterval int32
@@ -0,0 +1,62 @@
+package domain
+
+import "time"
+
+// Stream of one instrument that is not split by interval, e.g. last prices or trades
+type InstrumentInfo struct {
+	ID           string
+	ProviderType MarketDataProviderType
+}
+
+type OrderBookInfo struct {
+	ID           string
+	Depth        int
+	ProviderType MarketDataProviderType
+}
+
+// Quantity is in lots
+type OrderBookLevel struct {
+	Price    float64
+	Quantity int64
+}
+
+// Bids are sorted by price descending, asks ascending
+type OrderBook struct {
+	Info         OrderBookInfo
+	Bids         []OrderBookLevel
+	Asks         []OrderBookLevel
+	IsConsistent bool
+	Time         time.Time
+}
+
+// Difference between the best ask and the best bid, false if a side is empty
+func (o OrderBook) Spread() (float64, bool) {
+	if len(o.Bids) == 0 || len(o.Asks) == 0 {
+		return 0, false
+	}
+
+	return o.Asks[0].Price - o.Bids[0].Price, true
+}
+
+type LastPrice struct {
+	Info  InstrumentInfo
+	Price float64
+	Time  time.Time
+}
+
+type TradeDirection int32
+
+const (
+	TradeDirection_UNSPECIFIED TradeDirection = iota
+	TradeDirection_BUY
+	TradeDirection_SELL
+)
+
+// Anonymous trade of the exchange, Quantity is in lots
+type Trade struct {
+	Info      InstrumentInfo
+	Direction TradeDirection
+	Price     float64
+	Quantity  int64
+	Time      time.Time
+}
@@ -28,3 +28,12 @@ func MustInt(key string) int {
 
 	return valAsInt
 }
+
+func String(key string, fallback string) string {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	return val
+}
@@ -1,12 +1,19 @@
 package exchange
 
-import "time"
+import (
+	"math"
+	"time"
+)
 
+// Count is in pieces. Lot and MinPriceIncrement are taken from the instrument
+// metadata, zero values mean the exchange doesn't restrict them.
 type OrderRequest struct {
-	InstrumentID string
-	Count        int
-	Price        float64
-	Time         time.Time
+	InstrumentID      string
+	Count             int
+	Price             float64
+	Time              time.Time
+	Lot               int
+	MinPriceIncrement float64
 }
 
 type OrderResult struct {
@@ -20,3 +27,37 @@ type Exchanger interface {
 	Buy(orderRequest OrderRequest) (orderResult OrderResult, err error)
 	Sell(orderRequest OrderRequest) (orderResult OrderResult, err error)
 }
+
+// Rounds count down to whole lots
+func AlignToLot(count int, lot int) int {
+	if lot <= 1 {
+		return count
+	}
+
+	return count - count%lot
+}
+
+type OrderSide int32
+
+const (
+	OrderSide_BUY OrderSide = iota
+	OrderSide_SELL
+)
+
+// Share of a step that is float error of price/step, e.g. 100.3/0.1 = 1002.9999999999999
+const priceStepEpsilon = 1e-9
+
+// Rounds price to an allowed price step on the safe side: buys down, so an order sized
+// by the balance doesn't cost more than it, sells up, so they don't go below the requested price
+func AlignToPriceStep(price float64, step float64, side OrderSide) float64 {
+	if step <= 0 {
+		return price
+	}
+
+	steps := price / step
+	if side == OrderSide_BUY {
+		return math.Floor(steps+priceStepEpsilon) * step
+	}
+
+	return math.Ceil(steps-priceStepEpsilon) * step
+}
@@ -0,0 +1,80 @@
+package exchange
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAlignToLot(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    int
+		lot      int
+		expected int
+	}{
+		{"no lot", 7, 0, 7},
+		{"lot of one", 7, 1, 7},
+		{"whole lots", 30, 10, 30},
+		{"rounded down", 37, 10, 30},
+		{"less than a lot", 7, 10, 0},
+	}
+
+	for _, test := range tests {
+		if count := AlignToLot(test.count, test.lot); count != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, count)
+		}
+	}
+}
+
+func TestAlignToPriceStep(t *testing.T) {
+	tests := []struct {
+		name     string
+		price    float64
+		step     float64
+		side     OrderSide
+		expected float64
+	}{
+		{"no step", 100.37, 0, OrderSide_BUY, 100.37},
+		{"buy rounded down", 100.37, 0.1, OrderSide_BUY, 100.3},
+		{"sell rounded up", 100.33, 0.1, OrderSide_SELL, 100.4},
+		{"buy on step", 100.3, 0.1, OrderSide_BUY, 100.3},
+		{"sell on step", 100.3, 0.1, OrderSide_SELL, 100.3},
+		{"buy of large step", 5432, 5, OrderSide_BUY, 5430},
+		{"sell of large step", 5432, 5, OrderSide_SELL, 5435},
+	}
+
+	for _, test := range tests {
+		price := AlignToPriceStep(test.price, test.step, test.side)
+		if math.Abs(price-test.expected) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, price)
+		}
+	}
+}
+
+// Buy sized by the balance at the last price doesn't cost more than the balance
+func TestMockExchange_BuyWithinBalance(t *testing.T) {
+	balance := 1000.0
+	lastPrice := 100.39
+
+	result, err := NewMockExchange(0, 0).Buy(OrderRequest{
+		Count:             int(balance / lastPrice),
+		Price:             lastPrice,
+		Lot:               1,
+		MinPriceIncrement: 0.1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Count != 9 || result.LotPrice > balance {
+		t.Errorf("unexpected result %+v for balance %v", result, balance)
+	}
+
+	// Not a single lot for the balance
+	result, err = NewMockExchange(0, 0).Buy(OrderRequest{Count: 9, Price: lastPrice, Lot: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Count != 0 || result.LotPrice != 0 {
+		t.Errorf("expected empty order, got %+v", result)
+	}
+}
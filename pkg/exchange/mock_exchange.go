@@ -13,25 +13,31 @@ func NewMockExchange(commissionPercent float64, slippagePercent float64) *MockEx
 }
 
 func (e *MockExchange) Buy(orderRequest OrderRequest) (orderResult OrderResult, err error) {
-	basePrice := orderRequest.Price * float64(orderRequest.Count)
+	count := AlignToLot(orderRequest.Count, orderRequest.Lot)
+	price := AlignToPriceStep(orderRequest.Price, orderRequest.MinPriceIncrement, OrderSide_BUY)
+
+	basePrice := price * float64(count)
 	basePrice = basePrice * (1 + e.slippagePercent)
 
 	commission := basePrice * e.commissionPercent
 
 	return OrderResult{
-		Count:      orderRequest.Count,
+		Count:      count,
 		LotPrice:   basePrice + commission,
 		Commission: commission,
 	}, nil
 }
 
 func (e *MockExchange) Sell(orderRequest OrderRequest) (orderResult OrderResult, err error) {
-	basePrice := orderRequest.Price * float64(orderRequest.Count)
+	count := AlignToLot(orderRequest.Count, orderRequest.Lot)
+	price := AlignToPriceStep(orderRequest.Price, orderRequest.MinPriceIncrement, OrderSide_SELL)
+
+	basePrice := price * float64(count)
 	basePrice = basePrice * (1 - e.slippagePercent)
 
 	commission := basePrice * e.commissionPercent
 	return OrderResult{
-		Count:      orderRequest.Count,
+		Count:      count,
 		LotPrice:   basePrice - commission,
 		Commission: commission,
 	}, nil
@@ -0,0 +1,8 @@
+package instruments
+
+import "github.com/Reensef/sigmasage/pkg/domain"
+
+type InstrumentProvider interface {
+	GetInstrumentByTicker(ticker string, classCode string) (domain.Instrument, error)
+	GetInstrumentByUID(uid string) (domain.Instrument, error)
+}
@@ -0,0 +1,181 @@
+package instruments
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+	"github.com/Reensef/sigmasage/pkg/utils"
+)
+
+// MOEXInstrumentProvider reads instruments of the public Moscow Exchange ISS API.
+// UID and ticker are the SECID, class code is the board, e.g. "TQBR".
+type MOEXInstrumentProvider struct {
+	client *utils.MOEXISSClient
+}
+
+// endpoint is utils.MOEXISSEndpoint, tests pass the URL of a local stand-in
+func NewMOEXInstrumentProvider(endpoint string) *MOEXInstrumentProvider {
+	return &MOEXInstrumentProvider{
+		client: utils.NewMOEXISSClient(endpoint),
+	}
+}
+
+func (m *MOEXInstrumentProvider) GetInstrumentByTicker(
+	ticker string,
+	classCode string,
+) (domain.Instrument, error) {
+	return m.instrument(ticker, func(board utils.MOEXBoard) bool {
+		return strings.EqualFold(board.BoardID, classCode)
+	})
+}
+
+// Instrument on its primary board
+func (m *MOEXInstrumentProvider) GetInstrumentByUID(uid string) (domain.Instrument, error) {
+	return m.instrument(uid, func(board utils.MOEXBoard) bool {
+		return board.Primary
+	})
+}
+
+// Listing of a board, e.g. "stock", "shares", "TQBR"
+func (m *MOEXInstrumentProvider) GetInstrumentsByBoard(
+	engine string,
+	market string,
+	board string,
+) ([]domain.Instrument, error) {
+	path := fmt.Sprintf("/engines/%s/markets/%s/boards/%s/securities", engine, market, board)
+
+	blocks, err := m.client.Get(context.Background(), path, url.Values{"iss.only": {"securities,marketdata"}})
+	if err != nil {
+		return nil, fmt.Errorf("instruments of %s: %w", board, err)
+	}
+
+	statuses := make(map[string]string)
+	for _, row := range blocks["marketdata"].Rows() {
+		statuses[row.String("SECID")] = row.String("TRADINGSTATUS")
+	}
+
+	rows := blocks["securities"].Rows()
+	result := make([]domain.Instrument, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, m.convertInstrument(engine, market, row, statuses[row.String("SECID")]))
+	}
+
+	return result, nil
+}
+
+func (m *MOEXInstrumentProvider) instrument(
+	secID string,
+	match func(board utils.MOEXBoard) bool,
+) (domain.Instrument, error) {
+	ctx := context.Background()
+
+	boards, err := m.client.Boards(ctx, secID)
+	if err != nil {
+		return domain.Instrument{}, fmt.Errorf("instrument %s: %w", secID, err)
+	}
+
+	index := slices.IndexFunc(boards, match)
+	if index < 0 {
+		return domain.Instrument{}, fmt.Errorf("instrument %s: board not found", secID)
+	}
+	board := boards[index]
+
+	path := fmt.Sprintf(
+		"/engines/%s/markets/%s/boards/%s/securities/%s",
+		board.Engine,
+		board.Market,
+		board.BoardID,
+		url.PathEscape(secID),
+	)
+
+	blocks, err := m.client.Get(ctx, path, url.Values{"iss.only": {"securities,marketdata"}})
+	if err != nil {
+		return domain.Instrument{}, fmt.Errorf("instrument %s: %w", secID, err)
+	}
+
+	securities := blocks["securities"].Rows()
+	if len(securities) == 0 {
+		return domain.Instrument{}, fmt.Errorf("instrument %s not found on %s", secID, board.BoardID)
+	}
+
+	status := ""
+	if marketData := blocks["marketdata"].Rows(); len(marketData) > 0 {
+		status = marketData[0].String("TRADINGSTATUS")
+	}
+
+	return m.convertInstrument(board.Engine, board.Market, securities[0], status), nil
+}
+
+func (m *MOEXInstrumentProvider) convertInstrument(
+	engine string,
+	market string,
+	row utils.MOEXISSRow,
+	tradingStatus string,
+) domain.Instrument {
+	name := row.String("SECNAME")
+	if name == "" {
+		name = row.String("SHORTNAME")
+	}
+
+	lot := int(row.Float("LOTSIZE"))
+	if lot == 0 {
+		lot = 1
+	}
+
+	return domain.Instrument{
+		UID:               row.String("SECID"),
+		Ticker:            row.String("SECID"),
+		ClassCode:         row.String("BOARDID"),
+		Name:              name,
+		Type:              m.convertInstrumentType(engine, market, row.String("BOARDID")),
+		Currency:          m.convertCurrency(row.String("CURRENCYID")),
+		Lot:               lot,
+		MinPriceIncrement: row.Float("MINSTEP"),
+		TradingStatus:     m.convertTradingStatus(tradingStatus),
+		ProviderType:      domain.MarketDataProviderType_MOEX,
+	}
+}
+
+func (m *MOEXInstrumentProvider) convertInstrumentType(engine string, market string, board string) domain.InstrumentType {
+	switch {
+	case engine == "currency":
+		return domain.InstrumentType_CURRENCY
+	case engine == "futures" && market == "forts":
+		return domain.InstrumentType_FUTURES
+	case engine == "futures" && market == "options":
+		return domain.InstrumentType_OPTION
+	case engine == "stock" && market == "bonds":
+		return domain.InstrumentType_BOND
+	// Funds are traded on the shares market
+	case engine == "stock" && market == "shares" && board == "TQTF":
+		return domain.InstrumentType_ETF
+	case engine == "stock" && market == "shares":
+		return domain.InstrumentType_SHARE
+	default:
+		return domain.InstrumentType_UNSPECIFIED
+	}
+}
+
+// ISS uses SUR for roubles, currencies are lower case as the broker has them
+func (m *MOEXInstrumentProvider) convertCurrency(currency string) string {
+	if currency == "SUR" {
+		return "rub"
+	}
+
+	return strings.ToLower(currency)
+}
+
+func (m *MOEXInstrumentProvider) convertTradingStatus(status string) domain.InstrumentTradingStatus {
+	switch status {
+	case "T":
+		return domain.InstrumentTradingStatus_NORMAL_TRADING
+	case "N":
+		return domain.InstrumentTradingStatus_NOT_AVAILABLE
+	default:
+		return domain.InstrumentTradingStatus_UNSPECIFIED
+	}
+}
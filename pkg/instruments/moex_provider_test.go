@@ -0,0 +1,89 @@
+package instruments
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Serves recorded ISS responses
+func newMOEXStandIn(t *testing.T) *httptest.Server {
+	files := map[string]string{
+		"/iss/securities/SBER.json": "securities_SBER.json",
+		"/iss/engines/stock/markets/shares/boards/TQBR/securities/SBER.json": "board_TQBR_SBER.json",
+		"/iss/engines/stock/markets/shares/boards/TQBR/securities.json":      "board_TQBR.json",
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", "moex", file))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestMOEXInstrumentProvider_GetInstrumentByTicker(t *testing.T) {
+	server := newMOEXStandIn(t)
+	provider := NewMOEXInstrumentProvider(server.URL + "/iss")
+
+	instrument, err := provider.GetInstrumentByTicker("SBER", "TQBR")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := domain.Instrument{
+		UID:               "SBER",
+		Ticker:            "SBER",
+		ClassCode:         "TQBR",
+		Name:              "Сбербанк России ПАО ао",
+		Type:              domain.InstrumentType_SHARE,
+		Currency:          "rub",
+		Lot:               10,
+		MinPriceIncrement: 0.01,
+		TradingStatus:     domain.InstrumentTradingStatus_NORMAL_TRADING,
+		ProviderType:      domain.MarketDataProviderType_MOEX,
+	}
+	if instrument != expected {
+		t.Errorf("expected %+v, got %+v", expected, instrument)
+	}
+
+	byUID, err := provider.GetInstrumentByUID("SBER")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if byUID != expected {
+		t.Errorf("expected %+v, got %+v", expected, byUID)
+	}
+
+	if _, err := provider.GetInstrumentByTicker("SBER", "TQTF"); err == nil {
+		t.Errorf("expected error for a board without the security")
+	}
+}
+
+func TestMOEXInstrumentProvider_GetInstrumentsByBoard(t *testing.T) {
+	server := newMOEXStandIn(t)
+	provider := NewMOEXInstrumentProvider(server.URL + "/iss")
+
+	instruments, err := provider.GetInstrumentsByBoard("stock", "shares", "TQBR")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instruments) != 3 {
+		t.Fatalf("expected 3 instruments, got %d", len(instruments))
+	}
+
+	if instruments[0].Ticker != "GAZP" || instruments[0].Name != "\"Газпром\" (ПАО) ао" {
+		t.Errorf("unexpected instrument %+v", instruments[0])
+	}
+	if instruments[2].TradingStatus != domain.InstrumentTradingStatus_NOT_AVAILABLE {
+		t.Errorf("expected SBERP not available, got %v", instruments[2].TradingStatus)
+	}
+}
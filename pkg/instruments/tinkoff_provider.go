@@ -0,0 +1,115 @@
+package instruments
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+	"github.com/Reensef/sigmasage/pkg/utils"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+)
+
+type TinkoffInstrumentProvider struct {
+	instrumentService pb.InstrumentsServiceClient
+}
+
+func NewTinkoffInstrumentProvider(config utils.TinkoffConfig) (*TinkoffInstrumentProvider, error) {
+	conn, err := utils.NewTinkoffConn(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TinkoffInstrumentProvider{
+		instrumentService: pb.NewInstrumentsServiceClient(conn),
+	}, nil
+}
+
+// classCode is the trading mode, e.g. "TQBR" for shares
+func (t *TinkoffInstrumentProvider) GetInstrumentByTicker(
+	ticker string,
+	classCode string,
+) (domain.Instrument, error) {
+	resp, err := t.instrumentService.GetInstrumentBy(context.Background(), &pb.InstrumentRequest{
+		IdType:    pb.InstrumentIdType_INSTRUMENT_ID_TYPE_TICKER,
+		ClassCode: &classCode,
+		Id:        ticker,
+	})
+	if err != nil {
+		return domain.Instrument{}, fmt.Errorf("instrument %s %s: %w", ticker, classCode, err)
+	}
+
+	return t.convertInstrument(resp.GetInstrument()), nil
+}
+
+func (t *TinkoffInstrumentProvider) GetInstrumentByUID(uid string) (domain.Instrument, error) {
+	resp, err := t.instrumentService.GetInstrumentBy(context.Background(), &pb.InstrumentRequest{
+		IdType: pb.InstrumentIdType_INSTRUMENT_ID_TYPE_UID,
+		Id:     uid,
+	})
+	if err != nil {
+		return domain.Instrument{}, fmt.Errorf("instrument %s: %w", uid, err)
+	}
+
+	return t.convertInstrument(resp.GetInstrument()), nil
+}
+
+func (t *TinkoffInstrumentProvider) convertInstrument(instrument *pb.Instrument) domain.Instrument {
+	return domain.Instrument{
+		UID:               instrument.GetUid(),
+		FIGI:              instrument.GetFigi(),
+		Ticker:            instrument.GetTicker(),
+		ClassCode:         instrument.GetClassCode(),
+		Name:              instrument.GetName(),
+		Type:              t.convertInstrumentType(instrument.GetInstrumentType()),
+		Currency:          instrument.GetCurrency(),
+		Lot:               int(instrument.GetLot()),
+		MinPriceIncrement: instrument.GetMinPriceIncrement().ToFloat(),
+		TradingStatus:     t.convertTradingStatus(instrument.GetTradingStatus()),
+		ProviderType:      domain.MarketDataProviderType_TINKOFF,
+	}
+}
+
+func (t *TinkoffInstrumentProvider) convertInstrumentType(instrumentType string) domain.InstrumentType {
+	switch instrumentType {
+	case "share":
+		return domain.InstrumentType_SHARE
+	case "bond":
+		return domain.InstrumentType_BOND
+	case "etf":
+		return domain.InstrumentType_ETF
+	case "currency":
+		return domain.InstrumentType_CURRENCY
+	case "futures":
+		return domain.InstrumentType_FUTURES
+	case "option":
+		return domain.InstrumentType_OPTION
+	default:
+		return domain.InstrumentType_UNSPECIFIED
+	}
+}
+
+func (t *TinkoffInstrumentProvider) convertTradingStatus(status pb.SecurityTradingStatus) domain.InstrumentTradingStatus {
+	switch status {
+	case pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_NORMAL_TRADING,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_DEALER_NORMAL_TRADING:
+		return domain.InstrumentTradingStatus_NORMAL_TRADING
+	case pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_BREAK_IN_TRADING,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_DEALER_BREAK_IN_TRADING:
+		return domain.InstrumentTradingStatus_BREAK
+	case pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_OPENING_PERIOD,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_CLOSING_PERIOD,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_OPENING_AUCTION_PERIOD,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_CLOSING_AUCTION,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_DISCRETE_AUCTION,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_DARK_POOL_AUCTION,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_TRADING_AT_CLOSING_AUCTION_PRICE:
+		return domain.InstrumentTradingStatus_AUCTION
+	case pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_NOT_AVAILABLE_FOR_TRADING,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_DEALER_NOT_AVAILABLE_FOR_TRADING,
+		pb.SecurityTradingStatus_SECURITY_TRADING_STATUS_SESSION_CLOSE:
+		return domain.InstrumentTradingStatus_NOT_AVAILABLE
+	default:
+		return domain.InstrumentTradingStatus_UNSPECIFIED
+	}
+}
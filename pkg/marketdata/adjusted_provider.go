@@ -0,0 +1,292 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/corporateactions"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+type AdjustmentType int32
+
+const (
+	// Prices and volumes before splits are scaled to the shares after them.
+	// Bots get dividends as cash, see corporateactions.SplitAdjustedDividends.
+	AdjustmentType_SPLITS AdjustmentType = iota
+	// Total return prices, dividends are reinvested in the prices before their ex-dates.
+	// Bots must not credit dividends then.
+	AdjustmentType_SPLITS_AND_DIVIDENDS
+)
+
+// AdjustedMarketDataProvider returns back-adjusted history of the upstream:
+// candles after the last corporate action keep their prices, older ones are scaled.
+// Actions up to the clock are taken into account, streamed candles are after them
+// and are passed as is.
+type AdjustedMarketDataProvider struct {
+	upstream   MarketDataProvider
+	actions    corporateactions.CorporateActionProvider
+	adjustment AdjustmentType
+	clock      clock.Clock
+	mu         sync.Mutex
+	// Price factors of dividends, they depend on the close before the ex-date
+	dividendFactors map[dividendFactorKey]float64
+}
+
+type dividendFactorKey struct {
+	marketData domain.MarketData
+	exDate     time.Time
+}
+
+// Factors of one corporate action
+type priceAdjustment struct {
+	exDate time.Time
+	price  float64
+	volume float64
+}
+
+func NewAdjustedMarketDataProvider(
+	upstream MarketDataProvider,
+	actions corporateactions.CorporateActionProvider,
+	adjustment AdjustmentType,
+) *AdjustedMarketDataProvider {
+	return &AdjustedMarketDataProvider{
+		upstream:        upstream,
+		actions:         actions,
+		adjustment:      adjustment,
+		clock:           clock.Real,
+		dividendFactors: make(map[dividendFactorKey]float64),
+	}
+}
+
+// Corporate actions after c are not known yet
+func (a *AdjustedMarketDataProvider) SetClock(c clock.Clock) {
+	a.clock = c
+}
+
+func (a *AdjustedMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return a.upstream.SubscribeCandles(ctx, marketData)
+}
+
+func (a *AdjustedMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return a.upstream.UnsubscribeCandles(marketData, ch)
+}
+
+func (a *AdjustedMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return a.upstream.SubscribeCandleUpdates(ctx, marketData)
+}
+
+func (a *AdjustedMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return a.upstream.UnsubscribeCandleUpdates(marketData, ch)
+}
+
+func (a *AdjustedMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	return a.upstream.SubscribeOrderBook(ctx, orderBookInfo)
+}
+
+func (a *AdjustedMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	return a.upstream.UnsubscribeOrderBook(orderBookInfo, ch)
+}
+
+func (a *AdjustedMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	return a.upstream.SubscribeLastPrices(ctx, instrumentInfo)
+}
+
+func (a *AdjustedMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	return a.upstream.UnsubscribeLastPrices(instrumentInfo, ch)
+}
+
+func (a *AdjustedMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	return a.upstream.SubscribeTrades(ctx, instrumentInfo)
+}
+
+func (a *AdjustedMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	return a.upstream.UnsubscribeTrades(instrumentInfo, ch)
+}
+
+func (a *AdjustedMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	candles, err := a.upstream.GetCandlesByTime(ctx, marketData, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.adjust(ctx, marketData, candles)
+}
+
+func (a *AdjustedMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	candles, err := a.upstream.GetCandlesByCount(ctx, marketData, last, count)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.adjust(ctx, marketData, candles)
+}
+
+// Candles must be sorted by OpenTime, the result is a new slice
+func (a *AdjustedMarketDataProvider) adjust(
+	ctx context.Context,
+	marketData domain.MarketData,
+	candles []domain.Candle,
+) ([]domain.Candle, error) {
+	if len(candles) == 0 {
+		return candles, nil
+	}
+
+	adjustments, err := a.adjustments(ctx, marketData, candles[0].OpenTime)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]domain.Candle, len(candles))
+	copy(result, candles)
+
+	// Candles before an ex-date are scaled by every action from it on
+	price, volume := 1.0, 1.0
+	j := len(adjustments) - 1
+	for i := len(result) - 1; i >= 0; i-- {
+		for j >= 0 && result[i].OpenTime.Before(adjustments[j].exDate) {
+			price *= adjustments[j].price
+			volume *= adjustments[j].volume
+			j--
+		}
+
+		result[i].Open *= price
+		result[i].High *= price
+		result[i].Low *= price
+		result[i].Close *= price
+		result[i].Volume *= volume
+	}
+
+	return result, nil
+}
+
+// Adjustments of actions after from, sorted by ex-date
+func (a *AdjustedMarketDataProvider) adjustments(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+) ([]priceAdjustment, error) {
+	now := a.clock.Now()
+	if !from.Before(now) {
+		return nil, nil
+	}
+
+	actions, err := a.actions.GetCorporateActions(ctx, marketData.ID, from, now)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]priceAdjustment, 0, len(actions))
+	for _, action := range actions {
+		if !action.ExDate.After(from) {
+			continue
+		}
+
+		switch action.Type {
+		case domain.CorporateActionType_SPLIT:
+			if action.Ratio <= 0 {
+				return nil, fmt.Errorf("split of %s at %v has no ratio", marketData.ID, action.ExDate)
+			}
+			result = append(result, priceAdjustment{
+				exDate: action.ExDate,
+				price:  1 / action.Ratio,
+				volume: action.Ratio,
+			})
+		case domain.CorporateActionType_DIVIDEND:
+			if a.adjustment != AdjustmentType_SPLITS_AND_DIVIDENDS {
+				continue
+			}
+
+			factor, err := a.dividendFactor(ctx, marketData, action)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, priceAdjustment{
+				exDate: action.ExDate,
+				price:  factor,
+				volume: 1,
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// 1 - dividend / close before the ex-date, both are in prices of that time
+func (a *AdjustedMarketDataProvider) dividendFactor(
+	ctx context.Context,
+	marketData domain.MarketData,
+	dividend domain.CorporateAction,
+) (float64, error) {
+	key := dividendFactorKey{marketData: marketData, exDate: dividend.ExDate}
+
+	a.mu.Lock()
+	factor, ok := a.dividendFactors[key]
+	a.mu.Unlock()
+	if ok {
+		return factor, nil
+	}
+
+	candles, err := a.upstream.GetCandlesByCount(ctx, marketData, dividend.ExDate, 1)
+	if err != nil {
+		return 0, fmt.Errorf("close of %s before dividend at %v: %w", marketData.ID, dividend.ExDate, err)
+	}
+	if len(candles) == 0 {
+		return 0, fmt.Errorf("no close of %s before dividend at %v", marketData.ID, dividend.ExDate)
+	}
+
+	closePrice := candles[len(candles)-1].Close
+	if dividend.Dividend >= closePrice {
+		return 0, fmt.Errorf("dividend of %s at %v is not less than the close %v", marketData.ID, dividend.ExDate, closePrice)
+	}
+	factor = 1 - dividend.Dividend/closePrice
+
+	a.mu.Lock()
+	a.dividendFactors[key] = factor
+	a.mu.Unlock()
+
+	return factor, nil
+}
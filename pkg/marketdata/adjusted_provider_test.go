@@ -0,0 +1,86 @@
+package marketdata
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+type staticCorporateActions []domain.CorporateAction
+
+func (s staticCorporateActions) GetCorporateActions(
+	ctx context.Context,
+	instrumentID string,
+	from time.Time,
+	to time.Time,
+) ([]domain.CorporateAction, error) {
+	result := make([]domain.CorporateAction, 0)
+	for _, action := range s {
+		if action.InstrumentID == instrumentID && !action.ExDate.Before(from) && !action.ExDate.After(to) {
+			result = append(result, action)
+		}
+	}
+	return result, nil
+}
+
+func TestAdjustedMarketDataProvider(t *testing.T) {
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+	start := time.Date(2024, time.January, 3, 0, 0, 0, 0, time.UTC)
+
+	actions := staticCorporateActions{
+		{InstrumentID: "SBER", Type: domain.CorporateActionType_SPLIT, ExDate: start.Add(5 * time.Hour), Ratio: 2},
+		// Close before the ex-date is 7
+		{InstrumentID: "SBER", Type: domain.CorporateActionType_DIVIDEND, ExDate: start.Add(8 * time.Hour), Dividend: 1},
+		{InstrumentID: "GAZP", Type: domain.CorporateActionType_SPLIT, ExDate: start.Add(2 * time.Hour), Ratio: 10},
+	}
+
+	tests := []struct {
+		adjustment AdjustmentType
+		factor     func(hour int) float64
+	}{
+		{
+			adjustment: AdjustmentType_SPLITS,
+			factor: func(hour int) float64 {
+				if hour < 5 {
+					return 0.5
+				}
+				return 1
+			},
+		},
+		{
+			adjustment: AdjustmentType_SPLITS_AND_DIVIDENDS,
+			factor: func(hour int) float64 {
+				switch {
+				case hour < 5:
+					return 0.5 * 6 / 7
+				case hour < 8:
+					return 6.0 / 7
+				}
+				return 1
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		provider := NewAdjustedMarketDataProvider(&countingProvider{}, actions, tt.adjustment)
+
+		candles, err := provider.GetCandlesByTime(context.Background(), md, start, start.Add(10*time.Hour))
+		if err != nil {
+			t.Fatalf("adjustment %d: unexpected error: %v", tt.adjustment, err)
+		}
+		if len(candles) != 10 {
+			t.Fatalf("adjustment %d: expected 10 candles, got %d", tt.adjustment, len(candles))
+		}
+
+		for _, candle := range candles {
+			hour := candle.OpenTime.Hour()
+			expected := float64(hour) * tt.factor(hour)
+			if math.Abs(candle.Close-expected) > 1e-9 {
+				t.Errorf("adjustment %d: close at %d:00 is %v, expected %v", tt.adjustment, hour, candle.Close, expected)
+			}
+		}
+	}
+}
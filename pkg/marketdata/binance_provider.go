@@ -0,0 +1,674 @@
+package marketdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+
+	"github.com/gorilla/websocket"
+)
+
+// Production endpoints of the exchange, tests pass the URLs of a local stand-in
+const (
+	BinanceRESTEndpoint   = "https://api.binance.com"
+	BinanceStreamEndpoint = "wss://stream.binance.com:9443/ws"
+)
+
+// Request weight quota of the exchange is far above it, klines cost 2 of 6000 per minute
+const binanceKlinesRequestsPerMinute = 1000
+
+// Max klines of one request
+const binanceKlinesLimit = 1000
+
+const binanceRequestTimeout = 30 * time.Second
+
+// Delays between attempts to reconnect the stream, it is closed by the exchange every 24 hours
+const (
+	binanceReconnectMinDelay = time.Second
+	binanceReconnectMaxDelay = time.Minute
+)
+
+// BinanceMarketDataProvider serves candles of a crypto spot exchange with a Binance-style API:
+// REST klines for history and one WebSocket connection for every candle stream.
+// MarketData.ID is the symbol, e.g. "BTCUSDT". The market trades 24/7, candles are in UTC.
+type BinanceMarketDataProvider struct {
+	candlesOnlyProvider
+	// Lifetime of the provider, the stream is closed when it is done
+	ctx            context.Context
+	restEndpoint   string
+	streamEndpoint string
+	httpClient     *http.Client
+	limiter        *requestLimiter
+	calendar       calendar.Calendar
+	// Guards subscribers and writes to conn
+	mu                      sync.Mutex
+	conn                    *websocket.Conn
+	nextRequestID           int64
+	candleSubscribers       *subscribers[domain.MarketData, domain.Candle]
+	candleUpdateSubscribers *subscribers[domain.MarketData, domain.Candle]
+	lastCandleTimes         map[domain.MarketData]time.Time
+	isListening             bool
+}
+
+type binanceStreamRequest struct {
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	ID     int64    `json:"id"`
+}
+
+// Kline event of the stream, responses to requests have no event type.
+// Keys differ only in case, e.g. "e" and "E", json matches them case-insensitively,
+// so both are declared.
+type binanceStreamEvent struct {
+	EventType string `json:"e"`
+	EventTime int64  `json:"E"`
+	Symbol    string `json:"s"`
+	Kline     struct {
+		OpenTime       int64  `json:"t"`
+		CloseTime      int64  `json:"T"`
+		Interval       string `json:"i"`
+		Open           string `json:"o"`
+		High           string `json:"h"`
+		Low            string `json:"l"`
+		LastTradeID    int64  `json:"L"`
+		Close          string `json:"c"`
+		Volume         string `json:"v"`
+		TakerBuyVolume string `json:"V"`
+		IsClosed       bool   `json:"x"`
+	} `json:"k"`
+}
+
+type binanceError struct {
+	Code    int    `json:"code"`
+	Message string `json:"msg"`
+}
+
+// Endpoints are BinanceRESTEndpoint and BinanceStreamEndpoint in production
+func NewBinanceMarketDataProvider(
+	ctx context.Context,
+	restEndpoint string,
+	streamEndpoint string,
+) *BinanceMarketDataProvider {
+	return &BinanceMarketDataProvider{
+		candlesOnlyProvider:     candlesOnlyProvider{name: "Binance"},
+		ctx:                     ctx,
+		restEndpoint:            strings.TrimRight(restEndpoint, "/"),
+		streamEndpoint:          streamEndpoint,
+		httpClient:              &http.Client{Timeout: binanceRequestTimeout},
+		limiter:                 newRequestLimiter(binanceKlinesRequestsPerMinute, time.Minute),
+		calendar:                calendar.NewAlwaysOpenCalendar(),
+		candleSubscribers:       newSubscribers[domain.MarketData, domain.Candle]("Candle"),
+		candleUpdateSubscribers: newSubscribers[domain.MarketData, domain.Candle]("Candle update"),
+		lastCandleTimes:         make(map[domain.MarketData]time.Time),
+	}
+}
+
+// Calendar of the market, bots of this provider use it instead of MOEX one
+func (b *BinanceMarketDataProvider) Calendar() calendar.Calendar {
+	return b.calendar
+}
+
+// Only closed candles are sent, see SubscribeCandleUpdates for forming ones
+func (b *BinanceMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.subscribeCandleStream(marketData)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, _ := b.candleSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		b.UnsubscribeCandles(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (b *BinanceMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	last, err := b.candleSubscribers.remove(marketData, ch)
+	if err != nil || !last {
+		return err
+	}
+
+	delete(b.lastCandleTimes, marketData)
+
+	b.unsubscribeCandleStream(marketData)
+	return nil
+}
+
+// Every update of the forming candle with Partial set
+func (b *BinanceMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.subscribeCandleStream(marketData)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, _ := b.candleUpdateSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		b.UnsubscribeCandleUpdates(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (b *BinanceMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	last, err := b.candleUpdateSubscribers.remove(marketData, ch)
+	if err != nil || !last {
+		return err
+	}
+
+	b.unsubscribeCandleStream(marketData)
+	return nil
+}
+
+func (b *BinanceMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	result := make([]domain.Candle, 0)
+
+	for start := from; start.Before(to); {
+		params := url.Values{
+			"startTime": {strconv.FormatInt(start.UnixMilli(), 10)},
+			// endTime is inclusive
+			"endTime": {strconv.FormatInt(to.UnixMilli()-1, 10)},
+			"limit":   {strconv.Itoa(binanceKlinesLimit)},
+		}
+
+		candles, err := b.loadKlines(ctx, marketData, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(candles) == 0 {
+			break
+		}
+
+		result = append(result, closedCandles(candles)...)
+
+		if len(candles) < binanceKlinesLimit {
+			break
+		}
+		start = candles[len(candles)-1].OpenTime.Add(time.Millisecond)
+	}
+
+	return result, nil
+}
+
+// Klines are requested backwards from last, no calendar is needed
+func (b *BinanceMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	result := make([]domain.Candle, 0, count)
+
+	for end := last; len(result) < count; {
+		limit := min(count-len(result), binanceKlinesLimit)
+		params := url.Values{
+			"endTime": {strconv.FormatInt(end.UnixMilli()-1, 10)},
+			"limit":   {strconv.Itoa(limit)},
+		}
+
+		candles, err := b.loadKlines(ctx, marketData, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(candles) == 0 {
+			break
+		}
+
+		result = append(closedCandles(candles), result...)
+
+		// Symbol is not listed before
+		if len(candles) < limit {
+			break
+		}
+		end = candles[0].OpenTime
+	}
+
+	if len(result) < count {
+		return nil, fmt.Errorf(
+			"error getting history data by count",
+		)
+	}
+
+	return result[len(result)-count:], nil
+}
+
+// Klines of the interval sorted by OpenTime, the forming one included
+func (b *BinanceMarketDataProvider) loadKlines(
+	ctx context.Context,
+	marketData domain.MarketData,
+	params url.Values,
+) ([]domain.Candle, error) {
+	interval := b.convertToBinanceInterval(marketData.Interval)
+	if interval == "" {
+		return nil, fmt.Errorf("undefined interval")
+	}
+
+	params.Set("symbol", strings.ToUpper(marketData.ID))
+	params.Set("interval", interval)
+
+	err := b.limiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		b.restEndpoint+"/api/v3/klines?"+params.Encode(),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := b.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var apiErr binanceError
+		if json.NewDecoder(response.Body).Decode(&apiErr) == nil && apiErr.Message != "" {
+			return nil, fmt.Errorf("klines of %s: %s (%d)", marketData.ID, apiErr.Message, apiErr.Code)
+		}
+		return nil, fmt.Errorf("klines of %s: %s", marketData.ID, response.Status)
+	}
+
+	// [open time, open, high, low, close, volume, close time, ...]
+	var klines [][]any
+	if err := json.NewDecoder(response.Body).Decode(&klines); err != nil {
+		return nil, fmt.Errorf("klines of %s: %w", marketData.ID, err)
+	}
+
+	result := make([]domain.Candle, 0, len(klines))
+	for _, kline := range klines {
+		candle, err := b.convertKline(marketData, kline)
+		if err != nil {
+			return nil, fmt.Errorf("klines of %s: %w", marketData.ID, err)
+		}
+		result = append(result, candle)
+	}
+
+	return result, nil
+}
+
+// Must be called with mu locked.
+// Closed candles and updates share one stream subscription.
+func (b *BinanceMarketDataProvider) subscribeCandleStream(marketData domain.MarketData) error {
+	if b.convertToBinanceInterval(marketData.Interval) == "" {
+		return fmt.Errorf("undefined interval")
+	}
+
+	if b.candleSubscribers.has(marketData) || b.candleUpdateSubscribers.has(marketData) {
+		return nil
+	}
+
+	b.ensureListening()
+
+	// Without a connection the stream is subscribed when it is opened
+	if b.conn != nil {
+		b.writeStreamRequest("SUBSCRIBE", []string{b.streamName(marketData)})
+	}
+
+	return nil
+}
+
+// Must be called with mu locked after a subscriber is removed
+func (b *BinanceMarketDataProvider) unsubscribeCandleStream(marketData domain.MarketData) {
+	if b.candleSubscribers.has(marketData) || b.candleUpdateSubscribers.has(marketData) {
+		return
+	}
+
+	if b.conn != nil {
+		b.writeStreamRequest("UNSUBSCRIBE", []string{b.streamName(marketData)})
+	}
+}
+
+// Must be called with mu locked.
+// A failed write breaks the connection, the reader reconnects and resubscribes.
+func (b *BinanceMarketDataProvider) writeStreamRequest(method string, streams []string) {
+	b.nextRequestID++
+
+	err := b.conn.WriteJSON(binanceStreamRequest{
+		Method: method,
+		Params: streams,
+		ID:     b.nextRequestID,
+	})
+	if err != nil {
+		log.Printf("Error sending %s to Binance stream: %v", method, err)
+		b.conn.Close()
+	}
+}
+
+// Must be called with mu locked
+func (b *BinanceMarketDataProvider) ensureListening() {
+	if b.isListening {
+		return
+	}
+	b.isListening = true
+
+	go b.listen()
+
+	go func() {
+		<-b.ctx.Done()
+
+		b.mu.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.mu.Unlock()
+	}()
+}
+
+// Reads the stream and reconnects it with backoff when it stops
+func (b *BinanceMarketDataProvider) listen() {
+	delay := binanceReconnectMinDelay
+
+	for {
+		started := time.Now()
+		err := b.connect()
+		if err == nil {
+			err = b.read()
+		}
+		if b.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Binance stream stopped: %v", err)
+
+		// Stream that worked for a while is not a reason to slow down
+		if time.Since(started) > binanceReconnectMaxDelay {
+			delay = binanceReconnectMinDelay
+		}
+
+		log.Printf("Reconnecting Binance stream in %s", delay)
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay = min(delay*2, binanceReconnectMaxDelay)
+	}
+}
+
+// Opens a connection, restores every active subscription
+// and delivers candles missed while the stream was down
+func (b *BinanceMarketDataProvider) connect() error {
+	conn, _, err := websocket.DefaultDialer.DialContext(b.ctx, b.streamEndpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+
+	b.conn = conn
+
+	streams := make([]string, 0)
+	for _, marketData := range b.subscribedCandles() {
+		streams = append(streams, b.streamName(marketData))
+	}
+	if len(streams) > 0 {
+		b.writeStreamRequest("SUBSCRIBE", streams)
+	}
+
+	lastCandleTimes := maps.Clone(b.lastCandleTimes)
+
+	b.mu.Unlock()
+
+	// Stream is not read yet, so backfilled candles go first
+	b.backfillCandles(lastCandleTimes)
+
+	return nil
+}
+
+func (b *BinanceMarketDataProvider) read() error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		if b.conn == conn {
+			b.conn = nil
+		}
+		b.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var event binanceStreamEvent
+		if err := json.Unmarshal(message, &event); err != nil {
+			log.Printf("Error parsing Binance stream message: %v", err)
+			continue
+		}
+
+		if event.EventType == "kline" {
+			b.handleKline(event)
+		}
+	}
+}
+
+func (b *BinanceMarketDataProvider) handleKline(event binanceStreamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, marketData := range b.subscribedCandles() {
+		if !strings.EqualFold(marketData.ID, event.Symbol) ||
+			b.convertToBinanceInterval(marketData.Interval) != event.Kline.Interval {
+			continue
+		}
+
+		candle, err := b.convertStreamKline(marketData, event)
+		if err != nil {
+			log.Printf("Error parsing Binance kline of %s: %v", event.Symbol, err)
+			return
+		}
+
+		if event.Kline.IsClosed {
+			b.notifyCandleSubscribers(marketData, candle)
+		} else {
+			candle.Partial = true
+			b.candleUpdateSubscribers.notify(marketData, candle)
+		}
+	}
+}
+
+func (b *BinanceMarketDataProvider) backfillCandles(lastCandleTimes map[domain.MarketData]time.Time) {
+	now := time.Now()
+
+	for marketData, last := range lastCandleTimes {
+		candles, err := b.GetCandlesByTime(b.ctx, marketData, last, now)
+		if err != nil {
+			log.Printf("Error backfilling candles of %s: %v", marketData.ID, err)
+			continue
+		}
+
+		b.mu.Lock()
+		for _, candle := range candles {
+			b.notifyCandleSubscribers(marketData, candle)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Must be called with mu locked
+func (b *BinanceMarketDataProvider) subscribedCandles() []domain.MarketData {
+	result := b.candleSubscribers.keys()
+	for _, marketData := range b.candleUpdateSubscribers.keys() {
+		if !b.candleSubscribers.has(marketData) {
+			result = append(result, marketData)
+		}
+	}
+
+	return result
+}
+
+// Must be called with mu locked.
+// Candles are delivered once and in order of OpenTime.
+func (b *BinanceMarketDataProvider) notifyCandleSubscribers(
+	marketData domain.MarketData,
+	candle domain.Candle,
+) {
+	if !b.candleSubscribers.has(marketData) {
+		return
+	}
+
+	if !candle.OpenTime.After(b.lastCandleTimes[marketData]) {
+		return
+	}
+	b.lastCandleTimes[marketData] = candle.OpenTime
+
+	b.candleSubscribers.notify(marketData, candle)
+}
+
+func (b *BinanceMarketDataProvider) streamName(marketData domain.MarketData) string {
+	return strings.ToLower(marketData.ID) + "@kline_" + b.convertToBinanceInterval(marketData.Interval)
+}
+
+func (b *BinanceMarketDataProvider) convertKline(marketData domain.MarketData, kline []any) (domain.Candle, error) {
+	if len(kline) < 6 {
+		return domain.Candle{}, fmt.Errorf("kline has %d fields", len(kline))
+	}
+
+	openTime, ok := kline[0].(float64)
+	if !ok {
+		return domain.Candle{}, fmt.Errorf("undefined open time %v", kline[0])
+	}
+
+	values := make([]string, 0, 5)
+	for _, value := range kline[1:6] {
+		s, ok := value.(string)
+		if !ok {
+			return domain.Candle{}, fmt.Errorf("undefined kline value %v", value)
+		}
+		values = append(values, s)
+	}
+
+	return b.convertCandle(marketData, int64(openTime), values[0], values[1], values[2], values[3], values[4])
+}
+
+func (b *BinanceMarketDataProvider) convertStreamKline(
+	marketData domain.MarketData,
+	event binanceStreamEvent,
+) (domain.Candle, error) {
+	k := event.Kline
+	return b.convertCandle(marketData, k.OpenTime, k.Open, k.High, k.Low, k.Close, k.Volume)
+}
+
+// Prices are decimal strings, close time is derived from the interval
+func (b *BinanceMarketDataProvider) convertCandle(
+	marketData domain.MarketData,
+	openTime int64,
+	values ...string,
+) (domain.Candle, error) {
+	parsed := make([]float64, len(values))
+	for i, value := range values {
+		var err error
+		parsed[i], err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return domain.Candle{}, err
+		}
+	}
+
+	open := time.UnixMilli(openTime).UTC()
+
+	return domain.Candle{
+		MarketData: marketData,
+		OpenTime:   open,
+		CloseTime:  CandleCloseTime(marketData.Interval, open, b.calendar.Location()),
+		Open:       parsed[0],
+		High:       parsed[1],
+		Low:        parsed[2],
+		Close:      parsed[3],
+		Volume:     parsed[4],
+	}, nil
+}
+
+// Mirrors convertToCandleInterval of the broker, the exchange has no 2 and 10 minute klines
+func (b *BinanceMarketDataProvider) convertToBinanceInterval(interval domain.MarketDataInterval) string {
+	switch interval {
+	case domain.MarketDataInterval_ONE_MINUTE:
+		return "1m"
+	case domain.MarketDataInterval_THREE_MIN:
+		return "3m"
+	case domain.MarketDataInterval_FIVE_MINUTES:
+		return "5m"
+	case domain.MarketDataInterval_FIFTEEN_MINUTES:
+		return "15m"
+	case domain.MarketDataInterval_THERTY_MIN:
+		return "30m"
+	case domain.MarketDataInterval_ONE_HOUR:
+		return "1h"
+	case domain.MarketDataInterval_TWO_HOUR:
+		return "2h"
+	case domain.MarketDataInterval_FOUR_HOUR:
+		return "4h"
+	case domain.MarketDataInterval_ONE_DAY:
+		return "1d"
+	case domain.MarketDataInterval_WEEK:
+		return "1w"
+	case domain.MarketDataInterval_MONTH:
+		return "1M"
+	default:
+		return ""
+	}
+}
+
+// History includes the forming candle, it is sent by the stream when closed
+func closedCandles(candles []domain.Candle) []domain.Candle {
+	now := time.Now()
+
+	result := make([]domain.Candle, 0, len(candles))
+	for _, candle := range candles {
+		if !candle.CloseTime.After(now) {
+			result = append(result, candle)
+		}
+	}
+
+	return result
+}
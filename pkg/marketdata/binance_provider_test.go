@@ -0,0 +1,244 @@
+package marketdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hourly klines since listed, closes are hours since the listing.
+// Stream subscriptions are reported to subscribed, events are sent to every connection.
+type binanceStandIn struct {
+	server     *httptest.Server
+	listed     time.Time
+	mu         sync.Mutex
+	requests   int
+	subscribed chan []string
+	events     chan string
+}
+
+func newBinanceStandIn(t *testing.T, listed time.Time) *binanceStandIn {
+	s := &binanceStandIn{
+		listed:     listed,
+		subscribed: make(chan []string, 10),
+		events:     make(chan string, 10),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/klines", s.klines)
+	mux.HandleFunc("/ws", s.stream)
+
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+func (s *binanceStandIn) klines(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+
+	query := r.URL.Query()
+	if query.Get("symbol") != "BTCUSDT" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code": -1121, "msg": "Invalid symbol."}`))
+		return
+	}
+
+	param := func(name string, fallback int64) int64 {
+		value, err := strconv.ParseInt(query.Get(name), 10, 64)
+		if err != nil {
+			return fallback
+		}
+		return value
+	}
+
+	limit := int(param("limit", 500))
+	end := minTime(time.UnixMilli(param("endTime", time.Now().UnixMilli())), time.Now())
+	var start time.Time
+	if query.Has("startTime") {
+		start = maxTime(time.UnixMilli(param("startTime", 0)).Add(time.Hour-time.Millisecond).Truncate(time.Hour), s.listed)
+	} else {
+		start = maxTime(end.Truncate(time.Hour).Add(-time.Duration(limit-1)*time.Hour), s.listed)
+	}
+
+	result := make([][]any, 0)
+	for open := start; !open.After(end) && len(result) < limit; open = open.Add(time.Hour) {
+		price := strconv.Itoa(int(open.Sub(s.listed) / time.Hour))
+		result = append(result, []any{
+			open.UnixMilli(), price, price, price, price, "1.5",
+			open.Add(time.Hour).UnixMilli() - 1, "0", 10, "0", "0", "0",
+		})
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *binanceStandIn) stream(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		for event := range s.events {
+			if conn.WriteMessage(websocket.TextMessage, []byte(event)) != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var request binanceStreamRequest
+		if err := conn.ReadJSON(&request); err != nil {
+			return
+		}
+		if request.Method == "SUBSCRIBE" {
+			s.subscribed <- request.Params
+		}
+	}
+}
+
+func binanceKlineEvent(open time.Time, price float64, closed bool) string {
+	return fmt.Sprintf(
+		`{"e":"kline","E":%d,"s":"BTCUSDT","k":{"t":%d,"T":%d,"s":"BTCUSDT","i":"1h","f":100,"L":200,"o":"%v","c":"%v","h":"%v","l":"%v","v":"2","n":100,"x":%v,"q":"200","V":"1","Q":"100","B":"0"}}`,
+		open.UnixMilli(), open.UnixMilli(), open.Add(time.Hour).UnixMilli()-1, price, price, price, price, closed,
+	)
+}
+
+func TestBinanceMarketDataProvider_History(t *testing.T) {
+	listed := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	standIn := newBinanceStandIn(t, listed)
+	provider := NewBinanceMarketDataProvider(context.Background(), standIn.server.URL, "")
+
+	md := domain.MarketData{
+		ID:           "BTCUSDT",
+		Interval:     domain.MarketDataInterval_ONE_HOUR,
+		ProviderType: domain.MarketDataProviderType_BINANCE,
+	}
+
+	candles, err := provider.GetCandlesByTime(context.Background(), md, listed, listed.Add(1500*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 1500 {
+		t.Fatalf("expected 1500 candles, got %d", len(candles))
+	}
+	for i, candle := range candles {
+		if !candle.OpenTime.Equal(listed.Add(time.Duration(i)*time.Hour)) || candle.Close != float64(i) {
+			t.Fatalf("unexpected candle %d: %v %v", i, candle.OpenTime, candle.Close)
+		}
+	}
+	if !candles[0].CloseTime.Equal(listed.Add(time.Hour)) {
+		t.Errorf("unexpected close time %v", candles[0].CloseTime)
+	}
+	standIn.mu.Lock()
+	if standIn.requests != 2 {
+		t.Errorf("expected 2 requests, got %d", standIn.requests)
+	}
+	standIn.mu.Unlock()
+
+	candles, err = provider.GetCandlesByCount(context.Background(), md, listed.Add(1500*time.Hour), 1200)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 1200 || candles[0].Close != 300 || candles[1199].Close != 1499 {
+		t.Fatalf("expected 1200 candles from 300 to 1499, got %d", len(candles))
+	}
+
+	// Forming candle is not in the history
+	candles, err = provider.GetCandlesByCount(context.Background(), md, time.Now().Add(time.Hour), 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if candles[1].CloseTime.After(time.Now()) {
+		t.Errorf("forming candle %v is returned", candles[1].OpenTime)
+	}
+
+	if _, err := provider.GetCandlesByCount(context.Background(), md, listed.Add(10*time.Hour), 20); err == nil {
+		t.Errorf("expected error for candles before the listing")
+	}
+
+	md.ID = "UNKNOWN"
+	if _, err := provider.GetCandlesByTime(context.Background(), md, listed, listed.Add(time.Hour)); err == nil || !strings.Contains(err.Error(), "Invalid symbol") {
+		t.Errorf("expected invalid symbol error, got %v", err)
+	}
+}
+
+func TestBinanceMarketDataProvider_Stream(t *testing.T) {
+	listed := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	standIn := newBinanceStandIn(t, listed)
+	defer close(standIn.events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider := NewBinanceMarketDataProvider(ctx, standIn.server.URL, "ws"+strings.TrimPrefix(standIn.server.URL, "http")+"/ws")
+
+	md := domain.MarketData{
+		ID:           "BTCUSDT",
+		Interval:     domain.MarketDataInterval_ONE_HOUR,
+		ProviderType: domain.MarketDataProviderType_BINANCE,
+	}
+
+	candles, err := provider.SubscribeCandles(ctx, md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updates, err := provider.SubscribeCandleUpdates(ctx, md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case streams := <-standIn.subscribed:
+		if len(streams) != 1 || streams[0] != "btcusdt@kline_1h" {
+			t.Fatalf("unexpected streams %v", streams)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream is not subscribed")
+	}
+
+	open := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	standIn.events <- `{"result":null,"id":1}`
+	standIn.events <- binanceKlineEvent(open, 100.5, false)
+	standIn.events <- binanceKlineEvent(open, 101, true)
+
+	select {
+	case update := <-updates:
+		if !update.Partial || update.Close != 100.5 || update.Low != 100.5 || update.Volume != 2 || !update.OpenTime.Equal(open) {
+			t.Errorf("unexpected update %+v", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no candle update")
+	}
+
+	select {
+	case candle := <-candles:
+		if candle.Partial || candle.Close != 101 || !candle.CloseTime.Equal(open.Add(time.Hour)) {
+			t.Errorf("unexpected candle %+v", candle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no closed candle")
+	}
+
+	if err := provider.UnsubscribeCandles(md, candles); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := <-candles; ok {
+		t.Errorf("channel is not closed")
+	}
+}
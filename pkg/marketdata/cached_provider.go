@@ -0,0 +1,190 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// CachedMarketDataProvider keeps historical candles of the upstream provider on disk.
+// Only missing parts of the requested range are fetched from the upstream.
+// Streaming is passed to the upstream as is.
+type CachedMarketDataProvider struct {
+	upstream MarketDataProvider
+	store    *CandleStore
+}
+
+func NewCachedMarketDataProvider(
+	upstream MarketDataProvider,
+	dir string,
+) (*CachedMarketDataProvider, error) {
+	store, err := NewCandleStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachedMarketDataProvider{
+		upstream: upstream,
+		store:    store,
+	}, nil
+}
+
+func (c *CachedMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return c.upstream.SubscribeCandles(ctx, marketData)
+}
+
+func (c *CachedMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return c.upstream.UnsubscribeCandles(marketData, ch)
+}
+
+func (c *CachedMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return c.upstream.SubscribeCandleUpdates(ctx, marketData)
+}
+
+func (c *CachedMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return c.upstream.UnsubscribeCandleUpdates(marketData, ch)
+}
+
+func (c *CachedMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	return c.upstream.SubscribeOrderBook(ctx, orderBookInfo)
+}
+
+func (c *CachedMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	return c.upstream.UnsubscribeOrderBook(orderBookInfo, ch)
+}
+
+func (c *CachedMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	return c.upstream.SubscribeLastPrices(ctx, instrumentInfo)
+}
+
+func (c *CachedMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	return c.upstream.UnsubscribeLastPrices(instrumentInfo, ch)
+}
+
+func (c *CachedMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	return c.upstream.SubscribeTrades(ctx, instrumentInfo)
+}
+
+func (c *CachedMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	return c.upstream.UnsubscribeTrades(instrumentInfo, ch)
+}
+
+func (c *CachedMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	missing, err := c.store.Missing(marketData, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, gap := range missing {
+		candles, err := c.upstream.GetCandlesByTime(ctx, marketData, gap.From, gap.To)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.store.Save(marketData, candles, c.completeRange(marketData, gap))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.store.Candles(marketData, from, to)
+}
+
+func (c *CachedMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	covered, ok, err := c.store.Covering(marketData, last)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		candles, err := c.store.Candles(marketData, covered.From, last)
+		if err != nil {
+			return nil, err
+		}
+		if len(candles) >= count {
+			return candles[len(candles)-count:], nil
+		}
+	}
+
+	candles, err := c.upstream.GetCandlesByCount(ctx, marketData, last, count)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(candles) < count {
+		return nil, fmt.Errorf(
+			"error getting history data by count",
+		)
+	}
+
+	// Upstream returns every candle between the first one and last
+	err = c.store.Save(
+		marketData,
+		candles,
+		c.completeRange(marketData, TimeRange{From: candles[0].OpenTime, To: last}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return candles, nil
+}
+
+// Cuts the range so that it doesn't include candles that may still change
+func (c *CachedMarketDataProvider) completeRange(
+	marketData domain.MarketData,
+	r TimeRange,
+) TimeRange {
+	// Every candle before the current one is closed
+	complete := CandleOpenTime(marketData.Interval, time.Now(), calendar.MoscowLocation)
+
+	r.To = minTime(r.To, complete)
+	if !r.From.Before(r.To) {
+		return TimeRange{}
+	}
+
+	return r
+}
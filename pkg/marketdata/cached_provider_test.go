@@ -0,0 +1,110 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Hourly candles around the clock, records every history request
+type countingProvider struct {
+	candlesOnlyProvider
+	requests []TimeRange
+}
+
+func (p *countingProvider) SubscribeCandles(ctx context.Context, md domain.MarketData) (<-chan domain.Candle, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (p *countingProvider) UnsubscribeCandles(md domain.MarketData, ch <-chan domain.Candle) error {
+	return fmt.Errorf("not supported")
+}
+
+func (p *countingProvider) GetCandlesByTime(ctx context.Context, md domain.MarketData, from time.Time, to time.Time) ([]domain.Candle, error) {
+	p.requests = append(p.requests, TimeRange{From: from, To: to})
+
+	result := make([]domain.Candle, 0)
+	for t := from.Truncate(time.Hour); t.Before(to); t = t.Add(time.Hour) {
+		if t.Before(from) {
+			continue
+		}
+		result = append(result, domain.Candle{
+			MarketData: md,
+			OpenTime:   t,
+			CloseTime:  t.Add(time.Hour),
+			Close:      float64(t.Hour()),
+		})
+	}
+
+	return result, nil
+}
+
+func (p *countingProvider) GetCandlesByCount(ctx context.Context, md domain.MarketData, last time.Time, count int) ([]domain.Candle, error) {
+	return p.GetCandlesByTime(ctx, md, last.Add(-time.Duration(count)*time.Hour), last)
+}
+
+func TestCachedMarketDataProvider_FetchesOnlyGaps(t *testing.T) {
+	upstream := &countingProvider{}
+	provider, err := NewCachedMarketDataProvider(upstream, t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+	start := time.Date(2024, time.January, 3, 0, 0, 0, 0, time.UTC)
+
+	candles, err := provider.GetCandlesByTime(context.Background(), md, start.Add(10*time.Hour), start.Add(20*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 10 {
+		t.Fatalf("expected 10 candles, got %d", len(candles))
+	}
+
+	candles, err = provider.GetCandlesByTime(context.Background(), md, start, start.Add(30*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 30 {
+		t.Fatalf("expected 30 candles, got %d", len(candles))
+	}
+
+	expected := []TimeRange{
+		{From: start.Add(10 * time.Hour), To: start.Add(20 * time.Hour)},
+		{From: start, To: start.Add(10 * time.Hour)},
+		{From: start.Add(20 * time.Hour), To: start.Add(30 * time.Hour)},
+	}
+	if len(upstream.requests) != len(expected) {
+		t.Fatalf("expected %d upstream requests, got %v", len(expected), upstream.requests)
+	}
+	for i, r := range expected {
+		if !upstream.requests[i].From.Equal(r.From) || !upstream.requests[i].To.Equal(r.To) {
+			t.Errorf("request %d: expected %v, got %v", i, r, upstream.requests[i])
+		}
+	}
+
+	_, err = provider.GetCandlesByCount(context.Background(), md, start.Add(25*time.Hour), 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(upstream.requests) != len(expected) {
+		t.Errorf("expected count request to be served from cache, got %v", upstream.requests)
+	}
+
+	// A new provider over the same directory reads the cache from disk
+	reopened, err := NewCachedMarketDataProvider(upstream, provider.store.dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	candles, err = reopened.GetCandlesByTime(context.Background(), md, start, start.Add(30*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 30 || len(upstream.requests) != len(expected) {
+		t.Errorf("expected cached candles from disk, got %d candles and %d requests",
+			len(candles), len(upstream.requests))
+	}
+}
@@ -0,0 +1,84 @@
+package marketdata
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Turns updates of forming candles into closed candles.
+// A candle is closed when the next candle of the same MarketData starts
+// or when delay passes after its CloseTime without a newer update.
+type candleCloser struct {
+	// Lock of the owner, update and remove are called with it held, onClose too
+	mu      sync.Locker
+	delay   time.Duration
+	onClose func(candle domain.Candle)
+	forming map[domain.MarketData]domain.Candle
+	timers  map[domain.MarketData]*time.Timer
+}
+
+func newCandleCloser(
+	mu sync.Locker,
+	delay time.Duration,
+	onClose func(candle domain.Candle),
+) *candleCloser {
+	return &candleCloser{
+		mu:      mu,
+		delay:   delay,
+		onClose: onClose,
+		forming: make(map[domain.MarketData]domain.Candle),
+		timers:  make(map[domain.MarketData]*time.Timer),
+	}
+}
+
+// Must be called with mu locked.
+// Returns false for an update of a candle that is already closed.
+func (c *candleCloser) update(candle domain.Candle) bool {
+	marketData := candle.MarketData
+
+	if forming, ok := c.forming[marketData]; ok {
+		if candle.OpenTime.Before(forming.OpenTime) {
+			return false
+		}
+		if candle.OpenTime.After(forming.OpenTime) {
+			c.close(forming)
+		}
+	}
+
+	candle.Partial = true
+	c.forming[marketData] = candle
+
+	if timer, ok := c.timers[marketData]; ok {
+		timer.Stop()
+	}
+	openTime := candle.OpenTime
+	c.timers[marketData] = time.AfterFunc(time.Until(candle.CloseTime.Add(c.delay)), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// Newer update has already closed or replaced the candle
+		if forming, ok := c.forming[marketData]; ok && forming.OpenTime.Equal(openTime) {
+			c.close(forming)
+			delete(c.forming, marketData)
+			delete(c.timers, marketData)
+		}
+	})
+
+	return true
+}
+
+// Must be called with mu locked
+func (c *candleCloser) remove(marketData domain.MarketData) {
+	if timer, ok := c.timers[marketData]; ok {
+		timer.Stop()
+	}
+	delete(c.timers, marketData)
+	delete(c.forming, marketData)
+}
+
+func (c *candleCloser) close(candle domain.Candle) {
+	candle.Partial = false
+	c.onClose(candle)
+}
@@ -0,0 +1,63 @@
+package marketdata
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestCandleCloser(t *testing.T) {
+	mu := &sync.Mutex{}
+	closed := make([]domain.Candle, 0)
+	closer := newCandleCloser(mu, 20*time.Millisecond, func(candle domain.Candle) {
+		closed = append(closed, candle)
+	})
+
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_MINUTE}
+	now := time.Now()
+	candle := func(openTime time.Time, closePrice float64) domain.Candle {
+		return domain.Candle{
+			MarketData: md,
+			OpenTime:   openTime,
+			CloseTime:  openTime.Add(time.Minute),
+			Close:      closePrice,
+		}
+	}
+
+	mu.Lock()
+	closer.update(candle(now.Add(-time.Minute/2), 1))
+	closer.update(candle(now.Add(-time.Minute/2), 2))
+	if len(closed) != 0 {
+		t.Fatalf("expected forming candle not to be closed, got %v", closed)
+	}
+
+	// Next candle starts, so the previous one is closed with its last values
+	closer.update(candle(now.Add(time.Minute/2), 3))
+	if len(closed) != 1 || closed[0].Close != 2 || closed[0].Partial {
+		t.Fatalf("expected closed candle with close 2, got %v", closed)
+	}
+
+	if closer.update(candle(now.Add(-time.Minute/2), 4)) {
+		t.Errorf("expected update of a closed candle to be rejected")
+	}
+
+	// Candle that is already over is closed by the timer
+	other := domain.MarketData{ID: "LKOH", Interval: domain.MarketDataInterval_ONE_MINUTE}
+	late := candle(now.Add(-2*time.Minute), 5)
+	late.MarketData = other
+	closer.update(late)
+	mu.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(closed) != 2 || closed[1].MarketData != other || closed[1].Close != 5 {
+		t.Fatalf("expected candle closed by timer, got %v", closed)
+	}
+	if _, ok := closer.forming[other]; ok {
+		t.Errorf("expected closed candle to be forgotten")
+	}
+}
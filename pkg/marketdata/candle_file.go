@@ -0,0 +1,290 @@
+package marketdata
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Candle file formats: CSV with a header row or JSON lines.
+//
+// CSV:   open_time,open,high,low,close,volume
+// JSONL: {"open_time":"2024-01-03T07:00:00Z","open":1,"high":2,"low":0.5,"close":1.5,"volume":100}
+//
+// open_time is RFC3339, close time is derived from the interval.
+var candleCSVHeader = []string{"open_time", "open", "high", "low", "close", "volume"}
+
+type fileCandle struct {
+	OpenTime time.Time `json:"open_time"`
+	Open     float64   `json:"open"`
+	High     float64   `json:"high"`
+	Low      float64   `json:"low"`
+	Close    float64   `json:"close"`
+	Volume   float64   `json:"volume"`
+}
+
+// Имя файла со свечами для инструмента и интервала, например "<ID>_1h.csv".
+// Свечи с фильтром сессий лежат отдельно, например "<ID>_1h_main.csv"
+func CandleFileName(marketData domain.MarketData, ext string) string {
+	if marketData.SessionFilter != domain.SessionFilter_ALL {
+		ext = "_" + ConvertSessionFilterToString(marketData.SessionFilter) + ext
+	}
+
+	return fmt.Sprintf(
+		"%s_%s%s",
+		marketData.ID,
+		ConvertMarketDataIntervalToString(marketData.Interval),
+		ext,
+	)
+}
+
+// Reads candles from a CSV or JSONL file, the format is chosen by extension.
+// Result is sorted by OpenTime, of duplicated OpenTimes the last line is kept,
+// so candles appended by AppendCandlesFile replace earlier ones.
+func ReadCandlesFile(path string, marketData domain.MarketData) ([]domain.Candle, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var raw []fileCandle
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		raw, err = readCandlesCSV(file)
+	case ".jsonl", ".json":
+		raw, err = readCandlesJSONL(file)
+	default:
+		return nil, fmt.Errorf("unsupported candle file format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	// Reversed, so stable sort + compact keeps the last line
+	candles := make([]domain.Candle, 0, len(raw))
+	for i := len(raw) - 1; i >= 0; i-- {
+		candles = append(candles, raw[i].toCandle(marketData))
+	}
+
+	slices.SortStableFunc(candles, func(a, b domain.Candle) int {
+		return a.OpenTime.Compare(b.OpenTime)
+	})
+	candles = slices.CompactFunc(candles, func(a, b domain.Candle) bool {
+		return a.OpenTime.Equal(b.OpenTime)
+	})
+
+	return candles, nil
+}
+
+// Writes candles to a CSV or JSONL file, the format is chosen by extension.
+// Existing file is replaced.
+func WriteCandlesFile(path string, candles []domain.Candle) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".csv" && ext != ".jsonl" && ext != ".json" {
+		return fmt.Errorf("unsupported candle file format: %s", path)
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	if ext == ".csv" {
+		err = writeCandlesCSV(w, candles)
+	} else {
+		err = writeCandlesJSONL(w, candles)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Appends candles to a JSONL file without rewriting it, the file is created if it doesn't exist
+func AppendCandlesFile(path string, candles []domain.Candle) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".jsonl" && ext != ".json" {
+		return fmt.Errorf("unsupported candle file format for append: %s", path)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	err = writeCandlesJSONL(w, candles)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func readCandlesCSV(file *os.File) ([]fileCandle, error) {
+	r := csv.NewReader(bufio.NewReader(file))
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range candleCSVHeader {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	result := make([]fileCandle, 0)
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		var c fileCandle
+		c.OpenTime, err = time.Parse(time.RFC3339, record[columns["open_time"]])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		values := []*float64{&c.Open, &c.High, &c.Low, &c.Close, &c.Volume}
+		for i, name := range candleCSVHeader[1:] {
+			*values[i], err = strconv.ParseFloat(record[columns[name]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+
+		result = append(result, c)
+	}
+
+	return result, nil
+}
+
+func readCandlesJSONL(file *os.File) ([]fileCandle, error) {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	result := make([]fileCandle, 0)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var c fileCandle
+		if err := json.Unmarshal([]byte(text), &c); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		result = append(result, c)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func writeCandlesCSV(w *bufio.Writer, candles []domain.Candle) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(candleCSVHeader); err != nil {
+		return err
+	}
+
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	for _, c := range candles {
+		err := cw.Write([]string{
+			c.OpenTime.UTC().Format(time.RFC3339),
+			format(c.Open),
+			format(c.High),
+			format(c.Low),
+			format(c.Close),
+			format(c.Volume),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeCandlesJSONL(w *bufio.Writer, candles []domain.Candle) error {
+	enc := json.NewEncoder(w)
+	for _, c := range candles {
+		if err := enc.Encode(newFileCandle(c)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newFileCandle(c domain.Candle) fileCandle {
+	return fileCandle{
+		OpenTime: c.OpenTime.UTC(),
+		Open:     c.Open,
+		High:     c.High,
+		Low:      c.Low,
+		Close:    c.Close,
+		Volume:   c.Volume,
+	}
+}
+
+func (c fileCandle) toCandle(marketData domain.MarketData) domain.Candle {
+	return domain.Candle{
+		MarketData: marketData,
+		OpenTime:   c.OpenTime,
+		CloseTime: CandleCloseTime(
+			marketData.Interval,
+			c.OpenTime,
+			calendar.MoscowLocation,
+		),
+		Open:   c.Open,
+		High:   c.High,
+		Low:    c.Low,
+		Close:  c.Close,
+		Volume: c.Volume,
+	}
+}
@@ -0,0 +1,324 @@
+package marketdata
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Half-open time range [From, To)
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// CandleStore keeps candles on disk per provider type, instrument and interval
+// together with the time ranges that are known to be fully loaded.
+//
+// Files: "<provider>_<ID>_<interval>.jsonl" with candles and "<provider>_<ID>_<interval>.ranges.json" with ranges,
+// so the same ID of different providers doesn't share a cache.
+// Saved candles are appended to the file, it is rewritten only when replaced candles
+// make up most of it.
+type CandleStore struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[domain.MarketData]*candleStoreEntry
+}
+
+type candleStoreEntry struct {
+	candles []domain.Candle
+	ranges  []TimeRange
+	// Candles in the file including replaced ones
+	fileCandles int
+}
+
+// File is compacted when it has this many times more lines than candles
+const candleStoreCompactRatio = 2
+
+func NewCandleStore(dir string) (*CandleStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &CandleStore{
+		dir:     dir,
+		entries: make(map[domain.MarketData]*candleStoreEntry),
+	}, nil
+}
+
+// Returns stored candles with OpenTime in [from, to)
+func (s *CandleStore) Candles(
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.entry(marketData)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := entry.bounds(from, to)
+
+	return append(make([]domain.Candle, 0, last-first), entry.candles[first:last]...), nil
+}
+
+// Returns parts of [from, to) that are not loaded yet
+func (s *CandleStore) Missing(
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]TimeRange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.entry(marketData)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]TimeRange, 0)
+	current := from
+
+	for _, r := range entry.ranges {
+		if !current.Before(to) {
+			break
+		}
+		if !r.To.After(current) {
+			continue
+		}
+		if r.From.After(current) {
+			missing = append(missing, TimeRange{From: current, To: minTime(r.From, to)})
+		}
+		current = maxTime(current, r.To)
+	}
+
+	if current.Before(to) {
+		missing = append(missing, TimeRange{From: current, To: to})
+	}
+
+	return missing, nil
+}
+
+// Returns the loaded range that contains t, if any
+func (s *CandleStore) Covering(
+	marketData domain.MarketData,
+	t time.Time,
+) (TimeRange, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.entry(marketData)
+	if err != nil {
+		return TimeRange{}, false, err
+	}
+
+	for _, r := range entry.ranges {
+		if !t.Before(r.From) && !t.After(r.To) {
+			return r, true, nil
+		}
+	}
+
+	return TimeRange{}, false, nil
+}
+
+// Merges candles into the store and marks covered as fully loaded.
+// Candles with the same OpenTime replace stored ones.
+// Zero covered range means the candles don't make any range complete.
+func (s *CandleStore) Save(
+	marketData domain.MarketData,
+	candles []domain.Candle,
+	covered TimeRange,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.entry(marketData)
+	if err != nil {
+		return err
+	}
+
+	added := sortUniqueCandles(slices.Clone(candles))
+	merged := mergeCandles(entry.candles, added)
+
+	ranges := entry.ranges
+	if covered.From.Before(covered.To) {
+		ranges = mergeTimeRanges(append(slices.Clone(ranges), covered))
+	}
+
+	fileCandles := entry.fileCandles + len(added)
+	if fileCandles > candleStoreCompactRatio*len(merged) {
+		err = WriteCandlesFile(s.path(marketData, ".jsonl"), merged)
+		fileCandles = len(merged)
+	} else {
+		err = AppendCandlesFile(s.path(marketData, ".jsonl"), added)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = writeTimeRanges(s.path(marketData, ".ranges.json"), ranges)
+	if err != nil {
+		return err
+	}
+
+	entry.candles = merged
+	entry.ranges = ranges
+	entry.fileCandles = fileCandles
+
+	return nil
+}
+
+// Merges sorted unique candles, added ones replace stored ones with the same OpenTime.
+// Candles after the stored ones, e.g. of a new gap or year, are appended without a full merge.
+func mergeCandles(stored []domain.Candle, added []domain.Candle) []domain.Candle {
+	if len(added) == 0 {
+		return stored
+	}
+
+	// Only the stored tail that overlaps added candles is merged
+	tail := sort.Search(len(stored), func(i int) bool {
+		return !stored[i].OpenTime.Before(added[0].OpenTime)
+	})
+	if tail == len(stored) {
+		return append(stored, added...)
+	}
+
+	merged := make([]domain.Candle, 0, len(stored)+len(added))
+	merged = append(merged, stored[:tail]...)
+
+	i, j := tail, 0
+	for i < len(stored) || j < len(added) {
+		switch {
+		case j == len(added) || i < len(stored) && stored[i].OpenTime.Before(added[j].OpenTime):
+			merged = append(merged, stored[i])
+			i++
+		case i == len(stored) || added[j].OpenTime.Before(stored[i].OpenTime):
+			merged = append(merged, added[j])
+			j++
+		default:
+			merged = append(merged, added[j])
+			i++
+			j++
+		}
+	}
+
+	return merged
+}
+
+func (s *CandleStore) entry(marketData domain.MarketData) (*candleStoreEntry, error) {
+	if entry, ok := s.entries[marketData]; ok {
+		return entry, nil
+	}
+
+	entry := &candleStoreEntry{
+		candles: make([]domain.Candle, 0),
+		ranges:  make([]TimeRange, 0),
+	}
+
+	candles, err := ReadCandlesFile(s.path(marketData, ".jsonl"), marketData)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		entry.candles = candles
+		entry.fileCandles = len(candles)
+	}
+
+	data, err := os.ReadFile(s.path(marketData, ".ranges.json"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &entry.ranges); err != nil {
+			return nil, err
+		}
+		entry.ranges = mergeTimeRanges(entry.ranges)
+	}
+
+	s.entries[marketData] = entry
+
+	return entry, nil
+}
+
+func (s *CandleStore) path(marketData domain.MarketData, ext string) string {
+	return filepath.Join(
+		s.dir,
+		ConvertMarketDataProviderTypeToString(marketData.ProviderType)+"_"+CandleFileName(marketData, ext),
+	)
+}
+
+func (e *candleStoreEntry) bounds(from time.Time, to time.Time) (int, int) {
+	first := sort.Search(len(e.candles), func(i int) bool {
+		return !e.candles[i].OpenTime.Before(from)
+	})
+	last := sort.Search(len(e.candles), func(i int) bool {
+		return !e.candles[i].OpenTime.Before(to)
+	})
+
+	if last < first {
+		last = first
+	}
+
+	return first, last
+}
+
+// Sorts ranges and joins overlapping or adjacent ones
+func mergeTimeRanges(ranges []TimeRange) []TimeRange {
+	slices.SortFunc(ranges, func(a, b TimeRange) int {
+		return a.From.Compare(b.From)
+	})
+
+	merged := make([]TimeRange, 0, len(ranges))
+	for _, r := range ranges {
+		if !r.From.Before(r.To) {
+			continue
+		}
+
+		l := len(merged)
+		if l > 0 && !r.From.After(merged[l-1].To) {
+			merged[l-1].To = maxTime(merged[l-1].To, r.To)
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+func writeTimeRanges(path string, ranges []TimeRange) error {
+	data, err := json.MarshalIndent(ranges, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,132 @@
+package marketdata
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestCandleStore_SaveAppends(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCandleStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	candles := func(first int, count int, close float64) []domain.Candle {
+		result := make([]domain.Candle, 0, count)
+		for i := first; i < first+count; i++ {
+			openTime := start.Add(time.Duration(i) * time.Hour)
+			result = append(result, domain.Candle{MarketData: md, OpenTime: openTime, CloseTime: openTime.Add(time.Hour), Close: close})
+		}
+		return result
+	}
+	lines := func() int {
+		data, err := os.ReadFile(store.path(md, ".jsonl"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return bytes.Count(data, []byte("\n"))
+	}
+
+	if err := store.Save(md, candles(0, 4, 1), TimeRange{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The last stored candle is replaced, the file is appended
+	if err := store.Save(md, candles(3, 3, 2), TimeRange{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := lines(); n != 7 {
+		t.Fatalf("expected 7 lines after append, got %d", n)
+	}
+
+	// Reopened store keeps the replacing candles
+	reopened, err := NewCandleStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, s := range []*CandleStore{store, reopened} {
+		stored, err := s.Candles(md, start, start.Add(24*time.Hour))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(stored) != 6 {
+			t.Fatalf("expected 6 candles, got %d", len(stored))
+		}
+		for i, candle := range stored {
+			expected := 1.0
+			if i >= 3 {
+				expected = 2
+			}
+			if !candle.OpenTime.Equal(start.Add(time.Duration(i)*time.Hour)) || candle.Close != expected {
+				t.Errorf("unexpected candle %d %+v", i, candle)
+			}
+		}
+	}
+
+	// Replaced candles don't make the file grow without bound
+	for i := 0; i < 5; i++ {
+		if err := reopened.Save(md, candles(0, 6, float64(3+i)), TimeRange{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := lines(); n > candleStoreCompactRatio*6 {
+		t.Errorf("expected compacted file, got %d lines", n)
+	}
+	stored, err := reopened.Candles(md, start, start.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stored) != 6 || stored[0].Close != 7 || stored[5].Close != 7 {
+		t.Errorf("unexpected candles after compaction %+v", stored)
+	}
+}
+
+func TestCandleStore_SeparatesProviders(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCandleStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	covered := TimeRange{From: start, To: start.Add(time.Hour)}
+	tinkoff := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR, ProviderType: domain.MarketDataProviderType_TINKOFF}
+	moex := tinkoff
+	moex.ProviderType = domain.MarketDataProviderType_MOEX
+
+	candle := domain.Candle{MarketData: tinkoff, OpenTime: start, CloseTime: start.Add(time.Hour), Close: 1}
+	if err := store.Save(tinkoff, []domain.Candle{candle}, covered); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The same ID of another provider is neither loaded nor cached by a reopened store
+	reopened, err := NewCandleStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, err := reopened.Candles(moex, start, covered.To)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stored) != 0 {
+		t.Errorf("expected no candles of another provider, got %+v", stored)
+	}
+	missing, err := reopened.Missing(moex, covered.From, covered.To)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(missing) != 1 {
+		t.Errorf("expected the range of another provider to be missing, got %v", missing)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "tinkoff_SBER_1h.ranges.json")); err != nil {
+		t.Errorf("expected ranges file of the provider: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Embedded by providers that have only closed candles,
+// implements the rest of MarketDataProvider with errors
+type candlesOnlyProvider struct {
+	name string
+}
+
+func (p candlesOnlyProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return nil, fmt.Errorf("%s provider doesn't support candle updates streaming", p.name)
+}
+
+func (p candlesOnlyProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return fmt.Errorf("undefined subscriber")
+}
+
+func (p candlesOnlyProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	return nil, fmt.Errorf("%s provider doesn't support order book streaming", p.name)
+}
+
+func (p candlesOnlyProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	return fmt.Errorf("undefined subscriber")
+}
+
+func (p candlesOnlyProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	return nil, fmt.Errorf("%s provider doesn't support last price streaming", p.name)
+}
+
+func (p candlesOnlyProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	return fmt.Errorf("undefined subscriber")
+}
+
+func (p candlesOnlyProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	return nil, fmt.Errorf("%s provider doesn't support trade streaming", p.name)
+}
+
+func (p candlesOnlyProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	return fmt.Errorf("undefined subscriber")
+}
@@ -0,0 +1,675 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// History requests go to the secondary for this time after a primary error,
+// then the primary is tried again
+const failoverRetryDelay = time.Minute
+
+// How often candle streams check the primary
+const failoverCheckInterval = 10 * time.Second
+
+// Primary stream is stale when it has no candles for this many intervals of an open market
+const failoverStaleIntervals = 3
+
+// FailoverMarketDataProvider serves market data of the primary provider and switches
+// to the secondary when the primary fails: history requests on errors (including quota
+// exhaustion), candle streams on errors, closed channels and silence while the market is open.
+// It switches back once the primary answers again.
+//
+// Secondary IDs may differ, e.g. UID of the broker and SECID of MOEX, see MapInstrument.
+// Candles of the secondary are returned with MarketData of the request.
+// Order books, last prices and trades use the secondary only when the primary can't subscribe,
+// their values keep the IDs of the provider.
+type FailoverMarketDataProvider struct {
+	primary   MarketDataProvider
+	secondary MarketDataProvider
+	cal       calendar.Calendar
+	clock     clock.Clock
+	mu        sync.Mutex
+	// Secondary ID by primary ID, same ID when missing
+	secondaryIDs map[string]string
+	// Zero while the primary is healthy
+	primaryFailedAt         time.Time
+	candleSubscribers       *subscribers[domain.MarketData, domain.Candle]
+	candleUpdateSubscribers *subscribers[domain.MarketData, domain.Candle]
+	streams                 map[failoverStreamKey]context.CancelFunc
+	// Zero disables verification
+	tolerance    float64
+	onDivergence func(divergence CandleDivergence)
+}
+
+// Close prices of the same candle differ by more than the tolerance
+type CandleDivergence struct {
+	Primary   domain.Candle
+	Secondary domain.Candle
+	// |secondary - primary| / primary
+	Deviation float64
+}
+
+type failoverStreamKey struct {
+	marketData domain.MarketData
+	updates    bool
+}
+
+// Upstream subscriptions of one stream, owned by its goroutine
+type failoverStream struct {
+	key             failoverStreamKey
+	primary         <-chan domain.Candle
+	cancelPrimary   context.CancelFunc
+	secondary       <-chan domain.Candle
+	cancelSecondary context.CancelFunc
+	lastPrimary     time.Time
+	lastOpenTime    time.Time
+}
+
+// cal decides when the primary stream must have candles
+func NewFailoverMarketDataProvider(
+	primary MarketDataProvider,
+	secondary MarketDataProvider,
+	cal calendar.Calendar,
+) *FailoverMarketDataProvider {
+	return &FailoverMarketDataProvider{
+		primary:                 primary,
+		secondary:               secondary,
+		cal:                     cal,
+		clock:                   clock.Real,
+		secondaryIDs:            make(map[string]string),
+		candleSubscribers:       newSubscribers[domain.MarketData, domain.Candle]("Failover candle"),
+		candleUpdateSubscribers: newSubscribers[domain.MarketData, domain.Candle]("Failover candle update"),
+		streams:                 make(map[failoverStreamKey]context.CancelFunc),
+		onDivergence: func(divergence CandleDivergence) {
+			log.Printf(
+				"Candle of %s at %v diverges by %.2f%%: primary close %v, secondary close %v",
+				divergence.Primary.MarketData.ID,
+				divergence.Primary.OpenTime,
+				divergence.Deviation*100,
+				divergence.Primary.Close,
+				divergence.Secondary.Close,
+			)
+		},
+	}
+}
+
+// Retries of the primary and staleness checks are timed by c
+func (f *FailoverMarketDataProvider) SetClock(c clock.Clock) {
+	f.clock = c
+}
+
+// Instrument of the secondary for the ID of the primary, it is set at startup
+func (f *FailoverMarketDataProvider) MapInstrument(primaryID string, secondaryID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.secondaryIDs[primaryID] = secondaryID
+}
+
+// Candles of the primary are compared with the secondary: history requests
+// and closed streamed candles. Divergences above tolerance, e.g. 0.01 for 1%,
+// are passed to onDivergence, nil keeps the default that logs them.
+func (f *FailoverMarketDataProvider) SetVerification(tolerance float64, onDivergence func(divergence CandleDivergence)) {
+	f.tolerance = tolerance
+	if onDivergence != nil {
+		f.onDivergence = onDivergence
+	}
+}
+
+func (f *FailoverMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.subscribeStream(failoverStreamKey{marketData: marketData})
+	if err != nil {
+		return nil, err
+	}
+
+	ch, _ := f.candleSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		f.UnsubscribeCandles(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (f *FailoverMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	last, err := f.candleSubscribers.remove(marketData, ch)
+	if err != nil || !last {
+		return err
+	}
+
+	f.unsubscribeStream(failoverStreamKey{marketData: marketData})
+
+	return nil
+}
+
+func (f *FailoverMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.subscribeStream(failoverStreamKey{marketData: marketData, updates: true})
+	if err != nil {
+		return nil, err
+	}
+
+	ch, _ := f.candleUpdateSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		f.UnsubscribeCandleUpdates(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (f *FailoverMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	last, err := f.candleUpdateSubscribers.remove(marketData, ch)
+	if err != nil || !last {
+		return err
+	}
+
+	f.unsubscribeStream(failoverStreamKey{marketData: marketData, updates: true})
+
+	return nil
+}
+
+func (f *FailoverMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	ch, err := f.primary.SubscribeOrderBook(ctx, orderBookInfo)
+	if err == nil {
+		return ch, nil
+	}
+	log.Printf("Primary order book of %s is not available, using the secondary: %v", orderBookInfo.ID, err)
+
+	orderBookInfo.ID = f.secondaryID(orderBookInfo.ID)
+	return f.secondary.SubscribeOrderBook(ctx, orderBookInfo)
+}
+
+func (f *FailoverMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	if f.primary.UnsubscribeOrderBook(orderBookInfo, ch) == nil {
+		return nil
+	}
+
+	orderBookInfo.ID = f.secondaryID(orderBookInfo.ID)
+	return f.secondary.UnsubscribeOrderBook(orderBookInfo, ch)
+}
+
+func (f *FailoverMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	ch, err := f.primary.SubscribeLastPrices(ctx, instrumentInfo)
+	if err == nil {
+		return ch, nil
+	}
+	log.Printf("Primary last prices of %s are not available, using the secondary: %v", instrumentInfo.ID, err)
+
+	instrumentInfo.ID = f.secondaryID(instrumentInfo.ID)
+	return f.secondary.SubscribeLastPrices(ctx, instrumentInfo)
+}
+
+func (f *FailoverMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	if f.primary.UnsubscribeLastPrices(instrumentInfo, ch) == nil {
+		return nil
+	}
+
+	instrumentInfo.ID = f.secondaryID(instrumentInfo.ID)
+	return f.secondary.UnsubscribeLastPrices(instrumentInfo, ch)
+}
+
+func (f *FailoverMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	ch, err := f.primary.SubscribeTrades(ctx, instrumentInfo)
+	if err == nil {
+		return ch, nil
+	}
+	log.Printf("Primary trades of %s are not available, using the secondary: %v", instrumentInfo.ID, err)
+
+	instrumentInfo.ID = f.secondaryID(instrumentInfo.ID)
+	return f.secondary.SubscribeTrades(ctx, instrumentInfo)
+}
+
+func (f *FailoverMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	if f.primary.UnsubscribeTrades(instrumentInfo, ch) == nil {
+		return nil
+	}
+
+	instrumentInfo.ID = f.secondaryID(instrumentInfo.ID)
+	return f.secondary.UnsubscribeTrades(instrumentInfo, ch)
+}
+
+func (f *FailoverMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	return f.history(ctx, marketData, func(provider MarketDataProvider, marketData domain.MarketData) ([]domain.Candle, error) {
+		return provider.GetCandlesByTime(ctx, marketData, from, to)
+	})
+}
+
+func (f *FailoverMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	return f.history(ctx, marketData, func(provider MarketDataProvider, marketData domain.MarketData) ([]domain.Candle, error) {
+		return provider.GetCandlesByCount(ctx, marketData, last, count)
+	})
+}
+
+// Sends the request to the primary unless it failed recently, then to the secondary
+func (f *FailoverMarketDataProvider) history(
+	ctx context.Context,
+	marketData domain.MarketData,
+	request func(provider MarketDataProvider, marketData domain.MarketData) ([]domain.Candle, error),
+) ([]domain.Candle, error) {
+	var primaryErr error
+
+	if f.primaryAvailable() {
+		candles, err := request(f.primary, marketData)
+		if err == nil {
+			f.setPrimaryHealthy()
+			f.verifyHistory(marketData, candles, request)
+			return candles, nil
+		}
+
+		// Cancelled request says nothing about the primary
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		f.setPrimaryFailed(err)
+		primaryErr = err
+	}
+
+	candles, err := request(f.secondary, f.secondaryMarketData(marketData))
+	if err != nil {
+		if primaryErr != nil {
+			return nil, fmt.Errorf("primary: %v, secondary: %w", primaryErr, err)
+		}
+		return nil, fmt.Errorf("secondary: %w", err)
+	}
+
+	return f.fromSecondary(marketData, candles), nil
+}
+
+func (f *FailoverMarketDataProvider) primaryAvailable() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.primaryFailedAt.IsZero() || f.clock.Now().Sub(f.primaryFailedAt) >= failoverRetryDelay
+}
+
+func (f *FailoverMarketDataProvider) setPrimaryFailed(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.primaryFailedAt.IsZero() {
+		log.Printf("Primary market data provider failed, switching to the secondary: %v", err)
+	}
+	f.primaryFailedAt = f.clock.Now()
+}
+
+func (f *FailoverMarketDataProvider) setPrimaryHealthy() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.primaryFailedAt.IsZero() {
+		log.Printf("Primary market data provider is back")
+	}
+	f.primaryFailedAt = time.Time{}
+}
+
+func (f *FailoverMarketDataProvider) verifyHistory(
+	marketData domain.MarketData,
+	candles []domain.Candle,
+	request func(provider MarketDataProvider, marketData domain.MarketData) ([]domain.Candle, error),
+) {
+	if f.tolerance <= 0 || len(candles) == 0 {
+		return
+	}
+
+	secondary, err := request(f.secondary, f.secondaryMarketData(marketData))
+	if err != nil {
+		log.Printf("Error verifying candles of %s with the secondary: %v", marketData.ID, err)
+		return
+	}
+
+	f.compare(candles, f.fromSecondary(marketData, secondary))
+}
+
+// Candles are matched by OpenTime, both are sorted by it
+func (f *FailoverMarketDataProvider) compare(primary []domain.Candle, secondary []domain.Candle) {
+	j := 0
+	for _, candle := range primary {
+		for j < len(secondary) && secondary[j].OpenTime.Before(candle.OpenTime) {
+			j++
+		}
+		if j == len(secondary) {
+			return
+		}
+		if !secondary[j].OpenTime.Equal(candle.OpenTime) || candle.Close == 0 {
+			continue
+		}
+
+		deviation := math.Abs(secondary[j].Close-candle.Close) / math.Abs(candle.Close)
+		if deviation > f.tolerance {
+			f.onDivergence(CandleDivergence{
+				Primary:   candle,
+				Secondary: secondary[j],
+				Deviation: deviation,
+			})
+		}
+	}
+}
+
+func (f *FailoverMarketDataProvider) secondaryID(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if secondaryID, ok := f.secondaryIDs[id]; ok {
+		return secondaryID
+	}
+
+	return id
+}
+
+func (f *FailoverMarketDataProvider) secondaryMarketData(marketData domain.MarketData) domain.MarketData {
+	marketData.ID = f.secondaryID(marketData.ID)
+	return marketData
+}
+
+// Result is a new slice
+func (f *FailoverMarketDataProvider) fromSecondary(marketData domain.MarketData, candles []domain.Candle) []domain.Candle {
+	result := make([]domain.Candle, len(candles))
+	for i, candle := range candles {
+		candle.MarketData = marketData
+		result[i] = candle
+	}
+
+	return result
+}
+
+// Must be called with mu locked.
+// The primary is subscribed at once, the secondary when the primary can't.
+func (f *FailoverMarketDataProvider) subscribeStream(key failoverStreamKey) error {
+	if _, ok := f.streams[key]; ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &failoverStream{key: key, lastPrimary: f.clock.Now()}
+
+	err := f.subscribePrimary(ctx, stream)
+	if err != nil {
+		log.Printf("Primary candles of %s are not available, using the secondary: %v", key.marketData.ID, err)
+
+		// mu is locked, so the secondary ID is read directly
+		secondaryMarketData := key.marketData
+		if id, ok := f.secondaryIDs[key.marketData.ID]; ok {
+			secondaryMarketData.ID = id
+		}
+
+		err = f.subscribeSecondary(ctx, stream, secondaryMarketData)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("candles of %s are not available: %w", key.marketData.ID, err)
+		}
+	}
+
+	f.streams[key] = cancel
+
+	// The first check is planned before the goroutine starts, so a virtual clock can't miss it
+	go f.run(ctx, stream, f.clock.After(failoverCheckInterval))
+
+	return nil
+}
+
+// Must be called with mu locked after a subscriber is removed
+func (f *FailoverMarketDataProvider) unsubscribeStream(key failoverStreamKey) {
+	subscribers := f.candleSubscribers
+	if key.updates {
+		subscribers = f.candleUpdateSubscribers
+	}
+	if subscribers.has(key.marketData) {
+		return
+	}
+
+	if cancel, ok := f.streams[key]; ok {
+		cancel()
+		delete(f.streams, key)
+	}
+}
+
+func (f *FailoverMarketDataProvider) subscribePrimary(ctx context.Context, stream *failoverStream) error {
+	upstreamCtx, cancel := context.WithCancel(ctx)
+
+	ch, err := f.subscribe(upstreamCtx, f.primary, stream.key.marketData, stream.key.updates)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	stream.primary = ch
+	stream.cancelPrimary = cancel
+
+	return nil
+}
+
+func (f *FailoverMarketDataProvider) subscribeSecondary(
+	ctx context.Context,
+	stream *failoverStream,
+	secondaryMarketData domain.MarketData,
+) error {
+	upstreamCtx, cancel := context.WithCancel(ctx)
+
+	ch, err := f.subscribe(upstreamCtx, f.secondary, secondaryMarketData, stream.key.updates)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	stream.secondary = ch
+	stream.cancelSecondary = cancel
+
+	return nil
+}
+
+// Upstream subscription ends with its ctx
+func (f *FailoverMarketDataProvider) subscribe(
+	ctx context.Context,
+	provider MarketDataProvider,
+	marketData domain.MarketData,
+	updates bool,
+) (<-chan domain.Candle, error) {
+	if updates {
+		return provider.SubscribeCandleUpdates(ctx, marketData)
+	}
+
+	return provider.SubscribeCandles(ctx, marketData)
+}
+
+func (f *FailoverMarketDataProvider) run(ctx context.Context, stream *failoverStream, check <-chan time.Time) {
+	marketData := stream.key.marketData
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case candle, ok := <-stream.primary:
+			if !ok {
+				log.Printf("Primary candles of %s are closed, switching to the secondary", marketData.ID)
+				stream.primary = nil
+				stream.cancelPrimary()
+				f.failover(ctx, stream)
+				continue
+			}
+
+			stream.lastPrimary = f.clock.Now()
+			if stream.secondary != nil {
+				log.Printf("Primary candles of %s are back, leaving the secondary", marketData.ID)
+				stream.secondary = nil
+				stream.cancelSecondary()
+			}
+
+			f.deliver(stream, candle)
+			if !stream.key.updates && f.tolerance > 0 {
+				go f.verifyCandle(ctx, candle)
+			}
+		case candle, ok := <-stream.secondary:
+			if !ok {
+				// Subscribed again by the next check if the primary is still down
+				stream.secondary = nil
+				stream.cancelSecondary()
+				continue
+			}
+
+			candle.MarketData = marketData
+			f.deliver(stream, candle)
+		case <-check:
+			check = f.clock.After(failoverCheckInterval)
+			f.check(ctx, stream)
+		}
+	}
+}
+
+func (f *FailoverMarketDataProvider) check(ctx context.Context, stream *failoverStream) {
+	marketData := stream.key.marketData
+	now := f.clock.Now()
+
+	if stream.primary == nil {
+		err := f.subscribePrimary(ctx, stream)
+		if err == nil {
+			// Secondary is left when the primary sends a candle
+			stream.lastPrimary = now
+		}
+	}
+
+	// No candles are expected while the market is closed
+	if !f.cal.IsOpen(now) {
+		stream.lastPrimary = now
+		return
+	}
+
+	staleAfter := failoverStaleIntervals * ConvertMarketDataIntervalToTime(marketData.Interval)
+	if stream.primary != nil && stream.secondary == nil && now.Sub(stream.lastPrimary) > staleAfter {
+		log.Printf("Primary candles of %s are stale since %v, switching to the secondary", marketData.ID, stream.lastPrimary)
+		f.failover(ctx, stream)
+	}
+
+	if stream.primary == nil && stream.secondary == nil {
+		f.failover(ctx, stream)
+	}
+}
+
+// Subscribes the secondary and delivers closed candles missed since the last one
+func (f *FailoverMarketDataProvider) failover(ctx context.Context, stream *failoverStream) {
+	if stream.secondary != nil {
+		return
+	}
+
+	marketData := stream.key.marketData
+	secondaryMarketData := f.secondaryMarketData(marketData)
+
+	err := f.subscribeSecondary(ctx, stream, secondaryMarketData)
+	if err != nil {
+		log.Printf("Secondary candles of %s are not available: %v", marketData.ID, err)
+		return
+	}
+
+	if stream.key.updates || stream.lastOpenTime.IsZero() {
+		return
+	}
+
+	now := f.clock.Now()
+	candles, err := f.secondary.GetCandlesByTime(ctx, secondaryMarketData, stream.lastOpenTime.Add(time.Nanosecond), now)
+	if err != nil {
+		log.Printf("Error backfilling candles of %s from the secondary: %v", marketData.ID, err)
+		return
+	}
+
+	for _, candle := range candles {
+		if candle.CloseTime.After(now) {
+			break
+		}
+		candle.MarketData = marketData
+		f.deliver(stream, candle)
+	}
+}
+
+// Closed candles are delivered once and in order of OpenTime,
+// updates of an older candle than the last one are dropped
+func (f *FailoverMarketDataProvider) deliver(stream *failoverStream, candle domain.Candle) {
+	if stream.key.updates {
+		if candle.OpenTime.Before(stream.lastOpenTime) {
+			return
+		}
+	} else if !candle.OpenTime.After(stream.lastOpenTime) {
+		return
+	}
+	stream.lastOpenTime = candle.OpenTime
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if stream.key.updates {
+		f.candleUpdateSubscribers.notify(stream.key.marketData, candle)
+	} else {
+		f.candleSubscribers.notify(stream.key.marketData, candle)
+	}
+}
+
+func (f *FailoverMarketDataProvider) verifyCandle(ctx context.Context, candle domain.Candle) {
+	secondary, err := f.secondary.GetCandlesByTime(
+		ctx,
+		f.secondaryMarketData(candle.MarketData),
+		candle.OpenTime,
+		candle.CloseTime,
+	)
+	if err != nil {
+		log.Printf("Error verifying candle of %s with the secondary: %v", candle.MarketData.ID, err)
+		return
+	}
+
+	f.compare([]domain.Candle{candle}, f.fromSecondary(candle.MarketData, secondary))
+}
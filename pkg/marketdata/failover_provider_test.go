@@ -0,0 +1,187 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Fails history requests while err is set, closes are scaled by factor
+type flakyProvider struct {
+	countingProvider
+	err    error
+	factor float64
+	calls  int
+	lastID string
+}
+
+func (p *flakyProvider) GetCandlesByTime(ctx context.Context, md domain.MarketData, from time.Time, to time.Time) ([]domain.Candle, error) {
+	p.calls++
+	p.lastID = md.ID
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	candles, err := p.countingProvider.GetCandlesByTime(ctx, md, from, to)
+	if p.factor != 0 {
+		for i := range candles {
+			candles[i].Close *= p.factor
+		}
+	}
+
+	return candles, err
+}
+
+func TestFailoverMarketDataProvider_History(t *testing.T) {
+	primary := &flakyProvider{err: fmt.Errorf("quota exceeded")}
+	secondary := &flakyProvider{}
+	provider := NewFailoverMarketDataProvider(primary, secondary, calendar.NewAlwaysOpenCalendar())
+	provider.MapInstrument("uid-sber", "SBER")
+
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	virtualClock := clock.NewVirtualClock(start)
+	provider.SetClock(virtualClock)
+
+	md := domain.MarketData{ID: "uid-sber", Interval: domain.MarketDataInterval_ONE_HOUR}
+	from := start.Add(-5 * time.Hour)
+
+	candles, err := provider.GetCandlesByTime(context.Background(), md, from, start)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 5 || candles[0].MarketData != md {
+		t.Fatalf("expected 5 candles of %v, got %d", md, len(candles))
+	}
+	if secondary.lastID != "SBER" {
+		t.Errorf("expected mapped secondary ID, got %q", secondary.lastID)
+	}
+
+	// Primary is not asked again until the retry delay passes
+	primary.err = nil
+	if _, err := provider.GetCandlesByTime(context.Background(), md, from, start); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if primary.calls != 1 || secondary.calls != 2 {
+		t.Fatalf("expected requests to the secondary, got %d primary and %d secondary", primary.calls, secondary.calls)
+	}
+
+	virtualClock.Set(start.Add(failoverRetryDelay))
+	if _, err := provider.GetCandlesByTime(context.Background(), md, from, start); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if primary.calls != 2 || secondary.calls != 2 {
+		t.Fatalf("expected request to the primary, got %d primary and %d secondary", primary.calls, secondary.calls)
+	}
+
+	primary.err = fmt.Errorf("unavailable")
+	secondary.err = fmt.Errorf("timeout")
+	if _, err := provider.GetCandlesByTime(context.Background(), md, from, start); err == nil {
+		t.Errorf("expected error when both providers fail")
+	}
+}
+
+func TestFailoverMarketDataProvider_Verification(t *testing.T) {
+	primary := &flakyProvider{}
+	secondary := &flakyProvider{factor: 1.05}
+	provider := NewFailoverMarketDataProvider(primary, secondary, calendar.NewAlwaysOpenCalendar())
+
+	var divergences []CandleDivergence
+	provider.SetVerification(0.01, func(divergence CandleDivergence) {
+		divergences = append(divergences, divergence)
+	})
+
+	day := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+
+	candles, err := provider.GetCandlesByTime(context.Background(), md, day, day.Add(4*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if candles[3].Close != 3 {
+		t.Fatalf("expected candles of the primary, got close %v", candles[3].Close)
+	}
+
+	// Zero close of midnight can't be compared
+	if len(divergences) != 3 {
+		t.Fatalf("expected 3 divergences, got %d", len(divergences))
+	}
+	if divergences[0].Primary.Close != 1 || divergences[0].Secondary.Close != 1.05 || divergences[0].Deviation < 0.049 {
+		t.Errorf("unexpected divergence %+v", divergences[0])
+	}
+}
+
+func TestFailoverMarketDataProvider_StaleStream(t *testing.T) {
+	primary := &streamingProvider{channels: make(map[domain.MarketData]chan domain.Candle)}
+	secondary := &streamingProvider{channels: make(map[domain.MarketData]chan domain.Candle)}
+	provider := NewFailoverMarketDataProvider(primary, secondary, calendar.NewAlwaysOpenCalendar())
+	provider.MapInstrument("uid-btc", "BTC")
+
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	virtualClock := clock.NewVirtualClock(start)
+	provider.SetClock(virtualClock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	md := domain.MarketData{ID: "uid-btc", Interval: domain.MarketDataInterval_ONE_HOUR}
+	candles, err := provider.SubscribeCandles(ctx, md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	receive := func() domain.Candle {
+		select {
+		case candle := <-candles:
+			return candle
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no candle")
+			return domain.Candle{}
+		}
+	}
+
+	primary.send(domain.Candle{MarketData: md, OpenTime: start.Add(-time.Hour), CloseTime: start, Close: 9})
+	if candle := receive(); candle.Close != 9 {
+		t.Fatalf("unexpected candle %+v", candle)
+	}
+
+	// Primary is silent for 4 hours, missed candles come from the secondary history
+	virtualClock.Set(start.Add(4*time.Hour + failoverCheckInterval))
+	for hour := 10; hour < 14; hour++ {
+		candle := receive()
+		if candle.Close != float64(hour) || candle.MarketData != md {
+			t.Fatalf("expected backfilled candle of %d, got %+v", hour, candle)
+		}
+	}
+
+	secondary.mu.Lock()
+	_, subscribed := secondary.channels[domain.MarketData{ID: "BTC", Interval: md.Interval}]
+	secondary.mu.Unlock()
+	if !subscribed {
+		t.Fatalf("secondary is not subscribed with the mapped ID")
+	}
+
+	// Duplicate of the secondary is dropped
+	primary.send(domain.Candle{MarketData: md, OpenTime: start.Add(3 * time.Hour), CloseTime: start.Add(4 * time.Hour), Close: 13})
+	primary.send(domain.Candle{MarketData: md, OpenTime: start.Add(4 * time.Hour), CloseTime: start.Add(5 * time.Hour), Close: 14})
+	if candle := receive(); candle.Close != 14 {
+		t.Fatalf("unexpected candle %+v", candle)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		secondary.mu.Lock()
+		left := len(secondary.channels)
+		secondary.mu.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("secondary is still subscribed after the primary is back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
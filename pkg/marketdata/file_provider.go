@@ -0,0 +1,134 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+var candleFileExtensions = []string{".csv", ".jsonl"}
+
+// FileMarketDataProvider serves historical candles from local CSV or JSONL files.
+// Files are looked up in dir by CandleFileName, e.g. "<ID>_1h.csv".
+type FileMarketDataProvider struct {
+	candlesOnlyProvider
+	dir     string
+	mu      sync.Mutex
+	candles map[domain.MarketData][]domain.Candle
+}
+
+func NewFileMarketDataProvider(dir string) (*FileMarketDataProvider, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return &FileMarketDataProvider{
+		candlesOnlyProvider: candlesOnlyProvider{name: "file"},
+		dir:                 dir,
+		candles:             make(map[domain.MarketData][]domain.Candle),
+	}, nil
+}
+
+func (f *FileMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return nil, fmt.Errorf("file provider doesn't support candle streaming")
+}
+
+func (f *FileMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return fmt.Errorf("undefined subscriber")
+}
+
+func (f *FileMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	candles, err := f.load(marketData)
+	if err != nil {
+		return nil, err
+	}
+
+	first := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].OpenTime.Before(from)
+	})
+	last := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].OpenTime.Before(to)
+	})
+
+	if first >= last {
+		return make([]domain.Candle, 0), nil
+	}
+
+	return append(make([]domain.Candle, 0, last-first), candles[first:last]...), nil
+}
+
+func (f *FileMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	candles, err := f.load(marketData)
+	if err != nil {
+		return nil, err
+	}
+
+	end := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].OpenTime.Before(last)
+	})
+
+	if end < count {
+		return nil, fmt.Errorf(
+			"error getting history data by count",
+		)
+	}
+
+	return append(make([]domain.Candle, 0, count), candles[end-count:end]...), nil
+}
+
+// Candles are read once per instrument and interval and kept in memory
+func (f *FileMarketDataProvider) load(marketData domain.MarketData) ([]domain.Candle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if candles, ok := f.candles[marketData]; ok {
+		return candles, nil
+	}
+
+	for _, ext := range candleFileExtensions {
+		path := filepath.Join(f.dir, CandleFileName(marketData, ext))
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		candles, err := ReadCandlesFile(path, marketData)
+		if err != nil {
+			return nil, err
+		}
+
+		f.candles[marketData] = candles
+		return candles, nil
+	}
+
+	return nil, fmt.Errorf(
+		"candle file for %s not found in %s",
+		CandleFileName(marketData, ""),
+		f.dir,
+	)
+}
@@ -0,0 +1,91 @@
+package marketdata
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestFileMarketDataProvider_CSV(t *testing.T) {
+	dir := t.TempDir()
+	md := domain.MarketData{
+		ID:           "SBER",
+		Interval:     domain.MarketDataInterval_ONE_HOUR,
+		ProviderType: domain.MarketDataProviderType_FILE,
+	}
+
+	data := "open_time,open,high,low,close,volume\n" +
+		"2024-01-03T08:00:00Z,2,3,1,2.5,20\n" +
+		"2024-01-03T07:00:00Z,1,2,0.5,1.5,10\n" +
+		"2024-01-03T09:00:00Z,3,4,2,3.5,30\n"
+	err := os.WriteFile(filepath.Join(dir, "SBER_1h.csv"), []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewFileMarketDataProvider(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2024, time.January, 3, 7, 0, 0, 0, time.UTC)
+
+	candles, err := provider.GetCandlesByTime(context.Background(), md, start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 2 {
+		t.Fatalf("expected 2 candles, got %d", len(candles))
+	}
+	if !candles[0].OpenTime.Equal(start) || candles[0].Close != 1.5 {
+		t.Errorf("unexpected first candle: %+v", candles[0])
+	}
+	if !candles[1].CloseTime.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("unexpected close time: %v", candles[1].CloseTime)
+	}
+
+	candles, err = provider.GetCandlesByCount(context.Background(), md, start.Add(3*time.Hour), 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 2 || candles[1].Close != 3.5 {
+		t.Errorf("unexpected candles by count: %+v", candles)
+	}
+
+	_, err = provider.GetCandlesByCount(context.Background(), md, start.Add(3*time.Hour), 4)
+	if err == nil {
+		t.Error("expected error for not enough history, got nil")
+	}
+}
+
+func TestWriteCandlesFile_JSONLRoundTrip(t *testing.T) {
+	md := domain.MarketData{ID: "YDEX", Interval: domain.MarketDataInterval_ONE_DAY}
+	path := filepath.Join(t.TempDir(), CandleFileName(md, ".jsonl"))
+
+	open := time.Date(2024, time.January, 3, 0, 0, 0, 0, time.UTC)
+	candles := []domain.Candle{
+		{MarketData: md, OpenTime: open, Open: 1, High: 2, Low: 0.5, Close: 1.5, Volume: 10},
+		{MarketData: md, OpenTime: open.Add(24 * time.Hour), Open: 1.5, High: 3, Low: 1, Close: 2.5, Volume: 11},
+	}
+
+	if err := WriteCandlesFile(path, candles); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	read, err := ReadCandlesFile(path, md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(read) != len(candles) {
+		t.Fatalf("expected %d candles, got %d", len(candles), len(read))
+	}
+	for i := range read {
+		if !read[i].OpenTime.Equal(candles[i].OpenTime) || read[i].Close != candles[i].Close {
+			t.Errorf("candle %d: expected %+v, got %+v", i, candles[i], read[i])
+		}
+	}
+}
@@ -1,14 +1,50 @@
 package marketdata
 
 import (
+	"context"
 	"time"
 
 	"github.com/Reensef/sigmasage/pkg/domain"
 )
 
+// Subscriptions live until ctx is done or Unsubscribe is called, then the channel is closed.
+// Contexts of history requests cancel them.
 type MarketDataProvider interface {
-	SubscribeCandles(marketDataInfo domain.MarketData) (<-chan domain.Candle, error)
+	// Only closed candles
+	SubscribeCandles(ctx context.Context, marketDataInfo domain.MarketData) (<-chan domain.Candle, error)
 	UnsubscribeCandles(marketDataInfo domain.MarketData, ch <-chan domain.Candle) error
-	GetCandlesByCount(marketDataInfo domain.MarketData, to time.Time, count int) ([]domain.Candle, error)
-	GetCandlesByTime(marketDataInfo domain.MarketData, from time.Time, to time.Time) ([]domain.Candle, error)
+	// Updates of the forming candle, every candle has Partial set
+	SubscribeCandleUpdates(ctx context.Context, marketDataInfo domain.MarketData) (<-chan domain.Candle, error)
+	UnsubscribeCandleUpdates(marketDataInfo domain.MarketData, ch <-chan domain.Candle) error
+	GetCandlesByCount(ctx context.Context, marketDataInfo domain.MarketData, to time.Time, count int) ([]domain.Candle, error)
+	GetCandlesByTime(ctx context.Context, marketDataInfo domain.MarketData, from time.Time, to time.Time) ([]domain.Candle, error)
+
+	// Snapshots of the order book at the depth of orderBookInfo
+	SubscribeOrderBook(ctx context.Context, orderBookInfo domain.OrderBookInfo) (<-chan domain.OrderBook, error)
+	UnsubscribeOrderBook(orderBookInfo domain.OrderBookInfo, ch <-chan domain.OrderBook) error
+	SubscribeLastPrices(ctx context.Context, instrumentInfo domain.InstrumentInfo) (<-chan domain.LastPrice, error)
+	UnsubscribeLastPrices(instrumentInfo domain.InstrumentInfo, ch <-chan domain.LastPrice) error
+	// Anonymous trades of the exchange
+	SubscribeTrades(ctx context.Context, instrumentInfo domain.InstrumentInfo) (<-chan domain.Trade, error)
+	UnsubscribeTrades(instrumentInfo domain.InstrumentInfo, ch <-chan domain.Trade) error
+}
+
+// Short name of the provider type, used in file names of cached candles
+func ConvertMarketDataProviderTypeToString(providerType domain.MarketDataProviderType) string {
+	switch providerType {
+	case domain.MarketDataProviderType_TINKOFF:
+		return "tinkoff"
+	case domain.MarketDataProviderType_FILE:
+		return "file"
+	case domain.MarketDataProviderType_REPLAY:
+		return "replay"
+	case domain.MarketDataProviderType_SYNTHETIC:
+		return "synthetic"
+	case domain.MarketDataProviderType_MOEX:
+		return "moex"
+	case domain.MarketDataProviderType_BINANCE:
+		return "binance"
+	default:
+		return "undefined"
+	}
 }
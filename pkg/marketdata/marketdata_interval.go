@@ -3,9 +3,12 @@ package marketdata
 import (
 	"time"
 
+	"github.com/Reensef/sigmasage/pkg/calendar"
 	"github.com/Reensef/sigmasage/pkg/domain"
 )
 
+// Nominal duration of the interval, e.g. for timeouts and request windows.
+// Weeks and months differ in length, CandleBounds gives the real bounds of a candle.
 func ConvertMarketDataIntervalToTime(interval domain.MarketDataInterval) time.Duration {
 	switch interval {
 	case domain.MarketDataInterval_ONE_MINUTE:
@@ -39,47 +42,225 @@ func ConvertMarketDataIntervalToTime(interval domain.MarketDataInterval) time.Du
 	}
 }
 
-// TODO Тесты!!!
-// Считает длительность в зависимости от интервала и количества, учитывая только рабочие часы
-func AdjustDurationForWorkingHours(interval domain.MarketDataInterval, count int) time.Duration {
-	normalize := func(duration time.Duration) time.Duration {
-		daysCount := int(duration.Hours()) / 8
+// Candle [open, close) of the interval that contains t, close is the open of the next candle.
+// Days start at midnight in loc, weeks on Monday as ISO weeks, months on the first day.
+// Shorter intervals are multiples of their duration since the Unix epoch like the broker candles.
+func CandleBounds(
+	interval domain.MarketDataInterval,
+	t time.Time,
+	loc *time.Location,
+) (time.Time, time.Time) {
+	open := CandleOpenTime(interval, t, loc)
+	return open, AddCandles(interval, open, 1, loc)
+}
+
+// Open time of the candle of the interval that contains t
+func CandleOpenTime(
+	interval domain.MarketDataInterval,
+	t time.Time,
+	loc *time.Location,
+) time.Time {
+	local := t.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	switch interval {
+	case domain.MarketDataInterval_ONE_DAY:
+		return day
+	case domain.MarketDataInterval_WEEK:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case domain.MarketDataInterval_MONTH:
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+
+	step := ConvertMarketDataIntervalToTime(interval)
+	if step == 0 {
+		return t
+	}
+
+	return t.Truncate(step)
+}
+
+// Close time of the candle of the interval that contains t
+func CandleCloseTime(
+	interval domain.MarketDataInterval,
+	t time.Time,
+	loc *time.Location,
+) time.Time {
+	return AddCandles(interval, t, 1, loc)
+}
+
+// Open time of the candle n candles after the one that contains t, n may be negative
+func AddCandles(
+	interval domain.MarketDataInterval,
+	t time.Time,
+	n int,
+	loc *time.Location,
+) time.Time {
+	open := CandleOpenTime(interval, t, loc)
 
-		if daysCount > 7 {
-			duration += time.Duration((daysCount/7)*2*24) * time.Hour
+	switch interval {
+	case domain.MarketDataInterval_ONE_DAY:
+		return open.AddDate(0, 0, n)
+	case domain.MarketDataInterval_WEEK:
+		return open.AddDate(0, 0, 7*n)
+	case domain.MarketDataInterval_MONTH:
+		return open.AddDate(0, n, 0)
+	}
+
+	return open.Add(time.Duration(n) * ConvertMarketDataIntervalToTime(interval))
+}
+
+// Returns the start of the shortest range [start, last) that contains
+// count candles of the interval, trading sessions are taken from the calendar
+func CandlesWindowStart(
+	cal calendar.Calendar,
+	interval domain.MarketDataInterval,
+	last time.Time,
+	count int,
+) time.Time {
+	if count <= 0 {
+		return last
+	}
+
+	switch interval {
+	case domain.MarketDataInterval_ONE_DAY:
+		return tradingDaysWindowStart(cal, last, count)
+	case domain.MarketDataInterval_WEEK, domain.MarketDataInterval_MONTH:
+		return periodsWindowStart(cal, interval, last, count)
+	}
+
+	step := ConvertMarketDataIntervalToTime(interval)
+	if step == 0 {
+		return last
+	}
+
+	// Candles are aligned to multiples of the step, a candle may cover
+	// the end of one session and the start of the next one
+	var earliest time.Time
+	day := calendar.StartOfDay(cal, last)
+
+	for i := 0; i < maxWindowDays; i++ {
+		sessions := cal.Sessions(day)
+
+		for j := len(sessions) - 1; j >= 0; j-- {
+			session := sessions[j]
+
+			end := minTime(session.Close, last)
+			if !end.After(session.Open) {
+				continue
+			}
+
+			firstCandle := CandleOpenTime(interval, session.Open, cal.Location())
+			lastCandle := CandleOpenTime(interval, end.Add(-time.Nanosecond), cal.Location())
+			if !earliest.IsZero() && !lastCandle.Before(earliest) {
+				lastCandle = earliest.Add(-step)
+			}
+			if lastCandle.Before(firstCandle) {
+				continue
+			}
+
+			n := int(lastCandle.Sub(firstCandle)/step) + 1
+			if n >= count {
+				return lastCandle.Add(-time.Duration(count-1) * step)
+			}
+
+			count -= n
+			earliest = firstCandle
 		}
 
-		return duration
+		day = day.AddDate(0, 0, -1)
 	}
 
+	return day
+}
+
+// Limit of the calendar days CandlesWindowStart looks back
+const maxWindowDays = 366 * 50
+
+func tradingDaysWindowStart(cal calendar.Calendar, last time.Time, count int) time.Time {
+	day := calendar.StartOfDay(cal, last)
+
+	for i := 0; i < maxWindowDays; i++ {
+		sessions := cal.Sessions(day)
+		if len(sessions) > 0 && sessions[0].Open.Before(last) {
+			count--
+			if count == 0 {
+				return day
+			}
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+
+	return day
+}
+
+// Counts back periods (weeks, months) that have at least one trading day
+func periodsWindowStart(
+	cal calendar.Calendar,
+	interval domain.MarketDataInterval,
+	last time.Time,
+	count int,
+) time.Time {
+	start := CandleOpenTime(interval, last, cal.Location())
+	end := last
+
+	for i := 0; i < maxWindowDays; i++ {
+		if hasTradingDay(cal, start, end) {
+			count--
+			if count == 0 {
+				return start
+			}
+		}
+
+		end = start
+		start = AddCandles(interval, start, -1, cal.Location())
+	}
+
+	return start
+}
+
+func hasTradingDay(cal calendar.Calendar, from time.Time, to time.Time) bool {
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		sessions := cal.Sessions(day)
+		if len(sessions) > 0 && sessions[0].Open.Before(to) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Короткое имя интервала, используется в именах файлов со свечами.
+// Имена различаются не только регистром, файловые системы macOS и Windows его не различают
+func ConvertMarketDataIntervalToString(interval domain.MarketDataInterval) string {
 	switch interval {
 	case domain.MarketDataInterval_ONE_MINUTE:
-		return normalize(time.Minute * time.Duration(count))
+		return "1min"
 	case domain.MarketDataInterval_TWO_MIN:
-		return normalize(2 * time.Minute * time.Duration(count))
+		return "2min"
 	case domain.MarketDataInterval_THREE_MIN:
-		return normalize(3 * time.Minute * time.Duration(count))
+		return "3min"
 	case domain.MarketDataInterval_FIVE_MINUTES:
-		return normalize(5 * time.Minute * time.Duration(count))
+		return "5min"
 	case domain.MarketDataInterval_TEN_MIN:
-		return normalize(10 * time.Minute * time.Duration(count))
+		return "10min"
 	case domain.MarketDataInterval_FIFTEEN_MINUTES:
-		return normalize(15 * time.Minute * time.Duration(count))
+		return "15min"
 	case domain.MarketDataInterval_THERTY_MIN:
-		return normalize(30 * time.Minute * time.Duration(count))
+		return "30min"
 	case domain.MarketDataInterval_ONE_HOUR:
-		return normalize(time.Hour * time.Duration(count))
+		return "1h"
 	case domain.MarketDataInterval_TWO_HOUR:
-		return normalize(2 * time.Hour * time.Duration(count))
+		return "2h"
 	case domain.MarketDataInterval_FOUR_HOUR:
-		return normalize(4 * time.Hour * time.Duration(count))
+		return "4h"
 	case domain.MarketDataInterval_ONE_DAY:
-		return normalize(24 * time.Hour * time.Duration(count))
+		return "1d"
 	case domain.MarketDataInterval_WEEK:
-		return normalize(7 * 24 * time.Hour * time.Duration(count))
+		return "1w"
 	case domain.MarketDataInterval_MONTH:
-		return normalize(30 * 24 * time.Hour * time.Duration(count))
+		return "1mo"
 	default:
-		return 0
+		return ""
 	}
 }
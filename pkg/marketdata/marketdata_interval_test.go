@@ -0,0 +1,99 @@
+package marketdata
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestCandlesWindowStart(t *testing.T) {
+	cal := calendar.NewMOEXCalendar()
+	msk := func(month time.Month, day, hour int) time.Time {
+		return time.Date(2024, month, day, hour, 0, 0, 0, calendar.MoscowLocation)
+	}
+
+	tests := []struct {
+		name     string
+		interval domain.MarketDataInterval
+		last     time.Time
+		count    int
+		expected time.Time
+	}{
+		{"hours inside session", domain.MarketDataInterval_ONE_HOUR, msk(time.January, 10, 12), 3, msk(time.January, 10, 9)},
+		{"hours from evening session", domain.MarketDataInterval_ONE_HOUR, msk(time.January, 10, 12), 4, msk(time.January, 9, 23)},
+		{"hours over weekend", domain.MarketDataInterval_ONE_HOUR, msk(time.January, 15, 11), 3, msk(time.January, 12, 23)},
+		{"days over holiday", domain.MarketDataInterval_ONE_DAY, msk(time.February, 26, 12), 2, msk(time.February, 22, 0)},
+		{"weeks", domain.MarketDataInterval_WEEK, msk(time.January, 17, 12), 2, msk(time.January, 8, 0)},
+		{"months", domain.MarketDataInterval_MONTH, msk(time.March, 5, 12), 3, msk(time.January, 1, 0)},
+	}
+
+	for _, test := range tests {
+		start := CandlesWindowStart(cal, test.interval, test.last, test.count)
+		if !start.Equal(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, start)
+		}
+	}
+}
+
+func TestCandleBounds(t *testing.T) {
+	msk := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, calendar.MoscowLocation)
+	}
+
+	tests := []struct {
+		name     string
+		interval domain.MarketDataInterval
+		t        time.Time
+		open     time.Time
+		close    time.Time
+	}{
+		{"hour", domain.MarketDataInterval_ONE_HOUR, msk(2024, time.January, 10, 12).Add(30 * time.Minute), msk(2024, time.January, 10, 12), msk(2024, time.January, 10, 13)},
+		{"four hours in UTC", domain.MarketDataInterval_FOUR_HOUR, msk(2024, time.January, 10, 12), msk(2024, time.January, 10, 11), msk(2024, time.January, 10, 15)},
+		{"day after UTC midnight", domain.MarketDataInterval_ONE_DAY, time.Date(2024, time.January, 9, 22, 0, 0, 0, time.UTC), msk(2024, time.January, 10, 0), msk(2024, time.January, 11, 0)},
+		{"week on Sunday", domain.MarketDataInterval_WEEK, msk(2024, time.January, 14, 20), msk(2024, time.January, 8, 0), msk(2024, time.January, 15, 0)},
+		{"ISO week over new year", domain.MarketDataInterval_WEEK, msk(2025, time.January, 1, 12), msk(2024, time.December, 30, 0), msk(2025, time.January, 6, 0)},
+		{"leap February", domain.MarketDataInterval_MONTH, msk(2024, time.February, 29, 23), msk(2024, time.February, 1, 0), msk(2024, time.March, 1, 0)},
+		{"31 days month", domain.MarketDataInterval_MONTH, msk(2024, time.January, 31, 12), msk(2024, time.January, 1, 0), msk(2024, time.February, 1, 0)},
+	}
+
+	for _, test := range tests {
+		open, close := CandleBounds(test.interval, test.t, calendar.MoscowLocation)
+		if !open.Equal(test.open) || !close.Equal(test.close) {
+			t.Errorf("%s: expected [%v, %v), got [%v, %v)", test.name, test.open, test.close, open, close)
+		}
+	}
+}
+
+func TestAddCandles(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 12, 0, 0, 0, calendar.MoscowLocation)
+
+	next := AddCandles(domain.MarketDataInterval_MONTH, start, 1, calendar.MoscowLocation)
+	if expected := time.Date(2024, time.February, 1, 0, 0, 0, 0, calendar.MoscowLocation); !next.Equal(expected) {
+		t.Errorf("expected next month at %v, got %v", expected, next)
+	}
+
+	prev := AddCandles(domain.MarketDataInterval_MONTH, start, -11, calendar.MoscowLocation)
+	if expected := time.Date(2023, time.February, 1, 0, 0, 0, 0, calendar.MoscowLocation); !prev.Equal(expected) {
+		t.Errorf("expected month at %v, got %v", expected, prev)
+	}
+
+	prev = AddCandles(domain.MarketDataInterval_THERTY_MIN, start.Add(10*time.Minute), -2, calendar.MoscowLocation)
+	if expected := start.Add(-time.Hour); !prev.Equal(expected) {
+		t.Errorf("expected candle at %v, got %v", expected, prev)
+	}
+}
+
+func TestCandleFileNameDistinct(t *testing.T) {
+	names := make(map[string]domain.MarketDataInterval)
+
+	for interval := domain.MarketDataInterval_ONE_MINUTE; interval <= domain.MarketDataInterval_MONTH; interval++ {
+		name := strings.ToLower(CandleFileName(domain.MarketData{ID: "SBER", Interval: interval}, ".jsonl"))
+		if other, ok := names[name]; ok {
+			t.Errorf("intervals %v and %v share file %s", other, interval, name)
+		}
+		names[name] = interval
+	}
+}
@@ -0,0 +1,251 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+	"github.com/Reensef/sigmasage/pkg/utils"
+)
+
+// How many times GetCandlesByCount widens the window when the exchange had no trades
+const moexCountWindowExtensions = 3
+
+// ISS dates are local times of the exchange
+const moexISSTimeLayout = "2006-01-02 15:04:05"
+
+// MOEXMarketDataProvider serves candle history of the public Moscow Exchange ISS API.
+// MarketData.ID is the SECID, e.g. "SBER", candles are taken from its primary board.
+// Public data is delayed, so only history is supported.
+type MOEXMarketDataProvider struct {
+	candlesOnlyProvider
+	client   *utils.MOEXISSClient
+	calendar calendar.Calendar
+	mu       sync.Mutex
+	boards   map[string]utils.MOEXBoard
+}
+
+// endpoint is utils.MOEXISSEndpoint, tests pass the URL of a local stand-in
+func NewMOEXMarketDataProvider(endpoint string) *MOEXMarketDataProvider {
+	return &MOEXMarketDataProvider{
+		candlesOnlyProvider: candlesOnlyProvider{name: "MOEX"},
+		client:              utils.NewMOEXISSClient(endpoint),
+		calendar:            calendar.NewMOEXCalendar(),
+		boards:              make(map[string]utils.MOEXBoard),
+	}
+}
+
+func (m *MOEXMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return nil, fmt.Errorf("MOEX provider doesn't support candle streaming")
+}
+
+func (m *MOEXMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return fmt.Errorf("undefined subscriber")
+}
+
+func (m *MOEXMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	return m.loadCandles(ctx, marketData, from, to)
+}
+
+func (m *MOEXMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	cal := SessionCalendar(m.calendar, marketData.SessionFilter)
+	first := CandlesWindowStart(cal, marketData.Interval, last, count)
+
+	candles, err := m.loadCandles(ctx, marketData, first, last)
+	if err != nil {
+		return nil, err
+	}
+
+	// Illiquid instruments have no candles for periods without trades
+	for i := 0; i < moexCountWindowExtensions && len(candles) < count; i++ {
+		prevFirst := first
+		first = CandlesWindowStart(cal, marketData.Interval, first, count-len(candles))
+
+		older, err := m.loadCandles(ctx, marketData, first, prevFirst)
+		if err != nil {
+			return nil, err
+		}
+		candles = append(older, candles...)
+	}
+
+	if len(candles) < count {
+		return nil, fmt.Errorf(
+			"error getting history data by count",
+		)
+	}
+
+	return candles[len(candles)-count:], nil
+}
+
+// Candles with OpenTime in [from, to) page by page,
+// result is sorted by OpenTime without duplicates and filtered by the session filter
+func (m *MOEXMarketDataProvider) loadCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	interval, err := m.convertInterval(marketData.Interval)
+	if err != nil {
+		return nil, err
+	}
+
+	board, err := m.board(ctx, marketData.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf(
+		"/engines/%s/markets/%s/boards/%s/securities/%s/candles",
+		board.Engine,
+		board.Market,
+		board.BoardID,
+		url.PathEscape(marketData.ID),
+	)
+
+	loc := m.calendar.Location()
+	params := url.Values{
+		"interval": {strconv.Itoa(interval)},
+		"from":     {from.In(loc).Format(moexISSTimeLayout)},
+		// till is inclusive
+		"till": {to.Add(-time.Second).In(loc).Format(moexISSTimeLayout)},
+	}
+
+	result := make([]domain.Candle, 0)
+
+	// ISS returns a page of candles per request, an empty page is the end
+	for start := 0; ; {
+		params.Set("start", strconv.Itoa(start))
+
+		blocks, err := m.client.Get(ctx, path, params)
+		if err != nil {
+			return nil, fmt.Errorf("candles of %s: %w", marketData.ID, err)
+		}
+
+		rows := blocks["candles"].Rows()
+		if len(rows) == 0 {
+			break
+		}
+		start += len(rows)
+
+		for _, row := range rows {
+			candle, err := m.convertCandle(marketData, row)
+			if err != nil {
+				return nil, fmt.Errorf("candles of %s: %w", marketData.ID, err)
+			}
+
+			if !candle.OpenTime.Before(from) && candle.OpenTime.Before(to) {
+				result = append(result, candle)
+			}
+		}
+	}
+
+	slices.SortStableFunc(result, func(a, b domain.Candle) int {
+		return a.OpenTime.Compare(b.OpenTime)
+	})
+	result = slices.CompactFunc(result, func(a, b domain.Candle) bool {
+		return a.OpenTime.Equal(b.OpenTime)
+	})
+
+	return FilterCandlesBySession(m.calendar, marketData.SessionFilter, result), nil
+}
+
+// Primary board of the security is looked up once
+func (m *MOEXMarketDataProvider) board(ctx context.Context, secID string) (utils.MOEXBoard, error) {
+	m.mu.Lock()
+	board, ok := m.boards[secID]
+	m.mu.Unlock()
+	if ok {
+		return board, nil
+	}
+
+	boards, err := m.client.Boards(ctx, secID)
+	if err != nil {
+		return utils.MOEXBoard{}, err
+	}
+
+	index := slices.IndexFunc(boards, func(b utils.MOEXBoard) bool {
+		return b.Primary
+	})
+	if index < 0 {
+		return utils.MOEXBoard{}, fmt.Errorf("security %s has no primary board", secID)
+	}
+	board = boards[index]
+
+	m.mu.Lock()
+	m.boards[secID] = board
+	m.mu.Unlock()
+
+	return board, nil
+}
+
+// ISS "end" is the last second of the candle, close time is derived from the interval
+func (m *MOEXMarketDataProvider) convertCandle(
+	marketData domain.MarketData,
+	row utils.MOEXISSRow,
+) (domain.Candle, error) {
+	openTime, err := time.ParseInLocation(moexISSTimeLayout, row.String("begin"), m.calendar.Location())
+	if err != nil {
+		return domain.Candle{}, err
+	}
+
+	return domain.Candle{
+		MarketData: marketData,
+		OpenTime:   openTime.UTC(),
+		CloseTime: CandleCloseTime(
+			marketData.Interval,
+			openTime,
+			m.calendar.Location(),
+		).UTC(),
+		Open:   row.Float("open"),
+		High:   row.Float("high"),
+		Low:    row.Float("low"),
+		Close:  row.Float("close"),
+		Volume: row.Float("volume"),
+	}, nil
+}
+
+// ISS has only some of the intervals, others can be built by ResamplingMarketDataProvider
+func (m *MOEXMarketDataProvider) convertInterval(interval domain.MarketDataInterval) (int, error) {
+	switch interval {
+	case domain.MarketDataInterval_ONE_MINUTE:
+		return 1, nil
+	case domain.MarketDataInterval_TEN_MIN:
+		return 10, nil
+	case domain.MarketDataInterval_ONE_HOUR:
+		return 60, nil
+	case domain.MarketDataInterval_ONE_DAY:
+		return 24, nil
+	case domain.MarketDataInterval_WEEK:
+		return 7, nil
+	case domain.MarketDataInterval_MONTH:
+		return 31, nil
+	default:
+		return 0, fmt.Errorf(
+			"interval %s is not supported by MOEX ISS",
+			ConvertMarketDataIntervalToString(interval),
+		)
+	}
+}
@@ -0,0 +1,95 @@
+package marketdata
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Serves recorded ISS responses, pages after the first one are empty
+func newMOEXStandIn(t *testing.T) *httptest.Server {
+	files := map[string]string{
+		"/iss/securities/SBER.json": "securities_SBER.json",
+		"/iss/engines/stock/markets/shares/boards/TQBR/securities/SBER/candles.json": "candles_SBER_60.json",
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if filepath.Base(r.URL.Path) == "candles.json" {
+			if r.URL.Query().Get("interval") != "60" {
+				t.Errorf("unexpected interval %q", r.URL.Query().Get("interval"))
+			}
+			if r.URL.Query().Get("start") != "0" {
+				w.Write([]byte(`{"candles": {"columns": ["open", "close", "high", "low", "value", "volume", "begin", "end"], "data": []}}`))
+				return
+			}
+		}
+
+		http.ServeFile(w, r, filepath.Join("testdata", "moex", file))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestMOEXMarketDataProvider_GetCandlesByTime(t *testing.T) {
+	server := newMOEXStandIn(t)
+	provider := NewMOEXMarketDataProvider(server.URL + "/iss")
+
+	md := domain.MarketData{
+		ID:           "SBER",
+		Interval:     domain.MarketDataInterval_ONE_HOUR,
+		ProviderType: domain.MarketDataProviderType_MOEX,
+	}
+	from := time.Date(2024, time.January, 3, 10, 0, 0, 0, calendar.MoscowLocation)
+
+	candles, err := provider.GetCandlesByTime(context.Background(), md, from, from.Add(4*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 4 {
+		t.Fatalf("expected 4 candles, got %d", len(candles))
+	}
+
+	first := candles[0]
+	if !first.OpenTime.Equal(from) || !first.CloseTime.Equal(from.Add(time.Hour)) {
+		t.Errorf("unexpected candle times %v - %v", first.OpenTime, first.CloseTime)
+	}
+	if first.Open != 272.15 || first.Close != 273.01 || first.High != 273.27 || first.Low != 271.61 {
+		t.Errorf("unexpected prices %+v", first)
+	}
+	if first.Volume != 15344950 {
+		t.Errorf("unexpected volume %v", first.Volume)
+	}
+
+	candles, err = provider.GetCandlesByCount(context.Background(), md, from.Add(4*time.Hour), 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 3 || !candles[0].OpenTime.Equal(from.Add(time.Hour)) {
+		t.Fatalf("expected 3 candles from 11:00, got %d", len(candles))
+	}
+}
+
+func TestMOEXMarketDataProvider_UnsupportedInterval(t *testing.T) {
+	server := newMOEXStandIn(t)
+	provider := NewMOEXMarketDataProvider(server.URL + "/iss")
+
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_FIVE_MINUTES}
+	from := time.Date(2024, time.January, 3, 10, 0, 0, 0, calendar.MoscowLocation)
+
+	if _, err := provider.GetCandlesByTime(context.Background(), md, from, from.Add(time.Hour)); err == nil {
+		t.Fatalf("expected error for 5 minute candles")
+	}
+}
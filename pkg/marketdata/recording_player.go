@@ -0,0 +1,535 @@
+package marketdata
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// RecordingPlayerMarketDataProvider plays a recording of RecordingMarketDataProvider back
+// through the same interface: events are sent to subscribers in the recorded order and the
+// virtual clock is moved to their arrival times. History requests are answered with the recorded
+// responses to the same requests, in the recorded order. Requests the session didn't make
+// are answered with the recorded candles that are closed by the clock.
+//
+// Subscriptions and requests match recorded ones by ID, interval and session filter, the provider
+// type is the one of the subscription, so the player is registered as MarketDataProviderType_REPLAY.
+type RecordingPlayerMarketDataProvider struct {
+	events                  []recordedEvent
+	responses               []recordedResponse
+	history                 map[recordedMarketData][]domain.Candle
+	clock                   *clock.VirtualClock
+	speed                   float64
+	mu                      sync.Mutex
+	next                    int
+	candleSubscribers       *subscribers[domain.MarketData, domain.Candle]
+	candleUpdateSubscribers *subscribers[domain.MarketData, domain.Candle]
+	orderBookSubscribers    *subscribers[domain.OrderBookInfo, domain.OrderBook]
+	lastPriceSubscribers    *subscribers[domain.InstrumentInfo, domain.LastPrice]
+	tradeSubscribers        *subscribers[domain.InstrumentInfo, domain.Trade]
+}
+
+type recordedMarketData struct {
+	id            string
+	interval      domain.MarketDataInterval
+	sessionFilter domain.SessionFilter
+}
+
+func newRecordedMarketData(marketData domain.MarketData) recordedMarketData {
+	return recordedMarketData{
+		id:            marketData.ID,
+		interval:      marketData.Interval,
+		sessionFilter: marketData.SessionFilter,
+	}
+}
+
+type recordedResponse struct {
+	request recordedRequest
+	candles []domain.Candle
+	served  bool
+}
+
+// Subscription or request of a candle event, recordings without it have the one of the candle
+func (e recordedEvent) marketData() domain.MarketData {
+	if e.Request != nil {
+		return e.Request.MarketData
+	}
+	if e.Candle != nil {
+		return e.Candle.MarketData
+	}
+	if len(e.Candles) > 0 {
+		return e.Candles[0].MarketData
+	}
+
+	return domain.MarketData{}
+}
+
+// speed is one of ReplaySpeed or a multiplier of the real time, the clock starts at the first event
+func NewRecordingPlayerMarketDataProvider(path string, speed float64) (*RecordingPlayerMarketDataProvider, error) {
+	if speed < 0 {
+		return nil, fmt.Errorf("replay speed must not be negative")
+	}
+
+	events, err := readRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("recording %s is empty", path)
+	}
+
+	responses := make([]recordedResponse, 0)
+	history := make(map[recordedMarketData][]domain.Candle)
+	for _, event := range events {
+		candles := event.Candles
+		switch event.Kind {
+		case recordedEventKind_CANDLE:
+			candles = []domain.Candle{*event.Candle}
+		case recordedEventKind_HISTORY:
+			if event.Request != nil {
+				responses = append(responses, recordedResponse{request: *event.Request, candles: event.Candles})
+			}
+		default:
+			continue
+		}
+
+		key := newRecordedMarketData(event.marketData())
+		history[key] = append(history[key], candles...)
+	}
+
+	for key, candles := range history {
+		slices.SortStableFunc(candles, func(a, b domain.Candle) int {
+			return a.OpenTime.Compare(b.OpenTime)
+		})
+		history[key] = slices.CompactFunc(candles, func(a, b domain.Candle) bool {
+			return a.OpenTime.Equal(b.OpenTime)
+		})
+	}
+
+	return &RecordingPlayerMarketDataProvider{
+		events:                  events,
+		responses:               responses,
+		history:                 history,
+		clock:                   clock.NewVirtualClock(events[0].Time),
+		speed:                   speed,
+		candleSubscribers:       newSubscribers[domain.MarketData, domain.Candle]("Player candle"),
+		candleUpdateSubscribers: newSubscribers[domain.MarketData, domain.Candle]("Player candle update"),
+		orderBookSubscribers:    newSubscribers[domain.OrderBookInfo, domain.OrderBook]("Player order book"),
+		lastPriceSubscribers:    newSubscribers[domain.InstrumentInfo, domain.LastPrice]("Player last price"),
+		tradeSubscribers:        newSubscribers[domain.InstrumentInfo, domain.Trade]("Player trade"),
+	}, nil
+}
+
+func readRecording(path string) ([]recordedEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open recording: %w", err)
+	}
+	defer file.Close()
+
+	// History responses are long lines
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	result := make([]recordedEvent, 0)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event recordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("read %s: line %d: %w", path, line, err)
+		}
+
+		if (event.Kind == recordedEventKind_CANDLE || event.Kind == recordedEventKind_CANDLE_UPDATE) && event.Candle == nil ||
+			event.Kind == recordedEventKind_ORDER_BOOK && event.OrderBook == nil ||
+			event.Kind == recordedEventKind_LAST_PRICE && event.LastPrice == nil ||
+			event.Kind == recordedEventKind_TRADE && event.Trade == nil {
+			return nil, fmt.Errorf("read %s: line %d: %s event without value", path, line, event.Kind)
+		}
+
+		result = append(result, event)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return result, nil
+}
+
+// Clock to pass to services and bots that take part in the playback
+func (p *RecordingPlayerMarketDataProvider) Clock() *clock.VirtualClock {
+	return p.clock
+}
+
+func (p *RecordingPlayerMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, _ := p.candleSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		p.UnsubscribeCandles(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (p *RecordingPlayerMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.candleSubscribers.remove(marketData, ch)
+
+	return err
+}
+
+func (p *RecordingPlayerMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, _ := p.candleUpdateSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		p.UnsubscribeCandleUpdates(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (p *RecordingPlayerMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.candleUpdateSubscribers.remove(marketData, ch)
+
+	return err
+}
+
+func (p *RecordingPlayerMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, _ := p.orderBookSubscribers.add(ctx, orderBookInfo, func(ch <-chan domain.OrderBook) {
+		p.UnsubscribeOrderBook(orderBookInfo, ch)
+	})
+
+	return ch, nil
+}
+
+func (p *RecordingPlayerMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.orderBookSubscribers.remove(orderBookInfo, ch)
+
+	return err
+}
+
+func (p *RecordingPlayerMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, _ := p.lastPriceSubscribers.add(ctx, instrumentInfo, func(ch <-chan domain.LastPrice) {
+		p.UnsubscribeLastPrices(instrumentInfo, ch)
+	})
+
+	return ch, nil
+}
+
+func (p *RecordingPlayerMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.lastPriceSubscribers.remove(instrumentInfo, ch)
+
+	return err
+}
+
+func (p *RecordingPlayerMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, _ := p.tradeSubscribers.add(ctx, instrumentInfo, func(ch <-chan domain.Trade) {
+		p.UnsubscribeTrades(instrumentInfo, ch)
+	})
+
+	return ch, nil
+}
+
+func (p *RecordingPlayerMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.tradeSubscribers.remove(instrumentInfo, ch)
+
+	return err
+}
+
+func (p *RecordingPlayerMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	recorded, ok := p.response(marketData, func(request recordedRequest) bool {
+		return request.From != nil && request.From.Equal(from) && request.To.Equal(to)
+	})
+	if ok {
+		return recorded, nil
+	}
+
+	candles := p.closed(marketData)
+
+	result := make([]domain.Candle, 0)
+	for _, candle := range candles {
+		if !candle.OpenTime.Before(from) && candle.OpenTime.Before(to) {
+			result = append(result, candle)
+		}
+	}
+
+	return result, nil
+}
+
+func (p *RecordingPlayerMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	recorded, ok := p.response(marketData, func(request recordedRequest) bool {
+		return request.Last != nil && request.Last.Equal(last) && request.Count == count
+	})
+	if ok {
+		return recorded, nil
+	}
+
+	candles := p.closed(marketData)
+
+	end := len(candles)
+	for end > 0 && !candles[end-1].OpenTime.Before(last) {
+		end--
+	}
+
+	if end < count {
+		return nil, fmt.Errorf("recording has %d candles of %s before %v, %d requested", end, marketData.ID, last, count)
+	}
+
+	return candles[end-count : end], nil
+}
+
+// Recorded response to the same request, a new slice. Repeated requests get the responses
+// in the recorded order, the last one is repeated when they are over.
+func (p *RecordingPlayerMarketDataProvider) response(
+	marketData domain.MarketData,
+	match func(request recordedRequest) bool,
+) ([]domain.Candle, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := newRecordedMarketData(marketData)
+	found := -1
+	for i := range p.responses {
+		response := &p.responses[i]
+		if newRecordedMarketData(response.request.MarketData) != key || !match(response.request) {
+			continue
+		}
+
+		found = i
+		if !response.served {
+			break
+		}
+	}
+	if found == -1 {
+		return nil, false
+	}
+
+	response := &p.responses[found]
+	response.served = true
+
+	result := make([]domain.Candle, len(response.candles))
+	for i, candle := range response.candles {
+		candle.MarketData = marketData
+		result[i] = candle
+	}
+
+	return result, true
+}
+
+// Recorded candles of marketData closed by the clock, a new slice
+func (p *RecordingPlayerMarketDataProvider) closed(marketData domain.MarketData) []domain.Candle {
+	now := p.clock.Now()
+	recorded := p.history[newRecordedMarketData(marketData)]
+
+	result := make([]domain.Candle, 0, len(recorded))
+	for _, candle := range recorded {
+		if candle.CloseTime.After(now) {
+			break
+		}
+		candle.MarketData = marketData
+		result = append(result, candle)
+	}
+
+	return result
+}
+
+// Plays the rest of the recording and returns when it is over or ctx is done
+func (p *RecordingPlayerMarketDataProvider) Run(ctx context.Context) error {
+	for {
+		ok, err := p.step(ctx, true)
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+// Sends the next event at once, false when the recording is over.
+// Lets a debugger go through the session event by event.
+func (p *RecordingPlayerMarketDataProvider) Step(ctx context.Context) (bool, error) {
+	return p.step(ctx, false)
+}
+
+func (p *RecordingPlayerMarketDataProvider) step(ctx context.Context, wait bool) (bool, error) {
+	p.mu.Lock()
+	if p.next == len(p.events) {
+		p.mu.Unlock()
+		return false, p.waitDrained(ctx)
+	}
+	event := p.events[p.next]
+	p.next++
+	p.mu.Unlock()
+
+	if wait {
+		err := p.waitFor(ctx, event.Time)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	p.clock.Set(event.Time)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch event.Kind {
+	case recordedEventKind_CANDLE:
+		key := newRecordedMarketData(event.marketData())
+		notifyRecorded(p.candleSubscribers, *event.Candle, func(marketData domain.MarketData, candle *domain.Candle) bool {
+			candle.MarketData = marketData
+			return newRecordedMarketData(marketData) == key
+		})
+	case recordedEventKind_CANDLE_UPDATE:
+		key := newRecordedMarketData(event.marketData())
+		notifyRecorded(p.candleUpdateSubscribers, *event.Candle, func(marketData domain.MarketData, candle *domain.Candle) bool {
+			candle.MarketData = marketData
+			return newRecordedMarketData(marketData) == key
+		})
+	case recordedEventKind_ORDER_BOOK:
+		notifyRecorded(p.orderBookSubscribers, *event.OrderBook, func(info domain.OrderBookInfo, orderBook *domain.OrderBook) bool {
+			orderBook.Info = info
+			return info.ID == event.OrderBook.Info.ID && info.Depth == event.OrderBook.Info.Depth
+		})
+	case recordedEventKind_LAST_PRICE:
+		notifyRecorded(p.lastPriceSubscribers, *event.LastPrice, func(info domain.InstrumentInfo, lastPrice *domain.LastPrice) bool {
+			lastPrice.Info = info
+			return info.ID == event.LastPrice.Info.ID
+		})
+	case recordedEventKind_TRADE:
+		notifyRecorded(p.tradeSubscribers, *event.Trade, func(info domain.InstrumentInfo, trade *domain.Trade) bool {
+			trade.Info = info
+			return info.ID == event.Trade.Info.ID
+		})
+	}
+
+	return true, nil
+}
+
+// match sets the key of the subscription to the value and tells whether the value is for it
+func notifyRecorded[K comparable, V any](subscribers *subscribers[K, V], value V, match func(key K, value *V) bool) {
+	for _, key := range subscribers.keys() {
+		if match(key, &value) {
+			subscribers.notify(key, value)
+		}
+	}
+}
+
+// Sleeps the real time of the gap to the event,
+// at max speed waits until subscribers take the previous events
+func (p *RecordingPlayerMarketDataProvider) waitFor(ctx context.Context, at time.Time) error {
+	if p.speed == ReplaySpeedMax {
+		return p.waitDrained(ctx)
+	}
+
+	gap := at.Sub(p.clock.Now())
+	if gap <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(time.Duration(float64(gap) / p.speed))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (p *RecordingPlayerMarketDataProvider) waitDrained(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		queued := p.candleSubscribers.queued() +
+			p.candleUpdateSubscribers.queued() +
+			p.orderBookSubscribers.queued() +
+			p.lastPriceSubscribers.queued() +
+			p.tradeSubscribers.queued()
+		p.mu.Unlock()
+
+		if queued == 0 {
+			return ctx.Err()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(replayDrainCheckInterval):
+		}
+	}
+}
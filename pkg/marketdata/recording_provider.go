@@ -0,0 +1,314 @@
+package marketdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Recording is a JSON lines file, one event per line in order of arrival:
+//
+//	{"time":"2024-03-12T07:00:00.12Z","kind":"candle","candle":{...}}
+//
+// time is the arrival at the recorder. History responses are recorded with their requests,
+// so a player answers the warm-up requests of bots with the same candles the live provider did.
+// Candle events keep the subscription they were delivered to, e.g. with its session filter.
+type recordedEventKind string
+
+const (
+	recordedEventKind_CANDLE        recordedEventKind = "candle"
+	recordedEventKind_CANDLE_UPDATE recordedEventKind = "candle_update"
+	recordedEventKind_HISTORY       recordedEventKind = "history"
+	recordedEventKind_ORDER_BOOK    recordedEventKind = "order_book"
+	recordedEventKind_LAST_PRICE    recordedEventKind = "last_price"
+	recordedEventKind_TRADE         recordedEventKind = "trade"
+)
+
+type recordedEvent struct {
+	Time      time.Time         `json:"time"`
+	Kind      recordedEventKind `json:"kind"`
+	Request   *recordedRequest  `json:"request,omitempty"`
+	Candle    *domain.Candle    `json:"candle,omitempty"`
+	Candles   []domain.Candle   `json:"candles,omitempty"`
+	OrderBook *domain.OrderBook `json:"order_book,omitempty"`
+	LastPrice *domain.LastPrice `json:"last_price,omitempty"`
+	Trade     *domain.Trade     `json:"trade,omitempty"`
+}
+
+// History request or candle subscription, by time requests have From and To,
+// by count ones have Last and Count
+type recordedRequest struct {
+	MarketData domain.MarketData `json:"market_data"`
+	From       *time.Time        `json:"from,omitempty"`
+	To         *time.Time        `json:"to,omitempty"`
+	Last       *time.Time        `json:"last,omitempty"`
+	Count      int               `json:"count,omitempty"`
+}
+
+// RecordingMarketDataProvider passes everything of the source through
+// and appends delivered candles, events and history responses to a recording,
+// see RecordingPlayerMarketDataProvider to play it back.
+type RecordingMarketDataProvider struct {
+	source MarketDataProvider
+	clock  clock.Clock
+	mu     sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	// Cancels the source subscription of a returned channel
+	subscriptions map[any]context.CancelFunc
+}
+
+// Events are appended to path, the file is created if it doesn't exist
+func NewRecordingMarketDataProvider(source MarketDataProvider, path string) (*RecordingMarketDataProvider, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open recording: %w", err)
+	}
+
+	return &RecordingMarketDataProvider{
+		source:        source,
+		clock:         clock.Real,
+		file:          file,
+		enc:           json.NewEncoder(file),
+		subscriptions: make(map[any]context.CancelFunc),
+	}, nil
+}
+
+// Arrival times are taken from the clock
+func (r *RecordingMarketDataProvider) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// Stops recording, subscriptions keep passing the source through
+func (r *RecordingMarketDataProvider) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
+
+// Every event is one write, so a crash loses at most the event being written
+func (r *RecordingMarketDataProvider) record(event recordedEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	event.Time = r.clock.Now()
+	if err := r.enc.Encode(event); err != nil {
+		log.Printf("Error recording %s: %v", event.Kind, err)
+	}
+}
+
+func (r *RecordingMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return recordStream(r, ctx, func(ctx context.Context) (<-chan domain.Candle, error) {
+		return r.source.SubscribeCandles(ctx, marketData)
+	}, func(candle domain.Candle) recordedEvent {
+		return recordedEvent{
+			Kind:    recordedEventKind_CANDLE,
+			Request: &recordedRequest{MarketData: marketData},
+			Candle:  &candle,
+		}
+	})
+}
+
+func (r *RecordingMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return r.unsubscribe(ch)
+}
+
+func (r *RecordingMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return recordStream(r, ctx, func(ctx context.Context) (<-chan domain.Candle, error) {
+		return r.source.SubscribeCandleUpdates(ctx, marketData)
+	}, func(candle domain.Candle) recordedEvent {
+		return recordedEvent{
+			Kind:    recordedEventKind_CANDLE_UPDATE,
+			Request: &recordedRequest{MarketData: marketData},
+			Candle:  &candle,
+		}
+	})
+}
+
+func (r *RecordingMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return r.unsubscribe(ch)
+}
+
+func (r *RecordingMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	return recordStream(r, ctx, func(ctx context.Context) (<-chan domain.OrderBook, error) {
+		return r.source.SubscribeOrderBook(ctx, orderBookInfo)
+	}, func(orderBook domain.OrderBook) recordedEvent {
+		return recordedEvent{Kind: recordedEventKind_ORDER_BOOK, OrderBook: &orderBook}
+	})
+}
+
+func (r *RecordingMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	return r.unsubscribe(ch)
+}
+
+func (r *RecordingMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	return recordStream(r, ctx, func(ctx context.Context) (<-chan domain.LastPrice, error) {
+		return r.source.SubscribeLastPrices(ctx, instrumentInfo)
+	}, func(lastPrice domain.LastPrice) recordedEvent {
+		return recordedEvent{Kind: recordedEventKind_LAST_PRICE, LastPrice: &lastPrice}
+	})
+}
+
+func (r *RecordingMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	return r.unsubscribe(ch)
+}
+
+func (r *RecordingMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	return recordStream(r, ctx, func(ctx context.Context) (<-chan domain.Trade, error) {
+		return r.source.SubscribeTrades(ctx, instrumentInfo)
+	}, func(trade domain.Trade) recordedEvent {
+		return recordedEvent{Kind: recordedEventKind_TRADE, Trade: &trade}
+	})
+}
+
+func (r *RecordingMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	return r.unsubscribe(ch)
+}
+
+func (r *RecordingMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	candles, err := r.source.GetCandlesByTime(ctx, marketData, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	r.record(recordedEvent{
+		Kind:    recordedEventKind_HISTORY,
+		Request: &recordedRequest{MarketData: marketData, From: &from, To: &to},
+		Candles: candles,
+	})
+
+	return candles, nil
+}
+
+func (r *RecordingMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	candles, err := r.source.GetCandlesByCount(ctx, marketData, last, count)
+	if err != nil {
+		return nil, err
+	}
+
+	r.record(recordedEvent{
+		Kind:    recordedEventKind_HISTORY,
+		Request: &recordedRequest{MarketData: marketData, Last: &last, Count: count},
+		Candles: candles,
+	})
+
+	return candles, nil
+}
+
+// Source subscription ends by its own child ctx, when it closes the channel
+// the returned channel is closed too
+func recordStream[T any](
+	r *RecordingMarketDataProvider,
+	ctx context.Context,
+	subscribe func(ctx context.Context) (<-chan T, error),
+	event func(value T) recordedEvent,
+) (<-chan T, error) {
+	sourceCtx, cancel := context.WithCancel(ctx)
+
+	source, err := subscribe(sourceCtx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ch := make(chan T, subscriberBufferSize)
+
+	r.mu.Lock()
+	r.subscriptions[(<-chan T)(ch)] = cancel
+	r.mu.Unlock()
+
+	go func() {
+		defer close(ch)
+		defer func() {
+			r.mu.Lock()
+			delete(r.subscriptions, (<-chan T)(ch))
+			r.mu.Unlock()
+			cancel()
+		}()
+
+		for value := range source {
+			r.record(event(value))
+
+			select {
+			case ch <- value:
+			case <-sourceCtx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (r *RecordingMarketDataProvider) unsubscribe(ch any) error {
+	r.mu.Lock()
+	cancel, ok := r.subscriptions[ch]
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("undefined subscriber")
+	}
+
+	cancel()
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package marketdata
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestRecordingMarketDataProvider_PlaysBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	source := &streamingProvider{channels: make(map[domain.MarketData]chan domain.Candle)}
+
+	recorder, err := NewRecordingMarketDataProvider(source, path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2024, time.March, 12, 10, 0, 0, 0, time.UTC)
+	virtualClock := clock.NewVirtualClock(start)
+	recorder.SetClock(virtualClock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR, ProviderType: domain.MarketDataProviderType_TINKOFF}
+
+	// Warm-up of a bot
+	if _, err := recorder.GetCandlesByCount(ctx, md, start, 5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ch, err := recorder.SubscribeCandles(ctx, md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		openTime := start.Add(time.Duration(i) * time.Hour)
+		virtualClock.Set(openTime.Add(time.Hour + time.Second))
+		source.send(domain.Candle{MarketData: md, OpenTime: openTime, CloseTime: openTime.Add(time.Hour), Close: float64(100 + i)})
+
+		select {
+		case candle := <-ch:
+			if candle.Close != float64(100+i) {
+				t.Fatalf("unexpected candle %+v", candle)
+			}
+		case <-ctx.Done():
+			t.Fatalf("candle %d is not passed through", i)
+		}
+	}
+
+	if err := recorder.UnsubscribeCandles(md, ch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Errorf("channel is not closed")
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	player, err := NewRecordingPlayerMarketDataProvider(path, ReplaySpeedMax)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !player.Clock().Now().Equal(start) {
+		t.Fatalf("expected clock at the first event, got %v", player.Clock().Now())
+	}
+
+	replayMD := md
+	replayMD.ProviderType = domain.MarketDataProviderType_REPLAY
+
+	history, err := player.GetCandlesByCount(ctx, replayMD, start, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(history) != 5 || !history[4].CloseTime.Equal(start) || history[4].MarketData != replayMD {
+		t.Fatalf("unexpected warm-up history %+v", history)
+	}
+
+	played, err := player.SubscribeCandles(ctx, replayMD)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// History event of the warm-up
+	if ok, err := player.Step(ctx); !ok || err != nil {
+		t.Fatalf("unexpected step result %v %v", ok, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, err := player.Step(ctx); !ok || err != nil {
+			t.Fatalf("unexpected step result %v %v", ok, err)
+		}
+
+		candle := <-played
+		arrival := start.Add(time.Duration(i+1)*time.Hour + time.Second)
+		if candle.Close != float64(100+i) || candle.MarketData != replayMD || !player.Clock().Now().Equal(arrival) {
+			t.Fatalf("unexpected candle %+v at %v", candle, player.Clock().Now())
+		}
+
+		// Streamed candles are in the history once they are played
+		candles, err := player.GetCandlesByTime(ctx, replayMD, start, start.Add(10*time.Hour))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(candles) != i+1 {
+			t.Fatalf("expected %d candles in the history, got %d", i+1, len(candles))
+		}
+	}
+
+	if ok, err := player.Step(ctx); ok || err != nil {
+		t.Fatalf("expected end of the recording, got %v %v", ok, err)
+	}
+}
+
+func TestRecordingPlayerMarketDataProvider_Requests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	start := time.Date(2024, time.March, 12, 10, 0, 0, 0, time.UTC)
+
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+	mainMD := md
+	mainMD.SessionFilter = domain.SessionFilter_MAIN
+
+	candle := func(marketData domain.MarketData, hoursAgo int, close float64) domain.Candle {
+		openTime := start.Add(-time.Duration(hoursAgo) * time.Hour)
+		return domain.Candle{MarketData: marketData, OpenTime: openTime, CloseTime: openTime.Add(time.Hour), Close: close}
+	}
+	last := start
+	from := start.Add(-2 * time.Hour)
+	streamed := candle(md, 0, 8)
+	streamedMain := candle(mainMD, 0, 7)
+
+	events := []recordedEvent{
+		{Kind: recordedEventKind_HISTORY, Request: &recordedRequest{MarketData: md, Last: &last, Count: 2},
+			Candles: []domain.Candle{candle(md, 2, 1), candle(md, 1, 2)}},
+		// The same request later got revised candles
+		{Kind: recordedEventKind_HISTORY, Request: &recordedRequest{MarketData: md, Last: &last, Count: 2},
+			Candles: []domain.Candle{candle(md, 2, 10), candle(md, 1, 20)}},
+		{Kind: recordedEventKind_HISTORY, Request: &recordedRequest{MarketData: mainMD, From: &from, To: &start},
+			Candles: []domain.Candle{candle(md, 1, 5)}},
+		{Kind: recordedEventKind_CANDLE, Request: &recordedRequest{MarketData: mainMD}, Candle: &streamedMain},
+		{Kind: recordedEventKind_CANDLE, Request: &recordedRequest{MarketData: md}, Candle: &streamed},
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	enc := json.NewEncoder(file)
+	for i, event := range events {
+		event.Time = start.Add(time.Duration(i) * time.Minute)
+		if err := enc.Encode(event); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	file.Close()
+
+	player, err := NewRecordingPlayerMarketDataProvider(path, ReplaySpeedMax)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	closes := func(candles []domain.Candle) []float64 {
+		result := make([]float64, 0, len(candles))
+		for _, candle := range candles {
+			result = append(result, candle.Close)
+		}
+		return result
+	}
+
+	// Responses of the same request in the recorded order, the last one is repeated
+	for i, expected := range [][]float64{{1, 2}, {10, 20}, {10, 20}} {
+		candles, err := player.GetCandlesByCount(ctx, md, start, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !slices.Equal(closes(candles), expected) {
+			t.Fatalf("request %d: expected %v, got %v", i, expected, closes(candles))
+		}
+	}
+
+	candles, err := player.GetCandlesByTime(ctx, mainMD, from, start)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(closes(candles), []float64{5}) || candles[0].MarketData != mainMD {
+		t.Fatalf("unexpected main session response %+v", candles)
+	}
+
+	// Not recorded request is answered from the candles of the same session filter
+	candles, err = player.GetCandlesByCount(ctx, mainMD, start, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(closes(candles), []float64{5}) {
+		t.Fatalf("unexpected main session candles %v", closes(candles))
+	}
+
+	all, err := player.SubscribeCandles(ctx, md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	main, err := player.SubscribeCandles(ctx, mainMD)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for range events {
+		if ok, err := player.Step(ctx); !ok || err != nil {
+			t.Fatalf("unexpected step result %v %v", ok, err)
+		}
+	}
+
+	if candle := <-main; candle.Close != 7 || candle.MarketData != mainMD {
+		t.Errorf("unexpected main session candle %+v", candle)
+	}
+	if candle := <-all; candle.Close != 8 || candle.MarketData != md {
+		t.Errorf("unexpected candle %+v", candle)
+	}
+	select {
+	case candle := <-all:
+		t.Errorf("unexpected candle of another session filter %+v", candle)
+	case candle := <-main:
+		t.Errorf("unexpected candle of another session filter %+v", candle)
+	default:
+	}
+}
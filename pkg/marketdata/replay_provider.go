@@ -0,0 +1,235 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Speeds of the replay, other positive values multiply the real time, e.g. 60 replays an hour in a minute
+const (
+	ReplaySpeedMax      = 0.0
+	ReplaySpeedRealTime = 1.0
+)
+
+// How often the replay at max speed checks that subscribers took the previous candle
+const replayDrainCheckInterval = time.Millisecond
+
+// ReplayMarketDataProvider sends historical candles of the source through SubscribeCandles
+// as if they were closing now. The virtual clock follows the replay: before a candle
+// is sent the clock is moved to its CloseTime.
+// History requests don't see candles after the clock.
+type ReplayMarketDataProvider struct {
+	candlesOnlyProvider
+	source            MarketDataProvider
+	clock             *clock.VirtualClock
+	from              time.Time
+	to                time.Time
+	speed             float64
+	mu                sync.Mutex
+	candleSubscribers *subscribers[domain.MarketData, domain.Candle]
+	started           bool
+}
+
+// Candles closing in [from, to] are replayed, the clock starts at from
+func NewReplayMarketDataProvider(
+	source MarketDataProvider,
+	from time.Time,
+	to time.Time,
+	speed float64,
+) (*ReplayMarketDataProvider, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("replay range is empty")
+	}
+	if speed < 0 {
+		return nil, fmt.Errorf("replay speed must not be negative")
+	}
+
+	return &ReplayMarketDataProvider{
+		candlesOnlyProvider: candlesOnlyProvider{name: "replay"},
+		source:              source,
+		clock:               clock.NewVirtualClock(from),
+		from:                from,
+		to:                  to,
+		speed:               speed,
+		candleSubscribers:   newSubscribers[domain.MarketData, domain.Candle]("Replay candle"),
+	}, nil
+}
+
+// Clock to pass to services and bots that take part in the replay
+func (r *ReplayMarketDataProvider) Clock() *clock.VirtualClock {
+	return r.clock
+}
+
+func (r *ReplayMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, _ := r.candleSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		r.UnsubscribeCandles(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (r *ReplayMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.candleSubscribers.remove(marketData, ch)
+
+	return err
+}
+
+func (r *ReplayMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	now := r.clock.Now()
+	to = minTime(to, now)
+	if !from.Before(to) {
+		return make([]domain.Candle, 0), nil
+	}
+
+	candles, err := r.source.GetCandlesByTime(ctx, marketData, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.closedBy(candles, now), nil
+}
+
+func (r *ReplayMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	now := r.clock.Now()
+	last = minTime(last, now)
+
+	candles, err := r.source.GetCandlesByCount(ctx, marketData, last, count)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clock is inside the last candle, it is still forming
+	if len(candles) > 0 && candles[len(candles)-1].CloseTime.After(now) {
+		candles, err = r.source.GetCandlesByCount(ctx, marketData, last, count+1)
+		if err != nil {
+			return nil, err
+		}
+		candles = candles[:len(candles)-1]
+	}
+
+	return candles, nil
+}
+
+// Candles that are closed at now
+func (r *ReplayMarketDataProvider) closedBy(candles []domain.Candle, now time.Time) []domain.Candle {
+	return slices.DeleteFunc(candles, func(candle domain.Candle) bool {
+		return candle.CloseTime.After(now)
+	})
+}
+
+// Replays candles of the current subscriptions and returns when they are over or ctx is done.
+// Subscriptions made after the start don't get candles, the replay runs once.
+func (r *ReplayMarketDataProvider) Run(ctx context.Context) error {
+	r.mu.Lock()
+	if r.started {
+		r.mu.Unlock()
+		return fmt.Errorf("replay is already started")
+	}
+	r.started = true
+	subscribed := r.candleSubscribers.keys()
+	r.mu.Unlock()
+
+	candles := make([]domain.Candle, 0)
+	for _, marketData := range subscribed {
+		history, err := r.source.GetCandlesByTime(ctx, marketData, r.from, r.to)
+		if err != nil {
+			return err
+		}
+
+		for _, candle := range history {
+			if candle.CloseTime.After(r.from) && !candle.CloseTime.After(r.to) {
+				candle.MarketData = marketData
+				candles = append(candles, candle)
+			}
+		}
+	}
+
+	// Candles of different instruments closing at the same time keep the order of subscriptions
+	slices.SortStableFunc(candles, func(a, b domain.Candle) int {
+		return a.CloseTime.Compare(b.CloseTime)
+	})
+
+	for _, candle := range candles {
+		err := r.waitFor(ctx, candle.CloseTime)
+		if err != nil {
+			return err
+		}
+
+		r.clock.Set(candle.CloseTime)
+
+		r.mu.Lock()
+		r.candleSubscribers.notify(candle.MarketData, candle)
+		r.mu.Unlock()
+	}
+
+	return r.waitDrained(ctx)
+}
+
+// Sleeps the real time of the gap to the candle,
+// at max speed waits until subscribers take the previous candles
+func (r *ReplayMarketDataProvider) waitFor(ctx context.Context, closeTime time.Time) error {
+	if r.speed == ReplaySpeedMax {
+		return r.waitDrained(ctx)
+	}
+
+	gap := closeTime.Sub(r.clock.Now())
+	if gap <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(time.Duration(float64(gap) / r.speed))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (r *ReplayMarketDataProvider) waitDrained(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		queued := r.candleSubscribers.queued()
+		r.mu.Unlock()
+
+		if queued == 0 {
+			return ctx.Err()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(replayDrainCheckInterval):
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package marketdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestReplayMarketDataProvider_ReplaysByClock(t *testing.T) {
+	start := time.Date(2024, time.January, 3, 0, 0, 0, 0, time.UTC)
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+
+	replay, err := NewReplayMarketDataProvider(&countingProvider{}, start, start.Add(5*time.Hour), ReplaySpeedMax)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ch, err := replay.SubscribeCandles(ctx, md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// History stops at the clock
+	candles, err := replay.GetCandlesByTime(ctx, md, start.Add(-10*time.Hour), start.Add(10*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 10 {
+		t.Fatalf("expected 10 candles before the replay, got %d", len(candles))
+	}
+
+	// At max speed the next candle is sent when subscribers took the previous one
+	done := make(chan error, 1)
+	go func() {
+		done <- replay.Run(ctx)
+	}()
+
+	for i := 1; i <= 5; i++ {
+		select {
+		case candle := <-ch:
+			if !candle.CloseTime.Equal(start.Add(time.Duration(i) * time.Hour)) {
+				t.Fatalf("candle %d: unexpected close time %s", i, candle.CloseTime)
+			}
+		case <-ctx.Done():
+			t.Fatalf("candle %d is not replayed", i)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !replay.Clock().Now().Equal(start.Add(5 * time.Hour)) {
+		t.Errorf("expected clock at the last candle, got %s", replay.Clock().Now())
+	}
+
+	candles, err = replay.GetCandlesByCount(ctx, md, start.Add(10*time.Hour), 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !candles[2].CloseTime.Equal(start.Add(5 * time.Hour)) {
+		t.Errorf("expected last candle to close at the clock, got %s", candles[2].CloseTime)
+	}
+
+	if err := replay.Run(ctx); err == nil {
+		t.Errorf("expected error running the replay twice")
+	}
+}
+
+func TestReplayMarketDataProvider_Speed(t *testing.T) {
+	start := time.Date(2024, time.January, 3, 0, 0, 0, 0, time.UTC)
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+
+	// An hour of candles takes 20ms
+	speed := float64(time.Hour / (20 * time.Millisecond))
+	replay, err := NewReplayMarketDataProvider(&countingProvider{}, start, start.Add(3*time.Hour), speed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ch, err := replay.SubscribeCandles(context.Background(), md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go func() {
+		for range ch {
+		}
+	}()
+
+	began := time.Now()
+	if err := replay.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if elapsed := time.Since(began); elapsed < 60*time.Millisecond {
+		t.Errorf("replay of 3 hours took %s, expected at least 60ms", elapsed)
+	}
+}
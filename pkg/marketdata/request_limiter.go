@@ -0,0 +1,46 @@
+package marketdata
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// requestLimiter spreads requests evenly to stay within the quota of count requests per period
+type requestLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRequestLimiter(count int, period time.Duration) *requestLimiter {
+	return &requestLimiter{
+		interval: period / time.Duration(count),
+	}
+}
+
+// Blocks until the next request is allowed or ctx is done
+func (l *requestLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,200 @@
+package marketdata
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Resampler builds candles of a higher interval from closed candles of a lower one.
+// A bar is closed when a candle of the next bar comes or when source candles
+// reach the end of trading inside the bar, e.g. the main session close for an hour
+// bar that has no evening trading, so bars don't wait for the next session.
+// Source candles outside the sessions of the target session filter are skipped.
+// Not safe for concurrent use.
+type Resampler struct {
+	cal    calendar.Calendar
+	target domain.MarketData
+	bar    *resamplerBar
+}
+
+type resamplerBar struct {
+	candle domain.Candle
+	// Close time of the last source candle
+	last time.Time
+	// After it the calendar has no trading until the end of the bar
+	tradingEnd time.Time
+}
+
+func NewResampler(cal calendar.Calendar, target domain.MarketData) *Resampler {
+	return &Resampler{
+		cal:    SessionCalendar(cal, target.SessionFilter),
+		target: target,
+	}
+}
+
+// Adds a closed source candle and returns bars closed by it.
+// Candles older than the forming bar or already added are skipped.
+func (r *Resampler) Add(candle domain.Candle) []domain.Candle {
+	closed := make([]domain.Candle, 0)
+
+	if r.target.SessionFilter != domain.SessionFilter_ALL && !candleInSessions(r.cal, candle) {
+		return closed
+	}
+
+	if r.bar != nil {
+		if candle.OpenTime.Before(r.bar.last) {
+			return closed
+		}
+
+		if !candle.OpenTime.Before(r.bar.candle.CloseTime) {
+			closed = append(closed, r.closeBar())
+		}
+	}
+
+	if r.bar == nil {
+		start, end := CandleBounds(r.target.Interval, candle.OpenTime, r.cal.Location())
+		r.bar = &resamplerBar{
+			candle: domain.Candle{
+				MarketData: r.target,
+				Open:       candle.Open,
+				High:       candle.High,
+				Low:        candle.Low,
+				OpenTime:   start,
+				CloseTime:  end,
+			},
+			tradingEnd: tradingEnd(r.cal, start, end),
+		}
+	}
+
+	bar := r.bar
+	bar.candle.High = max(bar.candle.High, candle.High)
+	bar.candle.Low = min(bar.candle.Low, candle.Low)
+	bar.candle.Close = candle.Close
+	bar.candle.Volume += candle.Volume
+	bar.last = candle.CloseTime
+
+	// The source trades outside the calendar, the bar lasts until its end
+	if candle.CloseTime.After(bar.tradingEnd) {
+		bar.tradingEnd = bar.candle.CloseTime
+	}
+
+	if !bar.last.Before(bar.tradingEnd) {
+		closed = append(closed, r.closeBar())
+	}
+
+	return closed
+}
+
+// Closes the forming bar if now is past the end of its trading,
+// e.g. when the last minutes of the session had no trades
+func (r *Resampler) Close(now time.Time) (domain.Candle, bool) {
+	if r.bar == nil || now.Before(r.bar.tradingEnd) {
+		return domain.Candle{}, false
+	}
+
+	return r.closeBar(), true
+}
+
+// The bar being built with Partial set
+func (r *Resampler) Forming() (domain.Candle, bool) {
+	if r.bar == nil {
+		return domain.Candle{}, false
+	}
+
+	candle := r.bar.candle
+	candle.Partial = true
+
+	return candle, true
+}
+
+// Time when the forming bar closes without new candles
+func (r *Resampler) Deadline() (time.Time, bool) {
+	if r.bar == nil {
+		return time.Time{}, false
+	}
+
+	return r.bar.tradingEnd, true
+}
+
+func (r *Resampler) closeBar() domain.Candle {
+	candle := r.bar.candle
+	r.bar = nil
+
+	return candle
+}
+
+// Resamples candles sorted by OpenTime that cover the source up to until.
+// The last bar is returned only if until is past the end of its trading,
+// otherwise it is still forming.
+func ResampleCandles(
+	cal calendar.Calendar,
+	candles []domain.Candle,
+	target domain.MarketData,
+	until time.Time,
+) []domain.Candle {
+	resampler := NewResampler(cal, target)
+
+	result := make([]domain.Candle, 0)
+	for _, candle := range candles {
+		result = append(result, resampler.Add(candle)...)
+	}
+
+	if candle, ok := resampler.Close(until); ok {
+		result = append(result, candle)
+	}
+
+	return result
+}
+
+// Checks that every bar of target consists of whole candles of source
+func CanResample(source domain.MarketDataInterval, target domain.MarketDataInterval) error {
+	sourceStep := ConvertMarketDataIntervalToTime(source)
+	targetStep := ConvertMarketDataIntervalToTime(target)
+	if sourceStep == 0 || targetStep == 0 {
+		return fmt.Errorf("undefined interval")
+	}
+	if sourceStep >= targetStep {
+		return fmt.Errorf("%s candles can't be built from %s candles",
+			ConvertMarketDataIntervalToString(target), ConvertMarketDataIntervalToString(source))
+	}
+
+	switch target {
+	case domain.MarketDataInterval_ONE_DAY, domain.MarketDataInterval_WEEK:
+		targetStep = 24 * time.Hour
+	case domain.MarketDataInterval_MONTH:
+		// Weeks cross month boundaries
+		if source == domain.MarketDataInterval_WEEK {
+			return fmt.Errorf("month candles can't be built from week candles")
+		}
+		targetStep = 24 * time.Hour
+	}
+
+	if source == domain.MarketDataInterval_ONE_DAY {
+		return nil
+	}
+	if targetStep%sourceStep != 0 {
+		return fmt.Errorf("%s candles can't be built from %s candles",
+			ConvertMarketDataIntervalToString(target), ConvertMarketDataIntervalToString(source))
+	}
+
+	return nil
+}
+
+// Last moment of trading in [start, end), start if the calendar has no sessions there
+func tradingEnd(cal calendar.Calendar, start time.Time, end time.Time) time.Time {
+	result := start
+
+	// Evening session of the previous day may last past midnight
+	for day := calendar.StartOfDay(cal, start).AddDate(0, 0, -1); day.Before(end); day = day.AddDate(0, 0, 1) {
+		for _, session := range cal.Sessions(day) {
+			if session.Open.Before(end) && session.Close.After(start) {
+				result = maxTime(result, minTime(session.Close, end))
+			}
+		}
+	}
+
+	return result
+}
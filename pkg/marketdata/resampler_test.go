@@ -0,0 +1,252 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Minute candles of the MOEX sessions of the day, Close is the minute of the day
+func sessionMinutes(cal calendar.Calendar, day time.Time) []domain.Candle {
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_MINUTE}
+
+	result := make([]domain.Candle, 0)
+	for _, session := range cal.Sessions(day) {
+		for t := session.Open; t.Before(session.Close); t = t.Add(time.Minute) {
+			local := t.In(calendar.MoscowLocation)
+			price := float64(local.Hour()*60 + local.Minute())
+			result = append(result, domain.Candle{
+				MarketData: md,
+				Open:       price,
+				High:       price + 0.5,
+				Low:        price - 0.5,
+				Close:      price,
+				Volume:     1,
+				OpenTime:   t,
+				CloseTime:  t.Add(time.Minute),
+			})
+		}
+	}
+
+	return result
+}
+
+func TestResampleCandles(t *testing.T) {
+	cal := calendar.NewMOEXCalendar()
+	day := time.Date(2024, time.January, 10, 0, 0, 0, 0, calendar.MoscowLocation)
+	candles := sessionMinutes(cal, day)
+
+	hours := ResampleCandles(cal, candles, domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}, day.Add(24*time.Hour))
+	// 09:00-18:00 of the main session and 19:00-23:00 of the evening one
+	if len(hours) != 15 {
+		t.Fatalf("expected 15 hour candles, got %d", len(hours))
+	}
+
+	first := hours[0]
+	if !first.OpenTime.Equal(day.Add(9*time.Hour)) || first.Open != 9*60+50 || first.Close != 9*60+59 || first.Volume != 10 {
+		t.Errorf("unexpected first candle: %+v", first)
+	}
+
+	beforeBreak := hours[9]
+	if !beforeBreak.OpenTime.Equal(day.Add(18*time.Hour)) || beforeBreak.Close != 18*60+49 || beforeBreak.Volume != 50 {
+		t.Errorf("unexpected candle before the break: %+v", beforeBreak)
+	}
+
+	days := ResampleCandles(cal, candles, domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_DAY}, day.Add(24*time.Hour))
+	if len(days) != 1 {
+		t.Fatalf("expected 1 day candle, got %d", len(days))
+	}
+	if days[0].High != 23*60+49.5 || days[0].Low != 9*60+49.5 || days[0].Volume != float64(len(candles)) {
+		t.Errorf("unexpected day candle: %+v", days[0])
+	}
+
+	// The day is not over yet
+	days = ResampleCandles(cal, candles[:100], domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_DAY}, candles[99].CloseTime)
+	if len(days) != 0 {
+		t.Errorf("expected forming day candle not to be returned, got %v", days)
+	}
+}
+
+func TestResampler_ClosesAtSessionEnd(t *testing.T) {
+	cal := calendar.NewMOEXCalendar()
+	day := time.Date(2024, time.January, 10, 0, 0, 0, 0, calendar.MoscowLocation)
+	candles := sessionMinutes(cal, day)
+
+	resampler := NewResampler(cal, domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR})
+
+	for _, candle := range candles {
+		closed := resampler.Add(candle)
+
+		// Hour 18:00 has no evening trading, it closes with the last candle of the main session
+		if candle.CloseTime.Equal(day.Add(18*time.Hour + 50*time.Minute)) {
+			if len(closed) != 1 || !closed[0].OpenTime.Equal(day.Add(18*time.Hour)) {
+				t.Fatalf("expected hour 18:00 to close at the session end, got %v", closed)
+			}
+			if _, ok := resampler.Forming(); ok {
+				t.Fatalf("expected no forming candle between sessions")
+			}
+			return
+		}
+	}
+
+	t.Fatalf("main session close not found")
+}
+
+func TestCanResample(t *testing.T) {
+	tests := []struct {
+		source domain.MarketDataInterval
+		target domain.MarketDataInterval
+		ok     bool
+	}{
+		{domain.MarketDataInterval_ONE_MINUTE, domain.MarketDataInterval_FIVE_MINUTES, true},
+		{domain.MarketDataInterval_ONE_MINUTE, domain.MarketDataInterval_MONTH, true},
+		{domain.MarketDataInterval_ONE_DAY, domain.MarketDataInterval_WEEK, true},
+		{domain.MarketDataInterval_THREE_MIN, domain.MarketDataInterval_TEN_MIN, false},
+		{domain.MarketDataInterval_ONE_HOUR, domain.MarketDataInterval_ONE_HOUR, false},
+		{domain.MarketDataInterval_WEEK, domain.MarketDataInterval_MONTH, false},
+	}
+
+	for _, test := range tests {
+		err := CanResample(test.source, test.target)
+		if (err == nil) != test.ok {
+			t.Errorf("%v -> %v: unexpected result %v", test.source, test.target, err)
+		}
+	}
+}
+
+// Streams candles sent to it, counts subscriptions
+type streamingProvider struct {
+	countingProvider
+	mu            sync.Mutex
+	subscriptions int
+	channels      map[domain.MarketData]chan domain.Candle
+}
+
+func (p *streamingProvider) SubscribeCandles(ctx context.Context, md domain.MarketData) (<-chan domain.Candle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.channels[md]; ok {
+		return nil, fmt.Errorf("already subscribed")
+	}
+
+	ch := make(chan domain.Candle, subscriberBufferSize)
+	p.channels[md] = ch
+	p.subscriptions++
+
+	context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		delete(p.channels, md)
+		close(ch)
+	})
+
+	return ch, nil
+}
+
+func (p *streamingProvider) send(candle domain.Candle) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.channels[candle.MarketData] <- candle
+}
+
+func TestResamplingMarketDataProvider_Subscribe(t *testing.T) {
+	cal := calendar.NewMOEXCalendar()
+	source := &streamingProvider{channels: make(map[domain.MarketData]chan domain.Candle)}
+	provider := NewResamplingMarketDataProvider(source, domain.MarketDataInterval_ONE_MINUTE, cal)
+
+	day := time.Date(2024, time.January, 10, 0, 0, 0, 0, calendar.MoscowLocation)
+	virtualClock := clock.NewVirtualClock(day)
+	provider.SetClock(virtualClock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fiveMinutes, err := provider.SubscribeCandles(ctx, domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_FIVE_MINUTES})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hours, err := provider.SubscribeCandles(ctx, domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if source.subscriptions != 1 {
+		t.Fatalf("expected one source subscription, got %d", source.subscriptions)
+	}
+
+	// 09:50 - 11:00
+	candles := sessionMinutes(cal, day)
+	for _, candle := range candles[:70] {
+		source.send(candle)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case bar := <-hours:
+			if !bar.OpenTime.Equal(day.Add(time.Duration(9+i)*time.Hour)) || bar.Partial {
+				t.Errorf("unexpected hour candle: %+v", bar)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("hour candle %d not received", i)
+		}
+	}
+
+	for i := 0; i < 14; i++ {
+		select {
+		case bar := <-fiveMinutes:
+			if bar.Volume != 5 {
+				t.Errorf("unexpected five minutes candle: %+v", bar)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("five minutes candle %d not received", i)
+		}
+	}
+
+	// The last minute of the main session has no trades, the hour 18:00 is closed by the clock
+	for _, candle := range candles[70:539] {
+		source.send(candle)
+	}
+	for i := 0; i < 7; i++ {
+		<-hours
+	}
+	virtualClock.Set(day.Add(18*time.Hour + 50*time.Minute + resampleCloseDelay))
+
+	select {
+	case bar := <-hours:
+		if !bar.OpenTime.Equal(day.Add(18*time.Hour)) || bar.Close != 18*60+48 {
+			t.Errorf("unexpected hour candle: %+v", bar)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("hour candle at the session end not received")
+	}
+
+	// The last subscriber cancels the source subscription
+	cancel()
+	for range hours {
+	}
+	for range fiveMinutes {
+	}
+
+	// Source subscription is cancelled by its context asynchronously
+	for i := 0; ; i++ {
+		source.mu.Lock()
+		subscribed := len(source.channels)
+		source.mu.Unlock()
+
+		if subscribed == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected source subscription to be cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,399 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// A bar that doesn't get the final source candle is closed after this delay past its trading end
+const resampleCloseDelay = 5 * time.Second
+
+// How many times GetCandlesByCount widens the window when the source had no candles
+const resampleCountWindowExtensions = 3
+
+// ResamplingMarketDataProvider derives candles of higher intervals from candles
+// of one source interval. Every instrument has one source subscription shared
+// by all derived intervals. Intervals that can't be built from the source interval,
+// including the source interval itself, and other market data are passed to the source.
+type ResamplingMarketDataProvider struct {
+	source                  MarketDataProvider
+	sourceInterval          domain.MarketDataInterval
+	cal                     calendar.Calendar
+	clock                   clock.Clock
+	mu                      sync.Mutex
+	candleSubscribers       *subscribers[domain.MarketData, domain.Candle]
+	candleUpdateSubscribers *subscribers[domain.MarketData, domain.Candle]
+	// By market data of the source
+	streams map[domain.MarketData]*resampledStream
+}
+
+type resampledStream struct {
+	cancel     context.CancelFunc
+	resamplers map[domain.MarketDataInterval]*Resampler
+}
+
+func NewResamplingMarketDataProvider(
+	source MarketDataProvider,
+	sourceInterval domain.MarketDataInterval,
+	cal calendar.Calendar,
+) *ResamplingMarketDataProvider {
+	return &ResamplingMarketDataProvider{
+		source:                  source,
+		sourceInterval:          sourceInterval,
+		cal:                     cal,
+		clock:                   clock.Real,
+		candleSubscribers:       newSubscribers[domain.MarketData, domain.Candle]("Resampled candle"),
+		candleUpdateSubscribers: newSubscribers[domain.MarketData, domain.Candle]("Resampled candle update"),
+		streams:                 make(map[domain.MarketData]*resampledStream),
+	}
+}
+
+// Bars are closed by c
+func (r *ResamplingMarketDataProvider) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+func (r *ResamplingMarketDataProvider) resampled(marketData domain.MarketData) bool {
+	return CanResample(r.sourceInterval, marketData.Interval) == nil
+}
+
+func (r *ResamplingMarketDataProvider) sourceMarketData(marketData domain.MarketData) domain.MarketData {
+	marketData.Interval = r.sourceInterval
+	return marketData
+}
+
+func (r *ResamplingMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	if !r.resampled(marketData) {
+		return r.source.SubscribeCandles(ctx, marketData)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.subscribeStream(marketData)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, _ := r.candleSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		r.UnsubscribeCandles(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (r *ResamplingMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	if !r.resampled(marketData) {
+		return r.source.UnsubscribeCandles(marketData, ch)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.candleSubscribers.remove(marketData, ch)
+	if err != nil {
+		return err
+	}
+
+	r.unsubscribeStream(marketData)
+
+	return nil
+}
+
+// Updates of the forming bar after every source candle
+func (r *ResamplingMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	if !r.resampled(marketData) {
+		return r.source.SubscribeCandleUpdates(ctx, marketData)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.subscribeStream(marketData)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, _ := r.candleUpdateSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		r.UnsubscribeCandleUpdates(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (r *ResamplingMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	if !r.resampled(marketData) {
+		return r.source.UnsubscribeCandleUpdates(marketData, ch)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.candleUpdateSubscribers.remove(marketData, ch)
+	if err != nil {
+		return err
+	}
+
+	r.unsubscribeStream(marketData)
+
+	return nil
+}
+
+// Must be called with mu locked
+func (r *ResamplingMarketDataProvider) subscribeStream(marketData domain.MarketData) error {
+	sourceMarketData := r.sourceMarketData(marketData)
+
+	stream, ok := r.streams[sourceMarketData]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		upstream, err := r.source.SubscribeCandles(ctx, sourceMarketData)
+		if err != nil {
+			cancel()
+			return err
+		}
+
+		stream = &resampledStream{
+			cancel:     cancel,
+			resamplers: make(map[domain.MarketDataInterval]*Resampler),
+		}
+		r.streams[sourceMarketData] = stream
+
+		go r.run(sourceMarketData, stream, upstream)
+	}
+
+	if _, ok := stream.resamplers[marketData.Interval]; !ok {
+		stream.resamplers[marketData.Interval] = NewResampler(r.cal, marketData)
+	}
+
+	return nil
+}
+
+// Must be called with mu locked after a subscriber is removed
+func (r *ResamplingMarketDataProvider) unsubscribeStream(marketData domain.MarketData) {
+	if r.candleSubscribers.has(marketData) || r.candleUpdateSubscribers.has(marketData) {
+		return
+	}
+
+	sourceMarketData := r.sourceMarketData(marketData)
+	stream, ok := r.streams[sourceMarketData]
+	if !ok {
+		return
+	}
+
+	delete(stream.resamplers, marketData.Interval)
+	if len(stream.resamplers) == 0 {
+		stream.cancel()
+		delete(r.streams, sourceMarketData)
+	}
+}
+
+func (r *ResamplingMarketDataProvider) run(
+	sourceMarketData domain.MarketData,
+	stream *resampledStream,
+	upstream <-chan domain.Candle,
+) {
+	for {
+		// Bars without trades until their end are closed by the deadline
+		var timeout <-chan time.Time
+		r.mu.Lock()
+		deadline, ok := r.nextDeadline(stream)
+		r.mu.Unlock()
+		if ok {
+			timeout = r.clock.After(deadline.Add(resampleCloseDelay).Sub(r.clock.Now()))
+		}
+
+		select {
+		case candle, ok := <-upstream:
+			if !ok {
+				r.closeStream(sourceMarketData, stream)
+				return
+			}
+
+			r.mu.Lock()
+			for _, resampler := range stream.resamplers {
+				for _, bar := range resampler.Add(candle) {
+					r.candleSubscribers.notify(bar.MarketData, bar)
+				}
+				if bar, ok := resampler.Forming(); ok {
+					r.candleUpdateSubscribers.notify(bar.MarketData, bar)
+				}
+			}
+			r.mu.Unlock()
+		case <-timeout:
+			r.mu.Lock()
+			for _, resampler := range stream.resamplers {
+				if bar, ok := resampler.Close(r.clock.Now().Add(-resampleCloseDelay)); ok {
+					r.candleSubscribers.notify(bar.MarketData, bar)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// Must be called with mu locked
+func (r *ResamplingMarketDataProvider) nextDeadline(stream *resampledStream) (time.Time, bool) {
+	var result time.Time
+	found := false
+
+	for _, resampler := range stream.resamplers {
+		deadline, ok := resampler.Deadline()
+		if ok && (!found || deadline.Before(result)) {
+			result = deadline
+			found = true
+		}
+	}
+
+	return result, found
+}
+
+// The source subscription is over, subscribers of derived intervals are closed too
+func (r *ResamplingMarketDataProvider) closeStream(
+	sourceMarketData domain.MarketData,
+	stream *resampledStream,
+) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Unsubscribed, the stream may already be replaced by a new one
+	if r.streams[sourceMarketData] != stream {
+		return
+	}
+	delete(r.streams, sourceMarketData)
+
+	for interval := range stream.resamplers {
+		marketData := sourceMarketData
+		marketData.Interval = interval
+
+		r.candleSubscribers.removeAll(marketData)
+		r.candleUpdateSubscribers.removeAll(marketData)
+	}
+}
+
+func (r *ResamplingMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	return r.source.SubscribeOrderBook(ctx, orderBookInfo)
+}
+
+func (r *ResamplingMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	return r.source.UnsubscribeOrderBook(orderBookInfo, ch)
+}
+
+func (r *ResamplingMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	return r.source.SubscribeLastPrices(ctx, instrumentInfo)
+}
+
+func (r *ResamplingMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	return r.source.UnsubscribeLastPrices(instrumentInfo, ch)
+}
+
+func (r *ResamplingMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	return r.source.SubscribeTrades(ctx, instrumentInfo)
+}
+
+func (r *ResamplingMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	return r.source.UnsubscribeTrades(instrumentInfo, ch)
+}
+
+// Only closed bars are returned, the source is requested for whole bars of the range
+func (r *ResamplingMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	if !r.resampled(marketData) {
+		return r.source.GetCandlesByTime(ctx, marketData, from, to)
+	}
+	if !from.Before(to) {
+		return make([]domain.Candle, 0), nil
+	}
+
+	start := CandleOpenTime(marketData.Interval, from, r.cal.Location())
+	end := CandleCloseTime(marketData.Interval, to.Add(-time.Nanosecond), r.cal.Location())
+
+	candles, err := r.source.GetCandlesByTime(ctx, r.sourceMarketData(marketData), start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	bars := ResampleCandles(r.cal, candles, marketData, minTime(end, r.clock.Now()))
+
+	result := make([]domain.Candle, 0, len(bars))
+	for _, bar := range bars {
+		if !bar.OpenTime.Before(from) && bar.OpenTime.Before(to) {
+			result = append(result, bar)
+		}
+	}
+
+	return result, nil
+}
+
+func (r *ResamplingMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	if !r.resampled(marketData) {
+		return r.source.GetCandlesByCount(ctx, marketData, last, count)
+	}
+
+	cal := SessionCalendar(r.cal, marketData.SessionFilter)
+	from := CandlesWindowStart(cal, marketData.Interval, last, count)
+
+	for i := 0; ; i++ {
+		bars, err := r.GetCandlesByTime(ctx, marketData, from, last)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(bars) >= count {
+			return bars[len(bars)-count:], nil
+		}
+		if i == resampleCountWindowExtensions {
+			return nil, fmt.Errorf(
+				"error getting history data by count",
+			)
+		}
+
+		// Source had no candles for some bars, e.g. there were no trades
+		from = CandlesWindowStart(cal, marketData.Interval, from, count)
+	}
+}
@@ -0,0 +1,69 @@
+package marketdata
+
+import (
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Calendar with the sessions of the filter only, windows of history requests
+// and bars of resampling are counted by it
+func SessionCalendar(cal calendar.Calendar, filter domain.SessionFilter) calendar.Calendar {
+	switch filter {
+	case domain.SessionFilter_MAIN:
+		return calendar.NewFilteredCalendar(cal, calendar.SessionType_MAIN)
+	case domain.SessionFilter_MAIN_EVENING:
+		return calendar.NewFilteredCalendar(cal, calendar.SessionType_MAIN, calendar.SessionType_EVENING)
+	default:
+		return cal
+	}
+}
+
+// Candles that overlap sessions of the filter, e.g. an hour candle of the main session close
+// is kept and a day candle of a weekend session is dropped.
+// Candles of SessionFilter_ALL are returned as is, otherwise the result is a new slice.
+func FilterCandlesBySession(
+	cal calendar.Calendar,
+	filter domain.SessionFilter,
+	candles []domain.Candle,
+) []domain.Candle {
+	if filter == domain.SessionFilter_ALL {
+		return candles
+	}
+
+	cal = SessionCalendar(cal, filter)
+
+	result := make([]domain.Candle, 0, len(candles))
+	for _, candle := range candles {
+		if candleInSessions(cal, candle) {
+			result = append(result, candle)
+		}
+	}
+
+	return result
+}
+
+// Same check as FilterCandlesBySession for one candle, e.g. of a stream
+func CandleInSessionFilter(cal calendar.Calendar, filter domain.SessionFilter, candle domain.Candle) bool {
+	if filter == domain.SessionFilter_ALL {
+		return true
+	}
+
+	return candleInSessions(SessionCalendar(cal, filter), candle)
+}
+
+func candleInSessions(cal calendar.Calendar, candle domain.Candle) bool {
+	return tradingEnd(cal, candle.OpenTime, candle.CloseTime).After(candle.OpenTime)
+}
+
+func ConvertSessionFilterToString(filter domain.SessionFilter) string {
+	switch filter {
+	case domain.SessionFilter_ALL:
+		return "all"
+	case domain.SessionFilter_MAIN:
+		return "main"
+	case domain.SessionFilter_MAIN_EVENING:
+		return "main_evening"
+	default:
+		return "undefined"
+	}
+}
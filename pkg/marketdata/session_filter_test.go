@@ -0,0 +1,72 @@
+package marketdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestFilterCandlesBySession(t *testing.T) {
+	cal := calendar.NewMOEXCalendar()
+	friday := time.Date(2025, time.March, 14, 0, 0, 0, 0, calendar.MoscowLocation)
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+
+	hours := func(day time.Time, from int, to int) []domain.Candle {
+		result := make([]domain.Candle, 0)
+		for hour := from; hour < to; hour++ {
+			open := day.Add(time.Duration(hour) * time.Hour)
+			result = append(result, domain.Candle{MarketData: md, OpenTime: open, CloseTime: open.Add(time.Hour)})
+		}
+		return result
+	}
+
+	// Friday has every hour of trading, Saturday has the weekend session
+	candles := append(hours(friday, 7, 24), hours(friday.AddDate(0, 0, 1), 10, 19)...)
+
+	tests := []struct {
+		filter   domain.SessionFilter
+		expected int
+	}{
+		// 09:00 to 18:00, the first and the last hours are partly in the session
+		{domain.SessionFilter_MAIN, 10},
+		{domain.SessionFilter_MAIN_EVENING, 15},
+		{domain.SessionFilter_ALL, len(candles)},
+	}
+
+	for _, test := range tests {
+		result := FilterCandlesBySession(cal, test.filter, candles)
+		if len(result) != test.expected {
+			t.Errorf("%s: expected %d candles, got %d", ConvertSessionFilterToString(test.filter), test.expected, len(result))
+		}
+	}
+
+	days := []domain.Candle{
+		{OpenTime: friday, CloseTime: friday.AddDate(0, 0, 1)},
+		{OpenTime: friday.AddDate(0, 0, 1), CloseTime: friday.AddDate(0, 0, 2)},
+	}
+	if result := FilterCandlesBySession(cal, domain.SessionFilter_MAIN, days); len(result) != 1 || !result[0].OpenTime.Equal(friday) {
+		t.Errorf("expected the weekend day to be dropped, got %v", result)
+	}
+}
+
+func TestResampler_SessionFilter(t *testing.T) {
+	cal := calendar.NewMOEXCalendar()
+	day := time.Date(2024, time.January, 10, 0, 0, 0, 0, calendar.MoscowLocation)
+
+	bars := ResampleCandles(
+		cal,
+		sessionMinutes(cal, day),
+		domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_DAY, SessionFilter: domain.SessionFilter_MAIN},
+		day.Add(18*time.Hour+50*time.Minute),
+	)
+
+	// Day closes with the main session, evening minutes are not in it
+	if len(bars) != 1 {
+		t.Fatalf("expected one day bar at the main session close, got %d", len(bars))
+	}
+	if bars[0].Volume != 9*60 {
+		t.Errorf("expected volume of the main session minutes, got %v", bars[0].Volume)
+	}
+}
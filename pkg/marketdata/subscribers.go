@@ -0,0 +1,119 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// Buffer of every subscriber channel
+const subscriberBufferSize = 100
+
+// Fans out values of one upstream subscription to every subscriber of the key.
+// Not safe for concurrent use, providers guard it with their own mutex.
+type subscribers[K comparable, V any] struct {
+	name     string
+	channels map[K][]chan V
+	stops    map[chan V]func() bool
+}
+
+func newSubscribers[K comparable, V any](name string) *subscribers[K, V] {
+	return &subscribers[K, V]{
+		name:     name,
+		channels: make(map[K][]chan V),
+		stops:    make(map[chan V]func() bool),
+	}
+}
+
+// Returns a new channel of the key and whether it is the first subscriber.
+// When ctx is done, cancel is called with the channel without the owner's lock.
+func (s *subscribers[K, V]) add(
+	ctx context.Context,
+	key K,
+	cancel func(ch <-chan V),
+) (chan V, bool) {
+	_, exists := s.channels[key]
+
+	ch := make(chan V, subscriberBufferSize)
+	s.channels[key] = append(s.channels[key], ch)
+
+	s.stops[ch] = context.AfterFunc(ctx, func() {
+		cancel(ch)
+	})
+
+	return ch, !exists
+}
+
+// Closes the channel and returns whether it was the last subscriber of the key
+func (s *subscribers[K, V]) remove(key K, ch <-chan V) (bool, error) {
+	for i, subscriber := range s.channels[key] {
+		if subscriber != ch {
+			continue
+		}
+
+		s.channels[key] = slices.Delete(s.channels[key], i, i+1)
+		close(subscriber)
+
+		s.stops[subscriber]()
+		delete(s.stops, subscriber)
+
+		if len(s.channels[key]) == 0 {
+			delete(s.channels, key)
+			return true, nil
+		}
+
+		return false, nil
+	}
+
+	return false, fmt.Errorf("undefined subscriber")
+}
+
+// Closes every channel of the key, e.g. when its upstream is over
+func (s *subscribers[K, V]) removeAll(key K) {
+	for _, subscriber := range s.channels[key] {
+		close(subscriber)
+
+		s.stops[subscriber]()
+		delete(s.stops, subscriber)
+	}
+
+	delete(s.channels, key)
+}
+
+func (s *subscribers[K, V]) has(key K) bool {
+	_, exists := s.channels[key]
+	return exists
+}
+
+func (s *subscribers[K, V]) keys() []K {
+	result := make([]K, 0, len(s.channels))
+	for key := range s.channels {
+		result = append(result, key)
+	}
+
+	return result
+}
+
+func (s *subscribers[K, V]) notify(key K, value V) {
+	for _, subscriber := range s.channels[key] {
+		// Slow subscriber must not block the stream and unsubscribe calls
+		select {
+		case subscriber <- value:
+		default:
+			log.Printf("%s subscriber of %v is full, value dropped", s.name, key)
+		}
+	}
+}
+
+// Values sent but not received yet by subscribers of every key
+func (s *subscribers[K, V]) queued() int {
+	result := 0
+	for _, channels := range s.channels {
+		for _, ch := range channels {
+			result += len(ch)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,74 @@
+package marketdata
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscribers_FanOut(t *testing.T) {
+	s := newSubscribers[string, int]("Test")
+	cancel := func(ch <-chan int) {}
+
+	first, isFirst := s.add(context.Background(), "SBER", cancel)
+	if !isFirst {
+		t.Fatalf("expected the first subscriber")
+	}
+	second, isFirst := s.add(context.Background(), "SBER", cancel)
+	if isFirst {
+		t.Fatalf("expected not the first subscriber")
+	}
+
+	s.notify("SBER", 1)
+	s.notify("LKOH", 2)
+
+	for i, ch := range []chan int{first, second} {
+		if v := <-ch; v != 1 {
+			t.Errorf("subscriber %d: expected 1, got %d", i, v)
+		}
+		if len(ch) != 0 {
+			t.Errorf("subscriber %d: unexpected values of another key", i)
+		}
+	}
+
+	last, err := s.remove("SBER", first)
+	if err != nil || last {
+		t.Fatalf("expected not the last subscriber, got %v %v", last, err)
+	}
+	if _, ok := <-first; ok {
+		t.Errorf("expected removed channel to be closed")
+	}
+
+	if _, err := s.remove("SBER", first); err == nil {
+		t.Errorf("expected error removing unknown subscriber")
+	}
+
+	last, err = s.remove("SBER", second)
+	if err != nil || !last {
+		t.Fatalf("expected the last subscriber, got %v %v", last, err)
+	}
+	if s.has("SBER") {
+		t.Errorf("expected no subscribers left")
+	}
+}
+
+func TestSubscribers_ContextDone(t *testing.T) {
+	s := newSubscribers[string, int]("Test")
+
+	cancelled := make(chan (<-chan int), 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch, _ := s.add(ctx, "SBER", func(ch <-chan int) {
+		cancelled <- ch
+	})
+	cancel()
+
+	select {
+	case got := <-cancelled:
+		if got != (<-chan int)(ch) {
+			t.Errorf("expected cancel with the subscriber channel")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected cancel to be called when ctx is done")
+	}
+}
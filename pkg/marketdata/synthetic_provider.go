@@ -0,0 +1,399 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Steps of the price path inside one candle, High and Low are taken from the path
+const syntheticPathSteps = 4
+
+// Limit of generated candles of one series, e.g. about two years of minutes
+const syntheticMaxCandles = 1_000_000
+
+type SyntheticProcess int32
+
+const (
+	// Geometric Brownian motion: trend with constant volatility
+	SyntheticProcess_GBM SyntheticProcess = iota
+	// Ornstein-Uhlenbeck on log price: price is pulled back to MeanPrice
+	SyntheticProcess_MEAN_REVERTING
+)
+
+// Parameters of the price process while the market stays in the regime.
+// Drift, Volatility and MeanReversion are per candle, Volatility is the std of log returns.
+type SyntheticRegime struct {
+	Process       SyntheticProcess
+	Drift         float64
+	Volatility    float64
+	MeanPrice     float64
+	MeanReversion float64
+}
+
+// GARCH(1,1) clustering of volatility, Alpha + Beta must be below 1.
+// Long-run volatility stays equal to the one of the regime.
+type SyntheticVolatilityClusters struct {
+	Alpha float64
+	Beta  float64
+}
+
+type SyntheticConfig struct {
+	Seed       uint64
+	Start      time.Time
+	StartPrice float64
+	// Average volume of a candle, 1000 when zero
+	BaseVolume float64
+	// At least one regime, the market moves to a random other one
+	// with RegimeSwitchProbability after every candle
+	Regimes                 []SyntheticRegime
+	RegimeSwitchProbability float64
+	// Optional
+	VolatilityClusters *SyntheticVolatilityClusters
+	// The first candle of a day in Moscow opens with a gap with GapProbability,
+	// GapVolatility is the std of the log size of the gap
+	GapProbability float64
+	GapVolatility  float64
+	// Price drops by CrashDepth (0.1 is 10%) inside a candle with CrashProbability
+	// and recovers during CrashRecovery candles, zero recovery means the candle closes recovered
+	CrashProbability float64
+	CrashDepth       float64
+	CrashRecovery    int
+}
+
+// SyntheticMarketDataProvider generates candles from stochastic models.
+// Every instrument and interval has its own series that depends only on the seed,
+// so any range of it is the same between requests and runs.
+// Streaming is done by ReplayMarketDataProvider on top of it.
+type SyntheticMarketDataProvider struct {
+	candlesOnlyProvider
+	config SyntheticConfig
+	mu     sync.Mutex
+	series map[domain.MarketData]*syntheticSeries
+}
+
+func NewSyntheticMarketDataProvider(config SyntheticConfig) (*SyntheticMarketDataProvider, error) {
+	err := validateSyntheticConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.BaseVolume == 0 {
+		config.BaseVolume = 1000
+	}
+
+	return &SyntheticMarketDataProvider{
+		candlesOnlyProvider: candlesOnlyProvider{name: "synthetic"},
+		config:              config,
+		series:              make(map[domain.MarketData]*syntheticSeries),
+	}, nil
+}
+
+func validateSyntheticConfig(config SyntheticConfig) error {
+	if config.StartPrice <= 0 {
+		return fmt.Errorf("start price must be positive")
+	}
+	if len(config.Regimes) == 0 {
+		return fmt.Errorf("at least one regime is required")
+	}
+
+	for i, regime := range config.Regimes {
+		if regime.Volatility < 0 {
+			return fmt.Errorf("regime %d: volatility must not be negative", i)
+		}
+
+		switch regime.Process {
+		case SyntheticProcess_GBM:
+		case SyntheticProcess_MEAN_REVERTING:
+			if regime.MeanPrice <= 0 {
+				return fmt.Errorf("regime %d: mean price must be positive", i)
+			}
+			if regime.MeanReversion < 0 || regime.MeanReversion > 1 {
+				return fmt.Errorf("regime %d: mean reversion must be in [0, 1]", i)
+			}
+		default:
+			return fmt.Errorf("regime %d: undefined process", i)
+		}
+	}
+
+	if clusters := config.VolatilityClusters; clusters != nil {
+		if clusters.Alpha < 0 || clusters.Beta < 0 || clusters.Alpha+clusters.Beta >= 1 {
+			return fmt.Errorf("volatility clusters: alpha and beta must be non-negative with sum below 1")
+		}
+	}
+
+	probabilities := map[string]float64{
+		"regime switch": config.RegimeSwitchProbability,
+		"gap":           config.GapProbability,
+		"crash":         config.CrashProbability,
+	}
+	for name, p := range probabilities {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("%s probability must be in [0, 1]", name)
+		}
+	}
+
+	if config.CrashDepth < 0 || config.CrashDepth >= 1 {
+		return fmt.Errorf("crash depth must be in [0, 1)")
+	}
+	if config.CrashRecovery < 0 {
+		return fmt.Errorf("crash recovery must not be negative")
+	}
+
+	return nil
+}
+
+func (s *SyntheticMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return nil, fmt.Errorf("synthetic provider doesn't support candle streaming, replay it")
+}
+
+func (s *SyntheticMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return fmt.Errorf("undefined subscriber")
+}
+
+func (s *SyntheticMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	candles, err := s.generate(marketData, to)
+	if err != nil {
+		return nil, err
+	}
+
+	first := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].OpenTime.Before(from)
+	})
+	last := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].OpenTime.Before(to)
+	})
+
+	if first >= last {
+		return make([]domain.Candle, 0), nil
+	}
+
+	return append(make([]domain.Candle, 0, last-first), candles[first:last]...), nil
+}
+
+func (s *SyntheticMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	candles, err := s.generate(marketData, last)
+	if err != nil {
+		return nil, err
+	}
+
+	end := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].OpenTime.Before(last)
+	})
+
+	if end < count {
+		return nil, fmt.Errorf(
+			"error getting history data by count",
+		)
+	}
+
+	return append(make([]domain.Candle, 0, count), candles[end-count:end]...), nil
+}
+
+// Extends the series until it has every candle opening before to
+func (s *SyntheticMarketDataProvider) generate(
+	marketData domain.MarketData,
+	to time.Time,
+) ([]domain.Candle, error) {
+	if ConvertMarketDataIntervalToTime(marketData.Interval) == 0 {
+		return nil, fmt.Errorf("undefined interval")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	series, ok := s.series[marketData]
+	if !ok {
+		series = newSyntheticSeries(s.config, marketData)
+		s.series[marketData] = series
+	}
+
+	for openTime := series.nextOpenTime(); openTime.Before(to); openTime = series.nextOpenTime() {
+		if len(series.candles) >= syntheticMaxCandles {
+			return nil, fmt.Errorf("synthetic series of %s is limited to %d candles", marketData.ID, syntheticMaxCandles)
+		}
+		series.next(openTime)
+	}
+
+	return series.candles, nil
+}
+
+// State of the price process of one instrument and interval
+type syntheticSeries struct {
+	config     SyntheticConfig
+	marketData domain.MarketData
+	rng        *rand.Rand
+	candles    []domain.Candle
+	price      float64
+	regime     int
+	// Conditional variance of log returns and the last shock for volatility clusters
+	variance  float64
+	lastShock float64
+	// Candles left to recover after a crash and the log return added to each of them
+	recoveryLeft int
+	recoveryStep float64
+}
+
+func newSyntheticSeries(config SyntheticConfig, marketData domain.MarketData) *syntheticSeries {
+	// Instruments and intervals get different but reproducible series
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", marketData.ID, marketData.Interval)
+
+	return &syntheticSeries{
+		config:     config,
+		marketData: marketData,
+		rng:        rand.New(rand.NewPCG(config.Seed, h.Sum64())),
+		candles:    make([]domain.Candle, 0),
+		price:      config.StartPrice,
+		variance:   config.Regimes[0].Volatility * config.Regimes[0].Volatility,
+	}
+}
+
+// The first candle is the one that contains Start
+func (s *syntheticSeries) nextOpenTime() time.Time {
+	if len(s.candles) == 0 {
+		return CandleOpenTime(s.marketData.Interval, s.config.Start, calendar.MoscowLocation)
+	}
+
+	return s.candles[len(s.candles)-1].CloseTime
+}
+
+func (s *syntheticSeries) next(openTime time.Time) {
+	s.switchRegime()
+	regime := s.config.Regimes[s.regime]
+
+	sigma := s.volatility(regime)
+
+	open := s.price
+	if s.isGap(openTime) {
+		open *= math.Exp(s.rng.NormFloat64() * s.config.GapVolatility)
+	}
+
+	logPrice := math.Log(open)
+
+	var drift float64
+	switch regime.Process {
+	case SyntheticProcess_GBM:
+		drift = regime.Drift - sigma*sigma/2
+	case SyntheticProcess_MEAN_REVERTING:
+		drift = regime.MeanReversion * (math.Log(regime.MeanPrice) - logPrice)
+	}
+
+	if s.recoveryLeft > 0 {
+		drift += s.recoveryStep
+		s.recoveryLeft--
+	}
+
+	high, low := logPrice, logPrice
+	var shock float64
+	for i := 0; i < syntheticPathSteps; i++ {
+		e := s.rng.NormFloat64() / math.Sqrt(syntheticPathSteps)
+		shock += e
+
+		logPrice += drift/syntheticPathSteps + sigma*e
+		high = max(high, logPrice)
+		low = min(low, logPrice)
+	}
+	s.lastShock = sigma * shock
+
+	if s.config.CrashProbability > 0 && s.rng.Float64() < s.config.CrashProbability {
+		drop := math.Log(1 - s.config.CrashDepth)
+		low = min(low, logPrice+drop)
+
+		if s.config.CrashRecovery > 0 {
+			logPrice += drop
+			low = min(low, logPrice)
+			s.recoveryLeft = s.config.CrashRecovery
+			s.recoveryStep = -drop / float64(s.config.CrashRecovery)
+		}
+	}
+
+	close := math.Exp(logPrice)
+
+	// Volume grows with the size of the move
+	volume := s.config.BaseVolume * math.Exp(0.3*s.rng.NormFloat64())
+	if sigma > 0 {
+		volume *= 1 + math.Abs(s.lastShock)/sigma
+	}
+
+	s.candles = append(s.candles, domain.Candle{
+		MarketData: s.marketData,
+		Open:       open,
+		// exp(log(price)) may differ from price in the last bit
+		High:      max(math.Exp(high), open, close),
+		Low:       min(math.Exp(low), open, close),
+		Close:     close,
+		Volume:    math.Round(volume),
+		OpenTime:  openTime,
+		CloseTime: CandleCloseTime(s.marketData.Interval, openTime, calendar.MoscowLocation),
+	})
+	s.price = close
+}
+
+func (s *syntheticSeries) switchRegime() {
+	if len(s.config.Regimes) < 2 || s.config.RegimeSwitchProbability == 0 {
+		return
+	}
+	if s.rng.Float64() >= s.config.RegimeSwitchProbability {
+		return
+	}
+
+	// Any regime except the current one
+	next := s.rng.IntN(len(s.config.Regimes) - 1)
+	if next >= s.regime {
+		next++
+	}
+	s.regime = next
+}
+
+// Volatility of the candle, with clusters a big shock raises the next ones
+func (s *syntheticSeries) volatility(regime SyntheticRegime) float64 {
+	clusters := s.config.VolatilityClusters
+	if clusters == nil {
+		return regime.Volatility
+	}
+
+	omega := regime.Volatility * regime.Volatility * (1 - clusters.Alpha - clusters.Beta)
+	s.variance = omega + clusters.Alpha*s.lastShock*s.lastShock + clusters.Beta*s.variance
+
+	return math.Sqrt(s.variance)
+}
+
+// Gaps happen between days, the exchange is closed at night
+func (s *syntheticSeries) isGap(openTime time.Time) bool {
+	if s.config.GapProbability == 0 || len(s.candles) == 0 {
+		return false
+	}
+
+	prev := s.candles[len(s.candles)-1].OpenTime.In(calendar.MoscowLocation)
+	current := openTime.In(calendar.MoscowLocation)
+	if prev.YearDay() == current.YearDay() && prev.Year() == current.Year() {
+		return false
+	}
+
+	return s.rng.Float64() < s.config.GapProbability
+}
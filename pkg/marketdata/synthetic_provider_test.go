@@ -0,0 +1,147 @@
+package marketdata
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestSyntheticMarketDataProvider_Reproducible(t *testing.T) {
+	config := SyntheticConfig{
+		Seed:       42,
+		Start:      time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		StartPrice: 100,
+		Regimes: []SyntheticRegime{
+			{Process: SyntheticProcess_GBM, Drift: 0.001, Volatility: 0.01},
+			{Process: SyntheticProcess_MEAN_REVERTING, Volatility: 0.005, MeanPrice: 100, MeanReversion: 0.1},
+		},
+		RegimeSwitchProbability: 0.05,
+		VolatilityClusters:      &SyntheticVolatilityClusters{Alpha: 0.1, Beta: 0.85},
+		GapProbability:          0.5,
+		GapVolatility:           0.02,
+		CrashProbability:        0.01,
+		CrashDepth:              0.2,
+		CrashRecovery:           5,
+	}
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+	from := config.Start
+	to := from.Add(500 * time.Hour)
+
+	first, err := NewSyntheticMarketDataProvider(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := NewSyntheticMarketDataProvider(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	candles, err := first.GetCandlesByTime(context.Background(), md, from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 500 {
+		t.Fatalf("expected 500 candles, got %d", len(candles))
+	}
+
+	// The other provider generates the tail first, the series must be the same
+	tail, err := second.GetCandlesByCount(context.Background(), md, to, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, c := range tail {
+		if c != candles[400+i] {
+			t.Fatalf("candle %d differs: %+v and %+v", i, c, candles[400+i])
+		}
+	}
+
+	for i, c := range candles {
+		if c.Low > min(c.Open, c.Close) || c.High < max(c.Open, c.Close) || c.Low <= 0 {
+			t.Fatalf("candle %d has inconsistent prices: %+v", i, c)
+		}
+		if i > 0 && !c.OpenTime.Equal(candles[i-1].CloseTime) {
+			t.Fatalf("candle %d doesn't follow the previous one", i)
+		}
+	}
+
+	// Another instrument gets another series
+	other, err := first.GetCandlesByTime(context.Background(), domain.MarketData{ID: "GAZP", Interval: md.Interval}, from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if other[10].Close == candles[10].Close {
+		t.Errorf("expected different series for different instruments")
+	}
+}
+
+func TestSyntheticMarketDataProvider_MeanReverting(t *testing.T) {
+	provider, err := NewSyntheticMarketDataProvider(SyntheticConfig{
+		Seed:       1,
+		Start:      time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		StartPrice: 150,
+		Regimes: []SyntheticRegime{
+			{Process: SyntheticProcess_MEAN_REVERTING, Volatility: 0.01, MeanPrice: 100, MeanReversion: 0.2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_MINUTE}
+	candles, err := provider.GetCandlesByCount(context.Background(), md, time.Date(2024, time.January, 2, 0, 0, 0, 0, time.UTC), 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, c := range candles {
+		if math.Abs(math.Log(c.Close/100)) > 0.1 {
+			t.Fatalf("candle %d is too far from the mean: %v", i, c.Close)
+		}
+	}
+}
+
+func TestSyntheticMarketDataProvider_Crash(t *testing.T) {
+	provider, err := NewSyntheticMarketDataProvider(SyntheticConfig{
+		Seed:             7,
+		Start:            time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		StartPrice:       100,
+		Regimes:          []SyntheticRegime{{Process: SyntheticProcess_GBM}},
+		CrashProbability: 1,
+		CrashDepth:       0.3,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+	candles, err := provider.GetCandlesByTime(context.Background(), md, time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.January, 1, 3, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Without volatility and recovery only the shadow of the candle crashes
+	for i, c := range candles {
+		if math.Abs(c.Close-100) > 1e-9 || math.Abs(c.Low-70) > 1e-9 {
+			t.Errorf("candle %d: expected close 100 and low 70, got %+v", i, c)
+		}
+	}
+}
+
+func TestNewSyntheticMarketDataProvider_Validation(t *testing.T) {
+	configs := []SyntheticConfig{
+		{StartPrice: 100},
+		{StartPrice: 0, Regimes: []SyntheticRegime{{}}},
+		{StartPrice: 100, Regimes: []SyntheticRegime{{Process: SyntheticProcess_MEAN_REVERTING}}},
+		{StartPrice: 100, Regimes: []SyntheticRegime{{}}, VolatilityClusters: &SyntheticVolatilityClusters{Alpha: 0.5, Beta: 0.5}},
+		{StartPrice: 100, Regimes: []SyntheticRegime{{}}, CrashDepth: 1},
+	}
+
+	for i, config := range configs {
+		if _, err := NewSyntheticMarketDataProvider(config); err == nil {
+			t.Errorf("config %d: expected error", i)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package marketdata
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Yearly archives of minute candles, the token is the one of the market data API
+const TinkoffHistoryDataURL = "https://invest-public-api.tinkoff.ru/history-data"
+
+// Quota of the archive downloads
+const (
+	tinkoffArchiveRequests       = 30
+	tinkoffArchiveRequestsPeriod = time.Minute
+)
+
+const tinkoffArchiveRequestTimeout = 5 * time.Minute
+
+// How many times a download is repeated when the quota is exceeded anyway, e.g. by another client
+const tinkoffArchiveRetries = 3
+
+// The instrument has no candles in the year
+var ErrTinkoffArchiveNotFound = errors.New("archive not found")
+
+// Source of zip archives of minute candles of an instrument for a year
+type TinkoffArchiveSource interface {
+	Archive(ctx context.Context, instrumentID string, year int) ([]byte, error)
+}
+
+// TinkoffArchiveClient downloads archives of the history data service
+type TinkoffArchiveClient struct {
+	url        string
+	token      string
+	httpClient *http.Client
+	limiter    *requestLimiter
+	// Waits for the quota reset, tests don't spend wall time on it
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// url is TinkoffHistoryDataURL, tests pass the URL of a local stand-in
+func NewTinkoffArchiveClient(url string, token string) *TinkoffArchiveClient {
+	return &TinkoffArchiveClient{
+		url:        url,
+		token:      token,
+		httpClient: &http.Client{Timeout: tinkoffArchiveRequestTimeout},
+		limiter:    newRequestLimiter(tinkoffArchiveRequests, tinkoffArchiveRequestsPeriod),
+		sleep:      sleepContext,
+	}
+}
+
+// instrumentID is UID or FIGI
+func (c *TinkoffArchiveClient) Archive(ctx context.Context, instrumentID string, year int) ([]byte, error) {
+	query := url.Values{
+		"instrumentId": {instrumentID},
+		"year":         {strconv.Itoa(year)},
+	}
+
+	for i := 0; ; i++ {
+		err := c.limiter.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+c.token)
+
+		response, err := c.httpClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch response.StatusCode {
+		case http.StatusOK:
+			return data, nil
+		case http.StatusNotFound:
+			return nil, fmt.Errorf("%s %d: %w", instrumentID, year, ErrTinkoffArchiveNotFound)
+		case http.StatusTooManyRequests:
+			if i == tinkoffArchiveRetries {
+				return nil, fmt.Errorf("archive %s %d: %s", instrumentID, year, response.Status)
+			}
+
+			// Seconds until the quota is reset, 0 means it is already reset
+			reset, err := strconv.Atoi(response.Header.Get("X-Ratelimit-Reset"))
+			if err != nil || reset < 0 {
+				reset = int(tinkoffArchiveRequestsPeriod / time.Second)
+			}
+			if reset == 0 {
+				continue
+			}
+
+			err = c.sleep(ctx, time.Duration(reset)*time.Second)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("archive %s %d: %s", instrumentID, year, response.Status)
+		}
+	}
+}
+
+// TinkoffArchiveDir reads archives downloaded before, "<dir>/<instrumentID>_<year>.zip"
+type TinkoffArchiveDir string
+
+func (d TinkoffArchiveDir) Archive(ctx context.Context, instrumentID string, year int) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(string(d), fmt.Sprintf("%s_%d.zip", instrumentID, year)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s %d: %w", instrumentID, year, ErrTinkoffArchiveNotFound)
+	}
+
+	return data, err
+}
+
+// Reads minute candles of an archive, the result is sorted by OpenTime without duplicates.
+// Archive has a CSV file per day without a header:
+//
+//	<UID>;<open time RFC3339>;<open>;<close>;<high>;<low>;<volume>;
+func ReadTinkoffArchive(data []byte, marketData domain.MarketData) ([]domain.Candle, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("read archive: %w", err)
+	}
+
+	result := make([]domain.Candle, 0)
+	for _, file := range archive.File {
+		if !strings.EqualFold(filepath.Ext(file.Name), ".csv") {
+			continue
+		}
+
+		candles, err := readTinkoffArchiveFile(file, marketData)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", file.Name, err)
+		}
+		result = append(result, candles...)
+	}
+
+	slices.SortStableFunc(result, func(a, b domain.Candle) int {
+		return a.OpenTime.Compare(b.OpenTime)
+	})
+	result = slices.CompactFunc(result, func(a, b domain.Candle) bool {
+		return a.OpenTime.Equal(b.OpenTime)
+	})
+
+	return result, nil
+}
+
+func readTinkoffArchiveFile(file *zip.File, marketData domain.MarketData) ([]domain.Candle, error) {
+	r, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	result := make([]domain.Candle, 0)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		fields := strings.Split(text, ";")
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("line %d: expected 7 fields, got %d", line, len(fields))
+		}
+
+		openTime, err := time.Parse(time.RFC3339, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		var values [5]float64
+		for i := range values {
+			values[i], err = strconv.ParseFloat(fields[2+i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+
+		result = append(result, domain.Candle{
+			MarketData: marketData,
+			Open:       values[0],
+			Close:      values[1],
+			High:       values[2],
+			Low:        values[3],
+			Volume:     values[4],
+			OpenTime:   openTime,
+			CloseTime:  openTime.Add(time.Minute),
+		})
+	}
+
+	return result, scanner.Err()
+}
+
+// Result of one archive of ImportTinkoffArchives
+type TinkoffArchiveImport struct {
+	InstrumentID string
+	Year         int
+	Candles      int
+	// The instrument has no archive for the year
+	NotFound bool
+}
+
+// Loads archives of instruments for years into the store as minute candles of the Tinkoff provider.
+// Past years are marked as fully loaded, so CachedMarketDataProvider doesn't request them again.
+// A year that is not over by c is loaded up to the close of its last candle in the archive.
+// Years without archives are skipped.
+func ImportTinkoffArchives(
+	ctx context.Context,
+	c clock.Clock,
+	source TinkoffArchiveSource,
+	store *CandleStore,
+	instrumentIDs []string,
+	years []int,
+) ([]TinkoffArchiveImport, error) {
+	result := make([]TinkoffArchiveImport, 0, len(instrumentIDs)*len(years))
+	now := c.Now()
+
+	for _, instrumentID := range instrumentIDs {
+		marketData := domain.MarketData{
+			ID:           instrumentID,
+			Interval:     domain.MarketDataInterval_ONE_MINUTE,
+			ProviderType: domain.MarketDataProviderType_TINKOFF,
+		}
+
+		for _, year := range years {
+			data, err := source.Archive(ctx, instrumentID, year)
+			if errors.Is(err, ErrTinkoffArchiveNotFound) {
+				log.Printf("No archive of %s for %d", instrumentID, year)
+				result = append(result, TinkoffArchiveImport{InstrumentID: instrumentID, Year: year, NotFound: true})
+				continue
+			}
+			if err != nil {
+				return result, err
+			}
+
+			candles, err := ReadTinkoffArchive(data, marketData)
+			if err != nil {
+				return result, fmt.Errorf("archive %s %d: %w", instrumentID, year, err)
+			}
+
+			covered := TimeRange{
+				From: time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.UTC),
+			}
+			// Archive of the current year ends some time before now, an empty one covers nothing
+			if covered.To.After(now) {
+				covered.To = covered.From
+				if len(candles) > 0 {
+					covered.To = candles[len(candles)-1].CloseTime
+				}
+			}
+
+			err = store.Save(marketData, candles, covered)
+			if err != nil {
+				return result, fmt.Errorf("archive %s %d: %w", instrumentID, year, err)
+			}
+
+			log.Printf("Imported %d candles of %s for %d", len(candles), instrumentID, year)
+			result = append(result, TinkoffArchiveImport{InstrumentID: instrumentID, Year: year, Candles: len(candles)})
+		}
+	}
+
+	return result, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
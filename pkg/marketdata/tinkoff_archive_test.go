@@ -0,0 +1,170 @@
+package marketdata
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Archive of two days with three minutes each, closes are minutes since the first one
+func tinkoffArchive(t *testing.T, uid string, first time.Time) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	for day := 0; day < 2; day++ {
+		open := first.AddDate(0, 0, day)
+
+		file, err := w.Create(fmt.Sprintf("%s_%s.csv", uid, open.Format("20060102")))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for minute := 0; minute < 3; minute++ {
+			openTime := open.Add(time.Duration(minute) * time.Minute)
+			fmt.Fprintf(file, "%s;%s;1;%d;5;0.5;100;\n", uid, openTime.Format(time.RFC3339), day*3+minute)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestImportTinkoffArchives(t *testing.T) {
+	const uid = "e6123145-9665-43e0-8413-cd61b8aa9b13"
+	first := time.Date(2023, time.March, 1, 7, 0, 0, 0, time.UTC)
+	archive := tinkoffArchive(t, uid, first)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// The quota is exceeded by another client, first it is reset already, then in 2 seconds
+		if requests == 1 {
+			w.Header().Set("X-Ratelimit-Reset", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if requests == 2 {
+			w.Header().Set("X-Ratelimit-Reset", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.URL.Query().Get("instrumentId") != uid || r.URL.Query().Get("year") != "2023" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	client := NewTinkoffArchiveClient(server.URL, "token")
+	// The stand-in has no quota
+	client.limiter = newRequestLimiter(1000, time.Second)
+	client.httpClient = server.Client()
+	sleeps := make([]time.Duration, 0)
+	client.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+
+	store, err := NewCandleStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	imports, err := ImportTinkoffArchives(context.Background(), clock.Real, client, store, []string{uid}, []int{2022, 2023})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(imports) != 2 || !imports[0].NotFound || imports[1].Candles != 6 {
+		t.Fatalf("unexpected imports %+v", imports)
+	}
+
+	if len(sleeps) != 1 || sleeps[0] != 2*time.Second {
+		t.Errorf("expected one sleep of 2s until the quota reset, got %v", sleeps)
+	}
+
+	md := domain.MarketData{ID: uid, Interval: domain.MarketDataInterval_ONE_MINUTE, ProviderType: domain.MarketDataProviderType_TINKOFF}
+	candles, err := store.Candles(md, first, first.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candles) != 6 {
+		t.Fatalf("expected 6 candles, got %d", len(candles))
+	}
+	for i, candle := range candles {
+		if candle.Close != float64(i) || candle.Open != 1 || candle.High != 5 || candle.Low != 0.5 || candle.Volume != 100 {
+			t.Errorf("unexpected candle %d: %+v", i, candle)
+		}
+	}
+	if !candles[3].OpenTime.Equal(first.AddDate(0, 0, 1)) {
+		t.Errorf("unexpected open time of the second day %v", candles[3].OpenTime)
+	}
+
+	// The whole year is loaded, the cache doesn't ask the broker for it
+	missing, err := store.Missing(md, time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("expected the year to be loaded, missing %v", missing)
+	}
+
+	if _, err := TinkoffArchiveDir(t.TempDir()).Archive(context.Background(), uid, 2023); !errors.Is(err, ErrTinkoffArchiveNotFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestImportTinkoffArchivesOfCurrentYear(t *testing.T) {
+	const uid = "e6123145-9665-43e0-8413-cd61b8aa9b13"
+	first := time.Date(2023, time.March, 1, 7, 0, 0, 0, time.UTC)
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, uid+"_2023.zip"), tinkoffArchive(t, uid, first), 0o644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	store, err := NewCandleStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The archive is of the current year, days after its last candle are not loaded yet
+	now := clock.NewVirtualClock(time.Date(2023, time.March, 10, 12, 0, 0, 0, time.UTC))
+	_, err = ImportTinkoffArchives(context.Background(), now, TinkoffArchiveDir(dir), store, []string{uid}, []int{2023})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	md := domain.MarketData{ID: uid, Interval: domain.MarketDataInterval_ONE_MINUTE, ProviderType: domain.MarketDataProviderType_TINKOFF}
+	yearStart := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+	missing, err := store.Missing(md, yearStart, now.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lastClose := first.AddDate(0, 0, 1).Add(3 * time.Minute)
+	if len(missing) != 1 || !missing[0].From.Equal(lastClose) || !missing[0].To.Equal(now.Now()) {
+		t.Errorf("expected missing %s - %s, got %v", lastClose, now.Now(), missing)
+	}
+}
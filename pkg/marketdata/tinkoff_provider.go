@@ -4,289 +4,906 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os/signal"
+	"maps"
 	"sync"
-	"syscall"
 	"time"
 
+	"github.com/Reensef/sigmasage/pkg/calendar"
 	"github.com/Reensef/sigmasage/pkg/domain"
 	"github.com/Reensef/sigmasage/pkg/utils"
 
 	"slices"
 
-	"github.com/russianinvestments/invest-api-go-sdk/investgo"
 	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-// TinkoffMarketDataProvider implements an observer that distributes candle data to subscribers
+// Quota of the broker for GetCandles requests
+const tinkoffCandlesRequestsPerMinute = 300
+
+// How many times GetCandlesByCount widens the window when the exchange had no trades
+const tinkoffCountWindowExtensions = 3
+
+// Delays between attempts to reconnect the market data stream
+const (
+	tinkoffReconnectMinDelay = time.Second
+	tinkoffReconnectMaxDelay = time.Minute
+)
+
+// Stream may send the last update of a candle a bit after its close,
+// a candle without the next one is closed after this delay
+const tinkoffCandleCloseDelay = 5 * time.Second
+
+// Depths of order book subscriptions allowed by the broker
+var tinkoffOrderBookDepths = []int{1, 10, 20, 30, 40, 50}
+
+// TinkoffMarketDataProvider implements an observer that distributes market data to subscribers.
+// All subscriptions share one MarketDataStream, subscribers are guarded by mu.
 type TinkoffMarketDataProvider struct {
-	token                         string
-	mu                            sync.RWMutex
-	mdStream                      *investgo.MarketDataStream
-	mdService                     *investgo.MarketDataServiceClient
-	instrumentService             *investgo.InstrumentsServiceClient
-	candleSubscribers             map[domain.MarketData][]chan domain.Candle
-	candlesNotifyCancel           context.CancelFunc
-	isNotifyingCandlesSubscribers bool
+	// Lifetime of the provider, the stream is stopped when it is done
+	ctx                             context.Context
+	mu                              sync.RWMutex
+	mdStreamClient                  pb.MarketDataStreamServiceClient
+	mdStream                        *tinkoffStream
+	mdService                       pb.MarketDataServiceClient
+	candleSubscribers               *subscribers[domain.MarketData, domain.Candle]
+	candleUpdateSubscribers         *subscribers[domain.MarketData, domain.Candle]
+	candleCloser                    *candleCloser
+	orderBookSubscribers            *subscribers[domain.OrderBookInfo, domain.OrderBook]
+	lastPriceSubscribers            *subscribers[domain.InstrumentInfo, domain.LastPrice]
+	tradeSubscribers                *subscribers[domain.InstrumentInfo, domain.Trade]
+	lastCandleTimes                 map[domain.MarketData]time.Time
+	candlesNotifyCancel             context.CancelFunc
+	isListening                     bool
+	isNotifyingCandlesSubscribers   bool
+	isNotifyingOrderBookSubscribers bool
+	isNotifyingLastPriceSubscribers bool
+	isNotifyingTradeSubscribers     bool
+	limiter                         *requestLimiter
+	calendar                        calendar.Calendar
 }
 
-func NewTinkoffMarketDataProvider(token string) (*TinkoffMarketDataProvider, error) {
-	logger := utils.TinkoffLogger{}
+// The connection is closed when ctx is done
+func NewTinkoffMarketDataProvider(
+	ctx context.Context,
+	config utils.TinkoffConfig,
+) (*TinkoffMarketDataProvider, error) {
+	conn, err := utils.NewTinkoffConn(config)
+	if err != nil {
+		return nil, err
+	}
 
-	config := investgo.Config{
-		EndPoint:        "invest-public-api.tinkoff.ru:443",
-		Token:           token,
-		MaxRetries:      3,
-		AppName:         "sigmasage",
-		DisableAllRetry: false,
+	t := &TinkoffMarketDataProvider{
+		ctx:                     ctx,
+		candleSubscribers:       newSubscribers[domain.MarketData, domain.Candle]("Candle"),
+		candleUpdateSubscribers: newSubscribers[domain.MarketData, domain.Candle]("Candle update"),
+		orderBookSubscribers:    newSubscribers[domain.OrderBookInfo, domain.OrderBook]("Order book"),
+		lastPriceSubscribers:    newSubscribers[domain.InstrumentInfo, domain.LastPrice]("Last price"),
+		tradeSubscribers:        newSubscribers[domain.InstrumentInfo, domain.Trade]("Trade"),
+		lastCandleTimes:         make(map[domain.MarketData]time.Time),
+		mdStreamClient:          pb.NewMarketDataStreamServiceClient(conn),
+		mdService:               pb.NewMarketDataServiceClient(conn),
+		limiter:                 newRequestLimiter(tinkoffCandlesRequestsPerMinute, time.Minute),
+		calendar:                calendar.NewMOEXCalendar(),
 	}
+	t.candleCloser = newCandleCloser(&t.mu, tinkoffCandleCloseDelay, func(candle domain.Candle) {
+		t.notifyCandleSubscribers(candle.MarketData, candle)
+	})
 
-	client, err := investgo.NewClient(context.Background(), config, logger)
+	t.mdStream, err = newTinkoffStream(ctx, t.mdStreamClient, t.rejectSubscription)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	instrumentsService := client.NewInstrumentsServiceClient()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	return t, nil
+}
+
+// One stream serves every instrument and interval,
+// candles are routed to subscribers by instrument UID or FIGI and interval.
+// Only closed candles are sent, see SubscribeCandleUpdates for forming ones.
+func (t *TinkoffMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketDataInfo domain.MarketData,
+) (<-chan domain.Candle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	instrResp, err := instrumentsService.ShareByTicker("YDEX", "TQBR")
+	err := t.subscribeCandleStream(marketDataInfo)
 	if err != nil {
-		logger.Errorf(err.Error())
-	} else {
-		ins := instrResp.GetInstrument()
-		fmt.Printf("Инструменты по запросу YDEX - %v %v\n", ins.GetName(), ins.GetUid())
+		return nil, err
 	}
 
-	instrumentsService = client.NewInstrumentsServiceClient()
+	ch, _ := t.candleSubscribers.add(ctx, marketDataInfo, func(ch <-chan domain.Candle) {
+		t.UnsubscribeCandles(marketDataInfo, ch)
+	})
 
-	instrResp, err = instrumentsService.ShareByTicker("LKOH", "TQBR")
-	if err != nil {
-		logger.Errorf(err.Error())
-	} else {
-		ins := instrResp.GetInstrument()
-		fmt.Printf("Инструменты по запросу LKOH - %v %v\n", ins.GetName(), ins.GetUid())
+	return ch, nil
+}
+
+func (t *TinkoffMarketDataProvider) UnsubscribeCandles(
+	marketDataInfo domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last, err := t.candleSubscribers.remove(marketDataInfo, ch)
+	if err != nil || !last {
+		return err
 	}
 
-	mdStreamClient := client.NewMarketDataStreamClient()
+	delete(t.lastCandleTimes, marketDataInfo)
+
+	return t.unsubscribeCandleStream(marketDataInfo)
+}
+
+// Every update of the forming candle with Partial set
+func (t *TinkoffMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketDataInfo domain.MarketData,
+) (<-chan domain.Candle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	mdStream, err := mdStreamClient.MarketDataStream()
+	err := t.subscribeCandleStream(marketDataInfo)
 	if err != nil {
 		return nil, err
 	}
 
-	mdService := client.NewMarketDataServiceClient()
+	ch, _ := t.candleUpdateSubscribers.add(ctx, marketDataInfo, func(ch <-chan domain.Candle) {
+		t.UnsubscribeCandleUpdates(marketDataInfo, ch)
+	})
 
-	return &TinkoffMarketDataProvider{
-		token:             token,
-		candleSubscribers: make(map[domain.MarketData][]chan domain.Candle),
-		mdStream:          mdStream,
-		mdService:         mdService,
-		instrumentService: instrumentsService,
-	}, nil
+	return ch, nil
 }
 
-func (t *TinkoffMarketDataProvider) SubscribeCandles(
+func (t *TinkoffMarketDataProvider) UnsubscribeCandleUpdates(
 	marketDataInfo domain.MarketData,
-) (<-chan domain.Candle, error) {
-	ch := make(chan domain.Candle, 100)
+	ch <-chan domain.Candle,
+) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	if _, exists := t.candleSubscribers[marketDataInfo]; !exists {
-		t.candleSubscribers[marketDataInfo] =
-			make([]chan domain.Candle, 0)
+	last, err := t.candleUpdateSubscribers.remove(marketDataInfo, ch)
+	if err != nil || !last {
+		return err
+	}
+
+	return t.unsubscribeCandleStream(marketDataInfo)
+}
+
+// Must be called with mu locked.
+// Closed candles and updates share one stream subscription.
+func (t *TinkoffMarketDataProvider) subscribeCandleStream(marketDataInfo domain.MarketData) error {
+	if t.isCandleStreamSubscribed(marketDataInfo) {
+		return nil
 	}
-	t.candleSubscribers[marketDataInfo] =
-		append(t.candleSubscribers[marketDataInfo], ch)
 
 	candlesChan, err := t.mdStream.SubscribeCandle(
-		[]string{marketDataInfo.ID},
+		marketDataInfo.ID,
 		t.convertToSubscriptionInterval(marketDataInfo.Interval),
-		true,
-		nil,
 	)
-
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	t.ensureListening()
+
+	// The stream returns the same channel for every candle subscription
 	if !t.isNotifyingCandlesSubscribers {
-		t.startNotifyingCandlesSubscribers(
-			marketDataInfo,
-			candlesChan,
-		)
+		go t.notifyCandlesSubscribers(candlesChan)
 		t.isNotifyingCandlesSubscribers = true
 	}
 
+	return nil
+}
+
+// Must be called with mu locked after a subscriber is removed
+func (t *TinkoffMarketDataProvider) unsubscribeCandleStream(marketDataInfo domain.MarketData) error {
+	if t.candleSubscribers.has(marketDataInfo) || t.candleUpdateSubscribers.has(marketDataInfo) {
+		return nil
+	}
+
+	t.candleCloser.remove(marketDataInfo)
+
+	if t.isCandleStreamSubscribed(marketDataInfo) {
+		return nil
+	}
+
+	return t.mdStream.UnsubscribeCandle(
+		marketDataInfo.ID,
+		t.convertToSubscriptionInterval(marketDataInfo.Interval),
+	)
+}
+
+func (t *TinkoffMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	if !slices.Contains(tinkoffOrderBookDepths, orderBookInfo.Depth) {
+		return nil, fmt.Errorf("unsupported order book depth %d", orderBookInfo.Depth)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.orderBookSubscribers.has(orderBookInfo) {
+		orderBookChan, err := t.mdStream.SubscribeOrderBook(
+			orderBookInfo.ID,
+			int32(orderBookInfo.Depth),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		t.ensureListening()
+
+		if !t.isNotifyingOrderBookSubscribers {
+			go t.notifyOrderBookSubscribers(orderBookChan)
+			t.isNotifyingOrderBookSubscribers = true
+		}
+	}
+
+	ch, _ := t.orderBookSubscribers.add(ctx, orderBookInfo, func(ch <-chan domain.OrderBook) {
+		t.UnsubscribeOrderBook(orderBookInfo, ch)
+	})
+
 	return ch, nil
 }
 
-func (t *TinkoffMarketDataProvider) UnsubscribeCandles(
-	marketDataInfo domain.MarketData,
-	ch <-chan domain.Candle,
+func (t *TinkoffMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
 ) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	if subscribers, exists :=
-		t.candleSubscribers[marketDataInfo]; exists {
-		for i, subscriber := range subscribers {
-			if subscriber == ch {
-				t.candleSubscribers[marketDataInfo] =
-					slices.Delete(subscribers, i, i+1)
-				close(subscriber)
+	last, err := t.orderBookSubscribers.remove(orderBookInfo, ch)
+	if err != nil || !last {
+		return err
+	}
+
+	return t.mdStream.UnsubscribeOrderBook(
+		orderBookInfo.ID,
+		int32(orderBookInfo.Depth),
+	)
+}
 
-				l := len(t.candleSubscribers[marketDataInfo])
-				if l == 0 {
-					delete(t.candleSubscribers, marketDataInfo)
-				}
+func (t *TinkoffMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-				return nil
-			}
+	if !t.lastPriceSubscribers.has(instrumentInfo) {
+		lastPriceChan, err := t.mdStream.SubscribeLastPrice(instrumentInfo.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		t.ensureListening()
+
+		if !t.isNotifyingLastPriceSubscribers {
+			go t.notifyLastPriceSubscribers(lastPriceChan)
+			t.isNotifyingLastPriceSubscribers = true
 		}
 	}
 
-	return fmt.Errorf("undefined subscriber")
+	ch, _ := t.lastPriceSubscribers.add(ctx, instrumentInfo, func(ch <-chan domain.LastPrice) {
+		t.UnsubscribeLastPrices(instrumentInfo, ch)
+	})
+
+	return ch, nil
 }
 
-func (t *TinkoffMarketDataProvider) GetCandlesByTime(
-	marketData domain.MarketData,
-	from time.Time,
-	to time.Time,
-) ([]domain.Candle, error) {
-	result := make([]domain.Candle, 0)
+func (t *TinkoffMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	resp, err := t.mdService.GetHistoricCandles(
-		&investgo.GetHistoricCandlesRequest{
-			Instrument: marketData.ID,
-			Interval: t.convertToCandleInterval(
-				marketData.Interval,
-			),
-			From:   from,
-			To:     to,
-			Source: pb.GetCandlesRequest_CANDLE_SOURCE_INCLUDE_WEEKEND,
-		},
-	)
+	last, err := t.lastPriceSubscribers.remove(instrumentInfo, ch)
+	if err != nil || !last {
+		return err
+	}
 
-	if err != nil {
-		return nil, err
+	return t.mdStream.UnsubscribeLastPrice(instrumentInfo.ID)
+}
+
+func (t *TinkoffMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.tradeSubscribers.has(instrumentInfo) {
+		tradeChan, err := t.mdStream.SubscribeTrade(instrumentInfo.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		t.ensureListening()
+
+		if !t.isNotifyingTradeSubscribers {
+			go t.notifyTradeSubscribers(tradeChan)
+			t.isNotifyingTradeSubscribers = true
+		}
 	}
 
-	for _, candle := range resp {
-		result = append(result, domain.Candle{
-			MarketData: marketData,
-			OpenTime:   candle.GetTime().AsTime(),
-			CloseTime: candle.GetTime().AsTime().Add(
-				time.Duration(
-					ConvertMarketDataIntervalToTime(
-						marketData.Interval,
-					),
-				),
-			),
-			Open:   candle.GetOpen().ToFloat(),
-			High:   candle.GetHigh().ToFloat(),
-			Low:    candle.GetLow().ToFloat(),
-			Close:  candle.GetClose().ToFloat(),
-			Volume: float64(candle.GetVolume()),
-		})
+	ch, _ := t.tradeSubscribers.add(ctx, instrumentInfo, func(ch <-chan domain.Trade) {
+		t.UnsubscribeTrades(instrumentInfo, ch)
+	})
+
+	return ch, nil
+}
+
+func (t *TinkoffMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last, err := t.tradeSubscribers.remove(instrumentInfo, ch)
+	if err != nil || !last {
+		return err
 	}
 
-	return result, nil
+	return t.mdStream.UnsubscribeTrade(instrumentInfo.ID)
+}
+
+func (t *TinkoffMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	return t.loadCandles(ctx, marketData, from, to)
 }
 
 func (t *TinkoffMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
 	marketData domain.MarketData,
 	last time.Time,
 	count int,
 ) ([]domain.Candle, error) {
-	result := make([]domain.Candle, 0)
+	// Windows are counted by the sessions that are kept
+	cal := SessionCalendar(t.calendar, marketData.SessionFilter)
+	first := CandlesWindowStart(cal, marketData.Interval, last, count)
 
-	first := last.Add(-time.Hour * 24 * 14) // 2 weeks ago
-	first = first.Add(
-		-AdjustDurationForWorkingHours(
-			marketData.Interval, count,
-		),
-	) // only working hours
-
-	resp, err := t.mdService.GetHistoricCandles(
-		&investgo.GetHistoricCandlesRequest{
-			Instrument: marketData.ID,
-			Interval: t.convertToCandleInterval(
-				marketData.Interval,
-			),
-			From:   first,
-			To:     last,
-			Source: pb.GetCandlesRequest_CANDLE_SOURCE_INCLUDE_WEEKEND,
-		},
-	)
+	candles, err := t.loadCandles(ctx, marketData, first, last)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(resp) < count {
+	// Illiquid instruments have no candles for periods without trades
+	for i := 0; i < tinkoffCountWindowExtensions && len(candles) < count; i++ {
+		prevFirst := first
+		first = CandlesWindowStart(cal, marketData.Interval, first, count-len(candles))
+
+		older, err := t.loadCandles(ctx, marketData, first, prevFirst)
+		if err != nil {
+			return nil, err
+		}
+		candles = append(older, candles...)
+	}
+
+	if len(candles) < count {
 		return nil, fmt.Errorf(
 			"error getting history data by count",
 		)
 	}
 
-	for _, candle := range resp[len(resp)-count:] {
-		result = append(result, domain.Candle{
-			MarketData: marketData,
-			OpenTime:   candle.GetTime().AsTime(),
-			CloseTime: candle.GetTime().AsTime().Add(
-				time.Duration(
-					ConvertMarketDataIntervalToTime(
-						marketData.Interval,
-					),
-				),
-			),
-			Open:   candle.GetOpen().ToFloat(),
-			High:   candle.GetHigh().ToFloat(),
-			Low:    candle.GetLow().ToFloat(),
-			Close:  candle.GetClose().ToFloat(),
-			Volume: float64(candle.GetVolume()),
+	return candles[len(candles)-count:], nil
+}
+
+// Loads history by windows allowed for one request,
+// result is sorted by OpenTime without duplicates
+func (t *TinkoffMarketDataProvider) loadCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	interval := t.convertToCandleInterval(marketData.Interval)
+	if interval == pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
+		return nil, fmt.Errorf("undefined interval")
+	}
+
+	// Exchange candles have no weekend and dealer trading, main session is filtered by the calendar
+	source := pb.GetCandlesRequest_CANDLE_SOURCE_INCLUDE_WEEKEND
+	if marketData.SessionFilter != domain.SessionFilter_ALL {
+		source = pb.GetCandlesRequest_CANDLE_SOURCE_EXCHANGE
+	}
+
+	result := make([]domain.Candle, 0)
+
+	for _, window := range tinkoffCandlesWindows(marketData.Interval, from, to) {
+		err := t.limiter.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.mdService.GetCandles(ctx, &pb.GetCandlesRequest{
+			InstrumentId:     &marketData.ID,
+			Interval:         interval,
+			From:             timestamppb.New(window.From),
+			To:               timestamppb.New(window.To),
+			CandleSourceType: &source,
 		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, candle := range resp.GetCandles() {
+			result = append(result, t.convertHistoricCandle(marketData, candle))
+		}
+	}
+
+	result = FilterCandlesBySession(t.calendar, marketData.SessionFilter, result)
+
+	return sortUniqueCandles(result), nil
+}
+
+func (t *TinkoffMarketDataProvider) convertHistoricCandle(
+	marketData domain.MarketData,
+	candle *pb.HistoricCandle,
+) domain.Candle {
+	return domain.Candle{
+		MarketData: marketData,
+		OpenTime:   candle.GetTime().AsTime(),
+		CloseTime: CandleCloseTime(
+			marketData.Interval,
+			candle.GetTime().AsTime(),
+			t.calendar.Location(),
+		),
+		Open:   candle.GetOpen().ToFloat(),
+		High:   candle.GetHigh().ToFloat(),
+		Low:    candle.GetLow().ToFloat(),
+		Close:  candle.GetClose().ToFloat(),
+		Volume: float64(candle.GetVolume()),
 	}
+}
 
-	return result, nil
+// Must be called with mu locked
+func (t *TinkoffMarketDataProvider) ensureListening() {
+	if !t.isListening {
+		t.startListening()
+		t.isListening = true
+	}
 }
 
-func (t *TinkoffMarketDataProvider) startNotifyingCandlesSubscribers(marketdata domain.MarketData, candlesChan <-chan *pb.Candle) {
+func (t *TinkoffMarketDataProvider) startListening() {
 	var ctx context.Context
-	ctx, t.candlesNotifyCancel = signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	ctx, t.candlesNotifyCancel = context.WithCancel(t.ctx)
+
+	go t.listen(ctx)
 
 	go func() {
-		err := t.mdStream.Listen()
-		if err != nil {
-			log.Printf("Error listening to candles: %v", err)
-		}
+		<-ctx.Done()
+
+		t.mu.RLock()
+		t.mdStream.Stop()
+		t.mu.RUnlock()
 	}()
+}
+
+// Listens the stream and reconnects it with backoff when it stops
+func (t *TinkoffMarketDataProvider) listen(ctx context.Context) {
+	delay := tinkoffReconnectMinDelay
+
+	for {
+		t.mu.RLock()
+		mdStream := t.mdStream
+		t.mu.RUnlock()
+
+		started := time.Now()
+		err := mdStream.Listen()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Market data stream stopped: %v", err)
+
+		// Stream that worked for a while is not a reason to slow down
+		if time.Since(started) > tinkoffReconnectMaxDelay {
+			delay = tinkoffReconnectMinDelay
+		}
 
-	go func(ctx context.Context) {
 		for {
+			log.Printf("Reconnecting market data stream in %s", delay)
+
 			select {
 			case <-ctx.Done():
 				return
-			case pbCandle, ok := <-candlesChan:
-				if !ok {
-					return
-				}
-
-				candle := domain.Candle{
-					MarketData: marketdata,
-					OpenTime:   pbCandle.GetTime().AsTime(),
-					CloseTime:  pbCandle.GetTime().AsTime().Add(time.Duration(ConvertMarketDataIntervalToTime(marketdata.Interval))),
-					Open:       pbCandle.GetOpen().ToFloat(),
-					High:       pbCandle.GetHigh().ToFloat(),
-					Low:        pbCandle.GetLow().ToFloat(),
-					Close:      pbCandle.GetClose().ToFloat(),
-					Volume:     float64(pbCandle.GetVolume()),
-				}
-				t.mu.RLock()
-				for _, subscriber := range t.candleSubscribers[marketdata] {
-					subscriber <- candle
-				}
-				t.mu.RUnlock()
+			case <-time.After(delay):
+			}
+
+			delay = min(delay*2, tinkoffReconnectMaxDelay)
+
+			err := t.reconnect()
+			if err != nil {
+				log.Printf("Error reconnecting market data stream: %v", err)
+				continue
 			}
+
+			break
+		}
+	}
+}
+
+// Opens a new stream, restores every active subscription
+// and delivers candles missed while the stream was down
+func (t *TinkoffMarketDataProvider) reconnect() error {
+	mdStream, err := newTinkoffStream(t.ctx, t.mdStreamClient, t.rejectSubscription)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+
+	fail := func(err error) error {
+		t.mu.Unlock()
+		mdStream.Stop()
+		return err
+	}
+
+	var candlesChan <-chan *pb.Candle
+	subscribed := make(map[domain.MarketData]struct{})
+	for _, marketData := range t.subscribedCandles() {
+		stream := domain.MarketData{ID: marketData.ID, Interval: marketData.Interval}
+		if _, ok := subscribed[stream]; ok {
+			continue
 		}
-	}(ctx)
+		subscribed[stream] = struct{}{}
+
+		candlesChan, err = mdStream.SubscribeCandle(
+			marketData.ID,
+			t.convertToSubscriptionInterval(marketData.Interval),
+		)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	var orderBookChan <-chan *pb.OrderBook
+	for _, orderBookInfo := range t.orderBookSubscribers.keys() {
+		orderBookChan, err = mdStream.SubscribeOrderBook(
+			orderBookInfo.ID,
+			int32(orderBookInfo.Depth),
+		)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	var lastPriceChan <-chan *pb.LastPrice
+	for _, instrumentInfo := range t.lastPriceSubscribers.keys() {
+		lastPriceChan, err = mdStream.SubscribeLastPrice(instrumentInfo.ID)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	var tradeChan <-chan *pb.Trade
+	for _, instrumentInfo := range t.tradeSubscribers.keys() {
+		tradeChan, err = mdStream.SubscribeTrade(instrumentInfo.ID)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	t.mdStream = mdStream
+	t.isNotifyingCandlesSubscribers = candlesChan != nil
+	t.isNotifyingOrderBookSubscribers = orderBookChan != nil
+	t.isNotifyingLastPriceSubscribers = lastPriceChan != nil
+	t.isNotifyingTradeSubscribers = tradeChan != nil
+
+	lastCandleTimes := maps.Clone(t.lastCandleTimes)
+
+	t.mu.Unlock()
+
+	// Stream is not listened yet, so backfilled candles go first
+	t.backfillCandles(lastCandleTimes)
+
+	// Order books, last prices and trades are snapshots, missed ones are not restored
+	if candlesChan != nil {
+		go t.notifyCandlesSubscribers(candlesChan)
+	}
+	if orderBookChan != nil {
+		go t.notifyOrderBookSubscribers(orderBookChan)
+	}
+	if lastPriceChan != nil {
+		go t.notifyLastPriceSubscribers(lastPriceChan)
+	}
+	if tradeChan != nil {
+		go t.notifyTradeSubscribers(tradeChan)
+	}
+
+	return nil
+}
+
+func (t *TinkoffMarketDataProvider) backfillCandles(lastCandleTimes map[domain.MarketData]time.Time) {
+	now := time.Now()
+
+	for marketData, last := range lastCandleTimes {
+		candles, err := t.GetCandlesByTime(t.ctx, marketData, last, now)
+		if err != nil {
+			log.Printf("Error backfilling candles of %s: %v", marketData.ID, err)
+			continue
+		}
+
+		t.mu.Lock()
+		for _, candle := range candles {
+			// Stream sends only closed candles
+			if candle.CloseTime.After(now) {
+				break
+			}
+			t.notifyCandleSubscribers(marketData, candle)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *TinkoffMarketDataProvider) notifyCandlesSubscribers(candlesChan <-chan *pb.Candle) {
+	for pbCandle := range candlesChan {
+		interval := t.convertFromSubscriptionInterval(pbCandle.GetInterval())
+
+		t.mu.Lock()
+		for _, marketData := range t.subscribedCandles() {
+			if marketData.Interval != interval {
+				continue
+			}
+			if !t.isInstrument(marketData.ID, pbCandle.GetInstrumentUid(), pbCandle.GetFigi()) {
+				continue
+			}
+
+			// Stream sends updates of the forming candle, closer emits it when it is closed
+			candle := t.convertCandle(marketData, pbCandle)
+			if !CandleInSessionFilter(t.calendar, marketData.SessionFilter, candle) {
+				continue
+			}
+			if t.candleCloser.update(candle) {
+				t.candleUpdateSubscribers.notify(marketData, candle)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Must be called with mu locked.
+// Subscriptions that differ only by the session filter share the stream subscription.
+func (t *TinkoffMarketDataProvider) isCandleStreamSubscribed(marketDataInfo domain.MarketData) bool {
+	for _, marketData := range t.subscribedCandles() {
+		if marketData.ID == marketDataInfo.ID && marketData.Interval == marketDataInfo.Interval {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Must be called with mu locked
+func (t *TinkoffMarketDataProvider) subscribedCandles() []domain.MarketData {
+	result := t.candleSubscribers.keys()
+	for _, marketData := range t.candleUpdateSubscribers.keys() {
+		if !t.candleSubscribers.has(marketData) {
+			result = append(result, marketData)
+		}
+	}
+
+	return result
+}
+
+// Must be called with mu locked.
+// Candles are delivered once and in order of OpenTime.
+func (t *TinkoffMarketDataProvider) notifyCandleSubscribers(
+	marketData domain.MarketData,
+	candle domain.Candle,
+) {
+	if !t.candleSubscribers.has(marketData) {
+		return
+	}
+
+	if !candle.OpenTime.After(t.lastCandleTimes[marketData]) {
+		return
+	}
+	t.lastCandleTimes[marketData] = candle.OpenTime
+
+	t.candleSubscribers.notify(marketData, candle)
+}
+
+func (t *TinkoffMarketDataProvider) notifyOrderBookSubscribers(orderBookChan <-chan *pb.OrderBook) {
+	for pbOrderBook := range orderBookChan {
+		t.mu.Lock()
+		for _, orderBookInfo := range t.orderBookSubscribers.keys() {
+			if orderBookInfo.Depth != int(pbOrderBook.GetDepth()) ||
+				!t.isInstrument(orderBookInfo.ID, pbOrderBook.GetInstrumentUid(), pbOrderBook.GetFigi()) {
+				continue
+			}
+
+			t.orderBookSubscribers.notify(orderBookInfo, t.convertOrderBook(orderBookInfo, pbOrderBook))
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *TinkoffMarketDataProvider) notifyLastPriceSubscribers(lastPriceChan <-chan *pb.LastPrice) {
+	for pbLastPrice := range lastPriceChan {
+		t.mu.Lock()
+		for _, instrumentInfo := range t.lastPriceSubscribers.keys() {
+			if !t.isInstrument(instrumentInfo.ID, pbLastPrice.GetInstrumentUid(), pbLastPrice.GetFigi()) {
+				continue
+			}
+
+			t.lastPriceSubscribers.notify(instrumentInfo, domain.LastPrice{
+				Info:  instrumentInfo,
+				Price: pbLastPrice.GetPrice().ToFloat(),
+				Time:  pbLastPrice.GetTime().AsTime(),
+			})
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *TinkoffMarketDataProvider) notifyTradeSubscribers(tradeChan <-chan *pb.Trade) {
+	for pbTrade := range tradeChan {
+		t.mu.Lock()
+		for _, instrumentInfo := range t.tradeSubscribers.keys() {
+			if !t.isInstrument(instrumentInfo.ID, pbTrade.GetInstrumentUid(), pbTrade.GetFigi()) {
+				continue
+			}
+
+			t.tradeSubscribers.notify(instrumentInfo, domain.Trade{
+				Info:      instrumentInfo,
+				Direction: t.convertTradeDirection(pbTrade.GetDirection()),
+				Price:     pbTrade.GetPrice().ToFloat(),
+				Quantity:  pbTrade.GetQuantity(),
+				Time:      pbTrade.GetTime().AsTime(),
+			})
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Subscription refused by the broker will never send data,
+// so channels of its subscribers are closed
+func (t *TinkoffMarketDataProvider) rejectSubscription(rejection tinkoffRejection) {
+	log.Printf("Market data %s", rejection)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch rejection.Kind {
+	case tinkoffSubscriptionKind_CANDLES:
+		interval := t.convertFromSubscriptionInterval(rejection.Interval)
+		for _, marketData := range t.subscribedCandles() {
+			if marketData.Interval != interval || !t.isInstrument(marketData.ID, rejection.UID, rejection.FIGI) {
+				continue
+			}
+
+			t.candleSubscribers.removeAll(marketData)
+			t.candleUpdateSubscribers.removeAll(marketData)
+			t.candleCloser.remove(marketData)
+			delete(t.lastCandleTimes, marketData)
+		}
+	case tinkoffSubscriptionKind_ORDER_BOOK:
+		for _, orderBookInfo := range t.orderBookSubscribers.keys() {
+			if orderBookInfo.Depth == int(rejection.Depth) && t.isInstrument(orderBookInfo.ID, rejection.UID, rejection.FIGI) {
+				t.orderBookSubscribers.removeAll(orderBookInfo)
+			}
+		}
+	case tinkoffSubscriptionKind_LAST_PRICE:
+		for _, instrumentInfo := range t.lastPriceSubscribers.keys() {
+			if t.isInstrument(instrumentInfo.ID, rejection.UID, rejection.FIGI) {
+				t.lastPriceSubscribers.removeAll(instrumentInfo)
+			}
+		}
+	case tinkoffSubscriptionKind_TRADES:
+		for _, instrumentInfo := range t.tradeSubscribers.keys() {
+			if t.isInstrument(instrumentInfo.ID, rejection.UID, rejection.FIGI) {
+				t.tradeSubscribers.removeAll(instrumentInfo)
+			}
+		}
+	}
+}
+
+// Subscriptions are made by UID or FIGI, the stream sends both
+func (t *TinkoffMarketDataProvider) isInstrument(id string, uid string, figi string) bool {
+	return id == uid || id == figi
+}
+
+func (t *TinkoffMarketDataProvider) convertOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	pbOrderBook *pb.OrderBook,
+) domain.OrderBook {
+	convertLevels := func(orders []*pb.Order) []domain.OrderBookLevel {
+		levels := make([]domain.OrderBookLevel, 0, len(orders))
+		for _, order := range orders {
+			levels = append(levels, domain.OrderBookLevel{
+				Price:    order.GetPrice().ToFloat(),
+				Quantity: order.GetQuantity(),
+			})
+		}
+		return levels
+	}
+
+	return domain.OrderBook{
+		Info:         orderBookInfo,
+		Bids:         convertLevels(pbOrderBook.GetBids()),
+		Asks:         convertLevels(pbOrderBook.GetAsks()),
+		IsConsistent: pbOrderBook.GetIsConsistent(),
+		Time:         pbOrderBook.GetTime().AsTime(),
+	}
+}
+
+func (t *TinkoffMarketDataProvider) convertTradeDirection(direction pb.TradeDirection) domain.TradeDirection {
+	switch direction {
+	case pb.TradeDirection_TRADE_DIRECTION_BUY:
+		return domain.TradeDirection_BUY
+	case pb.TradeDirection_TRADE_DIRECTION_SELL:
+		return domain.TradeDirection_SELL
+	default:
+		return domain.TradeDirection_UNSPECIFIED
+	}
+}
+
+func (t *TinkoffMarketDataProvider) convertCandle(
+	marketData domain.MarketData,
+	pbCandle *pb.Candle,
+) domain.Candle {
+	return domain.Candle{
+		MarketData: marketData,
+		OpenTime:   pbCandle.GetTime().AsTime(),
+		CloseTime:  CandleCloseTime(marketData.Interval, pbCandle.GetTime().AsTime(), t.calendar.Location()),
+		Open:       pbCandle.GetOpen().ToFloat(),
+		High:       pbCandle.GetHigh().ToFloat(),
+		Low:        pbCandle.GetLow().ToFloat(),
+		Close:      pbCandle.GetClose().ToFloat(),
+		Volume:     float64(pbCandle.GetVolume()),
+		Partial:    true,
+	}
+}
+
+func (t *TinkoffMarketDataProvider) convertFromSubscriptionInterval(interval pb.SubscriptionInterval) domain.MarketDataInterval {
+	switch interval {
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_ONE_MINUTE:
+		return domain.MarketDataInterval_ONE_MINUTE
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_2_MIN:
+		return domain.MarketDataInterval_TWO_MIN
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_3_MIN:
+		return domain.MarketDataInterval_THREE_MIN
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_FIVE_MINUTES:
+		return domain.MarketDataInterval_FIVE_MINUTES
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_10_MIN:
+		return domain.MarketDataInterval_TEN_MIN
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_FIFTEEN_MINUTES:
+		return domain.MarketDataInterval_FIFTEEN_MINUTES
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_30_MIN:
+		return domain.MarketDataInterval_THERTY_MIN
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_ONE_HOUR:
+		return domain.MarketDataInterval_ONE_HOUR
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_2_HOUR:
+		return domain.MarketDataInterval_TWO_HOUR
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_4_HOUR:
+		return domain.MarketDataInterval_FOUR_HOUR
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_ONE_DAY:
+		return domain.MarketDataInterval_ONE_DAY
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_WEEK:
+		return domain.MarketDataInterval_WEEK
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_MONTH:
+		return domain.MarketDataInterval_MONTH
+	default:
+		return domain.MarketDataInterval_UNSPECIFIED
+	}
 }
 
 func (t *TinkoffMarketDataProvider) convertToSubscriptionInterval(interval domain.MarketDataInterval) pb.SubscriptionInterval {
@@ -0,0 +1,235 @@
+package marketdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/internal/tinkofffake"
+	"github.com/Reensef/sigmasage/pkg/domain"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func newFakeTinkoffProvider(t *testing.T) (*TinkoffMarketDataProvider, *tinkofffake.Server) {
+	t.Helper()
+
+	server, err := tinkofffake.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(server.Stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	provider, err := NewTinkoffMarketDataProvider(ctx, server.Config())
+	if err != nil {
+		t.Fatalf("NewTinkoffMarketDataProvider: %v", err)
+	}
+
+	return provider, server
+}
+
+func fakeHistoricCandle(openTime time.Time, close float64, complete bool) *pb.HistoricCandle {
+	return &pb.HistoricCandle{
+		Open:       tinkofffake.Quotation(close),
+		High:       tinkofffake.Quotation(close),
+		Low:        tinkofffake.Quotation(close),
+		Close:      tinkofffake.Quotation(close),
+		Volume:     1,
+		Time:       timestamppb.New(openTime),
+		IsComplete: complete,
+	}
+}
+
+func fakeStreamCandle(uid string, openTime time.Time, close float64) *pb.Candle {
+	return &pb.Candle{
+		Interval:      pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_ONE_MINUTE,
+		Open:          tinkofffake.Quotation(close),
+		High:          tinkofffake.Quotation(close),
+		Low:           tinkofffake.Quotation(close),
+		Close:         tinkofffake.Quotation(close),
+		Volume:        1,
+		Time:          timestamppb.New(openTime),
+		LastTradeTs:   timestamppb.New(openTime),
+		InstrumentUid: uid,
+	}
+}
+
+func TestTinkoffProviderPagesHistory(t *testing.T) {
+	provider, server := newFakeTinkoffProvider(t)
+
+	md := domain.MarketData{
+		ID:           "uid-1",
+		Interval:     domain.MarketDataInterval_ONE_MINUTE,
+		ProviderType: domain.MarketDataProviderType_TINKOFF,
+	}
+	from := time.Date(2024, time.March, 4, 7, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 3)
+
+	// One candle an hour is enough to check windows, the last one is still forming
+	for openTime := from; openTime.Before(to); openTime = openTime.Add(time.Hour) {
+		server.AddCandles(
+			md.ID,
+			pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+			fakeHistoricCandle(openTime, float64(openTime.Hour()), openTime.Before(to.Add(-time.Hour))),
+		)
+	}
+
+	candles, err := provider.GetCandlesByTime(context.Background(), md, from, to)
+	if err != nil {
+		t.Fatalf("GetCandlesByTime: %v", err)
+	}
+
+	// History includes the forming candle as the broker returns it
+	if len(candles) != 72 {
+		t.Fatalf("expected 72 candles, got %d", len(candles))
+	}
+	for i := 1; i < len(candles); i++ {
+		if !candles[i].OpenTime.After(candles[i-1].OpenTime) {
+			t.Fatalf("candles are not sorted at %d", i)
+		}
+	}
+
+	// Minute candles are requested by one day
+	requests := server.CandleRequests()
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+	for i, req := range requests {
+		windowFrom := from.AddDate(0, 0, i)
+		if !req.GetFrom().AsTime().Equal(windowFrom) || !req.GetTo().AsTime().Equal(windowFrom.AddDate(0, 0, 1)) {
+			t.Errorf("request %d: got %s - %s", i, req.GetFrom().AsTime(), req.GetTo().AsTime())
+		}
+	}
+}
+
+func TestTinkoffProviderReconnects(t *testing.T) {
+	provider, server := newFakeTinkoffProvider(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	md := domain.MarketData{
+		ID:           "uid-1",
+		Interval:     domain.MarketDataInterval_ONE_MINUTE,
+		ProviderType: domain.MarketDataProviderType_TINKOFF,
+	}
+
+	ch, err := provider.SubscribeCandles(ctx, md)
+	if err != nil {
+		t.Fatalf("SubscribeCandles: %v", err)
+	}
+
+	err = server.WaitSubscriptions(ctx, 1)
+	if err != nil {
+		t.Fatalf("WaitSubscriptions: %v", err)
+	}
+
+	// Candles of the past are closed right after the update
+	start := time.Now().Truncate(time.Minute).Add(-10 * time.Minute)
+
+	receive := func(openTime time.Time) {
+		t.Helper()
+
+		select {
+		case candle := <-ch:
+			if !candle.OpenTime.Equal(openTime) || candle.Partial {
+				t.Fatalf("expected closed candle at %s, got %+v", openTime, candle)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no candle at %s", openTime)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		openTime := start.Add(time.Duration(i) * time.Minute)
+		err = server.SendCandle(fakeStreamCandle(md.ID, openTime, 100))
+		if err != nil {
+			t.Fatalf("SendCandle: %v", err)
+		}
+		receive(openTime)
+	}
+
+	// Candle closed while the stream is down comes from history
+	missed := start.Add(2 * time.Minute)
+	server.AddCandles(md.ID, pb.CandleInterval_CANDLE_INTERVAL_1_MIN, fakeHistoricCandle(missed, 101, true))
+
+	server.DropStreams()
+
+	err = server.WaitSubscriptions(ctx, 2)
+	if err != nil {
+		t.Fatalf("stream is not resubscribed: %v", err)
+	}
+
+	next := start.Add(3 * time.Minute)
+	err = server.SendCandle(fakeStreamCandle(md.ID, next, 102))
+	if err != nil {
+		t.Fatalf("SendCandle: %v", err)
+	}
+
+	receive(missed)
+	receive(next)
+}
+
+func TestTinkoffProviderClosesRejectedSubscription(t *testing.T) {
+	provider, server := newFakeTinkoffProvider(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	server.RejectSubscriptions("unknown", pb.SubscriptionStatus_SUBSCRIPTION_STATUS_INSTRUMENT_NOT_FOUND)
+
+	rejected, err := provider.SubscribeCandles(ctx, domain.MarketData{
+		ID:           "unknown",
+		Interval:     domain.MarketDataInterval_ONE_MINUTE,
+		ProviderType: domain.MarketDataProviderType_TINKOFF,
+	})
+	if err != nil {
+		t.Fatalf("SubscribeCandles: %v", err)
+	}
+
+	md := domain.MarketData{
+		ID:           "uid-1",
+		Interval:     domain.MarketDataInterval_ONE_MINUTE,
+		ProviderType: domain.MarketDataProviderType_TINKOFF,
+	}
+	ch, err := provider.SubscribeCandles(ctx, md)
+	if err != nil {
+		t.Fatalf("SubscribeCandles: %v", err)
+	}
+
+	select {
+	case _, ok := <-rejected:
+		if ok {
+			t.Fatalf("expected the rejected channel to be closed")
+		}
+	case <-ctx.Done():
+		t.Fatalf("rejected channel is not closed")
+	}
+
+	// Other subscriptions of the stream keep working
+	err = server.WaitSubscriptions(ctx, 2)
+	if err != nil {
+		t.Fatalf("WaitSubscriptions: %v", err)
+	}
+
+	openTime := time.Now().Truncate(time.Minute).Add(-10 * time.Minute)
+	for i := 0; i < 2; i++ {
+		err = server.SendCandle(fakeStreamCandle(md.ID, openTime.Add(time.Duration(i)*time.Minute), 100))
+		if err != nil {
+			t.Fatalf("SendCandle: %v", err)
+		}
+	}
+
+	select {
+	case candle, ok := <-ch:
+		if !ok || !candle.OpenTime.Equal(openTime) {
+			t.Fatalf("expected candle at %s, got %+v", openTime, candle)
+		}
+	case <-ctx.Done():
+		t.Fatalf("no candle of the accepted subscription")
+	}
+}
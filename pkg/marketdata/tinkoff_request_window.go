@@ -0,0 +1,60 @@
+package marketdata
+
+import (
+	"slices"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Splits [from, to) into the ranges allowed for one history request of the broker
+func tinkoffCandlesWindows(interval domain.MarketDataInterval, from time.Time, to time.Time) []TimeRange {
+	result := make([]TimeRange, 0)
+
+	for windowFrom := from; windowFrom.Before(to); {
+		windowTo := minTime(tinkoffCandlesWindowEnd(interval, windowFrom), to)
+		result = append(result, TimeRange{From: windowFrom, To: windowTo})
+		windowFrom = windowTo
+	}
+
+	return result
+}
+
+// Broker limits the history range of one GetCandles request depending on the interval
+func tinkoffCandlesWindowEnd(interval domain.MarketDataInterval, from time.Time) time.Time {
+	switch interval {
+	case domain.MarketDataInterval_ONE_MINUTE,
+		domain.MarketDataInterval_TWO_MIN,
+		domain.MarketDataInterval_THREE_MIN:
+		return from.AddDate(0, 0, 1)
+	case domain.MarketDataInterval_FIVE_MINUTES,
+		domain.MarketDataInterval_TEN_MIN:
+		return from.AddDate(0, 0, 7)
+	case domain.MarketDataInterval_FIFTEEN_MINUTES,
+		domain.MarketDataInterval_THERTY_MIN:
+		return from.AddDate(0, 0, 21)
+	case domain.MarketDataInterval_ONE_HOUR,
+		domain.MarketDataInterval_TWO_HOUR,
+		domain.MarketDataInterval_FOUR_HOUR:
+		return from.AddDate(0, 3, 0)
+	case domain.MarketDataInterval_ONE_DAY:
+		return from.AddDate(6, 0, 0)
+	case domain.MarketDataInterval_WEEK:
+		return from.AddDate(5, 0, 0)
+	case domain.MarketDataInterval_MONTH:
+		return from.AddDate(10, 0, 0)
+	default:
+		return from.AddDate(0, 0, 1)
+	}
+}
+
+// Sorts candles of several windows by OpenTime, a candle returned by two windows is kept once
+func sortUniqueCandles(candles []domain.Candle) []domain.Candle {
+	slices.SortStableFunc(candles, func(a, b domain.Candle) int {
+		return a.OpenTime.Compare(b.OpenTime)
+	})
+
+	return slices.CompactFunc(candles, func(a, b domain.Candle) bool {
+		return a.OpenTime.Equal(b.OpenTime)
+	})
+}
@@ -0,0 +1,94 @@
+package marketdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestTinkoffCandlesWindows(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		interval domain.MarketDataInterval
+		to       time.Time
+		expected []time.Time
+	}{
+		{"empty range", domain.MarketDataInterval_ONE_MINUTE, start, []time.Time{}},
+		{"inside one window", domain.MarketDataInterval_ONE_MINUTE, start.Add(time.Hour), []time.Time{start, start.Add(time.Hour)}},
+		{"exactly one window", domain.MarketDataInterval_ONE_MINUTE, start.AddDate(0, 0, 1), []time.Time{start, start.AddDate(0, 0, 1)}},
+		{"minutes by days", domain.MarketDataInterval_ONE_MINUTE, start.AddDate(0, 0, 2).Add(-5 * time.Hour),
+			[]time.Time{start, start.AddDate(0, 0, 1), start.AddDate(0, 0, 2).Add(-5 * time.Hour)}},
+		{"five minutes by weeks", domain.MarketDataInterval_FIVE_MINUTES, start.AddDate(0, 0, 10),
+			[]time.Time{start, start.AddDate(0, 0, 7), start.AddDate(0, 0, 10)}},
+		{"hours by quarters", domain.MarketDataInterval_ONE_HOUR, start.AddDate(0, 7, 0),
+			[]time.Time{start, start.AddDate(0, 3, 0), start.AddDate(0, 6, 0), start.AddDate(0, 7, 0)}},
+		{"days by six years", domain.MarketDataInterval_ONE_DAY, start.AddDate(7, 0, 0),
+			[]time.Time{start, start.AddDate(6, 0, 0), start.AddDate(7, 0, 0)}},
+	}
+
+	for _, test := range tests {
+		windows := tinkoffCandlesWindows(test.interval, start, test.to)
+		if len(windows) != max(len(test.expected)-1, 0) {
+			t.Errorf("%s: expected %d windows, got %v", test.name, len(test.expected)-1, windows)
+			continue
+		}
+
+		for i, window := range windows {
+			if !window.From.Equal(test.expected[i]) || !window.To.Equal(test.expected[i+1]) {
+				t.Errorf("%s: unexpected window %d %v", test.name, i, window)
+			}
+		}
+	}
+}
+
+func TestSortUniqueCandles(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	candle := func(hour int, close float64) domain.Candle {
+		return domain.Candle{OpenTime: start.Add(time.Duration(hour) * time.Hour), Close: close}
+	}
+
+	// Second window starts with the candle that ends the first one
+	candles := sortUniqueCandles([]domain.Candle{
+		candle(0, 1), candle(1, 2), candle(2, 3),
+		candle(2, 30), candle(3, 4),
+		candle(1, 20),
+	})
+
+	expected := []float64{1, 2, 3, 4}
+	if len(candles) != len(expected) {
+		t.Fatalf("expected %d candles, got %+v", len(expected), candles)
+	}
+	for i, c := range candles {
+		if !c.OpenTime.Equal(start.Add(time.Duration(i)*time.Hour)) || c.Close != expected[i] {
+			t.Errorf("unexpected candle %d %+v", i, c)
+		}
+	}
+}
+
+func TestRequestLimiter(t *testing.T) {
+	limiter := newRequestLimiter(10, 100*time.Millisecond)
+	ctx := context.Background()
+
+	begin := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limiter.Wait(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// The first request goes at once, the rest are spread by 10ms
+	if elapsed := time.Since(begin); elapsed < 40*time.Millisecond {
+		t.Errorf("expected requests spread over 40ms, took %v", elapsed)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := limiter.Wait(cancelled); err == nil {
+			t.Errorf("expected error of cancelled context")
+		}
+	}
+}
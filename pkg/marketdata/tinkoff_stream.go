@@ -0,0 +1,277 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	pb "github.com/russianinvestments/invest-api-go-sdk/proto"
+)
+
+// Payloads waiting for the subscribers goroutines of the provider
+const tinkoffStreamBufferSize = 100
+
+type tinkoffSubscriptionKind int
+
+const (
+	tinkoffSubscriptionKind_CANDLES tinkoffSubscriptionKind = iota
+	tinkoffSubscriptionKind_ORDER_BOOK
+	tinkoffSubscriptionKind_LAST_PRICE
+	tinkoffSubscriptionKind_TRADES
+)
+
+var tinkoffSubscriptionKindNames = map[tinkoffSubscriptionKind]string{
+	tinkoffSubscriptionKind_CANDLES:    "candles",
+	tinkoffSubscriptionKind_ORDER_BOOK: "order book",
+	tinkoffSubscriptionKind_LAST_PRICE: "last price",
+	tinkoffSubscriptionKind_TRADES:     "trades",
+}
+
+// Subscription refused by the broker, e.g. of an unknown instrument or over the limit.
+// Interval is set for candles, Depth for order books.
+type tinkoffRejection struct {
+	Kind     tinkoffSubscriptionKind
+	UID      string
+	FIGI     string
+	Interval pb.SubscriptionInterval
+	Depth    int32
+	Status   pb.SubscriptionStatus
+}
+
+func (r tinkoffRejection) String() string {
+	id := r.UID
+	if id == "" {
+		id = r.FIGI
+	}
+
+	return fmt.Sprintf("%s subscription of %s rejected with status %v", tinkoffSubscriptionKindNames[r.Kind], id, r.Status)
+}
+
+// tinkoffStream is one MarketDataStream of the broker.
+// Payloads of every subscription of a kind go to one channel,
+// channels are closed when Listen returns.
+type tinkoffStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	stream pb.MarketDataStreamService_MarketDataStreamClient
+	// Called by Listen for every subscription the broker refused
+	reject func(rejection tinkoffRejection)
+	// Send of a gRPC stream must not be called concurrently
+	sendMu     sync.Mutex
+	candles    chan *pb.Candle
+	orderBooks chan *pb.OrderBook
+	lastPrices chan *pb.LastPrice
+	trades     chan *pb.Trade
+}
+
+// The stream lives until ctx is done or Stop is called
+func newTinkoffStream(
+	ctx context.Context,
+	client pb.MarketDataStreamServiceClient,
+	reject func(rejection tinkoffRejection),
+) (*tinkoffStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream, err := client.MarketDataStream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &tinkoffStream{
+		ctx:        ctx,
+		cancel:     cancel,
+		stream:     stream,
+		reject:     reject,
+		candles:    make(chan *pb.Candle, tinkoffStreamBufferSize),
+		orderBooks: make(chan *pb.OrderBook, tinkoffStreamBufferSize),
+		lastPrices: make(chan *pb.LastPrice, tinkoffStreamBufferSize),
+		trades:     make(chan *pb.Trade, tinkoffStreamBufferSize),
+	}, nil
+}
+
+func (s *tinkoffStream) send(req *pb.MarketDataRequest) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	return s.stream.Send(req)
+}
+
+func (s *tinkoffStream) SubscribeCandle(id string, interval pb.SubscriptionInterval) (<-chan *pb.Candle, error) {
+	return s.candles, s.candlesRequest(pb.SubscriptionAction_SUBSCRIPTION_ACTION_SUBSCRIBE, id, interval)
+}
+
+func (s *tinkoffStream) UnsubscribeCandle(id string, interval pb.SubscriptionInterval) error {
+	return s.candlesRequest(pb.SubscriptionAction_SUBSCRIPTION_ACTION_UNSUBSCRIBE, id, interval)
+}
+
+// WaitingClose is not requested: updates subscribers need every update of the forming candle,
+// so the provider closes candles itself, see candleCloser
+func (s *tinkoffStream) candlesRequest(
+	action pb.SubscriptionAction,
+	id string,
+	interval pb.SubscriptionInterval,
+) error {
+	return s.send(&pb.MarketDataRequest{
+		Payload: &pb.MarketDataRequest_SubscribeCandlesRequest{
+			SubscribeCandlesRequest: &pb.SubscribeCandlesRequest{
+				SubscriptionAction: action,
+				Instruments:        []*pb.CandleInstrument{{InstrumentId: id, Interval: interval}},
+			},
+		},
+	})
+}
+
+func (s *tinkoffStream) SubscribeOrderBook(id string, depth int32) (<-chan *pb.OrderBook, error) {
+	return s.orderBooks, s.orderBookRequest(pb.SubscriptionAction_SUBSCRIPTION_ACTION_SUBSCRIBE, id, depth)
+}
+
+func (s *tinkoffStream) UnsubscribeOrderBook(id string, depth int32) error {
+	return s.orderBookRequest(pb.SubscriptionAction_SUBSCRIPTION_ACTION_UNSUBSCRIBE, id, depth)
+}
+
+func (s *tinkoffStream) orderBookRequest(action pb.SubscriptionAction, id string, depth int32) error {
+	return s.send(&pb.MarketDataRequest{
+		Payload: &pb.MarketDataRequest_SubscribeOrderBookRequest{
+			SubscribeOrderBookRequest: &pb.SubscribeOrderBookRequest{
+				SubscriptionAction: action,
+				Instruments:        []*pb.OrderBookInstrument{{InstrumentId: id, Depth: depth}},
+			},
+		},
+	})
+}
+
+func (s *tinkoffStream) SubscribeLastPrice(id string) (<-chan *pb.LastPrice, error) {
+	return s.lastPrices, s.lastPriceRequest(pb.SubscriptionAction_SUBSCRIPTION_ACTION_SUBSCRIBE, id)
+}
+
+func (s *tinkoffStream) UnsubscribeLastPrice(id string) error {
+	return s.lastPriceRequest(pb.SubscriptionAction_SUBSCRIPTION_ACTION_UNSUBSCRIBE, id)
+}
+
+func (s *tinkoffStream) lastPriceRequest(action pb.SubscriptionAction, id string) error {
+	return s.send(&pb.MarketDataRequest{
+		Payload: &pb.MarketDataRequest_SubscribeLastPriceRequest{
+			SubscribeLastPriceRequest: &pb.SubscribeLastPriceRequest{
+				SubscriptionAction: action,
+				Instruments:        []*pb.LastPriceInstrument{{InstrumentId: id}},
+			},
+		},
+	})
+}
+
+// Trades of the exchange and the dealer
+func (s *tinkoffStream) SubscribeTrade(id string) (<-chan *pb.Trade, error) {
+	return s.trades, s.tradeRequest(pb.SubscriptionAction_SUBSCRIPTION_ACTION_SUBSCRIBE, id)
+}
+
+func (s *tinkoffStream) UnsubscribeTrade(id string) error {
+	return s.tradeRequest(pb.SubscriptionAction_SUBSCRIPTION_ACTION_UNSUBSCRIBE, id)
+}
+
+func (s *tinkoffStream) tradeRequest(action pb.SubscriptionAction, id string) error {
+	return s.send(&pb.MarketDataRequest{
+		Payload: &pb.MarketDataRequest_SubscribeTradesRequest{
+			SubscribeTradesRequest: &pb.SubscribeTradesRequest{
+				SubscriptionAction: action,
+				Instruments:        []*pb.TradeInstrument{{InstrumentId: id}},
+				TradeType:          pb.TradeSourceType_TRADE_SOURCE_ALL,
+			},
+		},
+	})
+}
+
+// Blocks until the stream ends and returns the reason.
+// Refused subscriptions are passed to reject, other responses and pings are skipped.
+func (s *tinkoffStream) Listen() error {
+	defer close(s.candles)
+	defer close(s.orderBooks)
+	defer close(s.lastPrices)
+	defer close(s.trades)
+
+	for {
+		resp, err := s.stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch payload := resp.GetPayload().(type) {
+		case *pb.MarketDataResponse_Candle:
+			err = deliverStreamPayload(s.ctx, s.candles, payload.Candle)
+		case *pb.MarketDataResponse_Orderbook:
+			err = deliverStreamPayload(s.ctx, s.orderBooks, payload.Orderbook)
+		case *pb.MarketDataResponse_LastPrice:
+			err = deliverStreamPayload(s.ctx, s.lastPrices, payload.LastPrice)
+		case *pb.MarketDataResponse_Trade:
+			err = deliverStreamPayload(s.ctx, s.trades, payload.Trade)
+		case *pb.MarketDataResponse_SubscribeCandlesResponse:
+			for _, sub := range payload.SubscribeCandlesResponse.GetCandlesSubscriptions() {
+				s.checkSubscription(tinkoffRejection{
+					Kind:     tinkoffSubscriptionKind_CANDLES,
+					UID:      sub.GetInstrumentUid(),
+					FIGI:     sub.GetFigi(),
+					Interval: sub.GetInterval(),
+					Status:   sub.GetSubscriptionStatus(),
+				})
+			}
+		case *pb.MarketDataResponse_SubscribeOrderBookResponse:
+			for _, sub := range payload.SubscribeOrderBookResponse.GetOrderBookSubscriptions() {
+				s.checkSubscription(tinkoffRejection{
+					Kind:   tinkoffSubscriptionKind_ORDER_BOOK,
+					UID:    sub.GetInstrumentUid(),
+					FIGI:   sub.GetFigi(),
+					Depth:  sub.GetDepth(),
+					Status: sub.GetSubscriptionStatus(),
+				})
+			}
+		case *pb.MarketDataResponse_SubscribeLastPriceResponse:
+			for _, sub := range payload.SubscribeLastPriceResponse.GetLastPriceSubscriptions() {
+				s.checkSubscription(tinkoffRejection{
+					Kind:   tinkoffSubscriptionKind_LAST_PRICE,
+					UID:    sub.GetInstrumentUid(),
+					FIGI:   sub.GetFigi(),
+					Status: sub.GetSubscriptionStatus(),
+				})
+			}
+		case *pb.MarketDataResponse_SubscribeTradesResponse:
+			for _, sub := range payload.SubscribeTradesResponse.GetTradeSubscriptions() {
+				s.checkSubscription(tinkoffRejection{
+					Kind:   tinkoffSubscriptionKind_TRADES,
+					UID:    sub.GetInstrumentUid(),
+					FIGI:   sub.GetFigi(),
+					Status: sub.GetSubscriptionStatus(),
+				})
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Responses to unsubscribe requests are answered with SUBSCRIPTION_NOT_FOUND
+// when the subscription is already gone, that is not a refusal
+func (s *tinkoffStream) checkSubscription(rejection tinkoffRejection) {
+	switch rejection.Status {
+	case pb.SubscriptionStatus_SUBSCRIPTION_STATUS_SUCCESS,
+		pb.SubscriptionStatus_SUBSCRIPTION_STATUS_SUBSCRIPTION_NOT_FOUND:
+		return
+	}
+
+	if s.reject != nil {
+		s.reject(rejection)
+	}
+}
+
+func (s *tinkoffStream) Stop() {
+	s.cancel()
+}
+
+func deliverStreamPayload[T any](ctx context.Context, ch chan<- T, payload T) error {
+	select {
+	case ch <- payload:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
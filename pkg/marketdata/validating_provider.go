@@ -0,0 +1,172 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// ValidatingMarketDataProvider runs history of the upstream through CandleValidator.
+// Streaming is passed to the upstream as is.
+type ValidatingMarketDataProvider struct {
+	upstream  MarketDataProvider
+	validator *CandleValidator
+	clock     clock.Clock
+	onReport  func(report ValidationReport)
+}
+
+func NewValidatingMarketDataProvider(
+	upstream MarketDataProvider,
+	validator *CandleValidator,
+) *ValidatingMarketDataProvider {
+	return &ValidatingMarketDataProvider{
+		upstream:  upstream,
+		validator: validator,
+		clock:     clock.Real,
+		onReport: func(report ValidationReport) {
+			if len(report.Issues) > 0 {
+				log.Printf("Candle validation: %s", report)
+			}
+		},
+	}
+}
+
+// Candles after c are not expected in the history
+func (v *ValidatingMarketDataProvider) SetClock(c clock.Clock) {
+	v.clock = c
+}
+
+// Called with the report of every history request, by default reports with issues are logged
+func (v *ValidatingMarketDataProvider) SetReportHandler(onReport func(report ValidationReport)) {
+	v.onReport = onReport
+}
+
+func (v *ValidatingMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return v.upstream.SubscribeCandles(ctx, marketData)
+}
+
+func (v *ValidatingMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return v.upstream.UnsubscribeCandles(marketData, ch)
+}
+
+func (v *ValidatingMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return v.upstream.SubscribeCandleUpdates(ctx, marketData)
+}
+
+func (v *ValidatingMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return v.upstream.UnsubscribeCandleUpdates(marketData, ch)
+}
+
+func (v *ValidatingMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	return v.upstream.SubscribeOrderBook(ctx, orderBookInfo)
+}
+
+func (v *ValidatingMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	return v.upstream.UnsubscribeOrderBook(orderBookInfo, ch)
+}
+
+func (v *ValidatingMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	return v.upstream.SubscribeLastPrices(ctx, instrumentInfo)
+}
+
+func (v *ValidatingMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	return v.upstream.UnsubscribeLastPrices(instrumentInfo, ch)
+}
+
+func (v *ValidatingMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	return v.upstream.SubscribeTrades(ctx, instrumentInfo)
+}
+
+func (v *ValidatingMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	return v.upstream.UnsubscribeTrades(instrumentInfo, ch)
+}
+
+func (v *ValidatingMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	candles, err := v.upstream.GetCandlesByTime(ctx, marketData, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	candles, report, err := v.validator.Validate(marketData, candles, from, minTime(to, v.clock.Now()))
+	v.onReport(report)
+
+	return candles, err
+}
+
+// Dropped candles are requested from the upstream once more
+func (v *ValidatingMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	requested := count
+
+	for attempt := 0; attempt < 2; attempt++ {
+		candles, err := v.upstream.GetCandlesByCount(ctx, marketData, last, requested)
+		if err != nil {
+			return nil, err
+		}
+
+		// Gaps before the first candle are out of the request
+		var from time.Time
+		if len(candles) > 0 {
+			from = candles[0].OpenTime
+		}
+
+		candles, report, err := v.validator.Validate(marketData, candles, from, minTime(last, v.clock.Now()))
+		v.onReport(report)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(candles) >= count {
+			return candles[len(candles)-count:], nil
+		}
+
+		requested += count - len(candles)
+	}
+
+	return nil, fmt.Errorf(
+		"error getting history data by count",
+	)
+}
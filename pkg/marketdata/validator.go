@@ -0,0 +1,375 @@
+package marketdata
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+type CandleIssueType int32
+
+const (
+	// No candle for a period when the calendar has trading
+	CandleIssueType_MISSING CandleIssueType = iota
+	CandleIssueType_DUPLICATE
+	CandleIssueType_OUT_OF_ORDER
+	// High below Low, Open or Close outside of them, non-positive prices
+	CandleIssueType_INCONSISTENT
+	CandleIssueType_ZERO_VOLUME
+	// Close too far from the previous one, see CandleValidator.SetOutlierDeviations
+	CandleIssueType_OUTLIER
+)
+
+var candleIssueNames = map[CandleIssueType]string{
+	CandleIssueType_MISSING:      "missing",
+	CandleIssueType_DUPLICATE:    "duplicate",
+	CandleIssueType_OUT_OF_ORDER: "out of order",
+	CandleIssueType_INCONSISTENT: "inconsistent",
+	CandleIssueType_ZERO_VOLUME:  "zero volume",
+	CandleIssueType_OUTLIER:      "outlier",
+}
+
+type CandlePolicy int32
+
+const (
+	// Only report the issue
+	CandlePolicy_KEEP CandlePolicy = iota
+	CandlePolicy_DROP
+	// Put a flat candle at the previous close with zero volume instead
+	CandlePolicy_FORWARD_FILL
+	// Fail the whole series
+	CandlePolicy_REJECT
+)
+
+// Policies that make sense for every issue
+var candleIssuePolicies = map[CandleIssueType][]CandlePolicy{
+	CandleIssueType_MISSING:      {CandlePolicy_KEEP, CandlePolicy_FORWARD_FILL, CandlePolicy_REJECT},
+	CandleIssueType_DUPLICATE:    {CandlePolicy_DROP, CandlePolicy_REJECT},
+	CandleIssueType_OUT_OF_ORDER: {CandlePolicy_DROP, CandlePolicy_REJECT},
+	CandleIssueType_INCONSISTENT: {CandlePolicy_KEEP, CandlePolicy_DROP, CandlePolicy_FORWARD_FILL, CandlePolicy_REJECT},
+	CandleIssueType_ZERO_VOLUME:  {CandlePolicy_KEEP, CandlePolicy_DROP, CandlePolicy_FORWARD_FILL, CandlePolicy_REJECT},
+	CandleIssueType_OUTLIER:      {CandlePolicy_KEEP, CandlePolicy_DROP, CandlePolicy_FORWARD_FILL, CandlePolicy_REJECT},
+}
+
+// Default outlier threshold in robust deviations of close to close log returns
+const defaultOutlierDeviations = 10.0
+
+// Issue found in a series and what was done with it
+type CandleIssue struct {
+	Type CandleIssueType
+	// Open time of the candle, for missing candles of the expected one
+	Time   time.Time
+	Action CandlePolicy
+}
+
+type ValidationReport struct {
+	MarketData domain.MarketData
+	Issues     []CandleIssue
+}
+
+func (r ValidationReport) Count(issueType CandleIssueType) int {
+	result := 0
+	for _, issue := range r.Issues {
+		if issue.Type == issueType {
+			result++
+		}
+	}
+
+	return result
+}
+
+func (r ValidationReport) String() string {
+	if len(r.Issues) == 0 {
+		return fmt.Sprintf("%s %s: no issues", r.MarketData.ID, ConvertMarketDataIntervalToString(r.MarketData.Interval))
+	}
+
+	result := fmt.Sprintf("%s %s:", r.MarketData.ID, ConvertMarketDataIntervalToString(r.MarketData.Interval))
+	for issueType := CandleIssueType_MISSING; issueType <= CandleIssueType_OUTLIER; issueType++ {
+		if count := r.Count(issueType); count > 0 {
+			result += fmt.Sprintf(" %s %d", candleIssueNames[issueType], count)
+		}
+	}
+
+	return result
+}
+
+// CandleValidator checks candle series against the trading calendar
+// and repairs them according to the policy of every issue.
+// By default duplicates and out of order candles are dropped, inconsistent ones reject the series,
+// the rest is only reported.
+type CandleValidator struct {
+	cal               calendar.Calendar
+	policies          map[CandleIssueType]CandlePolicy
+	outlierDeviations float64
+}
+
+func NewCandleValidator(cal calendar.Calendar) *CandleValidator {
+	return &CandleValidator{
+		cal: cal,
+		policies: map[CandleIssueType]CandlePolicy{
+			CandleIssueType_MISSING:      CandlePolicy_KEEP,
+			CandleIssueType_DUPLICATE:    CandlePolicy_DROP,
+			CandleIssueType_OUT_OF_ORDER: CandlePolicy_DROP,
+			CandleIssueType_INCONSISTENT: CandlePolicy_REJECT,
+			CandleIssueType_ZERO_VOLUME:  CandlePolicy_KEEP,
+			CandleIssueType_OUTLIER:      CandlePolicy_KEEP,
+		},
+		outlierDeviations: defaultOutlierDeviations,
+	}
+}
+
+func (v *CandleValidator) SetPolicy(issueType CandleIssueType, policy CandlePolicy) error {
+	policies, ok := candleIssuePolicies[issueType]
+	if !ok {
+		return fmt.Errorf("undefined candle issue")
+	}
+	if !slices.Contains(policies, policy) {
+		return fmt.Errorf("policy %d is not allowed for %s candles", policy, candleIssueNames[issueType])
+	}
+
+	v.policies[issueType] = policy
+
+	return nil
+}
+
+// Close is an outlier when its log return is more than deviations times
+// the median absolute log return of the series, zero disables the check
+func (v *CandleValidator) SetOutlierDeviations(deviations float64) {
+	v.outlierDeviations = deviations
+}
+
+// Validates candles of marketData requested for [from, to).
+// Candles missing at the ends of the range are found only when from and to are set,
+// to must not be later than now, forming candles are not expected.
+// The report is returned with the error of a rejected series too.
+func (v *CandleValidator) Validate(
+	marketData domain.MarketData,
+	candles []domain.Candle,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, ValidationReport, error) {
+	report := ValidationReport{
+		MarketData: marketData,
+		Issues:     make([]CandleIssue, 0),
+	}
+
+	result := make([]domain.Candle, 0, len(candles))
+	scale := v.returnsScale(candles)
+	// Close of the last candle that wasn't an outlier
+	var reference float64
+
+	issue := func(issueType CandleIssueType, t time.Time) (CandlePolicy, error) {
+		policy := v.policies[issueType]
+		report.Issues = append(report.Issues, CandleIssue{Type: issueType, Time: t, Action: policy})
+
+		if policy == CandlePolicy_REJECT {
+			return policy, fmt.Errorf("%s candles rejected: %s candle at %v",
+				marketData.ID, candleIssueNames[issueType], t)
+		}
+
+		return policy, nil
+	}
+
+	// Forward filling needs a previous candle, otherwise the issue is only reported
+	fill := func(openTime time.Time) bool {
+		if len(result) == 0 {
+			report.Issues[len(report.Issues)-1].Action = CandlePolicy_KEEP
+			return false
+		}
+
+		result = append(result, v.flatCandle(marketData, result[len(result)-1].Close, openTime))
+		return true
+	}
+
+	checkMissing := func(start time.Time, end time.Time) error {
+		for _, openTime := range v.expectedCandles(SessionCalendar(v.cal, marketData.SessionFilter), marketData.Interval, start, end) {
+			policy, err := issue(CandleIssueType_MISSING, openTime)
+			if err != nil {
+				return err
+			}
+			if policy == CandlePolicy_FORWARD_FILL {
+				fill(openTime)
+			}
+		}
+
+		return nil
+	}
+
+	for _, candle := range candles {
+		candle.MarketData = marketData
+
+		if len(result) > 0 {
+			last := result[len(result)-1]
+
+			if candle.OpenTime.Equal(last.OpenTime) {
+				if _, err := issue(CandleIssueType_DUPLICATE, candle.OpenTime); err != nil {
+					return nil, report, err
+				}
+				continue
+			}
+
+			if candle.OpenTime.Before(last.OpenTime) {
+				if _, err := issue(CandleIssueType_OUT_OF_ORDER, candle.OpenTime); err != nil {
+					return nil, report, err
+				}
+				continue
+			}
+		}
+
+		start := from
+		if len(result) > 0 {
+			start = result[len(result)-1].CloseTime
+		}
+		if !start.IsZero() {
+			if err := checkMissing(start, candle.OpenTime); err != nil {
+				return nil, report, err
+			}
+		}
+
+		problem, found := v.candleProblem(candle, reference, scale)
+		if !found {
+			result = append(result, candle)
+			reference = candle.Close
+			continue
+		}
+
+		policy, err := issue(problem, candle.OpenTime)
+		if err != nil {
+			return nil, report, err
+		}
+
+		switch policy {
+		case CandlePolicy_KEEP:
+			result = append(result, candle)
+			if problem != CandleIssueType_OUTLIER {
+				reference = candle.Close
+			}
+		case CandlePolicy_FORWARD_FILL:
+			if !fill(candle.OpenTime) {
+				result = append(result, candle)
+			}
+		}
+	}
+
+	if !to.IsZero() {
+		start := from
+		if len(result) > 0 {
+			start = result[len(result)-1].CloseTime
+		}
+		if !start.IsZero() {
+			if err := checkMissing(start, to); err != nil {
+				return nil, report, err
+			}
+		}
+	}
+
+	return result, report, nil
+}
+
+// The first problem of the candle, inconsistent prices are checked before the rest
+func (v *CandleValidator) candleProblem(
+	candle domain.Candle,
+	reference float64,
+	scale float64,
+) (CandleIssueType, bool) {
+	if candle.Low <= 0 ||
+		candle.High < max(candle.Open, candle.Close) ||
+		candle.Low > min(candle.Open, candle.Close) ||
+		!candle.CloseTime.After(candle.OpenTime) {
+		return CandleIssueType_INCONSISTENT, true
+	}
+
+	if candle.Volume == 0 {
+		return CandleIssueType_ZERO_VOLUME, true
+	}
+
+	if v.outlierDeviations > 0 && scale > 0 && reference > 0 &&
+		math.Abs(math.Log(candle.Close/reference)) > v.outlierDeviations*scale {
+		return CandleIssueType_OUTLIER, true
+	}
+
+	return 0, false
+}
+
+// Median absolute log return of consecutive closes, it is not affected by the outliers themselves
+func (v *CandleValidator) returnsScale(candles []domain.Candle) float64 {
+	returns := make([]float64, 0, len(candles))
+	for i := 1; i < len(candles); i++ {
+		if candles[i-1].Close > 0 && candles[i].Close > 0 {
+			returns = append(returns, math.Abs(math.Log(candles[i].Close/candles[i-1].Close)))
+		}
+	}
+
+	if len(returns) == 0 {
+		return 0
+	}
+
+	slices.Sort(returns)
+
+	return returns[len(returns)/2]
+}
+
+func (v *CandleValidator) flatCandle(
+	marketData domain.MarketData,
+	price float64,
+	openTime time.Time,
+) domain.Candle {
+	return domain.Candle{
+		MarketData: marketData,
+		Open:       price,
+		High:       price,
+		Low:        price,
+		Close:      price,
+		OpenTime:   openTime,
+		CloseTime:  CandleCloseTime(marketData.Interval, openTime, v.cal.Location()),
+	}
+}
+
+// Open times of the candles inside [from, to) that have trading by cal
+func (v *CandleValidator) expectedCandles(
+	cal calendar.Calendar,
+	interval domain.MarketDataInterval,
+	from time.Time,
+	to time.Time,
+) []time.Time {
+	result := make([]time.Time, 0)
+	if !from.Before(to) || ConvertMarketDataIntervalToTime(interval) == 0 {
+		return result
+	}
+
+	loc := cal.Location()
+
+	switch interval {
+	case domain.MarketDataInterval_ONE_DAY, domain.MarketDataInterval_WEEK, domain.MarketDataInterval_MONTH:
+		for open := CandleOpenTime(interval, from, loc); open.Before(to); open = AddCandles(interval, open, 1, loc) {
+			closeTime := CandleCloseTime(interval, open, loc)
+			if !open.Before(from) && !closeTime.After(to) && tradingEnd(cal, open, closeTime).After(open) {
+				result = append(result, open)
+			}
+		}
+
+		return result
+	}
+
+	// Intraday candles are looked up by sessions, a candle may cover two of them
+	for day := calendar.StartOfDay(cal, from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, session := range cal.Sessions(day) {
+			for open := CandleOpenTime(interval, session.Open, loc); open.Before(session.Close); open = AddCandles(interval, open, 1, loc) {
+				closeTime := CandleCloseTime(interval, open, loc)
+				if open.Before(from) || closeTime.After(to) {
+					continue
+				}
+				if len(result) > 0 && !open.After(result[len(result)-1]) {
+					continue
+				}
+				result = append(result, open)
+			}
+		}
+	}
+
+	return result
+}
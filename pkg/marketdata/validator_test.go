@@ -0,0 +1,157 @@
+package marketdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestCandleValidator_Validate(t *testing.T) {
+	cal := calendar.NewMOEXCalendar()
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_HOUR}
+	msk := func(day, hour int) time.Time {
+		return time.Date(2024, time.January, day, hour, 0, 0, 0, calendar.MoscowLocation)
+	}
+	candle := func(openTime time.Time, price float64) domain.Candle {
+		return domain.Candle{
+			MarketData: md,
+			Open:       price,
+			High:       price + 1,
+			Low:        price - 1,
+			Close:      price,
+			Volume:     10,
+			OpenTime:   openTime,
+			CloseTime:  openTime.Add(time.Hour),
+		}
+	}
+
+	broken := candle(msk(10, 14), 100)
+	broken.High = 90
+
+	zero := candle(msk(10, 15), 100)
+	zero.Volume = 0
+
+	candles := []domain.Candle{
+		candle(msk(10, 10), 100),
+		candle(msk(10, 11), 101),
+		candle(msk(10, 11), 101),
+		candle(msk(10, 10), 100),
+		// 12:00 is missing
+		candle(msk(10, 13), 102),
+		broken,
+		zero,
+		candle(msk(10, 16), 300),
+		candle(msk(10, 17), 101),
+	}
+
+	validator := NewCandleValidator(cal)
+	_, report, err := validator.Validate(md, candles, msk(10, 10), msk(10, 18))
+	if err == nil {
+		t.Fatalf("expected inconsistent candle to reject the series")
+	}
+	if report.Count(CandleIssueType_INCONSISTENT) != 1 {
+		t.Errorf("expected inconsistent candle in the report, got %v", report.Issues)
+	}
+
+	for issueType, policy := range map[CandleIssueType]CandlePolicy{
+		CandleIssueType_MISSING:      CandlePolicy_FORWARD_FILL,
+		CandleIssueType_INCONSISTENT: CandlePolicy_DROP,
+		CandleIssueType_OUTLIER:      CandlePolicy_FORWARD_FILL,
+	} {
+		if err := validator.SetPolicy(issueType, policy); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	result, report, err := validator.Validate(md, candles, msk(10, 10), msk(10, 18))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[CandleIssueType]int{
+		CandleIssueType_MISSING:      2,
+		CandleIssueType_DUPLICATE:    1,
+		CandleIssueType_OUT_OF_ORDER: 1,
+		CandleIssueType_INCONSISTENT: 1,
+		CandleIssueType_ZERO_VOLUME:  1,
+		CandleIssueType_OUTLIER:      1,
+	}
+	for issueType, count := range expected {
+		if report.Count(issueType) != count {
+			t.Errorf("expected %d %s issues, got %d", count, candleIssueNames[issueType], report.Count(issueType))
+		}
+	}
+
+	// 12:00 and 14:00 are forward filled, the outlier at 16:00 too
+	if len(result) != 8 {
+		t.Fatalf("expected 8 candles, got %d", len(result))
+	}
+	for i, c := range result {
+		if !c.OpenTime.Equal(msk(10, 10+i)) {
+			t.Errorf("candle %d: expected open time %v, got %v", i, msk(10, 10+i), c.OpenTime)
+		}
+	}
+	if result[2].Close != 101 || result[2].Volume != 0 {
+		t.Errorf("expected forward filled candle, got %+v", result[2])
+	}
+	if result[6].Close != 100 {
+		t.Errorf("expected outlier to be replaced by the previous close, got %+v", result[6])
+	}
+}
+
+func TestCandleValidator_MissingByCalendar(t *testing.T) {
+	cal := calendar.NewMOEXCalendar()
+	md := domain.MarketData{ID: "SBER", Interval: domain.MarketDataInterval_ONE_DAY}
+	day := func(month time.Month, day int) time.Time {
+		return time.Date(2024, month, day, 0, 0, 0, 0, calendar.MoscowLocation)
+	}
+	candle := func(openTime time.Time) domain.Candle {
+		return domain.Candle{
+			MarketData: md,
+			Open:       100,
+			High:       100,
+			Low:        100,
+			Close:      100,
+			Volume:     1,
+			OpenTime:   openTime,
+			CloseTime:  openTime.AddDate(0, 0, 1),
+		}
+	}
+
+	// Friday, then Monday and Tuesday after the weekend and the February 23 holiday
+	candles := []domain.Candle{
+		candle(day(time.February, 22)),
+		candle(day(time.February, 26)),
+		candle(day(time.February, 27)),
+	}
+
+	validator := NewCandleValidator(cal)
+	_, report, err := validator.Validate(md, candles, day(time.February, 19), day(time.February, 29))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Monday to Wednesday before and Wednesday after
+	missing := []time.Time{day(time.February, 19), day(time.February, 20), day(time.February, 21), day(time.February, 28)}
+	if len(report.Issues) != len(missing) {
+		t.Fatalf("expected %d missing days, got %v", len(missing), report.Issues)
+	}
+	for i, issue := range report.Issues {
+		if issue.Type != CandleIssueType_MISSING || !issue.Time.Equal(missing[i]) || issue.Action != CandlePolicy_KEEP {
+			t.Errorf("unexpected issue %d: %+v", i, issue)
+		}
+	}
+}
+
+func TestCandleValidator_SetPolicy(t *testing.T) {
+	validator := NewCandleValidator(calendar.NewMOEXCalendar())
+
+	if err := validator.SetPolicy(CandleIssueType_DUPLICATE, CandlePolicy_FORWARD_FILL); err == nil {
+		t.Errorf("expected forward filling of duplicates not to be allowed")
+	}
+	if err := validator.SetPolicy(CandleIssueType_MISSING, CandlePolicy_DROP); err == nil {
+		t.Errorf("expected dropping of missing candles not to be allowed")
+	}
+}
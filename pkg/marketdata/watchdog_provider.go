@@ -0,0 +1,415 @@
+package marketdata
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+type StalenessAlertType int32
+
+const (
+	// No candle by the close of the expected ones while the calendar has trading
+	StalenessAlertType_STALE StalenessAlertType = iota
+	// A candle came after STALE
+	StalenessAlertType_RECOVERED
+	// A candle came too far from its close by the clock
+	StalenessAlertType_DRIFT
+	// The source closed the subscription, subscribers are closed too
+	StalenessAlertType_CLOSED
+)
+
+var stalenessAlertNames = map[StalenessAlertType]string{
+	StalenessAlertType_STALE:     "stale",
+	StalenessAlertType_RECOVERED: "recovered",
+	StalenessAlertType_DRIFT:     "drift",
+	StalenessAlertType_CLOSED:    "closed",
+}
+
+type StalenessAlert struct {
+	Type       StalenessAlertType
+	MarketData domain.MarketData
+	// Clock time of the alert
+	Time time.Time
+	// OpenTime of the last candle, zero before the first one
+	LastCandle time.Time
+	// STALE: the deadline that passed
+	Deadline time.Time
+	// DRIFT: arrival minus the close of the candle, negative for candles from the future
+	Drift time.Duration
+}
+
+func (a StalenessAlert) String() string {
+	switch a.Type {
+	case StalenessAlertType_STALE:
+		return a.MarketData.ID + " " + ConvertMarketDataIntervalToString(a.MarketData.Interval) +
+			" is stale: no candle by " + a.Deadline.String() + ", last candle " + a.LastCandle.String()
+	case StalenessAlertType_DRIFT:
+		return a.MarketData.ID + " " + ConvertMarketDataIntervalToString(a.MarketData.Interval) +
+			" candle " + a.LastCandle.String() + " drifts by " + a.Drift.String()
+	default:
+		return a.MarketData.ID + " " + ConvertMarketDataIntervalToString(a.MarketData.Interval) +
+			" is " + stalenessAlertNames[a.Type]
+	}
+}
+
+// Candles that are not yet come before a subscription is stale
+const watchdogDefaultStaleCandles = 3
+
+// Slack of arrivals around candle closes, e.g. close delays of providers
+const watchdogDefaultMaxDrift = time.Minute
+
+// Limit of candles looked through for the next one with trading
+const watchdogMaxSkippedCandles = 10000
+
+// WatchdogMarketDataProvider watches closed candle subscriptions of the source.
+// By the interval and the calendar it knows when candles must come and raises alerts
+// when they don't come during trading, come far from their close by the clock,
+// or the source closes the subscription. Other market data is passed to the source as is.
+type WatchdogMarketDataProvider struct {
+	source            MarketDataProvider
+	cal               calendar.Calendar
+	clock             clock.Clock
+	staleCandles      int
+	maxDrift          time.Duration
+	onAlert           func(alert StalenessAlert)
+	mu                sync.Mutex
+	candleSubscribers *subscribers[domain.MarketData, domain.Candle]
+	streams           map[domain.MarketData]*watchedStream
+}
+
+type watchedStream struct {
+	marketData domain.MarketData
+	ctx        context.Context
+	cancel     context.CancelFunc
+	lastCandle time.Time
+	deadline   time.Time
+	stale      bool
+}
+
+func NewWatchdogMarketDataProvider(
+	source MarketDataProvider,
+	cal calendar.Calendar,
+) *WatchdogMarketDataProvider {
+	return &WatchdogMarketDataProvider{
+		source:            source,
+		cal:               cal,
+		clock:             clock.Real,
+		staleCandles:      watchdogDefaultStaleCandles,
+		maxDrift:          watchdogDefaultMaxDrift,
+		candleSubscribers: newSubscribers[domain.MarketData, domain.Candle]("Watched candle"),
+		streams:           make(map[domain.MarketData]*watchedStream),
+		onAlert: func(alert StalenessAlert) {
+			log.Printf("Market data watchdog: %s", alert)
+		},
+	}
+}
+
+// Deadlines and drift are measured by c
+func (w *WatchdogMarketDataProvider) SetClock(c clock.Clock) {
+	w.clock = c
+}
+
+// staleCandles candles with trading may be missing before STALE, e.g. minutes without trades
+// of illiquid instruments. maxDrift is the allowed distance of arrivals from candle closes.
+// They are set at startup.
+func (w *WatchdogMarketDataProvider) SetThresholds(staleCandles int, maxDrift time.Duration) {
+	w.staleCandles = max(staleCandles, 1)
+	w.maxDrift = maxDrift
+}
+
+// Called with every alert, by default alerts are logged
+func (w *WatchdogMarketDataProvider) SetAlertHandler(onAlert func(alert StalenessAlert)) {
+	w.onAlert = onAlert
+}
+
+func (w *WatchdogMarketDataProvider) SubscribeCandles(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.streams[marketData]; !ok {
+		streamCtx, cancel := context.WithCancel(context.Background())
+
+		upstream, err := w.source.SubscribeCandles(streamCtx, marketData)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		stream := &watchedStream{
+			marketData: marketData,
+			ctx:        streamCtx,
+			cancel:     cancel,
+		}
+		w.streams[marketData] = stream
+
+		// The first timer is set before the goroutine starts, so a virtual clock can't miss it
+		timeout := w.expect(stream, w.clock.Now())
+		go w.run(stream, upstream, timeout)
+	}
+
+	ch, _ := w.candleSubscribers.add(ctx, marketData, func(ch <-chan domain.Candle) {
+		w.UnsubscribeCandles(marketData, ch)
+	})
+
+	return ch, nil
+}
+
+func (w *WatchdogMarketDataProvider) UnsubscribeCandles(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	last, err := w.candleSubscribers.remove(marketData, ch)
+	if err != nil || !last {
+		return err
+	}
+
+	if stream, ok := w.streams[marketData]; ok {
+		stream.cancel()
+		delete(w.streams, marketData)
+	}
+
+	return nil
+}
+
+func (w *WatchdogMarketDataProvider) run(
+	stream *watchedStream,
+	upstream <-chan domain.Candle,
+	timeout <-chan time.Time,
+) {
+	for {
+		select {
+		case <-stream.ctx.Done():
+			return
+		case candle, ok := <-upstream:
+			if !ok {
+				w.closeStream(stream)
+				return
+			}
+
+			w.received(stream, candle)
+			timeout = w.expect(stream, candle.CloseTime)
+
+			w.mu.Lock()
+			w.candleSubscribers.notify(stream.marketData, candle)
+			w.mu.Unlock()
+		case <-timeout:
+			// Unsubscribed at the same moment
+			if stream.ctx.Err() != nil {
+				return
+			}
+
+			now := w.clock.Now()
+			if now.Before(stream.deadline) {
+				timeout = w.clock.After(stream.deadline.Sub(now))
+				continue
+			}
+
+			// Silent until the next candle
+			timeout = nil
+			stream.stale = true
+			w.onAlert(StalenessAlert{
+				Type:       StalenessAlertType_STALE,
+				MarketData: stream.marketData,
+				Time:       now,
+				LastCandle: stream.lastCandle,
+				Deadline:   stream.deadline,
+			})
+		}
+	}
+}
+
+func (w *WatchdogMarketDataProvider) received(stream *watchedStream, candle domain.Candle) {
+	now := w.clock.Now()
+	stream.lastCandle = candle.OpenTime
+
+	if stream.stale {
+		stream.stale = false
+		w.onAlert(StalenessAlert{
+			Type:       StalenessAlertType_RECOVERED,
+			MarketData: stream.marketData,
+			Time:       now,
+			LastCandle: candle.OpenTime,
+		})
+	}
+
+	// Candle may close when its trading ends, e.g. an hour bar at the main session close,
+	// or a bit after its CloseTime
+	earliest := tradingEnd(SessionCalendar(w.cal, stream.marketData.SessionFilter), candle.OpenTime, candle.CloseTime).Add(-w.maxDrift)
+	latest := candle.CloseTime.Add(w.maxDrift)
+
+	var drift time.Duration
+	if now.Before(earliest) {
+		drift = now.Sub(earliest.Add(w.maxDrift))
+	} else if now.After(latest) {
+		drift = now.Sub(candle.CloseTime)
+	} else {
+		return
+	}
+
+	w.onAlert(StalenessAlert{
+		Type:       StalenessAlertType_DRIFT,
+		MarketData: stream.marketData,
+		Time:       now,
+		LastCandle: candle.OpenTime,
+		Drift:      drift,
+	})
+}
+
+// Sets the deadline of the candles expected after the time
+// and returns the timer of it, nil if the calendar has no trading
+func (w *WatchdogMarketDataProvider) expect(stream *watchedStream, after time.Time) <-chan time.Time {
+	now := w.clock.Now()
+
+	stream.deadline = w.deadline(stream.marketData, after)
+	// Late candles, e.g. backfilled after a reconnect, are not a reason to wait less
+	if !stream.deadline.IsZero() && stream.deadline.Before(now) {
+		stream.deadline = w.deadline(stream.marketData, now)
+	}
+	if stream.deadline.IsZero() || stream.stale {
+		return nil
+	}
+
+	return w.clock.After(stream.deadline.Sub(now))
+}
+
+// Close of the last of staleCandles candles with trading after the time plus the drift slack,
+// zero if the calendar has no trading
+func (w *WatchdogMarketDataProvider) deadline(marketData domain.MarketData, after time.Time) time.Time {
+	cal := SessionCalendar(w.cal, marketData.SessionFilter)
+	loc := cal.Location()
+	interval := marketData.Interval
+
+	if ConvertMarketDataIntervalToTime(interval) == 0 {
+		return time.Time{}
+	}
+
+	open := CandleOpenTime(interval, after, loc)
+	expected := 0
+
+	for i := 0; i < watchdogMaxSkippedCandles; i++ {
+		closeTime := CandleCloseTime(interval, open, loc)
+
+		if tradingEnd(cal, open, closeTime).After(maxTime(open, after)) {
+			expected++
+			if expected == w.staleCandles {
+				return closeTime.Add(w.maxDrift)
+			}
+			open = closeTime
+			continue
+		}
+
+		next := cal.NextOpen(closeTime)
+		if next.IsZero() {
+			return time.Time{}
+		}
+		open = CandleOpenTime(interval, next, loc)
+	}
+
+	return time.Time{}
+}
+
+func (w *WatchdogMarketDataProvider) closeStream(stream *watchedStream) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Unsubscribed, the stream may already be replaced by a new one
+	if w.streams[stream.marketData] != stream {
+		return
+	}
+	delete(w.streams, stream.marketData)
+
+	w.candleSubscribers.removeAll(stream.marketData)
+
+	w.onAlert(StalenessAlert{
+		Type:       StalenessAlertType_CLOSED,
+		MarketData: stream.marketData,
+		Time:       w.clock.Now(),
+		LastCandle: stream.lastCandle,
+	})
+}
+
+func (w *WatchdogMarketDataProvider) SubscribeCandleUpdates(
+	ctx context.Context,
+	marketData domain.MarketData,
+) (<-chan domain.Candle, error) {
+	return w.source.SubscribeCandleUpdates(ctx, marketData)
+}
+
+func (w *WatchdogMarketDataProvider) UnsubscribeCandleUpdates(
+	marketData domain.MarketData,
+	ch <-chan domain.Candle,
+) error {
+	return w.source.UnsubscribeCandleUpdates(marketData, ch)
+}
+
+func (w *WatchdogMarketDataProvider) SubscribeOrderBook(
+	ctx context.Context,
+	orderBookInfo domain.OrderBookInfo,
+) (<-chan domain.OrderBook, error) {
+	return w.source.SubscribeOrderBook(ctx, orderBookInfo)
+}
+
+func (w *WatchdogMarketDataProvider) UnsubscribeOrderBook(
+	orderBookInfo domain.OrderBookInfo,
+	ch <-chan domain.OrderBook,
+) error {
+	return w.source.UnsubscribeOrderBook(orderBookInfo, ch)
+}
+
+func (w *WatchdogMarketDataProvider) SubscribeLastPrices(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.LastPrice, error) {
+	return w.source.SubscribeLastPrices(ctx, instrumentInfo)
+}
+
+func (w *WatchdogMarketDataProvider) UnsubscribeLastPrices(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.LastPrice,
+) error {
+	return w.source.UnsubscribeLastPrices(instrumentInfo, ch)
+}
+
+func (w *WatchdogMarketDataProvider) SubscribeTrades(
+	ctx context.Context,
+	instrumentInfo domain.InstrumentInfo,
+) (<-chan domain.Trade, error) {
+	return w.source.SubscribeTrades(ctx, instrumentInfo)
+}
+
+func (w *WatchdogMarketDataProvider) UnsubscribeTrades(
+	instrumentInfo domain.InstrumentInfo,
+	ch <-chan domain.Trade,
+) error {
+	return w.source.UnsubscribeTrades(instrumentInfo, ch)
+}
+
+func (w *WatchdogMarketDataProvider) GetCandlesByTime(
+	ctx context.Context,
+	marketData domain.MarketData,
+	from time.Time,
+	to time.Time,
+) ([]domain.Candle, error) {
+	return w.source.GetCandlesByTime(ctx, marketData, from, to)
+}
+
+func (w *WatchdogMarketDataProvider) GetCandlesByCount(
+	ctx context.Context,
+	marketData domain.MarketData,
+	last time.Time,
+	count int,
+) ([]domain.Candle, error) {
+	return w.source.GetCandlesByCount(ctx, marketData, last, count)
+}
@@ -0,0 +1,107 @@
+package marketdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+func TestWatchdogMarketDataProvider(t *testing.T) {
+	source := &streamingProvider{channels: make(map[domain.MarketData]chan domain.Candle)}
+	provider := NewWatchdogMarketDataProvider(source, calendar.NewAlwaysOpenCalendar())
+	provider.SetThresholds(2, time.Minute)
+
+	alerts := make(chan StalenessAlert, 10)
+	provider.SetAlertHandler(func(alert StalenessAlert) {
+		alerts <- alert
+	})
+
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	virtualClock := clock.NewVirtualClock(start)
+	provider.SetClock(virtualClock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	md := domain.MarketData{ID: "BTCUSDT", Interval: domain.MarketDataInterval_ONE_HOUR}
+	candles, err := provider.SubscribeCandles(ctx, md)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	candle := func(openTime time.Time) domain.Candle {
+		return domain.Candle{MarketData: md, OpenTime: openTime, CloseTime: openTime.Add(time.Hour)}
+	}
+	// The candle passes through only after the watchdog set the next deadline
+	receive := func() domain.Candle {
+		select {
+		case c := <-candles:
+			return c
+		case <-time.After(time.Second):
+			t.Fatalf("expected a candle")
+			return domain.Candle{}
+		}
+	}
+	expectAlert := func(alertType StalenessAlertType) StalenessAlert {
+		select {
+		case alert := <-alerts:
+			if alert.Type != alertType {
+				t.Fatalf("expected %s alert, got %s", stalenessAlertNames[alertType], alert)
+			}
+			return alert
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s alert", stalenessAlertNames[alertType])
+			return StalenessAlert{}
+		}
+	}
+
+	virtualClock.Set(start.Add(time.Hour + 30*time.Second))
+	source.send(candle(start))
+	receive()
+
+	// One missed candle is allowed
+	virtualClock.Set(start.Add(2*time.Hour + 30*time.Second))
+	select {
+	case alert := <-alerts:
+		t.Fatalf("unexpected alert %s", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	virtualClock.Set(start.Add(3*time.Hour + time.Minute))
+	alert := expectAlert(StalenessAlertType_STALE)
+	if !alert.LastCandle.Equal(start) || !alert.Deadline.Equal(start.Add(3*time.Hour+time.Minute)) {
+		t.Fatalf("unexpected stale alert %s", alert)
+	}
+
+	// Late candle recovers the stream, but drifts from the clock
+	source.send(candle(start.Add(time.Hour)))
+	receive()
+	expectAlert(StalenessAlertType_RECOVERED)
+	alert = expectAlert(StalenessAlertType_DRIFT)
+	if alert.Drift != time.Hour+time.Minute {
+		t.Fatalf("expected drift 1h1m, got %v", alert.Drift)
+	}
+
+	// Candle from the future
+	source.send(candle(start.Add(3 * time.Hour)))
+	receive()
+	alert = expectAlert(StalenessAlertType_DRIFT)
+	if alert.Drift != -time.Hour+time.Minute {
+		t.Fatalf("expected drift -59m, got %v", alert.Drift)
+	}
+
+	// Unsubscribed streams don't raise alerts
+	cancel()
+	for range candles {
+	}
+	virtualClock.Set(start.Add(24 * time.Hour))
+	select {
+	case alert := <-alerts:
+		t.Fatalf("unexpected alert %s", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -3,8 +3,9 @@ package strategy
 import (
 	"context"
 	"fmt"
+	"maps"
 	"slices"
-	"time"
+	"sync"
 
 	"github.com/Reensef/sigmasage/pkg/domain"
 )
@@ -15,15 +16,25 @@ type SMACStatus struct {
 	lastSMA       domain.SMA
 }
 
+// Removed is closed by unsubscribe, so a pending send gives up before the channel is closed
+type smacSubscriber struct {
+	ch      chan domain.SMACSignal
+	removed chan struct{}
+}
+
 type SMACStrategy struct {
-	subscribers map[domain.SMAInfo][]chan domain.SMACSignal
+	mu sync.Mutex
+	// Held while signals are sent, channels are closed only after it is released
+	sendMu      sync.Mutex
+	subscribers map[domain.SMAInfo][]*smacSubscriber
 	status      map[domain.SMAInfo]*SMACStatus
 	runners     map[domain.SMAInfo]context.CancelFunc
 }
 
 func NewSMACStrategy() *SMACStrategy {
 	return &SMACStrategy{
-		subscribers: make(map[domain.SMAInfo][]chan domain.SMACSignal),
+		subscribers: make(map[domain.SMAInfo][]*smacSubscriber),
+		status:      make(map[domain.SMAInfo]*SMACStatus),
 		runners:     make(map[domain.SMAInfo]context.CancelFunc),
 	}
 }
@@ -33,25 +44,24 @@ func (s *SMACStrategy) Subscribe(
 	srcChan <-chan domain.SMASrc,
 	smaChan <-chan domain.SMA,
 ) (<-chan domain.SMACSignal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	ch := make(chan domain.SMACSignal, 100)
 
 	if _, exists := s.subscribers[config]; !exists {
-		s.subscribers[config] = make([]chan domain.SMACSignal, 0)
+		s.subscribers[config] = make([]*smacSubscriber, 0)
 		ctx, cancel := context.WithCancel(context.Background())
 
 		s.runners[config] = cancel
-		firstSrc, firstSMA := s.syncSMACData(srcChan, smaChan, ctx)
-
-		s.status[config] = &SMACStatus{
-			isSrcAboveSMA: firstSrc.Value > firstSMA.Value,
-			lastSrc:       firstSrc,
-			lastSMA:       firstSMA,
-		}
 
-		s.run(config, srcChan, smaChan, ctx)
+		go s.run(config, srcChan, smaChan, ctx)
 	}
 
-	s.subscribers[config] = append(s.subscribers[config], ch)
+	s.subscribers[config] = append(s.subscribers[config], &smacSubscriber{
+		ch:      ch,
+		removed: make(chan struct{}),
+	})
 
 	return ch, nil
 }
@@ -60,14 +70,17 @@ func (s *SMACStrategy) UnsubscribeSMACStrategy(
 	config domain.SMAInfo,
 	ch <-chan domain.SMACSignal,
 ) error {
-	ok := false
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed *smacSubscriber
 
 	if subscribers, exists := s.subscribers[config]; exists {
 		for i, subscriber := range subscribers {
-			if subscriber == ch {
+			if subscriber.ch == ch {
 				s.subscribers[config] = slices.Delete(subscribers, i, i+1)
-				close(subscriber)
-				ok = true
+				close(subscriber.removed)
+				removed = subscriber
 				break
 			}
 		}
@@ -80,78 +93,98 @@ func (s *SMACStrategy) UnsubscribeSMACStrategy(
 		}
 	}
 
-	if !ok {
+	if removed == nil {
 		return fmt.Errorf("subscribe not found")
 	}
 
+	s.sendMu.Lock()
+	close(removed.ch)
+	s.sendMu.Unlock()
+
 	return nil
 }
 
+// Src and SMA of the same candle come by different paths, so they are paired by time.
+// The first pair sets the initial status, signals are made from the next ones.
 func (s *SMACStrategy) run(
 	config domain.SMAInfo,
 	srcChan <-chan domain.SMASrc,
 	smaChan <-chan domain.SMA,
 	ctx context.Context,
 ) {
-	for {
-		status, exists := s.status[config]
-		if !exists {
-			return
-		}
+	pendingSrc := make(map[int64]domain.SMASrc)
+	pendingSMA := make(map[int64]domain.SMA)
 
+	for {
 		select {
 		case <-ctx.Done():
 			return
-		case src := <-srcChan:
-			status.lastSrc = src
-
-			if time.Until(src.Time).Abs() < time.Second {
-				if status.lastSrc.Time == status.lastSMA.Time {
-					signal := s.makeDecision(status)
-					s.notifySMACSubscribers(config, signal, status.lastSrc.Time)
-				}
+		case src, ok := <-srcChan:
+			if !ok {
+				return
 			}
-		case sma := <-smaChan:
-			status.lastSMA = sma
-
-			if time.Until(status.lastSMA.Time).Abs() < time.Second {
-				if status.lastSrc.Time == status.lastSMA.Time {
-					signal := s.makeDecision(status)
-					s.notifySMACSubscribers(config, signal, status.lastSrc.Time)
-				}
+
+			key := src.Time.UnixNano()
+			sma, found := pendingSMA[key]
+			if !found {
+				pendingSrc[key] = src
+				continue
+			}
+
+			s.handlePair(ctx, config, src, sma)
+			prunePending(pendingSrc, pendingSMA, key)
+		case sma, ok := <-smaChan:
+			if !ok {
+				return
 			}
+
+			key := sma.Time.UnixNano()
+			src, found := pendingSrc[key]
+			if !found {
+				pendingSMA[key] = sma
+				continue
+			}
+
+			s.handlePair(ctx, config, src, sma)
+			prunePending(pendingSrc, pendingSMA, key)
 		}
-		s.status[config] = status
 	}
 }
 
-// TODO пересмотреть синхронизацию данных
-// В синнхронизации нет необходимости, если время не совпадет это признак ошибки
-func (s *SMACStrategy) syncSMACData(
-	candlesChan <-chan domain.SMASrc,
-	smaChan <-chan domain.SMA,
-	ctx context.Context,
-) (domain.SMASrc, domain.SMA) {
-	var src *domain.SMASrc
-	var sma *domain.SMA
+// Values up to the paired one will never get a pair
+func prunePending(pendingSrc map[int64]domain.SMASrc, pendingSMA map[int64]domain.SMA, key int64) {
+	maps.DeleteFunc(pendingSrc, func(k int64, _ domain.SMASrc) bool { return k <= key })
+	maps.DeleteFunc(pendingSMA, func(k int64, _ domain.SMA) bool { return k <= key })
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return domain.SMASrc{}, domain.SMA{}
-		case recvCandle := <-candlesChan:
-			src = &recvCandle
+func (s *SMACStrategy) handlePair(
+	ctx context.Context,
+	config domain.SMAInfo,
+	src domain.SMASrc,
+	sma domain.SMA,
+) {
+	s.mu.Lock()
 
-			if sma != nil && src.Time == sma.Time {
-				return *src, *sma
-			}
-		case recvSMA := <-smaChan:
-			sma = &recvSMA
-			if src != nil && src.Time == sma.Time {
-				return *src, *sma
-			}
+	status, exists := s.status[config]
+	if !exists {
+		s.status[config] = &SMACStatus{
+			isSrcAboveSMA: src.Value > sma.Value,
+			lastSrc:       src,
+			lastSMA:       sma,
 		}
+		s.mu.Unlock()
+		return
 	}
+
+	status.lastSrc = src
+	status.lastSMA = sma
+
+	signal := s.makeDecision(status)
+	subscribers := slices.Clone(s.subscribers[config])
+
+	s.mu.Unlock()
+
+	s.notifySMACSubscribers(ctx, config, subscribers, signal, src)
 }
 
 func (s *SMACStrategy) makeDecision(status *SMACStatus) domain.SMACSignalType {
@@ -174,12 +207,16 @@ func (s *SMACStrategy) makeDecision(status *SMACStatus) domain.SMACSignalType {
 	return domain.SMACSignalType_NO_CROSS
 }
 
-func (s *SMACStrategy) notifySMACSubscribers(info domain.SMAInfo, signalType domain.SMACSignalType, time time.Time) {
-	subscribers, exists := s.subscribers[info]
-	if !exists {
-		return
-	}
-
+// Must be called without mu locked, so subscribers can unsubscribe while a send waits.
+// Signals are not dropped: a full subscriber blocks the strategy until it reads,
+// unsubscribes or the strategy of the info is stopped.
+func (s *SMACStrategy) notifySMACSubscribers(
+	ctx context.Context,
+	info domain.SMAInfo,
+	subscribers []*smacSubscriber,
+	signalType domain.SMACSignalType,
+	src domain.SMASrc,
+) {
 	if signalType == domain.SMACSignalType_NO_CROSS {
 		return
 	}
@@ -187,11 +224,20 @@ func (s *SMACStrategy) notifySMACSubscribers(info domain.SMAInfo, signalType dom
 	signal := domain.SMACSignal{
 		Info:       info,
 		SignalType: signalType,
-		Time:       time,
+		Time:       src.Time,
+		LastPrice:  src.Value,
 	}
 
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
 	for _, subscriber := range subscribers {
-		subscriber <- signal
+		select {
+		case subscriber.ch <- signal:
+		case <-subscriber.removed:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -5,36 +5,59 @@ import (
 	"fmt"
 	"log"
 	"slices"
+	"sync"
 
 	"github.com/Reensef/sigmasage/pkg/domain"
 )
 
+// Removed is closed by unsubscribe, so a pending send gives up before the channel is closed
+type smaSubscriber struct {
+	ch      chan domain.SMA
+	removed chan struct{}
+}
+
 type SMAProvider struct {
-	subscribers   map[domain.SMAInfo][]chan domain.SMA
+	mu sync.Mutex
+	// Held while values are sent, channels are closed only after it is released
+	sendMu        sync.Mutex
+	subscribers   map[domain.SMAInfo][]*smaSubscriber
 	streamCancels map[domain.SMAInfo]context.CancelFunc
+	stops         map[<-chan domain.SMA]func() bool
 }
 
 func NewSMAProvider() *SMAProvider {
 	return &SMAProvider{
-		subscribers:   make(map[domain.SMAInfo][]chan domain.SMA),
+		subscribers:   make(map[domain.SMAInfo][]*smaSubscriber),
 		streamCancels: make(map[domain.SMAInfo]context.CancelFunc),
+		stops:         make(map[<-chan domain.SMA]func() bool),
 	}
 }
 
+// Subscription is cancelled and the channel is closed when ctx is done
 func (s *SMAProvider) Subscribe(
+	ctx context.Context,
 	info domain.SMAInfo,
 	src []float64,
 	srcCh chan domain.SMASrc,
 ) (<-chan domain.SMA, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	ch := make(chan domain.SMA, 100)
+	s.stops[ch] = context.AfterFunc(ctx, func() {
+		s.Unsubscribe(info, ch)
+	})
 
 	needStartNotify := false
 
 	if _, exists := s.subscribers[info]; !exists {
-		s.subscribers[info] = make([]chan domain.SMA, 0)
+		s.subscribers[info] = make([]*smaSubscriber, 0)
 		needStartNotify = true
 	}
-	s.subscribers[info] = append(s.subscribers[info], ch)
+	s.subscribers[info] = append(s.subscribers[info], &smaSubscriber{
+		ch:      ch,
+		removed: make(chan struct{}),
+	})
 
 	if needStartNotify {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -46,19 +69,31 @@ func (s *SMAProvider) Subscribe(
 }
 
 func (s *SMAProvider) Unsubscribe(info domain.SMAInfo, ch <-chan domain.SMA) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if _, exists := s.subscribers[info]; !exists {
 		return fmt.Errorf("undefined subscriber")
 	}
 
-	for i, c := range s.subscribers[info] {
-		if c == ch {
+	for i, subscriber := range s.subscribers[info] {
+		if subscriber.ch == ch {
 			s.subscribers[info] = slices.Delete(s.subscribers[info], i, i+1)
+			close(subscriber.removed)
+
+			s.stops[ch]()
+			delete(s.stops, ch)
 
 			if len(s.subscribers[info]) == 0 {
 				s.streamCancels[info]()
 				delete(s.streamCancels, info)
 				delete(s.subscribers, info)
 			}
+
+			s.sendMu.Lock()
+			close(subscriber.ch)
+			s.sendMu.Unlock()
+
 			return nil
 		}
 	}
@@ -105,13 +140,32 @@ func (s *SMAProvider) startStream(info domain.SMAInfo, src []float64, srcCh chan
 
 			sma := smaCalculator.Update(src.Value)
 
-			for _, subscriber := range s.subscribers[info] {
-				subscriber <- domain.SMA{
-					Info:  info,
-					Value: sma,
-					Time:  src.Time,
-				}
-			}
+			s.mu.Lock()
+			subscribers := slices.Clone(s.subscribers[info])
+			s.mu.Unlock()
+
+			s.notifySubscribers(ctx, subscribers, domain.SMA{
+				Info:  info,
+				Value: sma,
+				Time:  src.Time,
+			})
+		}
+	}
+}
+
+// Must be called without mu locked, so subscribers can unsubscribe while a send waits.
+// Values are not dropped: a full subscriber blocks the stream until it reads,
+// unsubscribes or the stream is stopped.
+func (s *SMAProvider) notifySubscribers(ctx context.Context, subscribers []*smaSubscriber, sma domain.SMA) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	for _, subscriber := range subscribers {
+		select {
+		case subscriber.ch <- sma:
+		case <-subscriber.removed:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
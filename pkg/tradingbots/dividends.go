@@ -0,0 +1,56 @@
+package tradingbots
+
+import (
+	"slices"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/domain"
+)
+
+// Dividends of backtests, they are credited for the shares held at the ex-date
+type dividendLedger struct {
+	pending  []domain.CorporateAction
+	payments []domain.DividendPayment
+}
+
+func (d *dividendLedger) add(dividends []domain.CorporateAction) {
+	for _, dividend := range dividends {
+		if dividend.Type == domain.CorporateActionType_DIVIDEND {
+			d.pending = append(d.pending, dividend)
+		}
+	}
+
+	slices.SortStableFunc(d.pending, func(a, b domain.CorporateAction) int {
+		return a.ExDate.Compare(b.ExDate)
+	})
+}
+
+// Returns the amount of dividends with ExDate not after until
+func (d *dividendLedger) credit(until time.Time, counts map[domain.MarketData]int) float64 {
+	amount := 0.0
+
+	for len(d.pending) > 0 && !d.pending[0].ExDate.After(until) {
+		dividend := d.pending[0]
+		d.pending = d.pending[1:]
+
+		count := 0
+		for marketData, held := range counts {
+			if marketData.ID == dividend.InstrumentID {
+				count += held
+			}
+		}
+		if count == 0 {
+			continue
+		}
+
+		payment := domain.DividendPayment{
+			Action: dividend,
+			Count:  count,
+			Amount: float64(count) * dividend.Dividend,
+		}
+		d.payments = append(d.payments, payment)
+		amount += payment.Amount
+	}
+
+	return amount
+}
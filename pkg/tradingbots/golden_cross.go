@@ -2,6 +2,10 @@ package tradingbots
 
 import (
 	"log"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
 
 	"github.com/Reensef/sigmasage/pkg/domain"
 	"github.com/Reensef/sigmasage/pkg/exchange"
@@ -16,12 +20,17 @@ type GoldenCrossBot struct {
 	exchanger      exchange.Exchanger
 	stopChan       chan struct{}
 	signalChan     <-chan domain.GoldenCrossSignal
+	calendar       calendar.Calendar
+	clock          clock.Clock
+	instruments    map[string]domain.Instrument
+	dividends      dividendLedger
 }
 
 func NewGoldenCrossBot(
 	exchanger exchange.Exchanger,
 	startBalance float64,
 	signalChan <-chan domain.GoldenCrossSignal,
+	cal calendar.Calendar,
 ) *GoldenCrossBot {
 	return &GoldenCrossBot{
 		exchanger:      exchanger,
@@ -30,20 +39,74 @@ func NewGoldenCrossBot(
 		counts:         make(map[domain.MarketData]int),
 		stopChan:       make(chan struct{}),
 		balanceHistory: []float64{startBalance},
+		calendar:       cal,
+		clock:          clock.Real,
+		instruments:    make(map[string]domain.Instrument),
 	}
 }
 
+// With a calendar, signals received while the market is closed are postponed
+// until the next session, only the latest one is kept.
+// Without a calendar (backtests) every signal is handled at once.
 func (s *GoldenCrossBot) Run() {
+	var pending *domain.GoldenCrossSignal
+	var openTimer <-chan time.Time
+
 	for {
 		select {
 		case <-s.stopChan:
 			return
-		case signal := <-s.signalChan:
+		case signal, ok := <-s.signalChan:
+			// Strategy is unsubscribed
+			if !ok {
+				return
+			}
+
+			now := s.clock.Now()
+			if s.calendar != nil && !s.calendar.IsOpen(now) {
+				pending = &signal
+				openTimer = s.clock.After(s.calendar.NextOpen(now).Sub(now))
+				continue
+			}
+
+			pending = nil
+			openTimer = nil
 			s.handleSignal(signal)
+		case <-openTimer:
+			openTimer = nil
+			if pending != nil {
+				s.handleSignal(*pending)
+				pending = nil
+			}
 		}
 	}
 }
 
+// Waiting for the market to open is timed by c
+func (s *GoldenCrossBot) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// Orders of the instrument are aligned to its lot and price step
+func (s *GoldenCrossBot) SetInstrument(marketData domain.MarketData, instrument domain.Instrument) {
+	s.instruments[marketData.ID] = instrument
+}
+
+// Dividends of held instruments are credited to the balance at their ex-dates,
+// before the signals of that time. Backtests add them before Run.
+func (s *GoldenCrossBot) AddDividends(dividends []domain.CorporateAction) {
+	s.dividends.add(dividends)
+}
+
+// Credits added dividends with ExDate not after until, e.g. at the end of a backtest
+func (s *GoldenCrossBot) CreditDividends(until time.Time) {
+	s.balance += s.dividends.credit(until, s.counts)
+}
+
+func (s *GoldenCrossBot) Dividends() []domain.DividendPayment {
+	return s.dividends.payments
+}
+
 func (s *GoldenCrossBot) Stop() {
 	close(s.stopChan)
 }
@@ -61,6 +124,8 @@ func (s *GoldenCrossBot) BalanceHistory() []float64 {
 }
 
 func (s *GoldenCrossBot) handleSignal(signal domain.GoldenCrossSignal) {
+	s.CreditDividends(signal.Time)
+
 	if signal.SignalType == domain.GoldenCrossSignalType_GOLDEN_CROSS {
 		s.handleGoldenCross(signal)
 	} else if signal.SignalType == domain.GoldenCrossSignalType_DEATH_CROSS {
@@ -70,11 +135,7 @@ func (s *GoldenCrossBot) handleSignal(signal domain.GoldenCrossSignal) {
 
 func (s *GoldenCrossBot) handleGoldenCross(signal domain.GoldenCrossSignal) {
 	count := s.balance / signal.LastPrice
-	res, err := s.exchanger.Buy(exchange.OrderRequest{
-		InstrumentID: signal.Md.ID,
-		Count:        int(count),
-		Price:        signal.LastPrice,
-	})
+	res, err := s.exchanger.Buy(s.orderRequest(signal.Md.ID, int(count), signal.LastPrice))
 	if err != nil {
 		log.Println("SMACBot: error buying", err)
 		return
@@ -105,11 +166,7 @@ func (s *GoldenCrossBot) handleDeathCross(signal domain.GoldenCrossSignal) {
 		return
 	}
 
-	res, err := s.exchanger.Sell(exchange.OrderRequest{
-		InstrumentID: signal.Md.ID,
-		Count:        s.counts[signal.Md],
-		Price:        signal.LastPrice,
-	})
+	res, err := s.exchanger.Sell(s.orderRequest(signal.Md.ID, s.counts[signal.Md], signal.LastPrice))
 	if err != nil {
 		log.Println("SMACBot: error selling", err)
 		return
@@ -135,3 +192,18 @@ func (s *GoldenCrossBot) handleDeathCross(signal domain.GoldenCrossSignal) {
 		delete(s.counts, signal.Md)
 	}
 }
+
+func (s *GoldenCrossBot) orderRequest(instrumentID string, count int, price float64) exchange.OrderRequest {
+	request := exchange.OrderRequest{
+		InstrumentID: instrumentID,
+		Count:        count,
+		Price:        price,
+	}
+
+	if instrument, ok := s.instruments[instrumentID]; ok {
+		request.Lot = instrument.Lot
+		request.MinPriceIncrement = instrument.MinPriceIncrement
+	}
+
+	return request
+}
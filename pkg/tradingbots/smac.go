@@ -2,6 +2,10 @@ package tradingbots
 
 import (
 	"log"
+	"time"
+
+	"github.com/Reensef/sigmasage/pkg/calendar"
+	"github.com/Reensef/sigmasage/pkg/clock"
 
 	"github.com/Reensef/sigmasage/pkg/domain"
 	"github.com/Reensef/sigmasage/pkg/exchange"
@@ -15,12 +19,17 @@ type SMACBot struct {
 	exchanger      exchange.Exchanger
 	stopChan       chan struct{}
 	signalChan     <-chan domain.SMACSignal
+	calendar       calendar.Calendar
+	clock          clock.Clock
+	instruments    map[string]domain.Instrument
+	dividends      dividendLedger
 }
 
 func NewSMACBot(
 	exchanger exchange.Exchanger,
 	startBalance float64,
 	signalChan <-chan domain.SMACSignal,
+	cal calendar.Calendar,
 ) *SMACBot {
 	return &SMACBot{
 		exchanger:      exchanger,
@@ -29,20 +38,74 @@ func NewSMACBot(
 		counts:         make(map[domain.MarketData]int),
 		stopChan:       make(chan struct{}),
 		balanceHistory: []float64{startBalance},
+		calendar:       cal,
+		clock:          clock.Real,
+		instruments:    make(map[string]domain.Instrument),
 	}
 }
 
+// With a calendar, signals received while the market is closed are postponed
+// until the next session, only the latest one is kept.
+// Without a calendar (backtests) every signal is handled at once.
 func (s *SMACBot) Run() {
+	var pending *domain.SMACSignal
+	var openTimer <-chan time.Time
+
 	for {
 		select {
 		case <-s.stopChan:
 			return
-		case signal := <-s.signalChan:
+		case signal, ok := <-s.signalChan:
+			// Strategy is unsubscribed
+			if !ok {
+				return
+			}
+
+			now := s.clock.Now()
+			if s.calendar != nil && !s.calendar.IsOpen(now) {
+				pending = &signal
+				openTimer = s.clock.After(s.calendar.NextOpen(now).Sub(now))
+				continue
+			}
+
+			pending = nil
+			openTimer = nil
 			s.handleSignal(signal)
+		case <-openTimer:
+			openTimer = nil
+			if pending != nil {
+				s.handleSignal(*pending)
+				pending = nil
+			}
 		}
 	}
 }
 
+// Waiting for the market to open is timed by c
+func (s *SMACBot) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// Orders of the instrument are aligned to its lot and price step
+func (s *SMACBot) SetInstrument(marketData domain.MarketData, instrument domain.Instrument) {
+	s.instruments[marketData.ID] = instrument
+}
+
+// Dividends of held instruments are credited to the balance at their ex-dates,
+// before the signals of that time. Backtests add them before Run.
+func (s *SMACBot) AddDividends(dividends []domain.CorporateAction) {
+	s.dividends.add(dividends)
+}
+
+// Credits added dividends with ExDate not after until, e.g. at the end of a backtest
+func (s *SMACBot) CreditDividends(until time.Time) {
+	s.balance += s.dividends.credit(until, s.counts)
+}
+
+func (s *SMACBot) Dividends() []domain.DividendPayment {
+	return s.dividends.payments
+}
+
 func (s *SMACBot) Stop() {
 	close(s.stopChan)
 }
@@ -60,6 +123,8 @@ func (s *SMACBot) BalanceHistory() []float64 {
 }
 
 func (s *SMACBot) handleSignal(signal domain.SMACSignal) {
+	s.CreditDividends(signal.Time)
+
 	if signal.SignalType == domain.SMACSignalType_SRC_ABOVE_SMA {
 		s.handleSrcAboveSMA(signal)
 	} else if signal.SignalType == domain.SMACSignalType_SRC_UNDER_SMA {
@@ -69,11 +134,7 @@ func (s *SMACBot) handleSignal(signal domain.SMACSignal) {
 
 func (s *SMACBot) handleSrcAboveSMA(signal domain.SMACSignal) {
 	count := s.balance / signal.LastPrice
-	res, err := s.exchanger.Buy(exchange.OrderRequest{
-		InstrumentID: signal.Info.MarketData.ID,
-		Count:        int(count),
-		Price:        signal.LastPrice,
-	})
+	res, err := s.exchanger.Buy(s.orderRequest(signal.Info.MarketData.ID, int(count), signal.LastPrice))
 	if err != nil {
 		log.Println("SMACBot: error buying", err)
 		return
@@ -104,11 +165,7 @@ func (s *SMACBot) handleSrcUnderSMA(signal domain.SMACSignal) {
 		return
 	}
 
-	res, err := s.exchanger.Sell(exchange.OrderRequest{
-		InstrumentID: signal.Info.MarketData.ID,
-		Count:        s.counts[signal.Info.MarketData],
-		Price:        signal.LastPrice,
-	})
+	res, err := s.exchanger.Sell(s.orderRequest(signal.Info.MarketData.ID, s.counts[signal.Info.MarketData], signal.LastPrice))
 	if err != nil {
 		log.Println("SMACBot: error selling", err)
 		return
@@ -134,3 +191,18 @@ func (s *SMACBot) handleSrcUnderSMA(signal domain.SMACSignal) {
 		delete(s.counts, signal.Info.MarketData)
 	}
 }
+
+func (s *SMACBot) orderRequest(instrumentID string, count int, price float64) exchange.OrderRequest {
+	request := exchange.OrderRequest{
+		InstrumentID: instrumentID,
+		Count:        count,
+		Price:        price,
+	}
+
+	if instrument, ok := s.instruments[instrumentID]; ok {
+		request.Lot = instrument.Lot
+		request.MinPriceIncrement = instrument.MinPriceIncrement
+	}
+
+	return request
+}
@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Public endpoint of Moscow Exchange ISS, tests pass the URL of a local stand-in
+const MOEXISSEndpoint = "https://iss.moex.com/iss"
+
+const moexISSRequestTimeout = 30 * time.Second
+
+// MOEXISSClient requests public ISS data in JSON, no token is needed
+type MOEXISSClient struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// ISS responses are named blocks of tables:
+// {"candles": {"columns": ["open", ...], "data": [[1, ...], ...]}}
+type MOEXISSTable struct {
+	Columns []string `json:"columns"`
+	Data    [][]any  `json:"data"`
+}
+
+// Row of a table by column names
+type MOEXISSRow map[string]any
+
+// Board where a security is traded, e.g. TQBR of the shares market of the stock engine
+type MOEXBoard struct {
+	SecID   string
+	BoardID string
+	Engine  string
+	Market  string
+	Primary bool
+}
+
+func NewMOEXISSClient(endpoint string) *MOEXISSClient {
+	return &MOEXISSClient{
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		httpClient: &http.Client{Timeout: moexISSRequestTimeout},
+	}
+}
+
+// path is relative to the endpoint without the format, e.g. "/securities/SBER"
+func (c *MOEXISSClient) Get(
+	ctx context.Context,
+	path string,
+	params url.Values,
+) (map[string]MOEXISSTable, error) {
+	query := url.Values{}
+	for key, values := range params {
+		query[key] = values
+	}
+	query.Set("iss.meta", "off")
+
+	requestURL := c.endpoint + path + ".json?" + query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ISS %s: %s", path, response.Status)
+	}
+
+	result := make(map[string]MOEXISSTable)
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("ISS %s: %w", path, err)
+	}
+
+	return result, nil
+}
+
+// Boards of the security, the primary one is used for history by default
+func (c *MOEXISSClient) Boards(ctx context.Context, secID string) ([]MOEXBoard, error) {
+	blocks, err := c.Get(ctx, "/securities/"+url.PathEscape(secID), url.Values{"iss.only": {"boards"}})
+	if err != nil {
+		return nil, err
+	}
+
+	rows := blocks["boards"].Rows()
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("security %s not found", secID)
+	}
+
+	result := make([]MOEXBoard, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, MOEXBoard{
+			SecID:   row.String("secid"),
+			BoardID: row.String("boardid"),
+			Engine:  row.String("engine"),
+			Market:  row.String("market"),
+			Primary: row.Float("is_primary") == 1,
+		})
+	}
+
+	return result, nil
+}
+
+func (t MOEXISSTable) Rows() []MOEXISSRow {
+	result := make([]MOEXISSRow, 0, len(t.Data))
+	for _, data := range t.Data {
+		row := make(MOEXISSRow, len(t.Columns))
+		for i, column := range t.Columns {
+			if i < len(data) {
+				row[column] = data[i]
+			}
+		}
+		result = append(result, row)
+	}
+
+	return result
+}
+
+// Empty string for null and missing values
+func (r MOEXISSRow) String(column string) string {
+	switch value := r[column].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// Zero for null and missing values
+func (r MOEXISSRow) Float(column string) float64 {
+	switch value := r[column].(type) {
+	case float64:
+		return value
+	case string:
+		result, _ := strconv.ParseFloat(value, 64)
+		return result
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Production endpoint of the broker, tests pass the address of a local fake
+const TinkoffEndpoint = "invest-public-api.tinkoff.ru:443"
+
+const tinkoffAppName = "sigmasage"
+
+// Unavailable and internal errors of read-only requests are retried by gRPC
+const tinkoffServiceConfig = `{
+	"methodConfig": [{
+		"name": [
+			{"service": "tinkoff.public.invest.api.contract.v1.MarketDataService"},
+			{"service": "tinkoff.public.invest.api.contract.v1.InstrumentsService"}
+		],
+		"retryPolicy": {
+			"maxAttempts": 4,
+			"initialBackoff": "0.5s",
+			"maxBackoff": "5s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE", "INTERNAL"]
+		}
+	}]
+}`
+
+// TinkoffConfig describes a connection to the Tinkoff Invest API
+type TinkoffConfig struct {
+	Endpoint string
+	Token    string
+	// Roots that verify the server certificate, system ones when nil.
+	// Tests pass the roots of a fake server here.
+	RootCAs *x509.CertPool
+}
+
+// Connection is made on the first request, so an unreachable endpoint fails requests, not the dial
+func NewTinkoffConn(config TinkoffConfig) (*grpc.ClientConn, error) {
+	return grpc.Dial(
+		config.Endpoint,
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: config.RootCAs})),
+		grpc.WithPerRPCCredentials(tinkoffToken(config.Token)),
+		grpc.WithDefaultServiceConfig(tinkoffServiceConfig),
+	)
+}
+
+// Sends the token and the app name with every request
+type tinkoffToken string
+
+func (t tinkoffToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + string(t),
+		"x-app-name":    tinkoffAppName,
+	}, nil
+}
+
+func (t tinkoffToken) RequireTransportSecurity() bool {
+	return true
+}
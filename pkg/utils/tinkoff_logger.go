@@ -7,6 +7,8 @@ import (
 // TODO Need rename
 // This is a implementation of logger for tinkoff api
 // He has methods of uber zap logger
+// Providers dial the API with NewTinkoffConn and don't log through it,
+// it is kept for clients of the investgo SDK like examples/main.go
 type TinkoffLogger struct {
 }
 